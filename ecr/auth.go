@@ -0,0 +1,95 @@
+/*
+ * Copyright 2017-2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You
+ * may not use this file except in compliance with the License. A copy of
+ * the License is located at
+ *
+ * 	http://aws.amazon.com/apache2.0/
+ *
+ * or in the "license" file accompanying this file. This file is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF
+ * ANY KIND, either express or implied. See the License for the specific
+ * language governing permissions and limitations under the License.
+ */
+
+package ecr
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/containerd/containerd/log"
+)
+
+// AuthorizationToken is a decoded Amazon ECR authorization token, usable as
+// basic authentication credentials for the registry at ProxyEndpoint.
+type AuthorizationToken struct {
+	// Username for basic authentication with the registry.
+	Username string
+	// Password for basic authentication with the registry.
+	Password string
+	// ProxyEndpoint is the URL of the registry the token is valid for, such
+	// as https://123456789012.dkr.ecr.us-west-2.amazonaws.com.
+	ProxyEndpoint string
+	// ExpiresAt is when the token expires.
+	ExpiresAt time.Time
+}
+
+// checkCredentials asserts that the credentials can be resolved and are not
+// anonymous.
+func checkCredentials(creds *credentials.Credentials) error {
+	if creds == nil || creds == credentials.AnonymousCredentials {
+		return errors.New("ecr: no credentials configured")
+	}
+	if _, err := creds.Get(); err != nil {
+		return fmt.Errorf("ecr: resolving credentials: %w", err)
+	}
+	return nil
+}
+
+// AuthorizationTokenProvider is implemented by the resolver to provide
+// credentials for the registry to other clients, such as docker login.
+type AuthorizationTokenProvider interface {
+	// AuthorizationToken returns a decoded authorization token for the
+	// default registry of the session's account in region.
+	AuthorizationToken(ctx context.Context, region string) (AuthorizationToken, error)
+}
+
+var _ AuthorizationTokenProvider = (*ecrResolver)(nil)
+
+// AuthorizationToken returns a decoded authorization token for the default
+// registry of the session's account in the given region.
+func (r *ecrResolver) AuthorizationToken(ctx context.Context, region string) (AuthorizationToken, error) {
+	output, err := r.getClient(region).GetAuthorizationTokenWithContext(ctx, &ecr.GetAuthorizationTokenInput{})
+	if err != nil {
+		log.G(ctx).WithField("region", region).WithError(err).Warn("Failed while calling GetAuthorizationToken")
+		return AuthorizationToken{}, err
+	}
+	if len(output.AuthorizationData) == 0 {
+		return AuthorizationToken{}, errors.New("ecr: no authorization data returned")
+	}
+	data := output.AuthorizationData[0]
+
+	decoded, err := base64.StdEncoding.DecodeString(aws.StringValue(data.AuthorizationToken))
+	if err != nil {
+		return AuthorizationToken{}, fmt.Errorf("ecr: failed to decode authorization token: %w", err)
+	}
+	username, password, ok := strings.Cut(string(decoded), ":")
+	if !ok {
+		return AuthorizationToken{}, errors.New("ecr: malformed authorization token")
+	}
+	return AuthorizationToken{
+		Username:      username,
+		Password:      password,
+		ProxyEndpoint: aws.StringValue(data.ProxyEndpoint),
+		ExpiresAt:     aws.TimeValue(data.ExpiresAt),
+	}, nil
+}
@@ -0,0 +1,154 @@
+/*
+ * Copyright 2017-2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You
+ * may not use this file except in compliance with the License. A copy of
+ * the License is located at
+ *
+ * 	http://aws.amazon.com/apache2.0/
+ *
+ * or in the "license" file accompanying this file. This file is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF
+ * ANY KIND, either express or implied. See the License for the specific
+ * language governing permissions and limitations under the License.
+ */
+
+package ecr
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/awstesting/unit"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAuthorizationToken(t *testing.T) {
+	const proxyEndpoint = "https://123456789012.dkr.ecr.us-west-2.amazonaws.com"
+	expiresAt := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	fakeClient := &fakeECRClient{
+		GetAuthorizationTokenFn: func(aws.Context, *ecr.GetAuthorizationTokenInput, ...request.Option) (*ecr.GetAuthorizationTokenOutput, error) {
+			return &ecr.GetAuthorizationTokenOutput{
+				AuthorizationData: []*ecr.AuthorizationData{{
+					AuthorizationToken: aws.String(base64.StdEncoding.EncodeToString([]byte("AWS:password"))),
+					ProxyEndpoint:      aws.String(proxyEndpoint),
+					ExpiresAt:          aws.Time(expiresAt),
+				}},
+			}, nil
+		},
+	}
+	resolver := &ecrResolver{
+		clients: map[string]ecrAPI{
+			"us-west-2": fakeClient,
+		},
+	}
+
+	token, err := resolver.AuthorizationToken(context.Background(), "us-west-2")
+	require.NoError(t, err)
+	assert.Equal(t, AuthorizationToken{
+		Username:      "AWS",
+		Password:      "password",
+		ProxyEndpoint: proxyEndpoint,
+		ExpiresAt:     expiresAt,
+	}, token)
+}
+
+func TestNewResolverRequireCredentials(t *testing.T) {
+	emptyChain := unit.Session.Copy(&aws.Config{
+		Credentials: credentials.NewChainCredentials(nil),
+	})
+	_, err := NewResolver(WithSession(emptyChain), WithRequireCredentials(true))
+	assert.ErrorIs(t, err, credentials.ErrNoValidProvidersFoundInChain)
+
+	anonymous := unit.Session.Copy(&aws.Config{
+		Credentials: credentials.AnonymousCredentials,
+	})
+	_, err = NewResolver(WithSession(anonymous), WithRequireCredentials(true))
+	assert.Error(t, err)
+
+	_, err = NewResolver(WithSession(emptyChain))
+	assert.NoError(t, err, "credentials should not be checked unless required")
+	_, err = NewResolver(WithSession(unit.Session), WithRequireCredentials(true))
+	assert.NoError(t, err)
+}
+
+// rotatingProvider provides credentials with a new access key each time the
+// previous credentials are expired.
+type rotatingProvider struct {
+	lock      sync.Mutex
+	retrieved int
+	expired   bool
+}
+
+func (p *rotatingProvider) Retrieve() (credentials.Value, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.retrieved++
+	p.expired = false
+	return credentials.Value{
+		AccessKeyID:     fmt.Sprintf("AKID%d", p.retrieved),
+		SecretAccessKey: "SECRET",
+	}, nil
+}
+
+func (p *rotatingProvider) IsExpired() bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.expired
+}
+
+func (p *rotatingProvider) expire() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.expired = true
+}
+
+func TestCredentialsProviderRefresh(t *testing.T) {
+	var accessKeyID string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Contains(t, r.Header.Get("Authorization"), "Credential="+accessKeyID+"/")
+		fmt.Fprint(w, `{"authorizationData":[{"authorizationToken":"QVdTOnBhc3N3b3Jk"}]}`)
+	}))
+	defer ts.Close()
+
+	for name, configure := range map[string]ResolverOption{
+		"session":  WithSession(unit.Session),
+		"configV2": WithConfigV2(testConfigV2()),
+	} {
+		t.Run(name, func(t *testing.T) {
+			provider := &rotatingProvider{}
+			resolver, err := NewResolver(
+				configure,
+				WithCredentialsProvider(provider),
+				WithRequireCredentials(true),
+				WithRegionEndpoints(map[string]string{"us-west-2": ts.URL}),
+			)
+			require.NoError(t, err)
+			ecrResolver := resolver.(*ecrResolver)
+
+			accessKeyID = "AKID1"
+			_, err = ecrResolver.AuthorizationToken(context.Background(), "us-west-2")
+			require.NoError(t, err)
+			_, err = ecrResolver.AuthorizationToken(context.Background(), "us-west-2")
+			require.NoError(t, err)
+			assert.Equal(t, 1, provider.retrieved, "unexpired credentials should be reused")
+
+			provider.expire()
+			accessKeyID = "AKID2"
+			_, err = ecrResolver.AuthorizationToken(context.Background(), "us-west-2")
+			require.NoError(t, err)
+			assert.Equal(t, 2, provider.retrieved, "expired credentials should be refreshed")
+		})
+	}
+}
@@ -18,6 +18,9 @@ package ecr
 import (
 	"context"
 	"errors"
+	"fmt"
+	"strings"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/request"
@@ -25,11 +28,18 @@ import (
 	"github.com/containerd/containerd/images"
 	"github.com/containerd/containerd/log"
 	"github.com/containerd/containerd/reference"
+	"github.com/opencontainers/go-digest"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	// batchGetImageLimit is the maximum number of image IDs ECR accepts in a
+	// single BatchGetImage request.
+	batchGetImageLimit = 100
 )
 
 var (
-	errImageNotFound     = errors.New("ecr: image not found")
 	errGetImageUnhandled = errors.New("ecr: unable to get images")
 
 	// supportedImageMediaTypes lists supported content types for images.
@@ -40,11 +50,59 @@ var (
 		images.MediaTypeDockerSchema2ManifestList,
 		images.MediaTypeDockerSchema1Manifest,
 	}
+
+	// mediaTypeFamilies groups the OCI and Docker variants of equivalent
+	// manifest schemas.
+	mediaTypeFamilies = [][]string{
+		{ocispec.MediaTypeImageManifest, images.MediaTypeDockerSchema2Manifest},
+		{ocispec.MediaTypeImageIndex, images.MediaTypeDockerSchema2ManifestList},
+	}
 )
 
+// acceptedMediaTypesKey is the context key for a per-call override of the
+// media types accepted when requesting images from ECR.
+type acceptedMediaTypesKey struct{}
+
+// WithAcceptedMediaTypesContext returns a context that overrides the media
+// types the resolver accepts when requesting image manifests from ECR. The
+// override applies to calls made with the returned context in place of the
+// resolver's default set of supported media types.
+func WithAcceptedMediaTypesContext(ctx context.Context, mediaTypes []string) context.Context {
+	return context.WithValue(ctx, acceptedMediaTypesKey{}, mediaTypes)
+}
+
+// acceptedMediaTypes returns the media types to accept for image requests made
+// with ctx, falling back to supportedImageMediaTypes when no override is set.
+func acceptedMediaTypes(ctx context.Context) []string {
+	if mediaTypes, ok := ctx.Value(acceptedMediaTypesKey{}).([]string); ok && len(mediaTypes) > 0 {
+		return mediaTypes
+	}
+	return supportedImageMediaTypes
+}
+
 type ecrBase struct {
 	client  ecrAPI
 	ecrSpec ECRSpec
+	// mediaTypeFamilies configures requests for a descriptor's image to
+	// accept the equivalent variants of the descriptor's media type.
+	mediaTypeFamilies bool
+	// logFields are added to the logger of each operation.
+	logFields log.Fields
+	// retryDeadline, when set, bounds the total delay of the retries made by
+	// each operation.
+	retryDeadline time.Duration
+	// tracer, when set, records a span for each ECR API request.
+	tracer trace.Tracer
+	// metrics, when set, receives the bytes of layer content transferred.
+	metrics MetricsRecorder
+}
+
+// withLogFields returns a context whose logger includes fields.
+func withLogFields(ctx context.Context, fields log.Fields) context.Context {
+	if len(fields) == 0 {
+		return ctx
+	}
+	return log.WithLogger(ctx, log.G(ctx).WithFields(fields))
 }
 
 // ecrAPI contains only the ECR APIs that are called by the resolver
@@ -54,17 +112,64 @@ type ecrAPI interface {
 	BatchGetImageWithContext(aws.Context, *ecr.BatchGetImageInput, ...request.Option) (*ecr.BatchGetImageOutput, error)
 	GetDownloadUrlForLayerWithContext(aws.Context, *ecr.GetDownloadUrlForLayerInput, ...request.Option) (*ecr.GetDownloadUrlForLayerOutput, error)
 	BatchCheckLayerAvailabilityWithContext(aws.Context, *ecr.BatchCheckLayerAvailabilityInput, ...request.Option) (*ecr.BatchCheckLayerAvailabilityOutput, error)
-	InitiateLayerUpload(*ecr.InitiateLayerUploadInput) (*ecr.InitiateLayerUploadOutput, error)
-	UploadLayerPart(*ecr.UploadLayerPartInput) (*ecr.UploadLayerPartOutput, error)
-	CompleteLayerUpload(*ecr.CompleteLayerUploadInput) (*ecr.CompleteLayerUploadOutput, error)
+	InitiateLayerUploadWithContext(aws.Context, *ecr.InitiateLayerUploadInput, ...request.Option) (*ecr.InitiateLayerUploadOutput, error)
+	UploadLayerPartWithContext(aws.Context, *ecr.UploadLayerPartInput, ...request.Option) (*ecr.UploadLayerPartOutput, error)
+	CompleteLayerUploadWithContext(aws.Context, *ecr.CompleteLayerUploadInput, ...request.Option) (*ecr.CompleteLayerUploadOutput, error)
 	PutImageWithContext(aws.Context, *ecr.PutImageInput, ...request.Option) (*ecr.PutImageOutput, error)
+	ListImagesWithContext(aws.Context, *ecr.ListImagesInput, ...request.Option) (*ecr.ListImagesOutput, error)
+	BatchDeleteImageWithContext(aws.Context, *ecr.BatchDeleteImageInput, ...request.Option) (*ecr.BatchDeleteImageOutput, error)
+	DescribeRepositoriesWithContext(aws.Context, *ecr.DescribeRepositoriesInput, ...request.Option) (*ecr.DescribeRepositoriesOutput, error)
+	DescribeImagesWithContext(aws.Context, *ecr.DescribeImagesInput, ...request.Option) (*ecr.DescribeImagesOutput, error)
+	GetAuthorizationTokenWithContext(aws.Context, *ecr.GetAuthorizationTokenInput, ...request.Option) (*ecr.GetAuthorizationTokenOutput, error)
+	DescribeRegistryWithContext(aws.Context, *ecr.DescribeRegistryInput, ...request.Option) (*ecr.DescribeRegistryOutput, error)
+	CreateRepositoryWithContext(aws.Context, *ecr.CreateRepositoryInput, ...request.Option) (*ecr.CreateRepositoryOutput, error)
+	GetRegistryScanningConfigurationWithContext(aws.Context, *ecr.GetRegistryScanningConfigurationInput, ...request.Option) (*ecr.GetRegistryScanningConfigurationOutput, error)
+}
+
+// imageFailureError returns the error of a BatchGetImage failure.
+func imageFailureError(ctx context.Context, failure *ecr.ImageFailure) error {
+	switch aws.StringValue(failure.FailureCode) {
+	// Requested image with a corresponding tag and digest does not exist.
+	// This failure will generally occur when pushing an updated (or new)
+	// image with a tag.
+	case ecr.ImageFailureCodeImageTagDoesNotMatchDigest:
+		log.G(ctx).WithField("failure", failure).Debug("ecr.base.image: no matching image with specified digest")
+		return ErrImageNotFound
+	// Requested image doesn't resolve to a known image. A new image will
+	// result in an ImageNotFound error when checked before push.
+	case ecr.ImageFailureCodeImageNotFound:
+		log.G(ctx).WithField("failure", failure).Debug("ecr.base.image: no image found")
+		return ErrImageNotFound
+	// Requested image identifiers are invalid.
+	case ecr.ImageFailureCodeInvalidImageDigest, ecr.ImageFailureCodeInvalidImageTag:
+		log.G(ctx).WithField("failure", failure).Error("ecr.base.image: invalid image identifier")
+		return reference.ErrInvalid
+	// Unhandled failure reported for image request made.
+	default:
+		log.G(ctx).WithField("failure", failure).Warn("ecr.base.image: unhandled image request failure")
+		return errGetImageUnhandled
+	}
+}
+
+// describeImageFailures lists the codes and reasons of BatchGetImage
+// failures.
+func describeImageFailures(failures []*ecr.ImageFailure) string {
+	descriptions := make([]string, 0, len(failures))
+	for _, failure := range failures {
+		description := aws.StringValue(failure.FailureCode)
+		if reason := aws.StringValue(failure.FailureReason); reason != "" {
+			description += ": " + reason
+		}
+		descriptions = append(descriptions, description)
+	}
+	return strings.Join(descriptions, "; ")
 }
 
 // getImage fetches the reference's image from ECR.
 func (b *ecrBase) getImage(ctx context.Context) (*ecr.Image, error) {
 	return b.runGetImage(ctx, ecr.BatchGetImageInput{
 		ImageIds:           []*ecr.ImageIdentifier{b.ecrSpec.ImageID()},
-		AcceptedMediaTypes: aws.StringSlice(supportedImageMediaTypes),
+		AcceptedMediaTypes: aws.StringSlice(acceptedMediaTypes(ctx)),
 	})
 }
 
@@ -101,16 +206,79 @@ func (b *ecrBase) getImageByDescriptor(ctx context.Context, desc ocispec.Descrip
 		ImageIds: []*ecr.ImageIdentifier{ident},
 	}
 
-	// Request exact mediaType when known.
+	// Request exact mediaType when known, or its family when configured.
 	if desc.MediaType != "" {
 		input.AcceptedMediaTypes = []*string{aws.String(desc.MediaType)}
+		if b.mediaTypeFamilies {
+			input.AcceptedMediaTypes = aws.StringSlice(mediaTypeFamily(desc.MediaType))
+		}
 	} else {
-		input.AcceptedMediaTypes = aws.StringSlice(supportedImageMediaTypes)
+		input.AcceptedMediaTypes = aws.StringSlice(acceptedMediaTypes(ctx))
 	}
 
 	return b.runGetImage(ctx, input)
 }
 
+// getImagesByDigest retrieves the images with the given digests, requesting
+// as many images in each BatchGetImage request as ECR accepts.  Images that
+// are not found are omitted from the returned images.
+func (b *ecrBase) getImagesByDigest(ctx context.Context, digests []digest.Digest, mediaTypes []string) (map[digest.Digest]*ecr.Image, error) {
+	found := make(map[digest.Digest]*ecr.Image, len(digests))
+	for begin := 0; begin < len(digests); begin += batchGetImageLimit {
+		end := begin + batchGetImageLimit
+		if end > len(digests) {
+			end = len(digests)
+		}
+		var imageIDs []*ecr.ImageIdentifier
+		for _, dgst := range digests[begin:end] {
+			imageIDs = append(imageIDs, &ecr.ImageIdentifier{ImageDigest: aws.String(dgst.String())})
+		}
+		spanCtx, span := startSpan(ctx, b.tracer, b.ecrSpec, "ecr.BatchGetImage")
+		batchGetImageOutput, err := b.client.BatchGetImageWithContext(spanCtx, &ecr.BatchGetImageInput{
+			RegistryId:         aws.String(b.ecrSpec.Registry()),
+			RepositoryName:     aws.String(b.ecrSpec.Repository),
+			ImageIds:           imageIDs,
+			AcceptedMediaTypes: aws.StringSlice(mediaTypes),
+		})
+		endSpan(span, err)
+		if err != nil {
+			log.G(ctx).WithError(err).Error("ecr.base.images: failed to get images")
+			return nil, err
+		}
+		log.G(ctx).
+			WithField("images", len(batchGetImageOutput.Images)).
+			WithField("failures", len(batchGetImageOutput.Failures)).
+			Trace("ecr.base.images: api response")
+		for _, image := range batchGetImageOutput.Images {
+			if image.ImageId == nil || image.ImageManifest == nil {
+				continue
+			}
+			found[digest.Digest(aws.StringValue(image.ImageId.ImageDigest))] = image
+		}
+	}
+	return found, nil
+}
+
+// mediaTypeFamily returns mediaType followed by its equivalent variants, or
+// only mediaType if it has none.
+func mediaTypeFamily(mediaType string) []string {
+	for _, family := range mediaTypeFamilies {
+		for _, member := range family {
+			if member != mediaType {
+				continue
+			}
+			mediaTypes := []string{mediaType}
+			for _, variant := range family {
+				if variant != mediaType {
+					mediaTypes = append(mediaTypes, variant)
+				}
+			}
+			return mediaTypes
+		}
+	}
+	return []string{mediaType}
+}
+
 // runGetImage submits and handles the response for requests of ECR images.
 func (b *ecrBase) runGetImage(ctx context.Context, batchGetImageInput ecr.BatchGetImageInput) (*ecr.Image, error) {
 	// Allow only a single image to be fetched at a time.
@@ -123,7 +291,10 @@ func (b *ecrBase) runGetImage(ctx context.Context, batchGetImageInput ecr.BatchG
 
 	log.G(ctx).WithField("batchGetImageInput", batchGetImageInput).Trace("ecr.base.image: requesting images")
 
-	batchGetImageOutput, err := b.client.BatchGetImageWithContext(ctx, &batchGetImageInput)
+	spanCtx, span := startSpan(ctx, b.tracer, b.ecrSpec, "ecr.BatchGetImage",
+		digestAttribute.String(aws.StringValue(batchGetImageInput.ImageIds[0].ImageDigest)))
+	batchGetImageOutput, err := b.client.BatchGetImageWithContext(spanCtx, &batchGetImageInput)
+	endSpan(span, err)
 	if err != nil {
 		log.G(ctx).WithError(err).Error("ecr.base.image: failed to get image")
 		return nil, err
@@ -131,32 +302,18 @@ func (b *ecrBase) runGetImage(ctx context.Context, batchGetImageInput ecr.BatchG
 	log.G(ctx).WithField("batchGetImageOutput", batchGetImageOutput).Trace("ecr.base.image: api response")
 
 	// Summarize image request failures for handled errors. Only the first
-	// failure is checked as only a single ImageIdentifier is allowed to be
-	// queried for.
-	if len(batchGetImageOutput.Failures) > 0 {
-		failure := batchGetImageOutput.Failures[0]
-		switch aws.StringValue(failure.FailureCode) {
-		// Requested image with a corresponding tag and digest does not exist.
-		// This failure will generally occur when pushing an updated (or new)
-		// image with a tag.
-		case ecr.ImageFailureCodeImageTagDoesNotMatchDigest:
-			log.G(ctx).WithField("failure", failure).Debug("ecr.base.image: no matching image with specified digest")
-			return nil, errImageNotFound
-		// Requested image doesn't resolve to a known image. A new image will
-		// result in an ImageNotFound error when checked before push.
-		case ecr.ImageFailureCodeImageNotFound:
-			log.G(ctx).WithField("failure", failure).Debug("ecr.base.image: no image found")
-			return nil, errImageNotFound
-		// Requested image identifiers are invalid.
-		case ecr.ImageFailureCodeInvalidImageDigest, ecr.ImageFailureCodeInvalidImageTag:
-			log.G(ctx).WithField("failure", failure).Error("ecr.base.image: invalid image identifier")
-			return nil, reference.ErrInvalid
-		// Unhandled failure reported for image request made.
-		default:
-			log.G(ctx).WithField("failure", failure).Warn("ecr.base.image: unhandled image request failure")
-			return nil, errGetImageUnhandled
+	// failure is mapped to an error as only a single ImageIdentifier is
+	// allowed to be queried for; any others are described by the error.
+	if failures := batchGetImageOutput.Failures; len(failures) > 0 {
+		err := imageFailureError(ctx, failures[0])
+		if len(failures) > 1 {
+			err = fmt.Errorf("%w (failures: %s)", err, describeImageFailures(failures))
 		}
+		return nil, err
 	}
 
+	if len(batchGetImageOutput.Images) == 0 {
+		return nil, ErrImageNotFound
+	}
 	return batchGetImageOutput.Images[0], nil
 }
@@ -0,0 +1,762 @@
+/*
+ * Copyright 2017-2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You
+ * may not use this file except in compliance with the License. A copy of
+ * the License is located at
+ *
+ * 	http://aws.amazon.com/apache2.0/
+ *
+ * or in the "license" file accompanying this file. This file is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF
+ * ANY KIND, either express or implied. See the License for the specific
+ * language governing permissions and limitations under the License.
+ */
+
+package ecr
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	awsv2 "github.com/aws/aws-sdk-go-v2/aws"
+	awsmiddleware "github.com/aws/aws-sdk-go-v2/aws/middleware"
+	"github.com/aws/aws-sdk-go-v2/aws/retry"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	ecrv2 "github.com/aws/aws-sdk-go-v2/service/ecr"
+	ecrtypes "github.com/aws/aws-sdk-go-v2/service/ecr/types"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/aws/smithy-go"
+	"github.com/aws/smithy-go/middleware"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+)
+
+// ecrClientV2 implements ecrAPI with a client of aws-sdk-go-v2, so that the
+// resolver can be configured with either SDK.  Requests and responses are
+// converted from and to the types of aws-sdk-go, and errors are converted to
+// awserr.Error values carrying the same codes.
+type ecrClientV2 struct {
+	client *ecrv2.Client
+	// apiCallTimeout, when set, bounds the duration of each attempt of the
+	// requests other than layer part uploads.
+	apiCallTimeout time.Duration
+	// metrics, when set, receives the completed requests.
+	metrics MetricsRecorder
+	// requestIDHeader is set to the request ID extracted from the request's
+	// context by requestIDFromContext, when set.
+	requestIDHeader      string
+	requestIDFromContext func(context.Context) string
+}
+
+var _ ecrAPI = (*ecrClientV2)(nil)
+
+// checkCredentialsV2 asserts that the config's credentials can be retrieved
+// and are not anonymous.
+func checkCredentialsV2(cfg awsv2.Config) error {
+	if cfg.Credentials == nil || awsv2.IsCredentialsProvider(cfg.Credentials, awsv2.AnonymousCredentials{}) {
+		return errors.New("ecr: no credentials configured")
+	}
+	if _, err := cfg.Credentials.Retrieve(context.Background()); err != nil {
+		return fmt.Errorf("ecr: resolving credentials: %w", err)
+	}
+	return nil
+}
+
+// newClientV2 creates an aws-sdk-go-v2 client for the region from the
+// resolver's config.
+func (r *ecrResolver) newClientV2(region string, fips bool) ecrAPI {
+	client := ecrv2.NewFromConfig(*r.configV2, func(options *ecrv2.Options) {
+		options.Region = region
+		options.APIOptions = append(options.APIOptions, awsmiddleware.AddUserAgentKeyValue(userAgentName, userAgentVersion))
+		if r.httpClient != nil {
+			options.HTTPClient = r.httpClient
+		}
+		if r.credentials != nil {
+			options.Credentials = credentialsProviderV2{r.credentials}
+		}
+		if fips {
+			options.EndpointOptions.UseFIPSEndpoint = awsv2.FIPSEndpointStateEnabled
+		}
+		if r.maxRetries != nil {
+			options.RetryMaxAttempts = *r.maxRetries + 1
+		}
+		options.Retryer = throttleRetryerV2{Retryer: options.Retryer, maxDelay: r.retryPolicy.MaxDelay}
+		if endpoint, ok := r.regionEndpoints[region]; ok {
+			options.BaseEndpoint = awsv2.String(endpoint)
+		} else if r.endpoint != "" {
+			options.BaseEndpoint = awsv2.String(r.endpoint)
+		}
+	})
+	return &ecrClientV2{
+		client:               client,
+		apiCallTimeout:       r.apiCallTimeout,
+		metrics:              r.metrics,
+		requestIDHeader:      r.requestIDHeader,
+		requestIDFromContext: r.requestIDFromContext,
+	}
+}
+
+// throttleRetryerV2 delays retries of throttled requests of aws-sdk-go-v2
+// clients by the response's Retry-After header when present, as
+// throttleRetryer does for aws-sdk-go clients.
+type throttleRetryerV2 struct {
+	awsv2.Retryer
+	// maxDelay, when set, caps the delays requested by Retry-After.
+	maxDelay time.Duration
+}
+
+var _ awsv2.RetryerV2 = throttleRetryerV2{}
+
+func (r throttleRetryerV2) RetryDelay(attempt int, err error) (time.Duration, error) {
+	var respErr *awshttp.ResponseError
+	if retry.IsErrorThrottles(retry.DefaultThrottles).IsErrorThrottle(err) == awsv2.TrueTernary &&
+		errors.As(err, &respErr) && respErr.Response != nil {
+		if delay, ok := retryAfter(respErr.Response.Response); ok {
+			if r.maxDelay > 0 && delay > r.maxDelay {
+				delay = r.maxDelay
+			}
+			return delay, nil
+		}
+	}
+	return r.Retryer.RetryDelay(attempt, err)
+}
+
+// GetAttemptToken uses the attempt tokens of the wrapped retryer, if it
+// provides them, so that its retry quota still applies.
+func (r throttleRetryerV2) GetAttemptToken(ctx context.Context) (func(error) error, error) {
+	if retryer, ok := r.Retryer.(awsv2.RetryerV2); ok {
+		return retryer.GetAttemptToken(ctx)
+	}
+	return r.Retryer.GetInitialToken(), nil
+}
+
+// credentialsProviderV2 provides the credentials of aws-sdk-go to clients of
+// aws-sdk-go-v2.
+type credentialsProviderV2 struct {
+	creds *credentials.Credentials
+}
+
+func (p credentialsProviderV2) Retrieve(ctx context.Context) (awsv2.Credentials, error) {
+	value, err := p.creds.GetWithContext(ctx)
+	if err != nil {
+		return awsv2.Credentials{}, err
+	}
+	result := awsv2.Credentials{
+		AccessKeyID:     value.AccessKeyID,
+		SecretAccessKey: value.SecretAccessKey,
+		SessionToken:    value.SessionToken,
+		Source:          value.ProviderName,
+		CanExpire:       true,
+	}
+	// Credentials of providers that do not report their expiry are
+	// reported as expired, so that the client's credentials cache defers
+	// to the expiry check of creds on each request.
+	if expiresAt, err := p.creds.ExpiresAt(); err == nil {
+		result.Expires = expiresAt
+	} else {
+		result.Expires = time.Now()
+	}
+	return result, nil
+}
+
+// call makes the request of the named operation with the options of the
+// client and the headers set by opts, and converts the error it fails with.
+func (c *ecrClientV2) call(ctx context.Context, operation string, opts []request.Option, do func(context.Context, ...func(*ecrv2.Options)) error) error {
+	header := requestOptionHeaders(opts)
+	if c.requestIDFromContext != nil {
+		if requestID := c.requestIDFromContext(ctx); requestID != "" {
+			header.Set(c.requestIDHeader, requestID)
+		}
+	}
+	var optFns []func(*ecrv2.Options)
+	if c.apiCallTimeout > 0 && operation != "UploadLayerPart" {
+		optFns = append(optFns, func(options *ecrv2.Options) {
+			options.APIOptions = append(options.APIOptions, func(stack *middleware.Stack) error {
+				return stack.Finalize.Insert(attemptTimeout(c.apiCallTimeout), (&retry.Attempt{}).ID(), middleware.After)
+			})
+		})
+	}
+	if requestOptionsDisableRetries(opts) {
+		optFns = append(optFns, func(options *ecrv2.Options) {
+			options.RetryMaxAttempts = 1
+		})
+	}
+	for key := range header {
+		key, value := key, header.Get(key)
+		optFns = append(optFns, func(options *ecrv2.Options) {
+			options.APIOptions = append(options.APIOptions, smithyhttp.SetHeaderValue(key, value))
+		})
+	}
+
+	start := time.Now()
+	err := fromErrorV2(do(ctx, optFns...))
+	if c.metrics != nil {
+		c.metrics.APICall(operation, time.Since(start), err)
+	}
+	return err
+}
+
+// attemptTimeout bounds the context of each attempt of a request by timeout.
+// It follows the retry middleware, so an attempt that times out is retried
+// like other failed attempts, rather than as a canceled request.
+func attemptTimeout(timeout time.Duration) middleware.FinalizeMiddleware {
+	return middleware.FinalizeMiddlewareFunc("ecr.AttemptTimeout", func(ctx context.Context, in middleware.FinalizeInput, next middleware.FinalizeHandler) (middleware.FinalizeOutput, middleware.Metadata, error) {
+		attemptCtx, cancel := context.WithTimeout(ctx, timeout)
+		defer cancel()
+		out, metadata, err := next.HandleFinalize(attemptCtx, in)
+		if err != nil && ctx.Err() == nil && errors.Is(attemptCtx.Err(), context.DeadlineExceeded) {
+			err = &attemptTimeoutError{err: err}
+		}
+		return out, metadata, err
+	})
+}
+
+// attemptTimeoutError is returned for an attempt that exceeded the API call
+// timeout.  It does not wrap the cancellation it was reported as, which the
+// SDK does not retry.
+type attemptTimeoutError struct {
+	err error
+}
+
+func (e *attemptTimeoutError) Error() string {
+	return fmt.Sprintf("ecr: request attempt timed out: %v", e.err)
+}
+
+func (e *attemptTimeoutError) Unwrap() error {
+	return context.DeadlineExceeded
+}
+
+// RetryableError marks the attempt as retryable to the SDK's retryer.
+func (e *attemptTimeoutError) RetryableError() bool {
+	return true
+}
+
+// requestOptionHeaders returns the headers set by aws-sdk-go request options,
+// such as request.WithSetRequestHeaders.  Other effects of the options are
+// not supported with aws-sdk-go-v2 and are ignored, other than those checked
+// by requestOptionsDisableRetries.
+func requestOptionHeaders(opts []request.Option) http.Header {
+	req := &request.Request{HTTPRequest: &http.Request{Header: http.Header{}}}
+	req.ApplyOptions(opts...)
+	return req.HTTPRequest.Header
+}
+
+// requestOptionsDisableRetries reports whether aws-sdk-go request options,
+// such as withoutSDKRetries, disable the retries of the request.
+func requestOptionsDisableRetries(opts []request.Option) bool {
+	req := &request.Request{HTTPRequest: &http.Request{Header: http.Header{}}}
+	req.ApplyOptions(opts...)
+	return req.Retryer != nil && req.MaxRetries() == 0
+}
+
+// fromErrorV2 converts an error of aws-sdk-go-v2 to the awserr.Error of
+// aws-sdk-go with the same code, which the resolver inspects.
+func fromErrorV2(err error) error {
+	if err == nil {
+		return nil
+	}
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		awsErr := awserr.New(apiErr.ErrorCode(), apiErr.ErrorMessage(), err)
+		var respErr *awshttp.ResponseError
+		if errors.As(err, &respErr) {
+			awsErr = awserr.NewRequestFailure(awsErr, respErr.HTTPStatusCode(), respErr.ServiceRequestID())
+		}
+		return asServerError(awsErr)
+	}
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return awserr.New(request.CanceledErrorCode, "request context canceled", err)
+	}
+	return err
+}
+
+func (c *ecrClientV2) BatchGetImageWithContext(ctx aws.Context, input *ecr.BatchGetImageInput, opts ...request.Option) (*ecr.BatchGetImageOutput, error) {
+	var output *ecrv2.BatchGetImageOutput
+	err := c.call(ctx, "BatchGetImage", opts, func(ctx context.Context, optFns ...func(*ecrv2.Options)) (err error) {
+		output, err = c.client.BatchGetImage(ctx, &ecrv2.BatchGetImageInput{
+			AcceptedMediaTypes: aws.StringValueSlice(input.AcceptedMediaTypes),
+			ImageIds:           toImageIdentifiersV2(input.ImageIds),
+			RegistryId:         input.RegistryId,
+			RepositoryName:     input.RepositoryName,
+		}, optFns...)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	images := make([]*ecr.Image, 0, len(output.Images))
+	for i := range output.Images {
+		images = append(images, fromImageV2(&output.Images[i]))
+	}
+	return &ecr.BatchGetImageOutput{
+		Failures: fromImageFailuresV2(output.Failures),
+		Images:   images,
+	}, nil
+}
+
+func (c *ecrClientV2) GetDownloadUrlForLayerWithContext(ctx aws.Context, input *ecr.GetDownloadUrlForLayerInput, opts ...request.Option) (*ecr.GetDownloadUrlForLayerOutput, error) {
+	var output *ecrv2.GetDownloadUrlForLayerOutput
+	err := c.call(ctx, "GetDownloadUrlForLayer", opts, func(ctx context.Context, optFns ...func(*ecrv2.Options)) (err error) {
+		output, err = c.client.GetDownloadUrlForLayer(ctx, &ecrv2.GetDownloadUrlForLayerInput{
+			LayerDigest:    input.LayerDigest,
+			RegistryId:     input.RegistryId,
+			RepositoryName: input.RepositoryName,
+		}, optFns...)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &ecr.GetDownloadUrlForLayerOutput{
+		DownloadUrl: output.DownloadUrl,
+		LayerDigest: output.LayerDigest,
+	}, nil
+}
+
+func (c *ecrClientV2) BatchCheckLayerAvailabilityWithContext(ctx aws.Context, input *ecr.BatchCheckLayerAvailabilityInput, opts ...request.Option) (*ecr.BatchCheckLayerAvailabilityOutput, error) {
+	var output *ecrv2.BatchCheckLayerAvailabilityOutput
+	err := c.call(ctx, "BatchCheckLayerAvailability", opts, func(ctx context.Context, optFns ...func(*ecrv2.Options)) (err error) {
+		output, err = c.client.BatchCheckLayerAvailability(ctx, &ecrv2.BatchCheckLayerAvailabilityInput{
+			LayerDigests:   aws.StringValueSlice(input.LayerDigests),
+			RegistryId:     input.RegistryId,
+			RepositoryName: input.RepositoryName,
+		}, optFns...)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	result := &ecr.BatchCheckLayerAvailabilityOutput{}
+	for _, failure := range output.Failures {
+		result.Failures = append(result.Failures, &ecr.LayerFailure{
+			FailureCode:   optionalString(string(failure.FailureCode)),
+			FailureReason: failure.FailureReason,
+			LayerDigest:   failure.LayerDigest,
+		})
+	}
+	for _, layer := range output.Layers {
+		result.Layers = append(result.Layers, &ecr.Layer{
+			LayerAvailability: optionalString(string(layer.LayerAvailability)),
+			LayerDigest:       layer.LayerDigest,
+			LayerSize:         layer.LayerSize,
+			MediaType:         layer.MediaType,
+		})
+	}
+	return result, nil
+}
+
+func (c *ecrClientV2) InitiateLayerUploadWithContext(ctx aws.Context, input *ecr.InitiateLayerUploadInput, opts ...request.Option) (*ecr.InitiateLayerUploadOutput, error) {
+	var output *ecrv2.InitiateLayerUploadOutput
+	err := c.call(ctx, "InitiateLayerUpload", opts, func(ctx context.Context, optFns ...func(*ecrv2.Options)) (err error) {
+		output, err = c.client.InitiateLayerUpload(ctx, &ecrv2.InitiateLayerUploadInput{
+			RegistryId:     input.RegistryId,
+			RepositoryName: input.RepositoryName,
+		}, optFns...)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &ecr.InitiateLayerUploadOutput{
+		PartSize: output.PartSize,
+		UploadId: output.UploadId,
+	}, nil
+}
+
+func (c *ecrClientV2) UploadLayerPartWithContext(ctx aws.Context, input *ecr.UploadLayerPartInput, opts ...request.Option) (*ecr.UploadLayerPartOutput, error) {
+	var output *ecrv2.UploadLayerPartOutput
+	err := c.call(ctx, "UploadLayerPart", opts, func(ctx context.Context, optFns ...func(*ecrv2.Options)) (err error) {
+		output, err = c.client.UploadLayerPart(ctx, &ecrv2.UploadLayerPartInput{
+			LayerPartBlob:  input.LayerPartBlob,
+			PartFirstByte:  input.PartFirstByte,
+			PartLastByte:   input.PartLastByte,
+			RegistryId:     input.RegistryId,
+			RepositoryName: input.RepositoryName,
+			UploadId:       input.UploadId,
+		}, optFns...)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &ecr.UploadLayerPartOutput{
+		LastByteReceived: output.LastByteReceived,
+		RegistryId:       output.RegistryId,
+		RepositoryName:   output.RepositoryName,
+		UploadId:         output.UploadId,
+	}, nil
+}
+
+func (c *ecrClientV2) CompleteLayerUploadWithContext(ctx aws.Context, input *ecr.CompleteLayerUploadInput, opts ...request.Option) (*ecr.CompleteLayerUploadOutput, error) {
+	var output *ecrv2.CompleteLayerUploadOutput
+	err := c.call(ctx, "CompleteLayerUpload", opts, func(ctx context.Context, optFns ...func(*ecrv2.Options)) (err error) {
+		output, err = c.client.CompleteLayerUpload(ctx, &ecrv2.CompleteLayerUploadInput{
+			LayerDigests:   aws.StringValueSlice(input.LayerDigests),
+			RegistryId:     input.RegistryId,
+			RepositoryName: input.RepositoryName,
+			UploadId:       input.UploadId,
+		}, optFns...)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &ecr.CompleteLayerUploadOutput{
+		LayerDigest:    output.LayerDigest,
+		RegistryId:     output.RegistryId,
+		RepositoryName: output.RepositoryName,
+		UploadId:       output.UploadId,
+	}, nil
+}
+
+func (c *ecrClientV2) PutImageWithContext(ctx aws.Context, input *ecr.PutImageInput, opts ...request.Option) (*ecr.PutImageOutput, error) {
+	var output *ecrv2.PutImageOutput
+	err := c.call(ctx, "PutImage", opts, func(ctx context.Context, optFns ...func(*ecrv2.Options)) (err error) {
+		output, err = c.client.PutImage(ctx, &ecrv2.PutImageInput{
+			ImageDigest:            input.ImageDigest,
+			ImageManifest:          input.ImageManifest,
+			ImageManifestMediaType: input.ImageManifestMediaType,
+			ImageTag:               input.ImageTag,
+			RegistryId:             input.RegistryId,
+			RepositoryName:         input.RepositoryName,
+		}, optFns...)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &ecr.PutImageOutput{Image: fromImageV2(output.Image)}, nil
+}
+
+func (c *ecrClientV2) ListImagesWithContext(ctx aws.Context, input *ecr.ListImagesInput, opts ...request.Option) (*ecr.ListImagesOutput, error) {
+	params := &ecrv2.ListImagesInput{
+		MaxResults:     toMaxResultsV2(input.MaxResults),
+		NextToken:      input.NextToken,
+		RegistryId:     input.RegistryId,
+		RepositoryName: input.RepositoryName,
+	}
+	if input.Filter != nil {
+		params.Filter = &ecrtypes.ListImagesFilter{TagStatus: ecrtypes.TagStatus(aws.StringValue(input.Filter.TagStatus))}
+	}
+	var output *ecrv2.ListImagesOutput
+	err := c.call(ctx, "ListImages", opts, func(ctx context.Context, optFns ...func(*ecrv2.Options)) (err error) {
+		output, err = c.client.ListImages(ctx, params, optFns...)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &ecr.ListImagesOutput{
+		ImageIds:  fromImageIdentifiersV2(output.ImageIds),
+		NextToken: output.NextToken,
+	}, nil
+}
+
+func (c *ecrClientV2) BatchDeleteImageWithContext(ctx aws.Context, input *ecr.BatchDeleteImageInput, opts ...request.Option) (*ecr.BatchDeleteImageOutput, error) {
+	var output *ecrv2.BatchDeleteImageOutput
+	err := c.call(ctx, "BatchDeleteImage", opts, func(ctx context.Context, optFns ...func(*ecrv2.Options)) (err error) {
+		output, err = c.client.BatchDeleteImage(ctx, &ecrv2.BatchDeleteImageInput{
+			ImageIds:       toImageIdentifiersV2(input.ImageIds),
+			RegistryId:     input.RegistryId,
+			RepositoryName: input.RepositoryName,
+		}, optFns...)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &ecr.BatchDeleteImageOutput{
+		Failures: fromImageFailuresV2(output.Failures),
+		ImageIds: fromImageIdentifiersV2(output.ImageIds),
+	}, nil
+}
+
+func (c *ecrClientV2) DescribeRepositoriesWithContext(ctx aws.Context, input *ecr.DescribeRepositoriesInput, opts ...request.Option) (*ecr.DescribeRepositoriesOutput, error) {
+	var output *ecrv2.DescribeRepositoriesOutput
+	err := c.call(ctx, "DescribeRepositories", opts, func(ctx context.Context, optFns ...func(*ecrv2.Options)) (err error) {
+		output, err = c.client.DescribeRepositories(ctx, &ecrv2.DescribeRepositoriesInput{
+			MaxResults:      toMaxResultsV2(input.MaxResults),
+			NextToken:       input.NextToken,
+			RegistryId:      input.RegistryId,
+			RepositoryNames: aws.StringValueSlice(input.RepositoryNames),
+		}, optFns...)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	result := &ecr.DescribeRepositoriesOutput{NextToken: output.NextToken}
+	for i := range output.Repositories {
+		result.Repositories = append(result.Repositories, fromRepositoryV2(&output.Repositories[i]))
+	}
+	return result, nil
+}
+
+func (c *ecrClientV2) DescribeImagesWithContext(ctx aws.Context, input *ecr.DescribeImagesInput, opts ...request.Option) (*ecr.DescribeImagesOutput, error) {
+	params := &ecrv2.DescribeImagesInput{
+		ImageIds:       toImageIdentifiersV2(input.ImageIds),
+		MaxResults:     toMaxResultsV2(input.MaxResults),
+		NextToken:      input.NextToken,
+		RegistryId:     input.RegistryId,
+		RepositoryName: input.RepositoryName,
+	}
+	if input.Filter != nil {
+		params.Filter = &ecrtypes.DescribeImagesFilter{TagStatus: ecrtypes.TagStatus(aws.StringValue(input.Filter.TagStatus))}
+	}
+	var output *ecrv2.DescribeImagesOutput
+	err := c.call(ctx, "DescribeImages", opts, func(ctx context.Context, optFns ...func(*ecrv2.Options)) (err error) {
+		output, err = c.client.DescribeImages(ctx, params, optFns...)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	result := &ecr.DescribeImagesOutput{NextToken: output.NextToken}
+	for _, detail := range output.ImageDetails {
+		imageDetail := &ecr.ImageDetail{
+			ArtifactMediaType:      detail.ArtifactMediaType,
+			ImageDigest:            detail.ImageDigest,
+			ImageManifestMediaType: detail.ImageManifestMediaType,
+			ImagePushedAt:          detail.ImagePushedAt,
+			ImageSizeInBytes:       detail.ImageSizeInBytes,
+			ImageTags:              aws.StringSlice(detail.ImageTags),
+			LastRecordedPullTime:   detail.LastRecordedPullTime,
+			RegistryId:             detail.RegistryId,
+			RepositoryName:         detail.RepositoryName,
+		}
+		if status := detail.ImageScanStatus; status != nil {
+			imageDetail.ImageScanStatus = &ecr.ImageScanStatus{
+				Description: status.Description,
+				Status:      optionalString(string(status.Status)),
+			}
+		}
+		if summary := detail.ImageScanFindingsSummary; summary != nil {
+			counts := make(map[string]*int64, len(summary.FindingSeverityCounts))
+			for severity, count := range summary.FindingSeverityCounts {
+				counts[severity] = aws.Int64(int64(count))
+			}
+			imageDetail.ImageScanFindingsSummary = &ecr.ImageScanFindingsSummary{
+				FindingSeverityCounts:        counts,
+				ImageScanCompletedAt:         summary.ImageScanCompletedAt,
+				VulnerabilitySourceUpdatedAt: summary.VulnerabilitySourceUpdatedAt,
+			}
+		}
+		result.ImageDetails = append(result.ImageDetails, imageDetail)
+	}
+	return result, nil
+}
+
+func (c *ecrClientV2) GetAuthorizationTokenWithContext(ctx aws.Context, input *ecr.GetAuthorizationTokenInput, opts ...request.Option) (*ecr.GetAuthorizationTokenOutput, error) {
+	var output *ecrv2.GetAuthorizationTokenOutput
+	err := c.call(ctx, "GetAuthorizationToken", opts, func(ctx context.Context, optFns ...func(*ecrv2.Options)) (err error) {
+		output, err = c.client.GetAuthorizationToken(ctx, &ecrv2.GetAuthorizationTokenInput{
+			RegistryIds: aws.StringValueSlice(input.RegistryIds),
+		}, optFns...)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	result := &ecr.GetAuthorizationTokenOutput{}
+	for _, data := range output.AuthorizationData {
+		result.AuthorizationData = append(result.AuthorizationData, &ecr.AuthorizationData{
+			AuthorizationToken: data.AuthorizationToken,
+			ExpiresAt:          data.ExpiresAt,
+			ProxyEndpoint:      data.ProxyEndpoint,
+		})
+	}
+	return result, nil
+}
+
+func (c *ecrClientV2) DescribeRegistryWithContext(ctx aws.Context, input *ecr.DescribeRegistryInput, opts ...request.Option) (*ecr.DescribeRegistryOutput, error) {
+	var output *ecrv2.DescribeRegistryOutput
+	err := c.call(ctx, "DescribeRegistry", opts, func(ctx context.Context, optFns ...func(*ecrv2.Options)) (err error) {
+		output, err = c.client.DescribeRegistry(ctx, &ecrv2.DescribeRegistryInput{}, optFns...)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	result := &ecr.DescribeRegistryOutput{RegistryId: output.RegistryId}
+	if config := output.ReplicationConfiguration; config != nil {
+		result.ReplicationConfiguration = &ecr.ReplicationConfiguration{}
+		for _, rule := range config.Rules {
+			replicationRule := &ecr.ReplicationRule{}
+			for _, destination := range rule.Destinations {
+				replicationRule.Destinations = append(replicationRule.Destinations, &ecr.ReplicationDestination{
+					Region:     destination.Region,
+					RegistryId: destination.RegistryId,
+				})
+			}
+			for _, filter := range rule.RepositoryFilters {
+				replicationRule.RepositoryFilters = append(replicationRule.RepositoryFilters, &ecr.RepositoryFilter{
+					Filter:     filter.Filter,
+					FilterType: optionalString(string(filter.FilterType)),
+				})
+			}
+			result.ReplicationConfiguration.Rules = append(result.ReplicationConfiguration.Rules, replicationRule)
+		}
+	}
+	return result, nil
+}
+
+func (c *ecrClientV2) GetRegistryScanningConfigurationWithContext(ctx aws.Context, input *ecr.GetRegistryScanningConfigurationInput, opts ...request.Option) (*ecr.GetRegistryScanningConfigurationOutput, error) {
+	var output *ecrv2.GetRegistryScanningConfigurationOutput
+	err := c.call(ctx, "GetRegistryScanningConfiguration", opts, func(ctx context.Context, optFns ...func(*ecrv2.Options)) (err error) {
+		output, err = c.client.GetRegistryScanningConfiguration(ctx, &ecrv2.GetRegistryScanningConfigurationInput{}, optFns...)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	result := &ecr.GetRegistryScanningConfigurationOutput{RegistryId: output.RegistryId}
+	if config := output.ScanningConfiguration; config != nil {
+		result.ScanningConfiguration = &ecr.RegistryScanningConfiguration{
+			ScanType: optionalString(string(config.ScanType)),
+		}
+		for _, rule := range config.Rules {
+			scanningRule := &ecr.RegistryScanningRule{
+				ScanFrequency: optionalString(string(rule.ScanFrequency)),
+			}
+			for _, filter := range rule.RepositoryFilters {
+				scanningRule.RepositoryFilters = append(scanningRule.RepositoryFilters, &ecr.ScanningRepositoryFilter{
+					Filter:     filter.Filter,
+					FilterType: optionalString(string(filter.FilterType)),
+				})
+			}
+			result.ScanningConfiguration.Rules = append(result.ScanningConfiguration.Rules, scanningRule)
+		}
+	}
+	return result, nil
+}
+
+func (c *ecrClientV2) CreateRepositoryWithContext(ctx aws.Context, input *ecr.CreateRepositoryInput, opts ...request.Option) (*ecr.CreateRepositoryOutput, error) {
+	params := &ecrv2.CreateRepositoryInput{
+		ImageTagMutability: ecrtypes.ImageTagMutability(aws.StringValue(input.ImageTagMutability)),
+		RegistryId:         input.RegistryId,
+		RepositoryName:     input.RepositoryName,
+	}
+	if config := input.EncryptionConfiguration; config != nil {
+		params.EncryptionConfiguration = &ecrtypes.EncryptionConfiguration{
+			EncryptionType: ecrtypes.EncryptionType(aws.StringValue(config.EncryptionType)),
+			KmsKey:         config.KmsKey,
+		}
+	}
+	if config := input.ImageScanningConfiguration; config != nil {
+		params.ImageScanningConfiguration = &ecrtypes.ImageScanningConfiguration{ScanOnPush: aws.BoolValue(config.ScanOnPush)}
+	}
+	for _, tag := range input.Tags {
+		params.Tags = append(params.Tags, ecrtypes.Tag{Key: tag.Key, Value: tag.Value})
+	}
+	var output *ecrv2.CreateRepositoryOutput
+	err := c.call(ctx, "CreateRepository", opts, func(ctx context.Context, optFns ...func(*ecrv2.Options)) (err error) {
+		output, err = c.client.CreateRepository(ctx, params, optFns...)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &ecr.CreateRepositoryOutput{Repository: fromRepositoryV2(output.Repository)}, nil
+}
+
+// optionalString returns a pointer to s, or nil if s is empty, as the enum
+// values of aws-sdk-go-v2 are empty where those of aws-sdk-go are nil.
+func optionalString(s string) *string {
+	if s == "" {
+		return nil
+	}
+	return aws.String(s)
+}
+
+// toMaxResultsV2 converts the maximum number of results of a request.
+func toMaxResultsV2(maxResults *int64) *int32 {
+	if maxResults == nil {
+		return nil
+	}
+	return awsv2.Int32(int32(*maxResults))
+}
+
+func toImageIdentifiersV2(imageIDs []*ecr.ImageIdentifier) []ecrtypes.ImageIdentifier {
+	var result []ecrtypes.ImageIdentifier
+	for _, imageID := range imageIDs {
+		result = append(result, ecrtypes.ImageIdentifier{
+			ImageDigest: imageID.ImageDigest,
+			ImageTag:    imageID.ImageTag,
+		})
+	}
+	return result
+}
+
+func fromImageIdentifierV2(imageID *ecrtypes.ImageIdentifier) *ecr.ImageIdentifier {
+	if imageID == nil {
+		return nil
+	}
+	return &ecr.ImageIdentifier{
+		ImageDigest: imageID.ImageDigest,
+		ImageTag:    imageID.ImageTag,
+	}
+}
+
+func fromImageIdentifiersV2(imageIDs []ecrtypes.ImageIdentifier) []*ecr.ImageIdentifier {
+	var result []*ecr.ImageIdentifier
+	for i := range imageIDs {
+		result = append(result, fromImageIdentifierV2(&imageIDs[i]))
+	}
+	return result
+}
+
+func fromImageFailuresV2(failures []ecrtypes.ImageFailure) []*ecr.ImageFailure {
+	var result []*ecr.ImageFailure
+	for _, failure := range failures {
+		result = append(result, &ecr.ImageFailure{
+			FailureCode:   optionalString(string(failure.FailureCode)),
+			FailureReason: failure.FailureReason,
+			ImageId:       fromImageIdentifierV2(failure.ImageId),
+		})
+	}
+	return result
+}
+
+func fromImageV2(image *ecrtypes.Image) *ecr.Image {
+	if image == nil {
+		return nil
+	}
+	return &ecr.Image{
+		ImageId:                fromImageIdentifierV2(image.ImageId),
+		ImageManifest:          image.ImageManifest,
+		ImageManifestMediaType: image.ImageManifestMediaType,
+		RegistryId:             image.RegistryId,
+		RepositoryName:         image.RepositoryName,
+	}
+}
+
+func fromRepositoryV2(repository *ecrtypes.Repository) *ecr.Repository {
+	if repository == nil {
+		return nil
+	}
+	result := &ecr.Repository{
+		CreatedAt:          repository.CreatedAt,
+		ImageTagMutability: optionalString(string(repository.ImageTagMutability)),
+		RegistryId:         repository.RegistryId,
+		RepositoryArn:      repository.RepositoryArn,
+		RepositoryName:     repository.RepositoryName,
+		RepositoryUri:      repository.RepositoryUri,
+	}
+	if config := repository.EncryptionConfiguration; config != nil {
+		result.EncryptionConfiguration = &ecr.EncryptionConfiguration{
+			EncryptionType: optionalString(string(config.EncryptionType)),
+			KmsKey:         config.KmsKey,
+		}
+	}
+	if config := repository.ImageScanningConfiguration; config != nil {
+		result.ImageScanningConfiguration = &ecr.ImageScanningConfiguration{ScanOnPush: aws.Bool(config.ScanOnPush)}
+	}
+	return result
+}
@@ -0,0 +1,274 @@
+/*
+ * Copyright 2017-2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You
+ * may not use this file except in compliance with the License. A copy of
+ * the License is located at
+ *
+ * 	http://aws.amazon.com/apache2.0/
+ *
+ * or in the "license" file accompanying this file. This file is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF
+ * ANY KIND, either express or implied. See the License for the specific
+ * language governing permissions and limitations under the License.
+ */
+
+package ecr
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	awsv2 "github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/retry"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/aws/smithy-go"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testConfigV2() awsv2.Config {
+	return awsv2.Config{
+		Region: "us-west-2",
+		Credentials: awsv2.CredentialsProviderFunc(func(context.Context) (awsv2.Credentials, error) {
+			return awsv2.Credentials{AccessKeyID: "AKID", SecretAccessKey: "SECRET"}, nil
+		}),
+	}
+}
+
+func TestConfigV2Resolve(t *testing.T) {
+	const manifest = `{"schemaVersion": 2, "mediaType": "application/vnd.oci.image.manifest.v1+json"}`
+	manifestDigest := digest.FromString(manifest)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "AmazonEC2ContainerRegistry_V20150921.BatchGetImage", r.Header.Get("X-Amz-Target"))
+		var input struct {
+			RegistryId     string
+			RepositoryName string
+			ImageIds       []struct{ ImageTag string }
+		}
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&input))
+		assert.Equal(t, "123456789012", input.RegistryId)
+		assert.Equal(t, "foo/bar", input.RepositoryName)
+		require.Len(t, input.ImageIds, 1)
+		assert.Equal(t, "latest", input.ImageIds[0].ImageTag)
+		json.NewEncoder(w).Encode(map[string]any{
+			"images": []map[string]any{{
+				"imageId":                map[string]string{"imageDigest": manifestDigest.String(), "imageTag": "latest"},
+				"imageManifest":          manifest,
+				"imageManifestMediaType": ocispec.MediaTypeImageManifest,
+			}},
+		})
+	}))
+	defer ts.Close()
+
+	resolver, err := NewResolver(
+		WithConfigV2(testConfigV2()),
+		WithRequireCredentials(true),
+		WithRegionEndpoints(map[string]string{"us-west-2": ts.URL}),
+	)
+	require.NoError(t, err)
+	_, desc, err := resolver.Resolve(context.Background(), "ecr.aws/arn:aws:ecr:us-west-2:123456789012:repository/foo/bar:latest")
+	require.NoError(t, err)
+	assert.Equal(t, manifestDigest, desc.Digest)
+	assert.Equal(t, ocispec.MediaTypeImageManifest, desc.MediaType)
+	assert.Equal(t, int64(len(manifest)), desc.Size)
+
+	_, err = NewResolver(WithConfigV2(awsv2.Config{Credentials: awsv2.AnonymousCredentials{}}), WithRequireCredentials(true))
+	assert.Error(t, err, "anonymous credentials should be rejected")
+}
+
+func TestConfigV2Errors(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Amzn-RequestId", "request")
+		switch {
+		case strings.HasSuffix(r.Header.Get("X-Amz-Target"), ".DescribeRegistry"):
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprint(w, `{"__type":"ServerException","message":"internal failure"}`)
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"__type":"RepositoryNotFoundException","message":"not found"}`)
+		}
+	}))
+	defer ts.Close()
+
+	resolver := &ecrResolver{
+		configV2:        &awsv2.Config{Credentials: testConfigV2().Credentials},
+		clients:         map[string]ecrAPI{},
+		regionEndpoints: map[string]string{"us-west-2": ts.URL},
+		maxRetries:      aws.Int(0),
+	}
+	client := resolver.getClient("us-west-2")
+	_, err := client.DescribeRepositoriesWithContext(context.Background(), &ecr.DescribeRepositoriesInput{
+		RepositoryNames: aws.StringSlice([]string{"foo"}),
+	})
+	var requestFailure awserr.RequestFailure
+	require.ErrorAs(t, err, &requestFailure)
+	assert.Equal(t, ecr.ErrCodeRepositoryNotFoundException, requestFailure.Code())
+	assert.Equal(t, http.StatusBadRequest, requestFailure.StatusCode())
+	assert.Equal(t, "request", requestFailure.RequestID())
+
+	_, err = client.DescribeRegistryWithContext(context.Background(), &ecr.DescribeRegistryInput{})
+	assert.ErrorIs(t, err, ErrECRServer)
+}
+
+func TestConfigV2WithoutSDKRetries(t *testing.T) {
+	attempts := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(w, `{"__type":"ServerException","message":"internal failure"}`)
+	}))
+	defer ts.Close()
+
+	resolver := &ecrResolver{
+		configV2:        &awsv2.Config{Credentials: testConfigV2().Credentials},
+		clients:         map[string]ecrAPI{},
+		regionEndpoints: map[string]string{"us-west-2": ts.URL},
+		maxRetries:      aws.Int(2),
+	}
+	_, err := resolver.getClient("us-west-2").DescribeRegistryWithContext(context.Background(), &ecr.DescribeRegistryInput{}, withoutSDKRetries)
+	assert.ErrorIs(t, err, ErrECRServer)
+	assert.Equal(t, 1, attempts)
+}
+
+func TestThrottleRetryerV2RetryDelay(t *testing.T) {
+	throttle := func(retryAfter string) error {
+		resp := &http.Response{StatusCode: http.StatusBadRequest, Header: http.Header{}}
+		if retryAfter != "" {
+			resp.Header.Set("Retry-After", retryAfter)
+		}
+		return &smithy.OperationError{Err: &awshttp.ResponseError{ResponseError: &smithyhttp.ResponseError{
+			Response: &smithyhttp.Response{Response: resp},
+			Err:      &smithy.GenericAPIError{Code: "ThrottlingException"},
+		}}}
+	}
+	retryer := throttleRetryerV2{Retryer: retry.NewStandard(), maxDelay: 5 * time.Second}
+
+	delay, err := retryer.RetryDelay(1, throttle("3"))
+	require.NoError(t, err)
+	assert.Equal(t, 3*time.Second, delay)
+
+	delay, err = retryer.RetryDelay(1, throttle("60"))
+	require.NoError(t, err)
+	assert.Equal(t, 5*time.Second, delay, "Retry-After should be capped at the maximum delay")
+
+	delay, err = retryer.RetryDelay(1, throttle(""))
+	require.NoError(t, err)
+	assert.LessOrEqual(t, delay, 2*time.Second, "the wrapped retryer's backoff should be used without Retry-After")
+}
+
+func TestConfigV2ThrottleRetryAfter(t *testing.T) {
+	attempts := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		if attempts == 1 {
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"__type":"ThrottlingException","message":"Rate exceeded"}`)
+			return
+		}
+		fmt.Fprint(w, `{"authorizationData":[]}`)
+	}))
+	defer ts.Close()
+
+	resolver := &ecrResolver{
+		configV2:        &awsv2.Config{Credentials: testConfigV2().Credentials},
+		clients:         map[string]ecrAPI{},
+		regionEndpoints: map[string]string{"us-west-2": ts.URL},
+	}
+	start := time.Now()
+	_, err := resolver.getClient("us-west-2").GetAuthorizationTokenWithContext(context.Background(), &ecr.GetAuthorizationTokenInput{})
+	require.NoError(t, err)
+	assert.Equal(t, 2, attempts, "throttled request should be retried")
+	assert.Less(t, time.Since(start), 500*time.Millisecond, "retry should wait for Retry-After")
+}
+
+func TestConfigV2RequestOptions(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "application/octet-stream", r.Header.Get("Content-Type"))
+		assert.Equal(t, "trace", r.Header.Get("X-Amzn-Trace-Id"))
+		fmt.Fprint(w, `{"lastByteReceived":4,"uploadId":"upload"}`)
+	}))
+	defer ts.Close()
+
+	resolver := &ecrResolver{
+		configV2:        &awsv2.Config{Credentials: testConfigV2().Credentials},
+		clients:         map[string]ecrAPI{},
+		regionEndpoints: map[string]string{"us-west-2": ts.URL},
+		requestIDHeader: "X-Amzn-Trace-Id",
+		requestIDFromContext: func(context.Context) string {
+			return "trace"
+		},
+	}
+	output, err := resolver.getClient("us-west-2").UploadLayerPartWithContext(context.Background(), &ecr.UploadLayerPartInput{
+		LayerPartBlob:  []byte("part"),
+		PartFirstByte:  aws.Int64(0),
+		PartLastByte:   aws.Int64(4),
+		RepositoryName: aws.String("foo"),
+		UploadId:       aws.String("upload"),
+	}, request.WithSetRequestHeaders(map[string]string{"Content-Type": "application/octet-stream"}))
+	require.NoError(t, err)
+	assert.Equal(t, int64(4), aws.Int64Value(output.LastByteReceived))
+	assert.Equal(t, "upload", aws.StringValue(output.UploadId))
+}
+
+func TestConfigV2UploadContext(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "trace", r.Header.Get("X-Amzn-Trace-Id"))
+		switch {
+		case strings.HasSuffix(r.Header.Get("X-Amz-Target"), ".InitiateLayerUpload"):
+			fmt.Fprint(w, `{"partSize":1024,"uploadId":"upload"}`)
+		default:
+			fmt.Fprint(w, `{"layerDigest":"sha256:layer","uploadId":"upload"}`)
+		}
+	}))
+	defer ts.Close()
+
+	type requestIDKey struct{}
+	resolver := &ecrResolver{
+		configV2:        &awsv2.Config{Credentials: testConfigV2().Credentials},
+		clients:         map[string]ecrAPI{},
+		regionEndpoints: map[string]string{"us-west-2": ts.URL},
+		requestIDHeader: "X-Amzn-Trace-Id",
+		requestIDFromContext: func(ctx context.Context) string {
+			requestID, _ := ctx.Value(requestIDKey{}).(string)
+			return requestID
+		},
+	}
+	client := resolver.getClient("us-west-2")
+	ctx := context.WithValue(context.Background(), requestIDKey{}, "trace")
+	initiated, err := client.InitiateLayerUploadWithContext(ctx, &ecr.InitiateLayerUploadInput{
+		RepositoryName: aws.String("foo"),
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "upload", aws.StringValue(initiated.UploadId))
+	completed, err := client.CompleteLayerUploadWithContext(ctx, &ecr.CompleteLayerUploadInput{
+		LayerDigests:   aws.StringSlice([]string{"sha256:layer"}),
+		RepositoryName: aws.String("foo"),
+		UploadId:       aws.String("upload"),
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "sha256:layer", aws.StringValue(completed.LayerDigest))
+
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	_, err = client.InitiateLayerUploadWithContext(cancelled, &ecr.InitiateLayerUploadInput{
+		RepositoryName: aws.String("foo"),
+	})
+	var awsErr awserr.Error
+	require.ErrorAs(t, err, &awsErr)
+	assert.Equal(t, request.CanceledErrorCode, awsErr.Code(), "the upload's context should be passed")
+}
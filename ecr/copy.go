@@ -0,0 +1,195 @@
+/*
+ * Copyright 2017-2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You
+ * may not use this file except in compliance with the License. A copy of
+ * the License is located at
+ *
+ * 	http://aws.amazon.com/apache2.0/
+ *
+ * or in the "license" file accompanying this file. This file is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF
+ * ANY KIND, either express or implied. See the License for the specific
+ * language governing permissions and limitations under the License.
+ */
+
+package ecr
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/containerd/remotes"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"golang.org/x/sync/errgroup"
+	"golang.org/x/sync/semaphore"
+)
+
+// defaultCopyParallelism is the number of blobs copied concurrently when a
+// parallelism is not configured with WithCopyParallelism.
+const defaultCopyParallelism = 4
+
+// CopyOption represents a functional option for configuring Copy.
+type CopyOption func(*CopyOptions) error
+
+// CopyOptions represents available options for configuring Copy.
+type CopyOptions struct {
+	// Parallelism is the maximum number of blobs, such as layers, copied
+	// concurrently.
+	Parallelism int
+}
+
+// WithCopyParallelism is a CopyOption to set the maximum number of blobs
+// copied concurrently.
+func WithCopyParallelism(n int) CopyOption {
+	return func(options *CopyOptions) error {
+		if n < 1 {
+			return fmt.Errorf("ecr: copy parallelism must be positive, got %d", n)
+		}
+		options.Parallelism = n
+		return nil
+	}
+}
+
+// Copy copies the image referenced by src to dst, fetching it with the
+// resolver's fetcher and pushing it with its pusher.  The blobs of the image,
+// such as its layers, are copied concurrently up to the configured
+// parallelism; manifests are pushed once the content they reference has been
+// copied.  Content already present at dst is not copied again.  dst names the
+// repository and tag to copy to; any digest it has is replaced by the digest of
+// the copied image.
+func Copy(ctx context.Context, r remotes.Resolver, src, dst string, opts ...CopyOption) error {
+	options := CopyOptions{Parallelism: defaultCopyParallelism}
+	for _, opt := range opts {
+		if err := opt(&options); err != nil {
+			return err
+		}
+	}
+	name, desc, err := r.Resolve(ctx, src)
+	if err != nil {
+		return fmt.Errorf("ecr: resolving %s: %w", src, err)
+	}
+	fetcher, err := r.Fetcher(ctx, name)
+	if err != nil {
+		return err
+	}
+	// The pusher takes the root descriptor from the digest of its reference,
+	// which replaces any digest dst already has.
+	dstName, _, _ := strings.Cut(dst, "@")
+	pusher, err := r.Pusher(ctx, dstName+"@"+desc.Digest.String())
+	if err != nil {
+		return err
+	}
+	c := &copier{
+		fetcher: fetcher,
+		pusher:  pusher,
+		limiter: semaphore.NewWeighted(int64(options.Parallelism)),
+	}
+	return c.copy(ctx, desc)
+}
+
+// copier copies content from a fetcher to a pusher.
+type copier struct {
+	fetcher remotes.Fetcher
+	pusher  remotes.Pusher
+	// limiter bounds the blobs copied concurrently.  Manifests do not hold
+	// the limiter while their children are copied, so that nested indexes
+	// cannot exhaust it.
+	limiter *semaphore.Weighted
+}
+
+// copy copies the content of desc, and of the content it references.
+func (c *copier) copy(ctx context.Context, desc ocispec.Descriptor) error {
+	ctx = log.WithLogger(ctx, log.G(ctx).WithField("desc", desc))
+	switch {
+	case images.IsNonDistributable(desc.MediaType):
+		log.G(ctx).Debug("ecr.copy: skipping non-distributable blob")
+		return nil
+	case desc.MediaType == images.MediaTypeDockerSchema1Manifest:
+		return fmt.Errorf("ecr: copying %q: %w", desc.MediaType, errdefs.ErrNotImplemented)
+	case images.IsIndexType(desc.MediaType), images.IsManifestType(desc.MediaType):
+		return c.copyManifest(ctx, desc)
+	default:
+		if err := c.limiter.Acquire(ctx, 1); err != nil {
+			return err
+		}
+		defer c.limiter.Release(1)
+		rc, err := c.fetcher.Fetch(ctx, desc)
+		if err != nil {
+			return err
+		}
+		defer rc.Close()
+		return c.push(ctx, desc, rc)
+	}
+}
+
+// copyManifest copies the content referenced by a manifest or index before
+// pushing the manifest itself.
+func (c *copier) copyManifest(ctx context.Context, desc ocispec.Descriptor) error {
+	rc, err := c.fetcher.Fetch(ctx, desc)
+	if err != nil {
+		return err
+	}
+	manifest, err := io.ReadAll(rc)
+	rc.Close()
+	if err != nil {
+		return err
+	}
+	children, err := manifestChildren(desc, manifest)
+	if err != nil {
+		return err
+	}
+	group, groupCtx := errgroup.WithContext(ctx)
+	for _, child := range children {
+		child := child
+		group.Go(func() error {
+			return c.copy(groupCtx, child)
+		})
+	}
+	if err := group.Wait(); err != nil {
+		return err
+	}
+	return c.push(ctx, desc, bytes.NewReader(manifest))
+}
+
+// push writes content to the pusher, treating content already present as
+// copied.
+func (c *copier) push(ctx context.Context, desc ocispec.Descriptor, r io.Reader) error {
+	writer, err := c.pusher.Push(ctx, desc)
+	if err != nil {
+		if errdefs.IsAlreadyExists(err) {
+			log.G(ctx).Debug("ecr.copy: content already exists")
+			return nil
+		}
+		return err
+	}
+	defer writer.Close()
+	if err := content.Copy(ctx, writer, r, desc.Size, desc.Digest); err != nil && !errdefs.IsAlreadyExists(err) {
+		return err
+	}
+	return nil
+}
+
+// manifestChildren returns the descriptors referenced by a manifest or index.
+func manifestChildren(desc ocispec.Descriptor, manifest []byte) ([]ocispec.Descriptor, error) {
+	if images.IsIndexType(desc.MediaType) {
+		var index ocispec.Index
+		if err := json.Unmarshal(manifest, &index); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal index: %v: %w", err, ErrInvalidManifest)
+		}
+		return index.Manifests, nil
+	}
+	var image ocispec.Manifest
+	if err := json.Unmarshal(manifest, &image); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal manifest: %v: %w", err, ErrInvalidManifest)
+	}
+	return append([]ocispec.Descriptor{image.Config}, image.Layers...), nil
+}
@@ -0,0 +1,257 @@
+/*
+ * Copyright 2017-2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You
+ * may not use this file except in compliance with the License. A copy of
+ * the License is located at
+ *
+ * 	http://aws.amazon.com/apache2.0/
+ *
+ * or in the "license" file accompanying this file. This file is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF
+ * ANY KIND, either express or implied. See the License for the specific
+ * language governing permissions and limitations under the License.
+ */
+
+package ecr
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/remotes"
+	"github.com/containerd/containerd/remotes/docker"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeCopyResolver serves content from src and pushes content to dst.
+type fakeCopyResolver struct {
+	root ocispec.Descriptor
+	src  map[digest.Digest][]byte
+
+	lock sync.Mutex
+	dst  map[digest.Digest][]byte
+	// active counts the blob writers open; maxActive is its high mark.
+	active    int
+	maxActive int
+	// started counts the blob writers opened; release is closed once it
+	// reaches the expected parallelism.
+	started   int
+	threshold int
+	release   chan struct{}
+}
+
+func (r *fakeCopyResolver) Resolve(context.Context, string) (string, ocispec.Descriptor, error) {
+	return "src", r.root, nil
+}
+
+func (r *fakeCopyResolver) Fetcher(context.Context, string) (remotes.Fetcher, error) {
+	return remotes.FetcherFunc(func(_ context.Context, desc ocispec.Descriptor) (io.ReadCloser, error) {
+		data, ok := r.src[desc.Digest]
+		if !ok {
+			return nil, errdefs.ErrNotFound
+		}
+		return io.NopCloser(bytes.NewReader(data)), nil
+	}), nil
+}
+
+func (r *fakeCopyResolver) Pusher(context.Context, string) (remotes.Pusher, error) {
+	return remotes.PusherFunc(func(_ context.Context, desc ocispec.Descriptor) (content.Writer, error) {
+		r.lock.Lock()
+		defer r.lock.Unlock()
+		if _, ok := r.dst[desc.Digest]; ok {
+			return nil, errdefs.ErrAlreadyExists
+		}
+		blob := desc.MediaType == ocispec.MediaTypeImageLayer || desc.MediaType == ocispec.MediaTypeImageConfig
+		if blob {
+			r.active++
+			if r.active > r.maxActive {
+				r.maxActive = r.active
+			}
+			r.started++
+			if r.started == r.threshold {
+				close(r.release)
+			}
+		}
+		return &fakeCopyWriter{resolver: r, desc: desc, blob: blob}, nil
+	}), nil
+}
+
+type fakeCopyWriter struct {
+	content.Writer
+	resolver *fakeCopyResolver
+	desc     ocispec.Descriptor
+	blob     bool
+	buf      bytes.Buffer
+}
+
+func (w *fakeCopyWriter) Write(p []byte) (int, error) {
+	return w.buf.Write(p)
+}
+
+func (w *fakeCopyWriter) Status() (content.Status, error) {
+	return content.Status{}, nil
+}
+
+func (w *fakeCopyWriter) Commit(ctx context.Context, size int64, expected digest.Digest, _ ...content.Opt) error {
+	if w.blob {
+		// Hold the blob open until as many blobs as the parallelism are
+		// being copied, to observe whether they are copied concurrently.
+		select {
+		case <-w.resolver.release:
+		case <-time.After(time.Second):
+		}
+	}
+	if digest.FromBytes(w.buf.Bytes()) != expected {
+		return errdefs.ErrFailedPrecondition
+	}
+	w.resolver.lock.Lock()
+	defer w.resolver.lock.Unlock()
+	w.resolver.dst[expected] = w.buf.Bytes()
+	return nil
+}
+
+func (w *fakeCopyWriter) Close() error {
+	if w.blob {
+		w.resolver.lock.Lock()
+		w.resolver.active--
+		w.resolver.lock.Unlock()
+	}
+	return nil
+}
+
+func TestCopy(t *testing.T) {
+	const parallelism = 3
+	src := map[digest.Digest][]byte{}
+	add := func(mediaType string, data []byte) ocispec.Descriptor {
+		desc := ocispec.Descriptor{MediaType: mediaType, Digest: digest.FromBytes(data), Size: int64(len(data))}
+		src[desc.Digest] = data
+		return desc
+	}
+	manifest := ocispec.Manifest{
+		MediaType: ocispec.MediaTypeImageManifest,
+		Config:    add(ocispec.MediaTypeImageConfig, []byte("{}")),
+	}
+	for i := 0; i < 8; i++ {
+		manifest.Layers = append(manifest.Layers, add(ocispec.MediaTypeImageLayer, []byte(fmt.Sprintf("layer %d", i))))
+	}
+	body, err := json.Marshal(manifest)
+	require.NoError(t, err)
+	resolver := &fakeCopyResolver{
+		root:      add(ocispec.MediaTypeImageManifest, body),
+		src:       src,
+		dst:       map[digest.Digest][]byte{},
+		threshold: parallelism,
+		release:   make(chan struct{}),
+	}
+
+	err = Copy(context.Background(), resolver, "src", "dst", WithCopyParallelism(parallelism))
+	require.NoError(t, err)
+	assert.Equal(t, src, resolver.dst)
+	assert.Equal(t, parallelism, resolver.maxActive, "blobs should be copied concurrently up to the parallelism")
+
+	// Content already at the destination is not copied again.
+	resolver.started, resolver.maxActive = 0, 0
+	err = Copy(context.Background(), resolver, "src", "dst")
+	require.NoError(t, err)
+	assert.Zero(t, resolver.maxActive)
+}
+
+func TestCopyParallelismInvalid(t *testing.T) {
+	err := Copy(context.Background(), &fakeCopyResolver{}, "src", "dst", WithCopyParallelism(0))
+	assert.Error(t, err)
+}
+
+func TestCopyResolver(t *testing.T) {
+	const (
+		srcRef = "ecr.aws/arn:aws:ecr:fake:123456789012:repository/src:latest"
+		dstRef = "ecr.aws/arn:aws:ecr:fake:123456789012:repository/dst:latest"
+	)
+	blobs := map[digest.Digest][]byte{}
+	add := func(mediaType string, data []byte) ocispec.Descriptor {
+		desc := ocispec.Descriptor{MediaType: mediaType, Digest: digest.FromBytes(data), Size: int64(len(data))}
+		blobs[desc.Digest] = data
+		return desc
+	}
+	manifest, err := json.Marshal(ocispec.Manifest{
+		MediaType: ocispec.MediaTypeImageManifest,
+		Config:    add(ocispec.MediaTypeImageConfig, []byte("{}")),
+		Layers:    []ocispec.Descriptor{add(ocispec.MediaTypeImageLayer, []byte("layer"))},
+	})
+	require.NoError(t, err)
+	manifestDigest := digest.FromBytes(manifest)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(blobs[digest.Digest(r.URL.Query().Get("digest"))])
+	}))
+	defer ts.Close()
+
+	for _, tc := range []struct {
+		name string
+		dst  string
+	}{
+		{name: "tag", dst: dstRef},
+		{name: "stale digest", dst: dstRef + "@" + digest.FromString("stale").String()},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var put *ecr.PutImageInput
+			client := &fakeECRClient{
+				BatchGetImageFn: func(_ aws.Context, input *ecr.BatchGetImageInput, _ ...request.Option) (*ecr.BatchGetImageOutput, error) {
+					if aws.StringValue(input.RepositoryName) == "dst" {
+						return &ecr.BatchGetImageOutput{
+							Failures: []*ecr.ImageFailure{{FailureCode: aws.String(ecr.ImageFailureCodeImageNotFound)}},
+						}, nil
+					}
+					return &ecr.BatchGetImageOutput{
+						Images: []*ecr.Image{{
+							ImageId:                &ecr.ImageIdentifier{ImageDigest: aws.String(manifestDigest.String())},
+							ImageManifest:          aws.String(string(manifest)),
+							ImageManifestMediaType: aws.String(ocispec.MediaTypeImageManifest),
+						}},
+					}, nil
+				},
+				GetDownloadUrlForLayerFn: func(_ aws.Context, input *ecr.GetDownloadUrlForLayerInput, _ ...request.Option) (*ecr.GetDownloadUrlForLayerOutput, error) {
+					return &ecr.GetDownloadUrlForLayerOutput{DownloadUrl: aws.String(ts.URL + "/?digest=" + aws.StringValue(input.LayerDigest))}, nil
+				},
+				BatchCheckLayerAvailabilityFn: func(aws.Context, *ecr.BatchCheckLayerAvailabilityInput, ...request.Option) (*ecr.BatchCheckLayerAvailabilityOutput, error) {
+					return &ecr.BatchCheckLayerAvailabilityOutput{
+						Layers: []*ecr.Layer{{LayerAvailability: aws.String(ecr.LayerAvailabilityAvailable)}},
+					}, nil
+				},
+				PutImageFn: func(_ aws.Context, input *ecr.PutImageInput, _ ...request.Option) (*ecr.PutImageOutput, error) {
+					put = input
+					return &ecr.PutImageOutput{
+						Image: &ecr.Image{ImageId: &ecr.ImageIdentifier{ImageDigest: input.ImageDigest}},
+					}, nil
+				},
+			}
+			resolver := &ecrResolver{
+				clients:    map[string]ecrAPI{"fake": client},
+				httpClient: ts.Client(),
+				tracker:    docker.NewInMemoryTracker(),
+			}
+
+			require.NoError(t, Copy(context.Background(), resolver, srcRef, tc.dst))
+			require.NotNil(t, put, "the manifest should be put")
+			assert.Equal(t, "dst", aws.StringValue(put.RepositoryName))
+			assert.Equal(t, "latest", aws.StringValue(put.ImageTag))
+			assert.Equal(t, manifestDigest.String(), aws.StringValue(put.ImageDigest))
+			assert.Equal(t, string(manifest), aws.StringValue(put.ImageManifest))
+		})
+	}
+}
@@ -26,6 +26,14 @@
 // The canonical ref format used by this package is ecr.aws/ followed by the ARN
 // of the repository and a label and/or a digest.  Valid references are of the
 // form "ecr.aws/arn:aws:ecr:<region>:<account>:repository/<name>:<tag>".
+// References that start with ecr-fips.aws/ instead are served by the FIPS
+// endpoint of the reference's region.
+//
+// Requests for a reference are made to Amazon ECR in the reference's region,
+// with a separate client for each region.  A single Resolver can be used with
+// references in different regions at the same time, such as to fetch an image
+// from one region while pushing it to another.  WithRegion instead makes every
+// request in a single region.
 //
 // License
 //
@@ -0,0 +1,116 @@
+/*
+ * Copyright 2017-2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You
+ * may not use this file except in compliance with the License. A copy of
+ * the License is located at
+ *
+ * 	http://aws.amazon.com/apache2.0/
+ *
+ * or in the "license" file accompanying this file. This file is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF
+ * ANY KIND, either express or implied. See the License for the specific
+ * language governing permissions and limitations under the License.
+ */
+
+package ecr
+
+import (
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// downloadURLExpiryMargin is how long before its presigned expiry a download
+// URL is no longer reused, so that a URL does not expire in flight.
+const downloadURLExpiryMargin = 30 * time.Second
+
+// downloadURLCache holds the download URLs of layers for a limited time, so
+// that fetchers of a resolver share the URLs of layers they have in common,
+// such as the layers shared by the platforms of an image index.
+type downloadURLCache struct {
+	ttl     time.Duration
+	now     func() time.Time
+	lock    sync.Mutex
+	entries map[string]downloadURLEntry
+	// requests shares a single GetDownloadUrlForLayer request among the
+	// concurrent misses for a layer.
+	requests singleflight.Group
+}
+
+type downloadURLEntry struct {
+	url     string
+	expires time.Time
+}
+
+func newDownloadURLCache(ttl time.Duration) *downloadURLCache {
+	return &downloadURLCache{
+		ttl:     ttl,
+		now:     time.Now,
+		entries: map[string]downloadURLEntry{},
+	}
+}
+
+// get returns the unexpired URL cached for key.
+func (c *downloadURLCache) get(key string) (string, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	entry, ok := c.entries[key]
+	if !ok {
+		return "", false
+	}
+	if !c.now().Before(entry.expires) {
+		delete(c.entries, key)
+		return "", false
+	}
+	return entry.url, true
+}
+
+// put caches url for key, dropping any entries that have expired.  The URL is
+// cached no longer than shortly before its presigned expiry, when it has one.
+func (c *downloadURLCache) put(key, url string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	now := c.now()
+	for k, entry := range c.entries {
+		if !now.Before(entry.expires) {
+			delete(c.entries, k)
+		}
+	}
+	expires := now.Add(c.ttl)
+	if urlExpires, ok := presignedURLExpiry(url); ok {
+		if urlExpires = urlExpires.Add(-downloadURLExpiryMargin); urlExpires.Before(expires) {
+			expires = urlExpires
+		}
+	}
+	c.entries[key] = downloadURLEntry{url: url, expires: expires}
+}
+
+// remove discards the URL cached for key, such as once it has been rejected.
+func (c *downloadURLCache) remove(key string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	delete(c.entries, key)
+}
+
+// presignedURLExpiry returns when a presigned download URL expires, from its
+// X-Amz-Date and X-Amz-Expires query parameters.
+func presignedURLExpiry(downloadURL string) (time.Time, bool) {
+	u, err := url.Parse(downloadURL)
+	if err != nil {
+		return time.Time{}, false
+	}
+	query := u.Query()
+	signed, err := time.Parse("20060102T150405Z", query.Get("X-Amz-Date"))
+	if err != nil {
+		return time.Time{}, false
+	}
+	seconds, err := strconv.ParseInt(query.Get("X-Amz-Expires"), 10, 64)
+	if err != nil || seconds < 0 {
+		return time.Time{}, false
+	}
+	return signed.Add(time.Duration(seconds) * time.Second), true
+}
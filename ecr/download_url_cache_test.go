@@ -0,0 +1,184 @@
+/*
+ * Copyright 2017-2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You
+ * may not use this file except in compliance with the License. A copy of
+ * the License is located at
+ *
+ * 	http://aws.amazon.com/apache2.0/
+ *
+ * or in the "license" file accompanying this file. This file is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF
+ * ANY KIND, either express or implied. See the License for the specific
+ * language governing permissions and limitations under the License.
+ */
+
+package ecr
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/arn"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/awstesting/unit"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDownloadURLCacheExpiry(t *testing.T) {
+	now := time.Now()
+	cache := newDownloadURLCache(time.Minute)
+	cache.now = func() time.Time { return now }
+
+	cache.put("key", "https://example.com/layer")
+	url, ok := cache.get("key")
+	assert.True(t, ok)
+	assert.Equal(t, "https://example.com/layer", url)
+
+	now = now.Add(time.Minute)
+	_, ok = cache.get("key")
+	assert.False(t, ok, "expired URL should not be returned")
+	assert.Empty(t, cache.entries)
+}
+
+func TestDownloadURLCachePresignedExpiry(t *testing.T) {
+	now := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	cache := newDownloadURLCache(time.Hour)
+	cache.now = func() time.Time { return now }
+
+	presigned := "https://example.com/layer?X-Amz-Date=20240102T030405Z&X-Amz-Expires=60"
+	expires, ok := presignedURLExpiry(presigned)
+	require.True(t, ok)
+	assert.Equal(t, now.Add(time.Minute), expires)
+	_, ok = presignedURLExpiry("https://example.com/layer")
+	assert.False(t, ok)
+
+	cache.put("key", presigned)
+	_, ok = cache.get("key")
+	assert.True(t, ok)
+	now = now.Add(time.Minute - downloadURLExpiryMargin)
+	_, ok = cache.get("key")
+	assert.False(t, ok, "URL about to expire should not be returned")
+}
+
+func TestFetchIndexSharedLayerDownloadURL(t *testing.T) {
+	const (
+		sharedLayer = "shared layer"
+		amd64Layer  = "amd64 layer"
+		arm64Layer  = "arm64 layer"
+	)
+	layers := map[digest.Digest]string{}
+	for _, layer := range []string{sharedLayer, amd64Layer, arm64Layer} {
+		layers[digest.FromString(layer)] = layer
+	}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, layers[digest.Digest(r.URL.Query().Get("digest"))])
+	}))
+	defer ts.Close()
+
+	urlRequests := map[string]int{}
+	fakeClient := &fakeECRClient{
+		GetDownloadUrlForLayerFn: func(_ aws.Context, input *ecr.GetDownloadUrlForLayerInput, _ ...request.Option) (*ecr.GetDownloadUrlForLayerOutput, error) {
+			urlRequests[aws.StringValue(input.LayerDigest)]++
+			return &ecr.GetDownloadUrlForLayerOutput{
+				DownloadUrl: aws.String(ts.URL + "/?digest=" + aws.StringValue(input.LayerDigest)),
+			}, nil
+		},
+	}
+	resolver, err := NewResolver(
+		WithSession(unit.Session),
+		WithHTTPClient(ts.Client()),
+		WithDownloadURLCache(time.Minute),
+	)
+	require.NoError(t, err)
+	resolver.(*ecrResolver).clients["fake"] = fakeClient
+
+	// Each platform's manifest is fetched with its own fetcher, as when
+	// pulling an index.
+	for _, platformLayers := range [][]string{{sharedLayer, amd64Layer}, {sharedLayer, arm64Layer}} {
+		fetcher, err := resolver.Fetcher(context.Background(), "ecr.aws/arn:aws:ecr:fake:123456789012:repository/foo/bar:latest")
+		require.NoError(t, err)
+		for _, layer := range platformLayers {
+			rc, err := fetcher.Fetch(context.Background(), ocispec.Descriptor{
+				MediaType: ocispec.MediaTypeImageLayerGzip,
+				Digest:    digest.FromString(layer),
+				Size:      int64(len(layer)),
+			})
+			require.NoError(t, err)
+			body, err := io.ReadAll(rc)
+			rc.Close()
+			require.NoError(t, err)
+			assert.Equal(t, layer, string(body))
+		}
+	}
+
+	assert.Equal(t, map[string]int{
+		digest.FromString(sharedLayer).String(): 1,
+		digest.FromString(amd64Layer).String():  1,
+		digest.FromString(arm64Layer).String():  1,
+	}, urlRequests)
+}
+
+func TestFetcherDownloadURLConcurrentMisses(t *testing.T) {
+	const fetches = 4
+	var requests int32
+	release := make(chan struct{})
+	fetcher := &ecrFetcher{
+		ecrBase: ecrBase{
+			client: &fakeECRClient{
+				GetDownloadUrlForLayerFn: func(aws.Context, *ecr.GetDownloadUrlForLayerInput, ...request.Option) (*ecr.GetDownloadUrlForLayerOutput, error) {
+					atomic.AddInt32(&requests, 1)
+					<-release
+					return &ecr.GetDownloadUrlForLayerOutput{DownloadUrl: aws.String("https://example.com/layer")}, nil
+				},
+			},
+			ecrSpec: ECRSpec{
+				arn:        arn.ARN{AccountID: "123456789012"},
+				Repository: "foo/bar",
+			},
+		},
+		downloadURLs: newDownloadURLCache(time.Minute),
+	}
+	desc := ocispec.Descriptor{Digest: digest.FromString("layer")}
+
+	var wg, waiting sync.WaitGroup
+	urls := make([]string, fetches)
+	errs := make([]error, fetches)
+	for i := 0; i < fetches; i++ {
+		wg.Add(1)
+		waiting.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			waiting.Done()
+			urls[i], errs[i] = fetcher.getDownloadURL(context.Background(), desc)
+		}(i)
+	}
+
+	// A fetcher that gives up waiting does not cancel the shared request.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := fetcher.getDownloadURL(ctx, desc)
+	assert.ErrorIs(t, err, context.Canceled)
+
+	// The request is held until every fetcher has asked for the URL; any that
+	// join after it completes find the URL it cached.
+	waiting.Wait()
+	close(release)
+	wg.Wait()
+	for i := 0; i < fetches; i++ {
+		require.NoError(t, errs[i])
+		assert.Equal(t, "https://example.com/layer", urls[i])
+	}
+	assert.Equal(t, int32(1), atomic.LoadInt32(&requests), "concurrent misses should share a request")
+}
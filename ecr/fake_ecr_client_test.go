@@ -24,14 +24,30 @@ import (
 // fakeECRClient is a fake that can be used for testing the ecrAPI interface.
 // Each method is backed by a function contained in the struct.  Nil functions
 // will cause panics when invoked.
+//
+// InitiateLayerUploadFn and CompleteLayerUploadFn predate the context-aware
+// upload methods of ecrAPI; they are called when the corresponding
+// WithContextFn is nil, so that fakes written against them still satisfy the
+// interface. The context and request options are dropped when falling back to
+// them, so tests asserting on either must set the WithContextFn instead.
 type fakeECRClient struct {
-	BatchGetImageFn               func(aws.Context, *ecr.BatchGetImageInput, ...request.Option) (*ecr.BatchGetImageOutput, error)
-	GetDownloadUrlForLayerFn      func(aws.Context, *ecr.GetDownloadUrlForLayerInput, ...request.Option) (*ecr.GetDownloadUrlForLayerOutput, error)
-	BatchCheckLayerAvailabilityFn func(aws.Context, *ecr.BatchCheckLayerAvailabilityInput, ...request.Option) (*ecr.BatchCheckLayerAvailabilityOutput, error)
-	InitiateLayerUploadFn         func(*ecr.InitiateLayerUploadInput) (*ecr.InitiateLayerUploadOutput, error)
-	UploadLayerPartFn             func(*ecr.UploadLayerPartInput) (*ecr.UploadLayerPartOutput, error)
-	CompleteLayerUploadFn         func(*ecr.CompleteLayerUploadInput) (*ecr.CompleteLayerUploadOutput, error)
-	PutImageFn                    func(aws.Context, *ecr.PutImageInput, ...request.Option) (*ecr.PutImageOutput, error)
+	BatchGetImageFn                    func(aws.Context, *ecr.BatchGetImageInput, ...request.Option) (*ecr.BatchGetImageOutput, error)
+	GetDownloadUrlForLayerFn           func(aws.Context, *ecr.GetDownloadUrlForLayerInput, ...request.Option) (*ecr.GetDownloadUrlForLayerOutput, error)
+	BatchCheckLayerAvailabilityFn      func(aws.Context, *ecr.BatchCheckLayerAvailabilityInput, ...request.Option) (*ecr.BatchCheckLayerAvailabilityOutput, error)
+	InitiateLayerUploadFn              func(*ecr.InitiateLayerUploadInput) (*ecr.InitiateLayerUploadOutput, error)
+	InitiateLayerUploadWithContextFn   func(aws.Context, *ecr.InitiateLayerUploadInput, ...request.Option) (*ecr.InitiateLayerUploadOutput, error)
+	CompleteLayerUploadWithContextFn   func(aws.Context, *ecr.CompleteLayerUploadInput, ...request.Option) (*ecr.CompleteLayerUploadOutput, error)
+	UploadLayerPartFn                  func(aws.Context, *ecr.UploadLayerPartInput, ...request.Option) (*ecr.UploadLayerPartOutput, error)
+	CompleteLayerUploadFn              func(*ecr.CompleteLayerUploadInput) (*ecr.CompleteLayerUploadOutput, error)
+	PutImageFn                         func(aws.Context, *ecr.PutImageInput, ...request.Option) (*ecr.PutImageOutput, error)
+	ListImagesFn                       func(aws.Context, *ecr.ListImagesInput, ...request.Option) (*ecr.ListImagesOutput, error)
+	BatchDeleteImageFn                 func(aws.Context, *ecr.BatchDeleteImageInput, ...request.Option) (*ecr.BatchDeleteImageOutput, error)
+	DescribeRepositoriesFn             func(aws.Context, *ecr.DescribeRepositoriesInput, ...request.Option) (*ecr.DescribeRepositoriesOutput, error)
+	DescribeImagesFn                   func(aws.Context, *ecr.DescribeImagesInput, ...request.Option) (*ecr.DescribeImagesOutput, error)
+	GetAuthorizationTokenFn            func(aws.Context, *ecr.GetAuthorizationTokenInput, ...request.Option) (*ecr.GetAuthorizationTokenOutput, error)
+	DescribeRegistryFn                 func(aws.Context, *ecr.DescribeRegistryInput, ...request.Option) (*ecr.DescribeRegistryOutput, error)
+	CreateRepositoryFn                 func(aws.Context, *ecr.CreateRepositoryInput, ...request.Option) (*ecr.CreateRepositoryOutput, error)
+	GetRegistryScanningConfigurationFn func(aws.Context, *ecr.GetRegistryScanningConfigurationInput, ...request.Option) (*ecr.GetRegistryScanningConfigurationOutput, error)
 }
 
 var _ ecrAPI = (*fakeECRClient)(nil)
@@ -48,18 +64,56 @@ func (f *fakeECRClient) BatchCheckLayerAvailabilityWithContext(ctx aws.Context,
 	return f.BatchCheckLayerAvailabilityFn(ctx, arg, opts...)
 }
 
-func (f *fakeECRClient) InitiateLayerUpload(arg *ecr.InitiateLayerUploadInput) (*ecr.InitiateLayerUploadOutput, error) {
+func (f *fakeECRClient) InitiateLayerUploadWithContext(ctx aws.Context, arg *ecr.InitiateLayerUploadInput, opts ...request.Option) (*ecr.InitiateLayerUploadOutput, error) {
+	if f.InitiateLayerUploadWithContextFn != nil {
+		return f.InitiateLayerUploadWithContextFn(ctx, arg, opts...)
+	}
 	return f.InitiateLayerUploadFn(arg)
 }
 
-func (f *fakeECRClient) UploadLayerPart(arg *ecr.UploadLayerPartInput) (*ecr.UploadLayerPartOutput, error) {
-	return f.UploadLayerPartFn(arg)
+func (f *fakeECRClient) UploadLayerPartWithContext(ctx aws.Context, arg *ecr.UploadLayerPartInput, opts ...request.Option) (*ecr.UploadLayerPartOutput, error) {
+	return f.UploadLayerPartFn(ctx, arg, opts...)
 }
 
-func (f *fakeECRClient) CompleteLayerUpload(arg *ecr.CompleteLayerUploadInput) (*ecr.CompleteLayerUploadOutput, error) {
+func (f *fakeECRClient) CompleteLayerUploadWithContext(ctx aws.Context, arg *ecr.CompleteLayerUploadInput, opts ...request.Option) (*ecr.CompleteLayerUploadOutput, error) {
+	if f.CompleteLayerUploadWithContextFn != nil {
+		return f.CompleteLayerUploadWithContextFn(ctx, arg, opts...)
+	}
 	return f.CompleteLayerUploadFn(arg)
 }
 
 func (f *fakeECRClient) PutImageWithContext(ctx aws.Context, arg *ecr.PutImageInput, opts ...request.Option) (*ecr.PutImageOutput, error) {
 	return f.PutImageFn(ctx, arg, opts...)
 }
+
+func (f *fakeECRClient) ListImagesWithContext(ctx aws.Context, arg *ecr.ListImagesInput, opts ...request.Option) (*ecr.ListImagesOutput, error) {
+	return f.ListImagesFn(ctx, arg, opts...)
+}
+
+func (f *fakeECRClient) BatchDeleteImageWithContext(ctx aws.Context, arg *ecr.BatchDeleteImageInput, opts ...request.Option) (*ecr.BatchDeleteImageOutput, error) {
+	return f.BatchDeleteImageFn(ctx, arg, opts...)
+}
+
+func (f *fakeECRClient) DescribeRepositoriesWithContext(ctx aws.Context, arg *ecr.DescribeRepositoriesInput, opts ...request.Option) (*ecr.DescribeRepositoriesOutput, error) {
+	return f.DescribeRepositoriesFn(ctx, arg, opts...)
+}
+
+func (f *fakeECRClient) DescribeImagesWithContext(ctx aws.Context, arg *ecr.DescribeImagesInput, opts ...request.Option) (*ecr.DescribeImagesOutput, error) {
+	return f.DescribeImagesFn(ctx, arg, opts...)
+}
+
+func (f *fakeECRClient) GetAuthorizationTokenWithContext(ctx aws.Context, arg *ecr.GetAuthorizationTokenInput, opts ...request.Option) (*ecr.GetAuthorizationTokenOutput, error) {
+	return f.GetAuthorizationTokenFn(ctx, arg, opts...)
+}
+
+func (f *fakeECRClient) DescribeRegistryWithContext(ctx aws.Context, arg *ecr.DescribeRegistryInput, opts ...request.Option) (*ecr.DescribeRegistryOutput, error) {
+	return f.DescribeRegistryFn(ctx, arg, opts...)
+}
+
+func (f *fakeECRClient) CreateRepositoryWithContext(ctx aws.Context, arg *ecr.CreateRepositoryInput, opts ...request.Option) (*ecr.CreateRepositoryOutput, error) {
+	return f.CreateRepositoryFn(ctx, arg, opts...)
+}
+
+func (f *fakeECRClient) GetRegistryScanningConfigurationWithContext(ctx aws.Context, arg *ecr.GetRegistryScanningConfigurationInput, opts ...request.Option) (*ecr.GetRegistryScanningConfigurationOutput, error) {
+	return f.GetRegistryScanningConfigurationFn(ctx, arg, opts...)
+}
@@ -18,12 +18,19 @@ package ecr
 import (
 	"bytes"
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"math"
 	"net/http"
 	"net/url"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/ecr"
@@ -32,10 +39,14 @@ import (
 	"github.com/containerd/containerd/errdefs"
 	"github.com/containerd/containerd/images"
 	"github.com/containerd/containerd/log"
+	"github.com/containerd/containerd/platforms"
 	"github.com/containerd/containerd/remotes"
 	"github.com/htcat/htcat"
+	"github.com/opencontainers/go-digest"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"golang.org/x/net/context/ctxhttp"
+	"golang.org/x/sync/semaphore"
+	"golang.org/x/time/rate"
 )
 
 // ecrFetcher implements the containerd remotes.Fetcher interface and can be
@@ -44,11 +55,126 @@ type ecrFetcher struct {
 	ecrBase
 	parallelism int
 	httpClient  *http.Client
+	retryPolicy RetryPolicy
+	integrity   ContentIntegrity
+	// adaptiveParallelism, when set, chooses the parallelism for each layer
+	// from its size in place of parallelism.
+	adaptiveParallelism func(size int64) int
+	// haveBlob, when set, reports blobs that are not fetched as they are
+	// already present with the caller.
+	haveBlob func(digest.Digest) bool
+	// rejectSchema1 fails fetches of Docker v2 Schema 1 manifests.
+	rejectSchema1 bool
+	// downloadURLs, when set, caches layer download URLs across the
+	// resolver's fetchers.
+	downloadURLs *downloadURLCache
+	// manifests, when set, holds manifests retrieved while resolving
+	// references that are reused by fetches of the same manifests.
+	manifests *manifestCache
+	// onLayerDownload, when set, receives the metadata of layer download
+	// responses.
+	onLayerDownload func(context.Context, ocispec.Descriptor, LayerDownloadMetadata)
+	// idleTimeout, when set, fails layer downloads that receive no content
+	// for longer than the timeout.
+	idleTimeout time.Duration
+	// urlRefreshes is how many times a layer download rejected as forbidden
+	// is retried with a fresh download URL.
+	urlRefreshes int
+	// sniffMediaType fetches content with an empty media type as a manifest
+	// when it is one, or as a blob otherwise.
+	sniffMediaType bool
+	// downloadLimiter, when set, limits the rate at which layer content is
+	// read, shared across the resolver's fetchers.
+	downloadLimiter *rate.Limiter
+	// fetchLimiter, when set, bounds the layer downloads in progress across
+	// every resolver sharing it.
+	fetchLimiter *semaphore.Weighted
+	// prefetchPlatforms, when set, limits the index children that are
+	// prefetched to those for matching platforms.
+	prefetchPlatforms platforms.Matcher
+
+	prefetchLock sync.Mutex
+	// prefetched holds the index children retrieved by prefetchChildren
+	// until they are fetched.
+	prefetched map[digest.Digest]prefetchedManifest
+}
+
+// prefetchedManifest is an index child held by a fetcher until it is fetched.
+type prefetchedManifest struct {
+	mediaType string
+	body      string
 }
 
-var _ remotes.Fetcher = (*ecrFetcher)(nil)
+// errDownloadForbidden is returned for layer downloads rejected as forbidden,
+// as Amazon S3 does once a presigned download URL expires.
+var errDownloadForbidden = errors.New("ecr: layer download forbidden")
+
+// LayerDownloadMetadata describes the response to a layer download.
+type LayerDownloadMetadata struct {
+	// ETag is the entity tag of the layer's content, if provided.
+	ETag string
+	// LastModified is when the layer's content was last modified, or the
+	// zero time if not provided.
+	LastModified time.Time
+}
+
+// ResumableFetcher is implemented by the fetchers of the resolver to resume
+// fetching content that was partially fetched, such as from the offset of an
+// interrupted ingest in a content store.
+type ResumableFetcher interface {
+	// FetchFrom fetches desc's content starting at offset.  prefix provides
+	// the content preceding offset and is used to validate the digest of the
+	// full content when the resolver is configured to do so; it may otherwise
+	// be nil.
+	FetchFrom(ctx context.Context, desc ocispec.Descriptor, offset int64, prefix io.Reader) (io.ReadCloser, error)
+}
+
+// BlobStatter is implemented by the fetchers of the resolver to describe a
+// blob in the repository without fetching its content.
+type BlobStatter interface {
+	// StatBlob returns a descriptor of the blob with digest dgst, with its
+	// size and, when ECR records one, its media type.  It returns an error
+	// wrapping errdefs.ErrNotFound when the blob is not available.
+	StatBlob(ctx context.Context, dgst digest.Digest) (ocispec.Descriptor, error)
+}
+
+var (
+	_ remotes.Fetcher  = (*ecrFetcher)(nil)
+	_ ResumableFetcher = (*ecrFetcher)(nil)
+	_ BlobStatter      = (*ecrFetcher)(nil)
+)
+
+// StatBlob describes the blob with a BatchCheckLayerAvailability request.
+func (f *ecrFetcher) StatBlob(ctx context.Context, dgst digest.Digest) (ocispec.Descriptor, error) {
+	ctx = withLogFields(ctx, f.logFields)
+	ctx = withRetryBudget(ctx, f.retryDeadline)
+	log.G(ctx).WithField("digest", dgst).Debug("ecr.fetch.stat")
+
+	output, err := f.client.BatchCheckLayerAvailabilityWithContext(ctx, &ecr.BatchCheckLayerAvailabilityInput{
+		RegistryId:     aws.String(f.ecrSpec.Registry()),
+		RepositoryName: aws.String(f.ecrSpec.Repository),
+		LayerDigests:   []*string{aws.String(dgst.String())},
+	})
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	for _, layer := range output.Layers {
+		if aws.StringValue(layer.LayerDigest) != dgst.String() ||
+			aws.StringValue(layer.LayerAvailability) != ecr.LayerAvailabilityAvailable {
+			continue
+		}
+		return ocispec.Descriptor{
+			MediaType: aws.StringValue(layer.MediaType),
+			Digest:    dgst,
+			Size:      aws.Int64Value(layer.LayerSize),
+		}, nil
+	}
+	return ocispec.Descriptor{}, fmt.Errorf("ecr: blob %v: %w", dgst, errdefs.ErrNotFound)
+}
 
 func (f *ecrFetcher) Fetch(ctx context.Context, desc ocispec.Descriptor) (io.ReadCloser, error) {
+	ctx = withLogFields(ctx, f.logFields)
+	ctx = withRetryBudget(ctx, f.retryDeadline)
 	ctx = log.WithLogger(ctx, log.G(ctx).WithField("desc", ociutil.RedactDescriptor(desc)))
 	log.G(ctx).Debug("ecr.fetch")
 
@@ -60,6 +186,9 @@ func (f *ecrFetcher) Fetch(ctx context.Context, desc ocispec.Descriptor) (io.Rea
 		images.MediaTypeDockerSchema2ManifestList,
 		ocispec.MediaTypeImageIndex,
 		ocispec.MediaTypeImageManifest:
+		if f.rejectSchema1 && isSchema1(desc.MediaType) {
+			return nil, fmt.Errorf("ecr: fetch %q: %w", desc.MediaType, ErrSchema1Unsupported)
+		}
 		return f.fetchManifest(ctx, desc)
 	case
 		images.MediaTypeDockerSchema2Layer,
@@ -69,11 +198,24 @@ func (f *ecrFetcher) Fetch(ctx context.Context, desc ocispec.Descriptor) (io.Rea
 		ocispec.MediaTypeImageLayerZstd,
 		ocispec.MediaTypeImageLayer,
 		ocispec.MediaTypeImageConfig:
+		if err := f.checkBlobPresent(ctx, desc); err != nil {
+			return nil, err
+		}
 		return f.fetchLayer(ctx, desc)
 	case
 		images.MediaTypeDockerSchema2LayerForeign,
 		images.MediaTypeDockerSchema2LayerForeignGzip:
-		return f.fetchForeignLayer(ctx, desc)
+		if err := f.checkBlobPresent(ctx, desc); err != nil {
+			return nil, err
+		}
+		return f.limitFetch(ctx, func() (io.ReadCloser, error) {
+			return f.fetchForeignLayer(ctx, desc)
+		})
+	case "":
+		if f.sniffMediaType {
+			return f.fetchSniffed(ctx, desc)
+		}
+		fallthrough
 	default:
 		log.G(ctx).
 			WithField("media type", desc.MediaType).
@@ -82,6 +224,66 @@ func (f *ecrFetcher) Fetch(ctx context.Context, desc ocispec.Descriptor) (io.Rea
 	}
 }
 
+// fetchSniffed fetches content of an unknown media type as a manifest when
+// BatchGetImage finds an image with its digest, and as a blob otherwise.
+func (f *ecrFetcher) fetchSniffed(ctx context.Context, desc ocispec.Descriptor) (io.ReadCloser, error) {
+	rc, err := f.fetchManifest(ctx, desc)
+	if desc.Digest == "" || !errors.Is(err, ErrImageNotFound) {
+		return rc, err
+	}
+	log.G(ctx).Debug("ecr.fetch: no manifest found, fetching as blob")
+	if err := f.checkBlobPresent(ctx, desc); err != nil {
+		return nil, err
+	}
+	return f.fetchLayer(ctx, desc)
+}
+
+// checkBlobPresent returns an error wrapping ErrBlobPresent if the blob is
+// reported as present by haveBlob.
+func (f *ecrFetcher) checkBlobPresent(ctx context.Context, desc ocispec.Descriptor) error {
+	if f.haveBlob == nil || !f.haveBlob(desc.Digest) {
+		return nil
+	}
+	log.G(ctx).Debug("ecr.fetch: blob present, skipping")
+	return fmt.Errorf("content %v: %w", desc.Digest, ErrBlobPresent)
+}
+
+// FetchFrom resumes fetching a layer at offset.  Only layers stored in ECR can
+// be resumed.
+func (f *ecrFetcher) FetchFrom(ctx context.Context, desc ocispec.Descriptor, offset int64, prefix io.Reader) (io.ReadCloser, error) {
+	if offset == 0 {
+		return f.Fetch(ctx, desc)
+	}
+	ctx = withLogFields(ctx, f.logFields)
+	ctx = withRetryBudget(ctx, f.retryDeadline)
+	ctx = log.WithLogger(ctx, log.G(ctx).WithField("desc", ociutil.RedactDescriptor(desc)))
+	log.G(ctx).WithField("offset", offset).Debug("ecr.fetch.resume")
+
+	if offset < 0 || (desc.Size > 0 && offset > desc.Size) {
+		return nil, fmt.Errorf("ecr: invalid offset %d for content of size %d: %w", offset, desc.Size, errdefs.ErrInvalidArgument)
+	}
+	switch desc.MediaType {
+	case
+		images.MediaTypeDockerSchema2Layer,
+		images.MediaTypeDockerSchema2LayerGzip,
+		images.MediaTypeDockerSchema2Config,
+		ocispec.MediaTypeImageLayerGzip,
+		ocispec.MediaTypeImageLayerZstd,
+		ocispec.MediaTypeImageLayer,
+		ocispec.MediaTypeImageConfig:
+		if offset == desc.Size {
+			// Nothing remains to be fetched, and a request for the range
+			// would be rejected as unsatisfiable.
+			return withResumedContentIntegrity(io.NopCloser(strings.NewReader("")), desc, f.integrity, offset, prefix)
+		}
+		return f.limitFetch(ctx, func() (io.ReadCloser, error) {
+			return f.fetchLayerFrom(ctx, desc, offset, prefix)
+		})
+	default:
+		return nil, fmt.Errorf("ecr: resuming fetch of %q: %w", desc.MediaType, errdefs.ErrNotImplemented)
+	}
+}
+
 func (f *ecrFetcher) fetchManifest(ctx context.Context, desc ocispec.Descriptor) (io.ReadCloser, error) {
 	var (
 		image *ecr.Image
@@ -94,6 +296,10 @@ func (f *ecrFetcher) fetchManifest(ctx context.Context, desc ocispec.Descriptor)
 		log.G(ctx).Debug("ecr.fetcher.manifest: fetch image by tag")
 		image, err = f.getImage(ctx)
 	} else {
+		if body, ok := f.reusedManifest(ctx, desc); ok {
+			f.prefetchChildren(ctx, desc, body)
+			return io.NopCloser(strings.NewReader(body)), nil
+		}
 		log.G(ctx).Debug("ecr.fetcher.manifest: fetch image by digest")
 		image, err = f.getImageByDescriptor(ctx, desc)
 	}
@@ -103,28 +309,297 @@ func (f *ecrFetcher) fetchManifest(ctx context.Context, desc ocispec.Descriptor)
 	if image == nil {
 		return nil, errors.New("fetchManifest: nil image")
 	}
+	manifest := aws.StringValue(image.ImageManifest)
+	// Manifests fetched by tag are verified against the digest of the
+	// reference, if any, which was requested along with the tag.
+	expected := desc.Digest
+	if expected == "" {
+		expected = f.ecrSpec.Spec().Digest()
+	}
+	if err := verifyManifestDigest(manifest, expected); err != nil {
+		log.G(ctx).WithError(err).Error("ecr.fetcher.manifest: content does not match descriptor")
+		return nil, err
+	}
+	if err := verifyManifestSize(manifest, desc.Size); err != nil {
+		log.G(ctx).WithError(err).Error("ecr.fetcher.manifest: content does not match descriptor")
+		return nil, err
+	}
+	f.prefetchChildren(ctx, desc, manifest)
+
+	return io.NopCloser(bytes.NewReader([]byte(manifest))), nil
+}
+
+// reusedManifest returns the manifest described by desc when it was
+// prefetched by this fetcher or retrieved by resolve, and matches desc.
+func (f *ecrFetcher) reusedManifest(ctx context.Context, desc ocispec.Descriptor) (string, bool) {
+	f.prefetchLock.Lock()
+	child, ok := f.prefetched[desc.Digest]
+	if ok {
+		delete(f.prefetched, desc.Digest)
+	}
+	f.prefetchLock.Unlock()
+	if ok && (desc.MediaType == "" || child.mediaType == desc.MediaType) &&
+		verifyManifestDigest(child.body, desc.Digest) == nil && verifyManifestSize(child.body, desc.Size) == nil {
+		log.G(ctx).Debug("ecr.fetcher.manifest: using prefetched manifest")
+		return child.body, true
+	}
+	if f.manifests == nil {
+		return "", false
+	}
+	key, err := manifestCacheKey(f.ecrSpec.ARN(), desc.Digest)
+	if err != nil {
+		return "", false
+	}
+	body, ok := f.manifests.get(key, desc.MediaType)
+	if ok && verifyManifestDigest(body, desc.Digest) == nil && verifyManifestSize(body, desc.Size) == nil {
+		log.G(ctx).Debug("ecr.fetcher.manifest: using manifest retrieved by resolve")
+		return body, true
+	}
+	return "", false
+}
+
+// prefetchChildren retrieves the manifests of an index or manifest list with
+// as few BatchGetImage requests as possible and holds them for the fetches of
+// the children that follow, rather than retrieving each child separately.
+// Only children for the platforms matched by prefetchPlatforms, if set, are
+// prefetched. Children that cannot be prefetched are left to be retrieved
+// when fetched.
+func (f *ecrFetcher) prefetchChildren(ctx context.Context, desc ocispec.Descriptor, manifest string) {
+	switch desc.MediaType {
+	case images.MediaTypeDockerSchema2ManifestList, ocispec.MediaTypeImageIndex:
+	default:
+		return
+	}
+	var index ocispec.Index
+	if err := json.Unmarshal([]byte(manifest), &index); err != nil {
+		log.G(ctx).WithError(err).Debug("ecr.fetcher.manifest: cannot parse index, skipping prefetch")
+		return
+	}
+	var digests []digest.Digest
+	mediaTypes := map[digest.Digest]string{}
+	var acceptedTypes []string
+	for _, child := range index.Manifests {
+		if child.Digest == "" {
+			continue
+		}
+		if child.Platform != nil && f.prefetchPlatforms != nil && !f.prefetchPlatforms.Match(*child.Platform) {
+			continue
+		}
+		if _, ok := mediaTypes[child.Digest]; ok {
+			continue
+		}
+		digests = append(digests, child.Digest)
+		mediaTypes[child.Digest] = child.MediaType
+		if child.MediaType != "" && !slices.Contains(acceptedTypes, child.MediaType) {
+			acceptedTypes = append(acceptedTypes, child.MediaType)
+		}
+	}
+	if len(digests) < 2 {
+		return
+	}
+	if len(acceptedTypes) == 0 {
+		acceptedTypes = acceptedMediaTypes(ctx)
+	}
 
-	return io.NopCloser(bytes.NewReader([]byte(aws.StringValue(image.ImageManifest)))), nil
+	children, err := f.getImagesByDigest(ctx, digests, acceptedTypes)
+	if err != nil {
+		log.G(ctx).WithError(err).Warn("ecr.fetcher.manifest: failed to prefetch index children")
+		return
+	}
+	f.prefetchLock.Lock()
+	if f.prefetched == nil {
+		f.prefetched = map[digest.Digest]prefetchedManifest{}
+	}
+	for dgst, image := range children {
+		mediaType := aws.StringValue(image.ImageManifestMediaType)
+		if mediaType == "" {
+			mediaType = mediaTypes[dgst]
+		}
+		f.prefetched[dgst] = prefetchedManifest{
+			mediaType: mediaType,
+			body:      aws.StringValue(image.ImageManifest),
+		}
+	}
+	f.prefetchLock.Unlock()
+	log.G(ctx).
+		WithField("children", len(digests)).
+		WithField("prefetched", len(children)).
+		Debug("ecr.fetcher.manifest: prefetched index children")
+}
+
+// verifyManifestSize asserts that the manifest's length matches the size of
+// its descriptor, when known.
+func verifyManifestSize(manifest string, size int64) error {
+	if size > 0 && int64(len(manifest)) != size {
+		return fmt.Errorf("ecr: manifest size %d does not match expected size %d: %w", len(manifest), size, errdefs.ErrFailedPrecondition)
+	}
+	return nil
+}
+
+// verifyManifestDigest asserts that the manifest's content matches the
+// requested digest, so that a manifest other than the one requested is not
+// returned in its place.  Manifests fetched without a digest, or with a digest
+// of an unavailable algorithm, are not verified.
+func verifyManifestDigest(manifest string, expected digest.Digest) error {
+	if expected == "" || !expected.Algorithm().Available() {
+		return nil
+	}
+	normalized, err := normalizeDigest(expected)
+	if err != nil {
+		return err
+	}
+	if actual := expected.Algorithm().FromString(manifest); actual != normalized {
+		return fmt.Errorf("ecr: manifest digest %v does not match expected digest %v: %w", actual, expected, errdefs.ErrFailedPrecondition)
+	}
+	return nil
 }
 
 func (f *ecrFetcher) fetchLayer(ctx context.Context, desc ocispec.Descriptor) (io.ReadCloser, error) {
+	return f.limitFetch(ctx, func() (io.ReadCloser, error) {
+		return f.fetchLayerFrom(ctx, desc, 0, nil)
+	})
+}
+
+// limitFetch holds a slot of the fetch limiter, if any, from before the
+// download starts until its content is closed.
+func (f *ecrFetcher) limitFetch(ctx context.Context, fetch func() (io.ReadCloser, error)) (io.ReadCloser, error) {
+	if f.fetchLimiter == nil {
+		return fetch()
+	}
+	if err := f.fetchLimiter.Acquire(ctx, 1); err != nil {
+		return nil, err
+	}
+	rc, err := fetch()
+	if err != nil {
+		f.fetchLimiter.Release(1)
+		return nil, err
+	}
+	return &releasingReadCloser{ReadCloser: rc, release: func() { f.fetchLimiter.Release(1) }}, nil
+}
+
+// releasingReadCloser calls release once it is first closed.
+type releasingReadCloser struct {
+	io.ReadCloser
+	release func()
+	once    sync.Once
+}
+
+func (rc *releasingReadCloser) Close() error {
+	err := rc.ReadCloser.Close()
+	rc.once.Do(rc.release)
+	return err
+}
+
+// fetchLayerFrom fetches a layer's content starting at offset.  Parallel
+// downloads are used only for layers fetched from the start.
+func (f *ecrFetcher) fetchLayerFrom(ctx context.Context, desc ocispec.Descriptor, offset int64, prefix io.Reader) (io.ReadCloser, error) {
 	log.G(ctx).Debug("ecr.fetcher.layer")
+	downloadURL, err := f.getDownloadURL(ctx, desc)
+	if err != nil {
+		return nil, err
+	}
+
+	var rc io.ReadCloser
+	parallelism := f.parallelism
+	if f.adaptiveParallelism != nil {
+		parallelism = f.adaptiveParallelism(desc.Size)
+	}
+	parallel := parallelism > 0 && offset == 0
+	for refreshes := 0; ; refreshes++ {
+		urlCtx := log.WithLogger(ctx, log.G(ctx).WithField("url", httputil.RedactHTTPQueryValuesFromURL(downloadURL)))
+		if parallel {
+			rc, err = f.fetchLayerHtcat(urlCtx, desc, downloadURL, parallelism)
+		} else {
+			rc, err = f.fetchLayerURL(urlCtx, desc, downloadURL, offset)
+		}
+		if !errors.Is(err, errDownloadForbidden) || refreshes >= f.urlRefreshes {
+			break
+		}
+		log.G(urlCtx).WithError(err).Warn("ecr.fetcher.layer: download URL rejected, refreshing")
+		downloadURL, err = f.refreshDownloadURL(ctx, desc)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if f.metrics != nil {
+		rc = &meteredReadCloser{ReadCloser: rc, metrics: f.metrics}
+	}
+	if !parallel {
+		// Parallel downloads are limited as their responses are read, as
+		// they read ahead of the content returned.
+		rc = f.limitDownload(ctx, rc)
+	}
+	return withResumedContentIntegrity(rc, desc, f.integrity, offset, prefix)
+}
+
+// getDownloadURL returns the URL to download the layer from, reusing a cached
+// URL when available.
+func (f *ecrFetcher) getDownloadURL(ctx context.Context, desc ocispec.Descriptor) (string, error) {
+	if f.downloadURLs == nil {
+		return f.requestDownloadURL(ctx, desc)
+	}
+	key := f.downloadURLKey(desc)
+	if downloadURL, ok := f.downloadURLs.get(key); ok {
+		log.G(ctx).Debug("ecr.fetcher.layer: using cached download URL")
+		return downloadURL, nil
+	}
+	// Fetchers pulling the platforms of an index in parallel miss the cache
+	// for their shared layers at once, so they wait on a single request.  The
+	// request is not canceled with the context of whichever fetcher made it,
+	// as the others still wait on it.  A fetcher that missed the cache just
+	// before a shared request completed finds the URL cached by it.
+	results := f.downloadURLs.requests.DoChan(key, func() (interface{}, error) {
+		if downloadURL, ok := f.downloadURLs.get(key); ok {
+			return downloadURL, nil
+		}
+		downloadURL, err := f.requestDownloadURL(context.WithoutCancel(ctx), desc)
+		if err != nil {
+			return "", err
+		}
+		f.downloadURLs.put(key, downloadURL)
+		return downloadURL, nil
+	})
+	select {
+	case <-ctx.Done():
+		return "", ctx.Err()
+	case result := <-results:
+		if result.Err != nil {
+			return "", result.Err
+		}
+		return result.Val.(string), nil
+	}
+}
+
+// requestDownloadURL requests a URL to download the layer from ECR.
+func (f *ecrFetcher) requestDownloadURL(ctx context.Context, desc ocispec.Descriptor) (string, error) {
 	getDownloadUrlForLayerInput := &ecr.GetDownloadUrlForLayerInput{
 		RegistryId:     aws.String(f.ecrSpec.Registry()),
 		RepositoryName: aws.String(f.ecrSpec.Repository),
 		LayerDigest:    aws.String(desc.Digest.String()),
 	}
-	output, err := f.client.GetDownloadUrlForLayerWithContext(ctx, getDownloadUrlForLayerInput)
+	spanCtx, span := startSpan(ctx, f.tracer, f.ecrSpec, "ecr.GetDownloadUrlForLayer", digestAttribute.String(desc.Digest.String()))
+	output, err := f.client.GetDownloadUrlForLayerWithContext(spanCtx, getDownloadUrlForLayerInput)
+	endSpan(span, err)
 	if err != nil {
-		return nil, err
+		return "", err
 	}
+	return aws.StringValue(output.DownloadUrl), nil
+}
 
-	downloadURL := aws.StringValue(output.DownloadUrl)
-	ctx = log.WithLogger(ctx, log.G(ctx).WithField("url", httputil.RedactHTTPQueryValuesFromURL(downloadURL)))
-	if f.parallelism > 0 {
-		return f.fetchLayerHtcat(ctx, desc, downloadURL)
+// refreshDownloadURL returns a fresh URL to download the layer from, in place
+// of a URL that was rejected.
+func (f *ecrFetcher) refreshDownloadURL(ctx context.Context, desc ocispec.Descriptor) (string, error) {
+	if f.downloadURLs != nil {
+		f.downloadURLs.remove(f.downloadURLKey(desc))
 	}
-	return f.fetchLayerURL(ctx, desc, downloadURL)
+	return f.getDownloadURL(ctx, desc)
+}
+
+func (f *ecrFetcher) downloadURLKey(desc ocispec.Descriptor) string {
+	return f.ecrSpec.ARN() + "@" + desc.Digest.String()
 }
 
 func (f *ecrFetcher) fetchForeignLayer(ctx context.Context, desc ocispec.Descriptor) (io.ReadCloser, error) {
@@ -137,40 +612,130 @@ func (f *ecrFetcher) fetchForeignLayer(ctx context.Context, desc ocispec.Descrip
 		redactedDownloadURL := httputil.RedactHTTPQueryValuesFromURL(layerURL)
 		log.G(ctx).WithField("url", redactedDownloadURL).Debug("ecr.fetcher.layer.foreign: fetching from URL")
 		var rdc io.ReadCloser
-		rdc, err = f.fetchLayerURL(ctx, desc, layerURL)
+		rdc, err = f.fetchLayerURL(ctx, desc, layerURL, 0)
 		if err == nil {
-			return rdc, nil
+			if f.metrics != nil {
+				rdc = &meteredReadCloser{ReadCloser: rdc, metrics: f.metrics}
+			}
+			rdc = f.limitDownload(ctx, rdc)
+			return withContentIntegrity(rdc, desc, f.integrity)
 		}
 		log.G(ctx).WithField("url", redactedDownloadURL).WithError(err).Warn("ecr.fetcher.layer.foreign: unable to fetch from URL")
 	}
 	return nil, err
 }
 
-func (f *ecrFetcher) fetchLayerURL(ctx context.Context, desc ocispec.Descriptor, downloadURL string) (io.ReadCloser, error) {
+// fetchLayerURL fetches the content at downloadURL, starting at offset.  The
+// span of the download ends once the returned content is closed.
+func (f *ecrFetcher) fetchLayerURL(ctx context.Context, desc ocispec.Descriptor, downloadURL string, offset int64) (io.ReadCloser, error) {
+	ctx, span := startSpan(ctx, f.tracer, f.ecrSpec, "ecr.DownloadLayer", digestAttribute.String(desc.Digest.String()))
+	rc, err := f.fetchLayerURLSpan(ctx, desc, downloadURL, offset)
+	if err != nil {
+		endSpan(span, err)
+		return nil, err
+	}
+	return &tracedReadCloser{ReadCloser: rc, span: span}, nil
+}
+
+func (f *ecrFetcher) fetchLayerURLSpan(ctx context.Context, desc ocispec.Descriptor, downloadURL string, offset int64) (io.ReadCloser, error) {
+	body, acceptRanges, err := f.openLayerURL(ctx, desc, downloadURL, offset)
+	if err != nil || !acceptRanges || !f.retryPolicy.retryable(1) {
+		return body, err
+	}
+	return &resumableReadCloser{
+		ReadCloser:  body,
+		ctx:         ctx,
+		fetcher:     f,
+		desc:        desc,
+		downloadURL: downloadURL,
+		offset:      offset,
+	}, nil
+}
+
+// openLayerURL requests the content at downloadURL, starting at offset, and
+// reports whether the server accepts range requests for the content.
+func (f *ecrFetcher) openLayerURL(ctx context.Context, desc ocispec.Descriptor, downloadURL string, offset int64) (io.ReadCloser, bool, error) {
 	req, err := http.NewRequest(http.MethodGet, downloadURL, nil)
 	if err != nil {
 		log.G(ctx).
 			WithError(err).
 			Error("ecr.fetcher.layer.url: failed to create HTTP request")
-		return nil, err
+		return nil, false, err
 	}
 	log.G(ctx).Debug("ecr.fetcher.layer.url")
 
 	req.Header.Set("Accept", strings.Join([]string{desc.MediaType, `*`}, ", "))
-	resp, err := f.doRequest(ctx, req)
-	if err != nil {
-		return nil, err
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+	reqCtx, idle := ctx, (*idleTimer)(nil)
+	if f.idleTimeout > 0 {
+		reqCtx, idle = newIdleTimer(ctx, f.idleTimeout)
+	}
+	var resp *http.Response
+	for attempts := 1; ; attempts++ {
+		idle.reset()
+		resp, err = f.doRequest(reqCtx, req)
+		idle.pause()
+		if err != nil {
+			idle.stop()
+			return nil, false, idle.error(err)
+		}
+		// Amazon S3 responds with 503 SlowDown when the request rate is too
+		// high, which is expected to succeed when retried after backing off.
+		if resp.StatusCode != http.StatusServiceUnavailable || !f.retryPolicy.retryable(attempts) {
+			break
+		}
+		resp.Body.Close()
+		delay, ok := retryAfter(resp)
+		if !ok {
+			delay = f.retryPolicy.backoff(attempts)
+		}
+		log.G(ctx).
+			WithField("attempts", attempts).
+			WithField("delay", delay).
+			Warn("ecr.fetcher.layer.url: service unavailable, retrying")
+		if err := sleep(ctx, delay); err != nil {
+			idle.stop()
+			return nil, false, err
+		}
+	}
+	if idle != nil {
+		resp.Body = &idleReadCloser{ReadCloser: resp.Body, idle: idle}
 	}
 	if resp.StatusCode > 299 {
 		resp.Body.Close()
 		redactedDownloadURL := httputil.RedactHTTPQueryValuesFromURL(downloadURL)
 		if resp.StatusCode == http.StatusNotFound {
-			return nil, fmt.Errorf("content at %v not found: %w", redactedDownloadURL, errdefs.ErrNotFound)
+			return nil, false, fmt.Errorf("content at %v not found: %w", redactedDownloadURL, errdefs.ErrNotFound)
+		}
+		if resp.StatusCode == http.StatusForbidden {
+			return nil, false, fmt.Errorf("%w: %v: %v", errDownloadForbidden, redactedDownloadURL, resp.Status)
+		}
+		return nil, false, fmt.Errorf("ecr.fetcher.layer.url: unexpected status code %v: %v", redactedDownloadURL, resp.Status)
+	}
+	// Servers may ignore the requested range and respond with the full
+	// content, which is skipped up to the offset.
+	if offset > 0 && resp.StatusCode != http.StatusPartialContent {
+		log.G(ctx).WithField("offset", offset).Debug("ecr.fetcher.layer.url: range ignored, skipping to offset")
+		if _, err := io.CopyN(io.Discard, resp.Body, offset); err != nil {
+			resp.Body.Close()
+			return nil, false, fmt.Errorf("ecr.fetcher.layer.url: failed to skip to offset %d: %w", offset, err)
+		}
+	}
+	if f.onLayerDownload != nil {
+		metadata := LayerDownloadMetadata{ETag: resp.Header.Get("ETag")}
+		if lastModified := resp.Header.Get("Last-Modified"); lastModified != "" {
+			if t, err := http.ParseTime(lastModified); err == nil {
+				metadata.LastModified = t
+			} else {
+				log.G(ctx).WithError(err).Debug("ecr.fetcher.layer.url: invalid Last-Modified")
+			}
 		}
-		return nil, fmt.Errorf("ecr.fetcher.layer.url: unexpected status code %v: %v", redactedDownloadURL, resp.Status)
+		f.onLayerDownload(ctx, desc, metadata)
 	}
 	log.G(ctx).Debug("ecr.fetcher.layer.url: returning body")
-	return resp.Body, nil
+	return resp.Body, resp.Header.Get("Accept-Ranges") == "bytes", nil
 }
 
 func (f *ecrFetcher) doRequest(ctx context.Context, req *http.Request) (*http.Response, error) {
@@ -182,8 +747,8 @@ func (f *ecrFetcher) doRequest(ctx context.Context, req *http.Request) (*http.Re
 	return resp, nil
 }
 
-func (f *ecrFetcher) fetchLayerHtcat(ctx context.Context, desc ocispec.Descriptor, downloadURL string) (io.ReadCloser, error) {
-	log.G(ctx).Debug("ecr.fetcher.layer.htcat")
+func (f *ecrFetcher) fetchLayerHtcat(ctx context.Context, desc ocispec.Descriptor, downloadURL string, parallelism int) (io.ReadCloser, error) {
+	log.G(ctx).WithField("parallelism", parallelism).Debug("ecr.fetcher.layer.htcat")
 	parsedURL, err := url.Parse(downloadURL)
 	if err != nil {
 		log.G(ctx).
@@ -195,16 +760,331 @@ func (f *ecrFetcher) fetchLayerHtcat(ctx context.Context, desc ocispec.Descripto
 	if hc == nil {
 		hc = http.DefaultClient
 	}
-	htc := htcat.New(hc, parsedURL, f.parallelism)
+	hc = f.limitClient(ctx, contextClient(ctx, hc))
 	pr, pw := io.Pipe()
 	go func() {
-		defer pw.Close()
-		_, err := htc.WriteTo(pw)
+		// htcat requests the first part of the content as it is created,
+		// which is then also subject to the stall timeout.
+		// The content written is counted as htcat does not report
+		// content written before it is canceled.
+		w := &countingWriter{Writer: pw}
+		htc := htcat.New(hc, parsedURL, parallelism)
+		_, err := htc.WriteTo(w)
+		for refreshes := 0; htcatForbidden(err) && refreshes < f.urlRefreshes; refreshes++ {
+			log.G(ctx).
+				WithField("offset", w.written).
+				Warn("ecr.fetcher.layer.htcat: download URL rejected, resuming with a fresh URL")
+			err = f.resumeLayer(ctx, desc, w.written, w)
+		}
 		if err != nil {
+			err = httputil.RedactHTTPQueryValuesFromURLError(err)
 			log.G(ctx).
-				WithError(httputil.RedactHTTPQueryValuesFromURLError(err)).
+				WithError(err).
 				Error("ecr.fetcher.layer.htcat: failed to download layer")
+			pw.CloseWithError(err)
+			return
 		}
+		pw.Close()
 	}()
+	if f.idleTimeout > 0 {
+		return &stallReadCloser{
+			stallReader: newStallReader(pr, f.idleTimeout, downloadStalledError(f.idleTimeout)),
+			pipe:        pr,
+		}, nil
+	}
 	return pr, nil
 }
+
+// resumableReadCloser resumes a layer download that fails part way through
+// with a range request from the offset of the content already read, retrying
+// as configured by the fetcher's retry policy.  Content integrity is validated
+// by the readers wrapping it, over the content of all of its requests.
+type resumableReadCloser struct {
+	io.ReadCloser
+	ctx         context.Context
+	fetcher     *ecrFetcher
+	desc        ocispec.Descriptor
+	downloadURL string
+	offset      int64
+	attempts    int
+}
+
+func (rc *resumableReadCloser) Read(p []byte) (int, error) {
+	for {
+		n, err := rc.ReadCloser.Read(p)
+		rc.offset += int64(n)
+		if n > 0 {
+			rc.attempts = 0
+		}
+		if err == nil || errors.Is(err, io.EOF) {
+			return n, err
+		}
+		if err := rc.resume(err); err != nil {
+			return n, err
+		}
+		if n > 0 {
+			return n, nil
+		}
+	}
+}
+
+// resume replaces the failed response with a response for the remaining
+// content, or returns the error to report when the download cannot resume.
+func (rc *resumableReadCloser) resume(err error) error {
+	policy := rc.fetcher.retryPolicy
+	for {
+		rc.attempts++
+		if rc.ctx.Err() != nil || !policy.retryable(rc.attempts) {
+			return err
+		}
+		delay := policy.backoff(rc.attempts)
+		log.G(rc.ctx).
+			WithError(err).
+			WithField("offset", rc.offset).
+			WithField("attempts", rc.attempts).
+			WithField("delay", delay).
+			Warn("ecr.fetcher.layer.url: download interrupted, resuming")
+		if err := sleep(rc.ctx, delay); err != nil {
+			return err
+		}
+		rc.ReadCloser.Close()
+		var body io.ReadCloser
+		body, _, err = rc.fetcher.openLayerURL(rc.ctx, rc.desc, rc.downloadURL, rc.offset)
+		if err == nil {
+			rc.ReadCloser = body
+			return nil
+		}
+	}
+}
+
+// htcatForbidden reports whether err is the error of a parallel download, or
+// of its resumption, that was rejected as forbidden.
+func htcatForbidden(err error) bool {
+	var statusErr htcat.HttpStatusError
+	if errors.As(err, &statusErr) {
+		return strings.HasPrefix(statusErr.Status, strconv.Itoa(http.StatusForbidden))
+	}
+	return errors.Is(err, errDownloadForbidden)
+}
+
+// resumeLayer writes the layer's content from offset to w, downloaded from a
+// fresh URL.
+func (f *ecrFetcher) resumeLayer(ctx context.Context, desc ocispec.Descriptor, offset int64, w io.Writer) error {
+	downloadURL, err := f.refreshDownloadURL(ctx, desc)
+	if err != nil {
+		return err
+	}
+	ctx = log.WithLogger(ctx, log.G(ctx).WithField("url", httputil.RedactHTTPQueryValuesFromURL(downloadURL)))
+	rc, err := f.fetchLayerURL(ctx, desc, downloadURL, offset)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	_, err = io.Copy(w, f.limitDownload(ctx, rc))
+	return err
+}
+
+// countingWriter counts the bytes written to its Writer.
+type countingWriter struct {
+	io.Writer
+	written int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.Writer.Write(p)
+	w.written += int64(n)
+	return n, err
+}
+
+// stallReadCloser is a stallReader over the pipe of a parallel download.
+type stallReadCloser struct {
+	*stallReader
+	pipe *io.PipeReader
+}
+
+func (rc *stallReadCloser) Close() error {
+	return rc.pipe.Close()
+}
+
+// downloadStalledError returns the error of a layer download that received
+// no content within timeout.
+func downloadStalledError(timeout time.Duration) error {
+	return fmt.Errorf("ecr: layer download stalled, no content received within %v", timeout)
+}
+
+// idleTimer cancels the context of a download when it makes no progress
+// within the timeout.  The timer runs only while the download is waiting for
+// the server, so that neither retry delays nor slow readers are mistaken for
+// stalls.  A nil idleTimer does nothing.
+type idleTimer struct {
+	timeout time.Duration
+	timer   *time.Timer
+	cancel  context.CancelFunc
+	stalled atomic.Bool
+}
+
+func newIdleTimer(ctx context.Context, timeout time.Duration) (context.Context, *idleTimer) {
+	ctx, cancel := context.WithCancel(ctx)
+	t := &idleTimer{timeout: timeout, cancel: cancel}
+	t.timer = time.AfterFunc(timeout, func() {
+		t.stalled.Store(true)
+		cancel()
+	})
+	return ctx, t
+}
+
+// reset restarts the timer.
+func (t *idleTimer) reset() {
+	if t != nil {
+		t.timer.Reset(t.timeout)
+	}
+}
+
+// pause stops the timer until it is reset.
+func (t *idleTimer) pause() {
+	if t != nil {
+		t.timer.Stop()
+	}
+}
+
+// stop stops the timer and releases the download's context.
+func (t *idleTimer) stop() {
+	if t != nil {
+		t.timer.Stop()
+		t.cancel()
+	}
+}
+
+// error returns the stall error in place of err once the timer has expired.
+func (t *idleTimer) error(err error) error {
+	if t != nil && err != nil && t.stalled.Load() {
+		return downloadStalledError(t.timeout)
+	}
+	return err
+}
+
+// idleReadCloser times the reads of a download's body with an idleTimer.
+type idleReadCloser struct {
+	io.ReadCloser
+	idle *idleTimer
+}
+
+func (rc *idleReadCloser) Read(p []byte) (int, error) {
+	rc.idle.reset()
+	n, err := rc.ReadCloser.Read(p)
+	rc.idle.pause()
+	return n, rc.idle.error(err)
+}
+
+func (rc *idleReadCloser) Close() error {
+	rc.idle.stop()
+	return rc.ReadCloser.Close()
+}
+
+// newDownloadLimiter returns a limiter of downloads to bytesPerSec, which
+// permits bursts of up to a second of content.
+func newDownloadLimiter(bytesPerSec int64) *rate.Limiter {
+	burst := bytesPerSec
+	if burst > math.MaxInt32 {
+		burst = math.MaxInt32
+	}
+	return rate.NewLimiter(rate.Limit(bytesPerSec), int(burst))
+}
+
+// limitDownload limits the rate at which rc is read with the fetcher's
+// download limiter, if any.
+func (f *ecrFetcher) limitDownload(ctx context.Context, rc io.ReadCloser) io.ReadCloser {
+	if f.downloadLimiter == nil {
+		return rc
+	}
+	return &rateLimitedReadCloser{ReadCloser: rc, ctx: ctx, limiter: f.downloadLimiter}
+}
+
+// limitClient returns a client making hc's requests whose response bodies are
+// limited with the fetcher's download limiter, if any.
+func (f *ecrFetcher) limitClient(ctx context.Context, hc *http.Client) *http.Client {
+	if f.downloadLimiter == nil {
+		return hc
+	}
+	transport := hc.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	limited := *hc
+	limited.Transport = &rateLimitedTransport{RoundTripper: transport, ctx: ctx, limiter: f.downloadLimiter}
+	return &limited
+}
+
+// rateLimitedTransport limits the rate at which the bodies of its responses
+// are read.  Waits end with ctx, the context of the download.
+type rateLimitedTransport struct {
+	http.RoundTripper
+	ctx     context.Context
+	limiter *rate.Limiter
+}
+
+func (t *rateLimitedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.RoundTripper.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = &rateLimitedReadCloser{ReadCloser: resp.Body, ctx: t.ctx, limiter: t.limiter}
+	return resp, nil
+}
+
+// contextClient returns a client whose requests are also canceled with ctx,
+// for the requests of parallel downloads, which htcat makes without a context.
+func contextClient(ctx context.Context, hc *http.Client) *http.Client {
+	transport := hc.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	withContext := *hc
+	withContext.Transport = &contextTransport{RoundTripper: transport, ctx: ctx}
+	return &withContext
+}
+
+// contextTransport makes its requests with a context that is canceled with
+// either ctx or the request's own context, such as for the client's timeout.
+// The context is released once the response body is closed.
+type contextTransport struct {
+	http.RoundTripper
+	ctx context.Context
+}
+
+func (t *contextTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx, cancel := context.WithCancel(t.ctx)
+	stop := context.AfterFunc(req.Context(), cancel)
+	release := func() {
+		stop()
+		cancel()
+	}
+	resp, err := t.RoundTripper.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		release()
+		return nil, err
+	}
+	resp.Body = &releasingReadCloser{ReadCloser: resp.Body, release: release}
+	return resp, nil
+}
+
+// rateLimitedReadCloser waits for each read's content to be permitted by the
+// limiter before returning it.
+type rateLimitedReadCloser struct {
+	io.ReadCloser
+	ctx     context.Context
+	limiter *rate.Limiter
+}
+
+func (rc *rateLimitedReadCloser) Read(p []byte) (int, error) {
+	if burst := rc.limiter.Burst(); len(p) > burst {
+		p = p[:burst]
+	}
+	n, err := rc.ReadCloser.Read(p)
+	if n > 0 {
+		if err := rc.limiter.WaitN(rc.ctx, n); err != nil {
+			return n, err
+		}
+	}
+	return n, err
+}
@@ -19,27 +19,45 @@ import (
 	"bytes"
 	"context"
 	"crypto/rand"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/arn"
 	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/awstesting/unit"
 	"github.com/aws/aws-sdk-go/service/ecr"
 	"github.com/awslabs/amazon-ecr-containerd-resolver/ecr/internal/testdata"
 	"github.com/containerd/containerd/errdefs"
 	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/remotes"
 	"github.com/opencontainers/go-digest"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
 
+// newResolverFetcher returns a fetcher for a repository in the "fake" region,
+// served by client, from a resolver created with the options.
+func newResolverFetcher(t *testing.T, client ecrAPI, options ...ResolverOption) remotes.Fetcher {
+	t.Helper()
+	resolver, err := NewResolver(append([]ResolverOption{WithSession(unit.Session)}, options...)...)
+	require.NoError(t, err)
+	resolver.(*ecrResolver).clients["fake"] = client
+	fetcher, err := resolver.Fetcher(context.Background(), "ecr.aws/arn:aws:ecr:fake:123456789012:repository/foo/bar:latest")
+	require.NoError(t, err)
+	return fetcher
+}
+
 func TestFetchUnimplemented(t *testing.T) {
 	fetcher := &ecrFetcher{}
 	desc := ocispec.Descriptor{
@@ -49,6 +67,61 @@ func TestFetchUnimplemented(t *testing.T) {
 	assert.EqualError(t, err, unimplemented.Error())
 }
 
+func TestFetchSniffMediaType(t *testing.T) {
+	const (
+		manifest = `{"schemaVersion": 2, "mediaType": "application/vnd.oci.image.manifest.v1+json"}`
+		blob     = "blob content"
+	)
+	manifestDigest := digest.FromString(manifest)
+	blobDigest := digest.FromString(blob)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, blob)
+	}))
+	defer ts.Close()
+
+	fakeClient := &fakeECRClient{
+		BatchGetImageFn: func(_ aws.Context, input *ecr.BatchGetImageInput, _ ...request.Option) (*ecr.BatchGetImageOutput, error) {
+			imageID := input.ImageIds[0]
+			if aws.StringValue(imageID.ImageDigest) != manifestDigest.String() {
+				return &ecr.BatchGetImageOutput{Failures: []*ecr.ImageFailure{{
+					FailureCode: aws.String(ecr.ImageFailureCodeImageNotFound),
+					ImageId:     imageID,
+				}}}, nil
+			}
+			return &ecr.BatchGetImageOutput{Images: []*ecr.Image{{
+				ImageId:       imageID,
+				ImageManifest: aws.String(manifest),
+			}}}, nil
+		},
+		GetDownloadUrlForLayerFn: func(_ aws.Context, input *ecr.GetDownloadUrlForLayerInput, _ ...request.Option) (*ecr.GetDownloadUrlForLayerOutput, error) {
+			assert.Equal(t, blobDigest.String(), aws.StringValue(input.LayerDigest))
+			return &ecr.GetDownloadUrlForLayerOutput{DownloadUrl: aws.String(ts.URL)}, nil
+		},
+	}
+	fetcher := newResolverFetcher(t, fakeClient, WithHTTPClient(ts.Client()))
+	_, err := fetcher.Fetch(context.Background(), ocispec.Descriptor{Digest: manifestDigest})
+	assert.EqualError(t, err, unimplemented.Error(), "empty media types should not be sniffed by default")
+
+	fetcher = newResolverFetcher(t, fakeClient, WithHTTPClient(ts.Client()), WithSniffMediaType(true))
+	for _, tc := range []struct {
+		name     string
+		digest   digest.Digest
+		expected string
+	}{
+		{name: "manifest", digest: manifestDigest, expected: manifest},
+		{name: "blob", digest: blobDigest, expected: blob},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			rc, err := fetcher.Fetch(context.Background(), ocispec.Descriptor{Digest: tc.digest})
+			require.NoError(t, err)
+			defer rc.Close()
+			body, err := io.ReadAll(rc)
+			require.NoError(t, err)
+			assert.Equal(t, tc.expected, string(body))
+		})
+	}
+}
+
 func TestFetchForeignLayer(t *testing.T) {
 	// setup
 	const expectedBody = "hello, this is dog"
@@ -116,7 +189,7 @@ func TestFetchManifest(t *testing.T) {
 		registry       = "registry"
 		repository     = "repository"
 		imageManifest  = "image manifest"
-		imageDigest    = "sha256:18019fb68413973fcde9ff917d333bbaa228c4aaebba9ad0ca5ffec26e4f3541"
+		imageDigest    = "sha256:e0f1a497a93630605f20f99b839c253e526b5eeac63ec567913167dbb6861719"
 		imageTag       = "tag"
 		imageTagDigest = "tag@" + imageDigest
 	)
@@ -197,6 +270,45 @@ func TestFetchManifest(t *testing.T) {
 	}
 }
 
+func TestFetchManifestDigestMismatch(t *testing.T) {
+	const imageManifest = "image manifest"
+	requested := digest.FromString("another manifest")
+	fakeClient := &fakeECRClient{
+		BatchGetImageFn: func(aws.Context, *ecr.BatchGetImageInput, ...request.Option) (*ecr.BatchGetImageOutput, error) {
+			return &ecr.BatchGetImageOutput{
+				Images: []*ecr.Image{{ImageManifest: aws.String(imageManifest)}},
+			}, nil
+		},
+	}
+	fetcher := &ecrFetcher{
+		ecrBase: ecrBase{
+			client: fakeClient,
+			ecrSpec: ECRSpec{
+				arn:        arn.ARN{AccountID: "registry"},
+				Repository: "repository",
+			},
+		},
+	}
+
+	_, err := fetcher.Fetch(context.Background(), ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageManifest,
+		Digest:    requested,
+	})
+	assert.True(t, errdefs.IsFailedPrecondition(err), "mismatched manifest should fail verification: %v", err)
+
+	_, err = fetcher.Fetch(context.Background(), ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageManifest,
+		Digest:    digest.FromString(imageManifest),
+		Size:      int64(len(imageManifest)) + 1,
+	})
+	assert.True(t, errdefs.IsFailedPrecondition(err), "manifest of the wrong size should fail verification: %v", err)
+
+	// A manifest fetched by tag is verified against the reference's digest.
+	fetcher.ecrSpec.Object = "latest@" + requested.String()
+	_, err = fetcher.Fetch(context.Background(), ocispec.Descriptor{MediaType: ocispec.MediaTypeImageManifest})
+	assert.True(t, errdefs.IsFailedPrecondition(err), "mismatched manifest should fail verification: %v", err)
+}
+
 func TestFetchManifestAPIError(t *testing.T) {
 	ref := "ecr.aws/arn:aws:ecr:fake:123456789012:repository/foo/bar:latest"
 	mediaType := ocispec.MediaTypeImageManifest
@@ -238,7 +350,36 @@ func TestFetchManifestNotFound(t *testing.T) {
 	fetcher, err := resolver.Fetcher(context.Background(), ref)
 	require.NoError(t, err, "failed to create fetcher")
 	_, err = fetcher.Fetch(context.Background(), ocispec.Descriptor{MediaType: mediaType})
-	assert.Error(t, err)
+	assert.ErrorIs(t, err, ErrImageNotFound)
+	assert.True(t, errdefs.IsNotFound(err), "unexpected error: %v", err)
+}
+
+func TestFetchManifestMultipleFailures(t *testing.T) {
+	ref := "ecr.aws/arn:aws:ecr:fake:123456789012:repository/foo/bar:latest"
+	fakeClient := &fakeECRClient{
+		BatchGetImageFn: func(aws.Context, *ecr.BatchGetImageInput, ...request.Option) (*ecr.BatchGetImageOutput, error) {
+			return &ecr.BatchGetImageOutput{
+				Failures: []*ecr.ImageFailure{
+					{FailureCode: aws.String(ecr.ImageFailureCodeImageNotFound)},
+					{
+						FailureCode:   aws.String(ecr.ImageFailureCodeKmsError),
+						FailureReason: aws.String("key disabled"),
+					},
+				},
+			}, nil
+		},
+	}
+	resolver := &ecrResolver{
+		clients: map[string]ecrAPI{
+			"fake": fakeClient,
+		},
+	}
+	fetcher, err := resolver.Fetcher(context.Background(), ref)
+	require.NoError(t, err, "failed to create fetcher")
+	_, err = fetcher.Fetch(context.Background(), ocispec.Descriptor{MediaType: ocispec.MediaTypeImageManifest})
+	assert.ErrorIs(t, err, ErrImageNotFound, "the first failure should be mapped")
+	assert.ErrorContains(t, err, ecr.ImageFailureCodeImageNotFound)
+	assert.ErrorContains(t, err, ecr.ImageFailureCodeKmsError+": key disabled")
 }
 
 func TestFetchLayer(t *testing.T) {
@@ -297,6 +438,42 @@ func TestFetchLayer(t *testing.T) {
 	}
 }
 
+func TestFetchLayerDownloadMetadata(t *testing.T) {
+	const layerData = "layer"
+	lastModified := time.Date(2024, time.March, 1, 12, 0, 0, 0, time.UTC)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"etag"`)
+		w.Header().Set("Last-Modified", lastModified.Format(http.TimeFormat))
+		io.WriteString(w, layerData)
+	}))
+	defer ts.Close()
+
+	var metadata []LayerDownloadMetadata
+	fetcher := newResolverFetcher(t,
+		&fakeECRClient{
+			GetDownloadUrlForLayerFn: func(aws.Context, *ecr.GetDownloadUrlForLayerInput, ...request.Option) (*ecr.GetDownloadUrlForLayerOutput, error) {
+				return &ecr.GetDownloadUrlForLayerOutput{DownloadUrl: aws.String(ts.URL)}, nil
+			},
+		},
+		WithHTTPClient(ts.Client()),
+		WithLayerDownloadHandler(func(_ context.Context, desc ocispec.Descriptor, m LayerDownloadMetadata) {
+			assert.Equal(t, digest.FromString(layerData), desc.Digest)
+			metadata = append(metadata, m)
+		}),
+	)
+
+	reader, err := fetcher.Fetch(context.Background(), ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageLayerGzip,
+		Digest:    digest.FromString(layerData),
+	})
+	require.NoError(t, err)
+	reader.Close()
+
+	require.Len(t, metadata, 1)
+	assert.Equal(t, `"etag"`, metadata[0].ETag)
+	assert.True(t, lastModified.Equal(metadata[0].LastModified), "Last-Modified should be surfaced, got %v", metadata[0].LastModified)
+}
+
 func TestFetchLayerAPIError(t *testing.T) {
 	fakeClient := &fakeECRClient{
 		GetDownloadUrlForLayerFn: func(aws.Context, *ecr.GetDownloadUrlForLayerInput, ...request.Option) (*ecr.GetDownloadUrlForLayerOutput, error) {
@@ -368,3 +545,903 @@ func TestFetchLayerHtcat(t *testing.T) {
 	assert.Equal(t, expectedBody, body)
 	assert.True(t, handlerCallCount > 1, "ServeContent should be called more than once: %d", handlerCallCount)
 }
+
+func TestFetchLayerIdleTimeout(t *testing.T) {
+	const idleTimeout = 100 * time.Millisecond
+	_, err := NewResolver(WithSession(unit.Session), WithDataPlaneIdleTimeout(-time.Second))
+	require.Error(t, err)
+	resolver, err := NewResolver(WithSession(unit.Session), WithControlPlaneTimeout(time.Second))
+	require.NoError(t, err)
+	assert.Equal(t, time.Second, resolver.(*ecrResolver).apiCallTimeout)
+
+	stalled := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		flusher := w.(http.Flusher)
+		switch r.URL.Path {
+		case "/slow":
+			// Content arrives steadily, but over longer than the timeout.
+			for i := 0; i < 5; i++ {
+				fmt.Fprint(w, "chunk")
+				flusher.Flush()
+				time.Sleep(40 * time.Millisecond)
+			}
+		case "/stalled":
+			fmt.Fprint(w, "chunk")
+			flusher.Flush()
+			fallthrough
+		default:
+			select {
+			case <-stalled:
+			case <-r.Context().Done():
+			}
+		}
+	}))
+	defer ts.Close()
+	defer close(stalled)
+
+	desc := ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageLayerGzip,
+		Digest:    testdata.InsignificantDigest,
+	}
+	fetch := func(t *testing.T, path string, parallelism int) (string, error) {
+		fetcher := newResolverFetcher(t,
+			&fakeECRClient{
+				GetDownloadUrlForLayerFn: func(aws.Context, *ecr.GetDownloadUrlForLayerInput, ...request.Option) (*ecr.GetDownloadUrlForLayerOutput, error) {
+					return &ecr.GetDownloadUrlForLayerOutput{DownloadUrl: aws.String(ts.URL + path)}, nil
+				},
+			},
+			WithHTTPClient(ts.Client()),
+			WithLayerDownloadParallelism(parallelism),
+			WithDataPlaneIdleTimeout(idleTimeout),
+		)
+		rc, err := fetcher.Fetch(context.Background(), desc)
+		if err != nil {
+			return "", err
+		}
+		defer rc.Close()
+		body, err := io.ReadAll(rc)
+		return string(body), err
+	}
+
+	t.Run("slow", func(t *testing.T) {
+		start := time.Now()
+		body, err := fetch(t, "/slow", 0)
+		require.NoError(t, err)
+		assert.Equal(t, strings.Repeat("chunk", 5), body)
+		assert.Greater(t, time.Since(start), idleTimeout, "the download should outlast the timeout")
+	})
+	t.Run("stalled", func(t *testing.T) {
+		body, err := fetch(t, "/stalled", 0)
+		assert.ErrorContains(t, err, "layer download stalled")
+		assert.Equal(t, "chunk", body)
+	})
+	t.Run("no response", func(t *testing.T) {
+		_, err := fetch(t, "/", 0)
+		assert.ErrorContains(t, err, "layer download stalled")
+	})
+	t.Run("htcat", func(t *testing.T) {
+		_, err := fetch(t, "/", 2)
+		assert.ErrorContains(t, err, "layer download stalled")
+	})
+}
+
+func TestFetchLayerRefreshDownloadURL(t *testing.T) {
+	_, err := NewResolver(WithSession(unit.Session), WithDownloadURLRefreshes(-1))
+	require.Error(t, err)
+
+	const mB = 1024 * 1024
+	expectedBody := make([]byte, 4*mB)
+	_, err = rand.Read(expectedBody)
+	require.NoError(t, err)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/expired",
+			// Parallel downloads expire after their first request.
+			r.URL.Path == "/expiring" && r.Header.Get("Range") != "":
+			w.WriteHeader(http.StatusForbidden)
+		default:
+			http.ServeContent(w, r, "", time.Now(), bytes.NewReader(expectedBody))
+		}
+	}))
+	defer ts.Close()
+
+	desc := ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageLayerGzip,
+		Digest:    testdata.InsignificantDigest,
+	}
+	fetch := func(t *testing.T, parallelism, refreshes int, paths ...string) ([]byte, int, error) {
+		calls := 0
+		fetcher := newResolverFetcher(t,
+			&fakeECRClient{
+				GetDownloadUrlForLayerFn: func(aws.Context, *ecr.GetDownloadUrlForLayerInput, ...request.Option) (*ecr.GetDownloadUrlForLayerOutput, error) {
+					path := paths[min(calls, len(paths)-1)]
+					calls++
+					return &ecr.GetDownloadUrlForLayerOutput{DownloadUrl: aws.String(ts.URL + path)}, nil
+				},
+			},
+			WithHTTPClient(ts.Client()),
+			WithDownloadURLCache(time.Minute),
+			WithLayerDownloadParallelism(parallelism),
+			WithDownloadURLRefreshes(refreshes),
+		)
+		rc, err := fetcher.Fetch(context.Background(), desc)
+		if err != nil {
+			return nil, calls, err
+		}
+		defer rc.Close()
+		body, err := io.ReadAll(rc)
+		return body, calls, err
+	}
+
+	t.Run("refreshed", func(t *testing.T) {
+		body, calls, err := fetch(t, 0, 1, "/expired", "/fresh")
+		require.NoError(t, err)
+		assert.Equal(t, expectedBody, body)
+		assert.Equal(t, 2, calls, "the rejected URL should be refreshed")
+	})
+	t.Run("not refreshed", func(t *testing.T) {
+		_, calls, err := fetch(t, 0, 0, "/expired", "/fresh")
+		assert.ErrorIs(t, err, errDownloadForbidden)
+		assert.Equal(t, 1, calls)
+	})
+	t.Run("refreshes exhausted", func(t *testing.T) {
+		_, calls, err := fetch(t, 0, 1, "/expired")
+		assert.ErrorIs(t, err, errDownloadForbidden)
+		assert.Equal(t, 2, calls)
+	})
+	t.Run("htcat resumed", func(t *testing.T) {
+		body, calls, err := fetch(t, 2, 1, "/expiring", "/fresh")
+		require.NoError(t, err)
+		assert.Equal(t, expectedBody, body)
+		assert.Equal(t, 2, calls, "the rejected URL should be refreshed")
+	})
+	t.Run("htcat not resumed", func(t *testing.T) {
+		_, _, err := fetch(t, 2, 0, "/expiring")
+		assert.ErrorContains(t, err, "403")
+	})
+}
+
+func TestFetchLayerRetrySlowDown(t *testing.T) {
+	const expectedBody = "hello this is dog"
+	for _, tc := range []struct {
+		name       string
+		retryAfter string
+		failures   int
+		policy     RetryPolicy
+		err        bool
+	}{
+		{name: "backoff", failures: 2, policy: RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond}},
+		{name: "retry-after", failures: 1, retryAfter: "0", policy: RetryPolicy{MaxAttempts: 2, BaseDelay: time.Hour}},
+		{name: "exhausted", failures: 3, policy: RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond}, err: true},
+		{name: "disabled", failures: 1, err: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			requests := 0
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				requests++
+				if requests <= tc.failures {
+					if tc.retryAfter != "" {
+						w.Header().Set("Retry-After", tc.retryAfter)
+					}
+					w.WriteHeader(http.StatusServiceUnavailable)
+					fmt.Fprint(w, "<Error><Code>SlowDown</Code></Error>")
+					return
+				}
+				fmt.Fprint(w, expectedBody)
+			}))
+			defer ts.Close()
+
+			fetcher := &ecrFetcher{
+				ecrBase: ecrBase{
+					client: &fakeECRClient{
+						GetDownloadUrlForLayerFn: func(aws.Context, *ecr.GetDownloadUrlForLayerInput, ...request.Option) (*ecr.GetDownloadUrlForLayerOutput, error) {
+							return &ecr.GetDownloadUrlForLayerOutput{DownloadUrl: aws.String(ts.URL)}, nil
+						},
+					},
+				},
+				retryPolicy: tc.policy,
+			}
+			desc := ocispec.Descriptor{
+				MediaType: ocispec.MediaTypeImageLayerGzip,
+				Digest:    testdata.InsignificantDigest,
+			}
+
+			reader, err := fetcher.Fetch(context.Background(), desc)
+			if tc.err {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			defer reader.Close()
+			assert.Equal(t, tc.failures+1, requests)
+			body, err := io.ReadAll(reader)
+			assert.NoError(t, err)
+			assert.Equal(t, expectedBody, string(body))
+		})
+	}
+}
+
+func TestFetchLayerResume(t *testing.T) {
+	expectedBody := make([]byte, 64*1024)
+	_, err := rand.Read(expectedBody)
+	require.NoError(t, err)
+	for _, tc := range []struct {
+		name         string
+		interrupts   int
+		acceptRanges bool
+		reset        bool
+		policy       RetryPolicy
+		err          bool
+	}{
+		{name: "resumed", interrupts: 2, acceptRanges: true, policy: RetryPolicy{MaxAttempts: 2, BaseDelay: time.Millisecond}},
+		{name: "connection reset", interrupts: 2, acceptRanges: true, reset: true, policy: RetryPolicy{MaxAttempts: 2, BaseDelay: time.Millisecond}},
+		{name: "ranges not accepted", interrupts: 1, policy: RetryPolicy{MaxAttempts: 2, BaseDelay: time.Millisecond}, err: true},
+		{name: "disabled", interrupts: 1, acceptRanges: true, err: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var ranges []string
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				ranges = append(ranges, r.Header.Get("Range"))
+				if tc.acceptRanges {
+					w.Header().Set("Accept-Ranges", "bytes")
+				}
+				if len(ranges) > tc.interrupts {
+					http.ServeContent(w, r, "", time.Now(), bytes.NewReader(expectedBody))
+					return
+				}
+				// Each interrupted response sends a further 1KiB of the
+				// content before the connection is dropped.
+				start := 1024 * (len(ranges) - 1)
+				w.Header().Set("Content-Length", fmt.Sprint(len(expectedBody)-start))
+				if start > 0 {
+					w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, len(expectedBody)-1, len(expectedBody)))
+					w.WriteHeader(http.StatusPartialContent)
+				}
+				w.Write(expectedBody[start : start+1024])
+				w.(http.Flusher).Flush()
+				if tc.reset {
+					// require would call t.FailNow outside the test's
+					// goroutine, so the failure is only recorded here.
+					conn, _, err := w.(http.Hijacker).Hijack()
+					if !assert.NoError(t, err) {
+						return
+					}
+					conn.(*net.TCPConn).SetLinger(0)
+					conn.Close()
+					return
+				}
+				panic(http.ErrAbortHandler)
+			}))
+			defer ts.Close()
+
+			fetcher := &ecrFetcher{
+				ecrBase: ecrBase{
+					client: &fakeECRClient{
+						GetDownloadUrlForLayerFn: func(aws.Context, *ecr.GetDownloadUrlForLayerInput, ...request.Option) (*ecr.GetDownloadUrlForLayerOutput, error) {
+							return &ecr.GetDownloadUrlForLayerOutput{DownloadUrl: aws.String(ts.URL)}, nil
+						},
+					},
+				},
+				httpClient:  ts.Client(),
+				retryPolicy: tc.policy,
+				integrity:   ContentIntegrityBoth,
+			}
+			desc := ocispec.Descriptor{
+				MediaType: ocispec.MediaTypeImageLayerGzip,
+				Digest:    digest.FromBytes(expectedBody),
+				Size:      int64(len(expectedBody)),
+			}
+
+			reader, err := fetcher.Fetch(context.Background(), desc)
+			require.NoError(t, err)
+			defer reader.Close()
+			body, err := io.ReadAll(reader)
+			if tc.err {
+				assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, expectedBody, body)
+			assert.Equal(t, []string{"", "bytes=1024-", "bytes=2048-"}, ranges)
+		})
+	}
+}
+
+func TestFetchLayerRateLimit(t *testing.T) {
+	const limit = 64 * 1024
+	_, err := NewResolver(WithSession(unit.Session), WithDownloadRateLimit(-1))
+	require.Error(t, err)
+
+	// The first second of content is permitted at once, so the remainder
+	// takes half a second at the limit.
+	expectedBody := make([]byte, limit*3/2)
+	_, err = rand.Read(expectedBody)
+	require.NoError(t, err)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "", time.Now(), bytes.NewReader(expectedBody))
+	}))
+	defer ts.Close()
+
+	for _, parallelism := range []int{0, 2} {
+		t.Run(fmt.Sprintf("parallelism %d", parallelism), func(t *testing.T) {
+			fetcher := newResolverFetcher(t,
+				&fakeECRClient{
+					GetDownloadUrlForLayerFn: func(aws.Context, *ecr.GetDownloadUrlForLayerInput, ...request.Option) (*ecr.GetDownloadUrlForLayerOutput, error) {
+						return &ecr.GetDownloadUrlForLayerOutput{DownloadUrl: aws.String(ts.URL)}, nil
+					},
+				},
+				WithHTTPClient(ts.Client()),
+				WithLayerDownloadParallelism(parallelism),
+				WithDownloadRateLimit(limit),
+			)
+			desc := ocispec.Descriptor{
+				MediaType: ocispec.MediaTypeImageLayerGzip,
+				Digest:    testdata.InsignificantDigest,
+			}
+
+			start := time.Now()
+			reader, err := fetcher.Fetch(context.Background(), desc)
+			require.NoError(t, err)
+			defer reader.Close()
+			body, err := io.ReadAll(reader)
+			require.NoError(t, err)
+			assert.Equal(t, expectedBody, body)
+			assert.GreaterOrEqual(t, time.Since(start), 400*time.Millisecond, "the download should be limited")
+		})
+	}
+}
+
+// countingTransport counts the bytes read from the bodies of its responses.
+type countingTransport struct {
+	http.RoundTripper
+	read atomic.Int64
+}
+
+func (t *countingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.RoundTripper.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = &countingReadCloser{ReadCloser: resp.Body, read: &t.read}
+	return resp, nil
+}
+
+type countingReadCloser struct {
+	io.ReadCloser
+	read *atomic.Int64
+}
+
+func (rc *countingReadCloser) Read(p []byte) (int, error) {
+	n, err := rc.ReadCloser.Read(p)
+	rc.read.Add(int64(n))
+	return n, err
+}
+
+func TestFetchLayerHtcatRateLimit(t *testing.T) {
+	const limit = 64 * 1024
+	expectedBody := make([]byte, limit*3)
+	_, err := rand.Read(expectedBody)
+	require.NoError(t, err)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "", time.Now(), bytes.NewReader(expectedBody))
+	}))
+	defer ts.Close()
+
+	transport := &countingTransport{RoundTripper: ts.Client().Transport}
+	fetcher := &ecrFetcher{
+		ecrBase: ecrBase{
+			client: &fakeECRClient{
+				GetDownloadUrlForLayerFn: func(aws.Context, *ecr.GetDownloadUrlForLayerInput, ...request.Option) (*ecr.GetDownloadUrlForLayerOutput, error) {
+					return &ecr.GetDownloadUrlForLayerOutput{DownloadUrl: aws.String(ts.URL)}, nil
+				},
+			},
+		},
+		httpClient:      &http.Client{Transport: transport},
+		parallelism:     2,
+		downloadLimiter: newDownloadLimiter(limit),
+	}
+	reader, err := fetcher.Fetch(context.Background(), ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageLayerGzip,
+		Digest:    testdata.InsignificantDigest,
+	})
+	require.NoError(t, err)
+	defer reader.Close()
+
+	// htcat reads responses ahead of the content returned, so the download
+	// is limited before any of the content is read.
+	time.Sleep(200 * time.Millisecond)
+	assert.Less(t, transport.read.Load(), int64(limit*2), "the download should be limited as it is received")
+
+	body, err := io.ReadAll(reader)
+	require.NoError(t, err)
+	assert.Equal(t, expectedBody, body)
+}
+
+func TestFetchLayerHtcatContext(t *testing.T) {
+	started, canceled, done := make(chan struct{}), make(chan struct{}), make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		select {
+		case <-r.Context().Done():
+			close(canceled)
+		case <-done:
+		}
+	}))
+	defer ts.Close()
+	defer close(done)
+
+	fetcher := &ecrFetcher{
+		ecrBase: ecrBase{
+			client: &fakeECRClient{
+				GetDownloadUrlForLayerFn: func(aws.Context, *ecr.GetDownloadUrlForLayerInput, ...request.Option) (*ecr.GetDownloadUrlForLayerOutput, error) {
+					return &ecr.GetDownloadUrlForLayerOutput{DownloadUrl: aws.String(ts.URL)}, nil
+				},
+			},
+		},
+		httpClient:  ts.Client(),
+		parallelism: 2,
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	reader, err := fetcher.Fetch(ctx, ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageLayerGzip,
+		Digest:    testdata.InsignificantDigest,
+	})
+	require.NoError(t, err)
+	defer reader.Close()
+
+	<-started
+	cancel()
+	select {
+	case <-canceled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the parallel download's request should be canceled with the download's context")
+	}
+}
+
+func TestFetchLayerContentIntegrity(t *testing.T) {
+	const body = "hello this is dog"
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, body)
+	}))
+	defer ts.Close()
+
+	valid := ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageLayerGzip,
+		Digest:    digest.FromString(body),
+		Size:      int64(len(body)),
+	}
+	wrongSize := valid
+	wrongSize.Size++
+	wrongDigest := valid
+	wrongDigest.Digest = digest.FromString("not " + body)
+
+	for _, tc := range []struct {
+		mode        ContentIntegrity
+		sizeErr     bool
+		digestErr   bool
+		description string
+	}{
+		{mode: ContentIntegrityNone, description: "none"},
+		{mode: ContentIntegritySize, sizeErr: true, description: "size"},
+		{mode: ContentIntegrityDigest, digestErr: true, description: "digest"},
+		{mode: ContentIntegrityBoth, sizeErr: true, digestErr: true, description: "both"},
+	} {
+		for _, desc := range []struct {
+			name string
+			desc ocispec.Descriptor
+			err  bool
+		}{
+			{name: "valid", desc: valid},
+			{name: "wrong size", desc: wrongSize, err: tc.sizeErr},
+			{name: "wrong digest", desc: wrongDigest, err: tc.digestErr},
+		} {
+			t.Run(tc.description+"/"+desc.name, func(t *testing.T) {
+				fetcher := &ecrFetcher{
+					ecrBase: ecrBase{
+						client: &fakeECRClient{
+							GetDownloadUrlForLayerFn: func(aws.Context, *ecr.GetDownloadUrlForLayerInput, ...request.Option) (*ecr.GetDownloadUrlForLayerOutput, error) {
+								return &ecr.GetDownloadUrlForLayerOutput{DownloadUrl: aws.String(ts.URL)}, nil
+							},
+						},
+					},
+					integrity: tc.mode,
+				}
+				reader, err := fetcher.Fetch(context.Background(), desc.desc)
+				require.NoError(t, err)
+				defer reader.Close()
+				output, err := io.ReadAll(reader)
+				if desc.err {
+					assert.True(t, errors.Is(err, errdefs.ErrFailedPrecondition), "expected integrity error, got %v", err)
+					return
+				}
+				assert.NoError(t, err)
+				assert.Equal(t, body, string(output))
+			})
+		}
+	}
+}
+
+func TestFetchManifestMediaTypeFamilies(t *testing.T) {
+	imageDigest := digest.FromString("image manifest")
+	for _, tc := range []struct {
+		mediaType string
+		expected  []string
+	}{
+		{images.MediaTypeDockerSchema2Manifest, []string{images.MediaTypeDockerSchema2Manifest, ocispec.MediaTypeImageManifest}},
+		{ocispec.MediaTypeImageIndex, []string{ocispec.MediaTypeImageIndex, images.MediaTypeDockerSchema2ManifestList}},
+		{images.MediaTypeDockerSchema1Manifest, []string{images.MediaTypeDockerSchema1Manifest}},
+	} {
+		t.Run(tc.mediaType, func(t *testing.T) {
+			fakeClient := &fakeECRClient{
+				BatchGetImageFn: func(_ aws.Context, input *ecr.BatchGetImageInput, _ ...request.Option) (*ecr.BatchGetImageOutput, error) {
+					assert.Equal(t, tc.expected, aws.StringValueSlice(input.AcceptedMediaTypes))
+					return &ecr.BatchGetImageOutput{Images: []*ecr.Image{{
+						ImageId:       &ecr.ImageIdentifier{ImageDigest: aws.String(imageDigest.String())},
+						ImageManifest: aws.String("image manifest"),
+					}}}, nil
+				},
+			}
+			fetcher := &ecrFetcher{
+				ecrBase: ecrBase{
+					client: fakeClient,
+					ecrSpec: ECRSpec{
+						arn: arn.ARN{
+							AccountID: "registry",
+						},
+						Repository: "repository",
+						Object:     "@" + imageDigest.String(),
+					},
+					mediaTypeFamilies: true,
+				},
+			}
+
+			reader, err := fetcher.Fetch(context.Background(), ocispec.Descriptor{
+				MediaType: tc.mediaType,
+				Digest:    imageDigest,
+			})
+			require.NoError(t, err)
+			defer reader.Close()
+		})
+	}
+}
+
+func TestFetchLayerFrom(t *testing.T) {
+	const (
+		body   = "hello this is dog"
+		offset = 6
+	)
+	desc := ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageLayerGzip,
+		Digest:    digest.FromString(body),
+		Size:      int64(len(body)),
+	}
+
+	for _, tc := range []struct {
+		name    string
+		handler http.HandlerFunc
+	}{
+		{
+			name: "range",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				assert.Equal(t, fmt.Sprintf("bytes=%d-", offset), r.Header.Get("Range"))
+				http.ServeContent(w, r, "", time.Time{}, strings.NewReader(body))
+			},
+		},
+		{
+			name: "range ignored",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				fmt.Fprint(w, body)
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ts := httptest.NewServer(tc.handler)
+			defer ts.Close()
+
+			fetcher := &ecrFetcher{
+				ecrBase: ecrBase{
+					client: &fakeECRClient{
+						GetDownloadUrlForLayerFn: func(aws.Context, *ecr.GetDownloadUrlForLayerInput, ...request.Option) (*ecr.GetDownloadUrlForLayerOutput, error) {
+							return &ecr.GetDownloadUrlForLayerOutput{DownloadUrl: aws.String(ts.URL)}, nil
+						},
+					},
+				},
+				integrity: ContentIntegrityBoth,
+			}
+			reader, err := fetcher.FetchFrom(context.Background(), desc, offset, strings.NewReader(body[:offset]))
+			require.NoError(t, err)
+			defer reader.Close()
+			rest, err := io.ReadAll(reader)
+			require.NoError(t, err, "resumed content should pass integrity checks")
+			assert.Equal(t, body, body[:offset]+string(rest))
+		})
+	}
+
+	t.Run("missing prefix", func(t *testing.T) {
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			http.ServeContent(w, r, "", time.Time{}, strings.NewReader(body))
+		}))
+		defer ts.Close()
+
+		fetcher := &ecrFetcher{
+			ecrBase: ecrBase{
+				client: &fakeECRClient{
+					GetDownloadUrlForLayerFn: func(aws.Context, *ecr.GetDownloadUrlForLayerInput, ...request.Option) (*ecr.GetDownloadUrlForLayerOutput, error) {
+						return &ecr.GetDownloadUrlForLayerOutput{DownloadUrl: aws.String(ts.URL)}, nil
+					},
+				},
+			},
+			integrity: ContentIntegrityDigest,
+		}
+		_, err := fetcher.FetchFrom(context.Background(), desc, offset, nil)
+		assert.True(t, errdefs.IsInvalidArgument(err), "digest cannot be verified without the prefix, got %v", err)
+	})
+
+	t.Run("complete", func(t *testing.T) {
+		fetcher := &ecrFetcher{
+			ecrBase: ecrBase{
+				client: &fakeECRClient{
+					GetDownloadUrlForLayerFn: func(aws.Context, *ecr.GetDownloadUrlForLayerInput, ...request.Option) (*ecr.GetDownloadUrlForLayerOutput, error) {
+						t.Error("fully fetched content should not be requested")
+						return nil, errors.New("unexpected request")
+					},
+				},
+			},
+			integrity: ContentIntegrityBoth,
+		}
+		reader, err := fetcher.FetchFrom(context.Background(), desc, desc.Size, strings.NewReader(body))
+		require.NoError(t, err)
+		defer reader.Close()
+		rest, err := io.ReadAll(reader)
+		require.NoError(t, err, "the prefix should pass integrity checks")
+		assert.Empty(t, rest)
+	})
+}
+
+func TestFetchLayerAdaptiveParallelism(t *testing.T) {
+	const (
+		kB = 1024 * 1
+		mB = 1024 * kB
+	)
+	// need >1mb of content for htcat to do parallel requests
+	expectedBody := make([]byte, 30*mB)
+	_, err := rand.Read(expectedBody)
+	require.NoError(t, err)
+	handlerCallCount := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handlerCallCount++
+		http.ServeContent(w, r, "", time.Now(), bytes.NewReader(expectedBody))
+	}))
+	defer ts.Close()
+
+	var sizes []int64
+	fetcher := &ecrFetcher{
+		ecrBase: ecrBase{
+			client: &fakeECRClient{
+				GetDownloadUrlForLayerFn: func(aws.Context, *ecr.GetDownloadUrlForLayerInput, ...request.Option) (*ecr.GetDownloadUrlForLayerOutput, error) {
+					return &ecr.GetDownloadUrlForLayerOutput{DownloadUrl: aws.String(ts.URL)}, nil
+				},
+			},
+		},
+		// The static setting is ignored in favor of the adaptive choice.
+		parallelism: 8,
+		adaptiveParallelism: func(size int64) int {
+			sizes = append(sizes, size)
+			if size < 10*mB {
+				return 0
+			}
+			return 4
+		},
+	}
+
+	for _, tc := range []struct {
+		name     string
+		size     int64
+		parallel bool
+	}{
+		{name: "small", size: 1 * mB, parallel: false},
+		{name: "large", size: 30 * mB, parallel: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			handlerCallCount = 0
+			desc := ocispec.Descriptor{
+				MediaType: images.MediaTypeDockerSchema2Layer,
+				Digest:    testdata.InsignificantDigest,
+				Size:      tc.size,
+			}
+			reader, err := fetcher.Fetch(context.Background(), desc)
+			require.NoError(t, err, "fetch")
+			defer reader.Close()
+			body, err := io.ReadAll(reader)
+			assert.NoError(t, err, "reading body")
+			assert.Equal(t, expectedBody, body)
+			if tc.parallel {
+				assert.Greater(t, handlerCallCount, 1, "layer should be downloaded in parallel")
+			} else {
+				assert.Equal(t, 1, handlerCallCount, "layer should be downloaded in a single request")
+			}
+		})
+	}
+	assert.Equal(t, []int64{1 * mB, 30 * mB}, sizes)
+}
+
+func TestFetchHaveBlob(t *testing.T) {
+	present := digest.FromString("present")
+	absent := digest.FromString("absent")
+	const body = "hello this is dog"
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, body)
+	}))
+	defer ts.Close()
+
+	downloadURLCallCount := 0
+	fetcher := &ecrFetcher{
+		ecrBase: ecrBase{
+			client: &fakeECRClient{
+				GetDownloadUrlForLayerFn: func(aws.Context, *ecr.GetDownloadUrlForLayerInput, ...request.Option) (*ecr.GetDownloadUrlForLayerOutput, error) {
+					downloadURLCallCount++
+					return &ecr.GetDownloadUrlForLayerOutput{DownloadUrl: aws.String(ts.URL)}, nil
+				},
+			},
+		},
+		haveBlob: func(dgst digest.Digest) bool {
+			return dgst == present
+		},
+	}
+
+	_, err := fetcher.Fetch(context.Background(), ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageLayerGzip,
+		Digest:    present,
+	})
+	assert.ErrorIs(t, err, ErrBlobPresent)
+	assert.True(t, errdefs.IsAlreadyExists(err), "expected already exists: %v", err)
+	assert.Equal(t, 0, downloadURLCallCount, "present blob should not be fetched")
+
+	reader, err := fetcher.Fetch(context.Background(), ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageLayerGzip,
+		Digest:    absent,
+	})
+	require.NoError(t, err)
+	defer reader.Close()
+	output, err := io.ReadAll(reader)
+	assert.NoError(t, err)
+	assert.Equal(t, body, string(output))
+	assert.Equal(t, 1, downloadURLCallCount, "absent blob should be fetched")
+}
+
+func TestFetcherStatBlob(t *testing.T) {
+	available := digest.FromString("available")
+	unavailable := digest.FromString("unavailable")
+	fetcher := &ecrFetcher{
+		ecrBase: ecrBase{
+			client: &fakeECRClient{
+				BatchCheckLayerAvailabilityFn: func(_ aws.Context, input *ecr.BatchCheckLayerAvailabilityInput, _ ...request.Option) (*ecr.BatchCheckLayerAvailabilityOutput, error) {
+					assert.Equal(t, "123456789012", aws.StringValue(input.RegistryId))
+					assert.Equal(t, "foo/bar", aws.StringValue(input.RepositoryName))
+					require.Len(t, input.LayerDigests, 1)
+					availability := ecr.LayerAvailabilityAvailable
+					if aws.StringValue(input.LayerDigests[0]) == unavailable.String() {
+						availability = ecr.LayerAvailabilityUnavailable
+					}
+					return &ecr.BatchCheckLayerAvailabilityOutput{
+						Layers: []*ecr.Layer{{
+							LayerDigest:       input.LayerDigests[0],
+							LayerAvailability: aws.String(availability),
+							LayerSize:         aws.Int64(42),
+							MediaType:         aws.String(ocispec.MediaTypeImageConfig),
+						}},
+					}, nil
+				},
+			},
+			ecrSpec: ECRSpec{
+				arn:        arn.ARN{AccountID: "123456789012"},
+				Repository: "foo/bar",
+			},
+		},
+	}
+
+	desc, err := fetcher.StatBlob(context.Background(), available)
+	require.NoError(t, err)
+	assert.Equal(t, ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageConfig,
+		Digest:    available,
+		Size:      42,
+	}, desc)
+
+	_, err = fetcher.StatBlob(context.Background(), unavailable)
+	assert.True(t, errdefs.IsNotFound(err), "expected not found: %v", err)
+}
+
+func TestFetchIndexPrefetchesChildren(t *testing.T) {
+	amd64 := `{"schemaVersion":2,"mediaType":"application/vnd.oci.image.manifest.v1+json","annotations":{"arch":"amd64"}}`
+	arm64 := `{"schemaVersion":2,"mediaType":"application/vnd.oci.image.manifest.v1+json","annotations":{"arch":"arm64"}}`
+	children := map[digest.Digest]string{
+		digest.FromString(amd64): amd64,
+		digest.FromString(arm64): arm64,
+	}
+	index, err := json.Marshal(ocispec.Index{
+		MediaType: ocispec.MediaTypeImageIndex,
+		Manifests: []ocispec.Descriptor{
+			{MediaType: ocispec.MediaTypeImageManifest, Digest: digest.FromString(amd64), Size: int64(len(amd64))},
+			{MediaType: ocispec.MediaTypeImageManifest, Digest: digest.FromString(arm64), Size: int64(len(arm64))},
+		},
+	})
+	require.NoError(t, err)
+	indexDigest := digest.FromBytes(index)
+
+	var requestedIDs [][]string
+	fakeClient := &fakeECRClient{
+		BatchGetImageFn: func(_ aws.Context, input *ecr.BatchGetImageInput, _ ...request.Option) (*ecr.BatchGetImageOutput, error) {
+			var ids []string
+			output := &ecr.BatchGetImageOutput{}
+			for _, id := range input.ImageIds {
+				dgst := digest.Digest(aws.StringValue(id.ImageDigest))
+				ids = append(ids, dgst.String())
+				manifest, mediaType := children[dgst], ocispec.MediaTypeImageManifest
+				if dgst == indexDigest {
+					manifest, mediaType = string(index), ocispec.MediaTypeImageIndex
+				}
+				output.Images = append(output.Images, &ecr.Image{
+					ImageId:                &ecr.ImageIdentifier{ImageDigest: id.ImageDigest},
+					ImageManifest:          aws.String(manifest),
+					ImageManifestMediaType: aws.String(mediaType),
+				})
+			}
+			requestedIDs = append(requestedIDs, ids)
+			return output, nil
+		},
+	}
+	fetcher := &ecrFetcher{
+		ecrBase: ecrBase{
+			client: fakeClient,
+			ecrSpec: ECRSpec{
+				arn:        arn.ARN{AccountID: "registry"},
+				Repository: "repository",
+			},
+		},
+	}
+
+	rc, err := fetcher.Fetch(context.Background(), ocispec.Descriptor{MediaType: ocispec.MediaTypeImageIndex, Digest: indexDigest})
+	require.NoError(t, err)
+	rc.Close()
+	for dgst, expected := range children {
+		rc, err := fetcher.Fetch(context.Background(), ocispec.Descriptor{MediaType: ocispec.MediaTypeImageManifest, Digest: dgst})
+		require.NoError(t, err)
+		body, err := io.ReadAll(rc)
+		rc.Close()
+		require.NoError(t, err)
+		assert.Equal(t, expected, string(body))
+	}
+
+	assert.Equal(t, [][]string{
+		{indexDigest.String()},
+		{digest.FromString(amd64).String(), digest.FromString(arm64).String()},
+	}, requestedIDs, "children should be retrieved with a single BatchGetImage")
+}
+
+func TestGetImagesByDigestBatches(t *testing.T) {
+	var batchSizes []int
+	fakeClient := &fakeECRClient{
+		BatchGetImageFn: func(_ aws.Context, input *ecr.BatchGetImageInput, _ ...request.Option) (*ecr.BatchGetImageOutput, error) {
+			batchSizes = append(batchSizes, len(input.ImageIds))
+			output := &ecr.BatchGetImageOutput{}
+			for _, id := range input.ImageIds {
+				output.Images = append(output.Images, &ecr.Image{
+					ImageId:       id,
+					ImageManifest: aws.String("manifest"),
+				})
+			}
+			return output, nil
+		},
+	}
+	base := &ecrBase{client: fakeClient}
+	var digests []digest.Digest
+	for i := 0; i < batchGetImageLimit+50; i++ {
+		digests = append(digests, digest.FromString(fmt.Sprint(i)))
+	}
+
+	found, err := base.getImagesByDigest(context.Background(), digests, []string{ocispec.MediaTypeImageManifest})
+	require.NoError(t, err)
+	assert.Len(t, found, len(digests))
+	assert.Equal(t, []int{batchGetImageLimit, 50}, batchSizes)
+}
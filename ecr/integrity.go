@@ -0,0 +1,126 @@
+/*
+ * Copyright 2017-2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You
+ * may not use this file except in compliance with the License. A copy of
+ * the License is located at
+ *
+ * 	http://aws.amazon.com/apache2.0/
+ *
+ * or in the "license" file accompanying this file. This file is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF
+ * ANY KIND, either express or implied. See the License for the specific
+ * language governing permissions and limitations under the License.
+ */
+
+package ecr
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// ContentIntegrity selects how fetched layer content is validated against its
+// descriptor.
+type ContentIntegrity int
+
+const (
+	// ContentIntegrityNone performs no validation of fetched content.
+	ContentIntegrityNone ContentIntegrity = iota
+	// ContentIntegritySize validates that the fetched content's length
+	// matches the descriptor's size.
+	ContentIntegritySize
+	// ContentIntegrityDigest validates that the fetched content's digest
+	// matches the descriptor's digest.
+	ContentIntegrityDigest
+	// ContentIntegrityBoth validates both the size and the digest of the
+	// fetched content.
+	ContentIntegrityBoth
+)
+
+func (mode ContentIntegrity) verifySize() bool {
+	return mode == ContentIntegritySize || mode == ContentIntegrityBoth
+}
+
+func (mode ContentIntegrity) verifyDigest() bool {
+	return mode == ContentIntegrityDigest || mode == ContentIntegrityBoth
+}
+
+// integrityReader validates the content read from the wrapped reader against
+// a descriptor, returning an error in place of io.EOF when the content does
+// not match.
+type integrityReader struct {
+	io.ReadCloser
+	desc     ocispec.Descriptor
+	size     int64
+	read     int64
+	verifier digest.Verifier
+}
+
+// withContentIntegrity wraps rc to validate its content as configured by
+// mode. Validation is skipped for descriptor fields that are not set.
+func withContentIntegrity(rc io.ReadCloser, desc ocispec.Descriptor, mode ContentIntegrity) (io.ReadCloser, error) {
+	return withResumedContentIntegrity(rc, desc, mode, 0, nil)
+}
+
+// withResumedContentIntegrity wraps rc, which provides the content from offset
+// onwards, to validate the full content as configured by mode. prefix provides
+// the content preceding offset and is required to validate the digest of
+// resumed content.
+func withResumedContentIntegrity(rc io.ReadCloser, desc ocispec.Descriptor, mode ContentIntegrity, offset int64, prefix io.Reader) (io.ReadCloser, error) {
+	r := &integrityReader{
+		ReadCloser: rc,
+		desc:       desc,
+		size:       -1,
+		read:       offset,
+	}
+	if mode.verifySize() && desc.Size > 0 {
+		r.size = desc.Size
+	}
+	if mode.verifyDigest() && desc.Digest != "" {
+		if err := desc.Digest.Validate(); err != nil {
+			rc.Close()
+			return nil, fmt.Errorf("ecr: cannot verify content %v: %w", desc.Digest, err)
+		}
+		r.verifier = desc.Digest.Verifier()
+		if offset > 0 {
+			if prefix == nil {
+				rc.Close()
+				return nil, fmt.Errorf("ecr: cannot verify content %v resumed without its prefix: %w", desc.Digest, errdefs.ErrInvalidArgument)
+			}
+			if _, err := io.CopyN(r.verifier, prefix, offset); err != nil {
+				rc.Close()
+				return nil, fmt.Errorf("ecr: cannot verify content %v: failed to read prefix: %w", desc.Digest, err)
+			}
+		}
+	}
+	if r.size < 0 && r.verifier == nil {
+		return rc, nil
+	}
+	return r, nil
+}
+
+func (r *integrityReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.read += int64(n)
+	if r.verifier != nil {
+		r.verifier.Write(p[:n])
+	}
+	if r.size >= 0 && r.read > r.size {
+		return n, fmt.Errorf("ecr: content %v exceeds expected size %d: %w", r.desc.Digest, r.size, errdefs.ErrFailedPrecondition)
+	}
+	if err != io.EOF {
+		return n, err
+	}
+	if r.size >= 0 && r.read != r.size {
+		return n, fmt.Errorf("ecr: content %v size %d does not match expected size %d: %w", r.desc.Digest, r.read, r.size, errdefs.ErrFailedPrecondition)
+	}
+	if r.verifier != nil && !r.verifier.Verified() {
+		return n, fmt.Errorf("ecr: content does not match expected digest %v: %w", r.desc.Digest, errdefs.ErrFailedPrecondition)
+	}
+	return n, io.EOF
+}
@@ -18,30 +18,68 @@ package ecr
 import (
 	"context"
 	"errors"
+	"fmt"
 	"io"
-	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/service/ecr"
 	"github.com/awslabs/amazon-ecr-containerd-resolver/ecr/stream"
 	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/errdefs"
 	"github.com/containerd/containerd/log"
 	"github.com/containerd/containerd/remotes/docker"
 	"github.com/opencontainers/go-digest"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type layerWriter struct {
 	ctx      context.Context
+	cancel   context.CancelFunc
 	base     *ecrBase
 	desc     ocispec.Descriptor
-	buf      io.WriteCloser
+	buf      *io.PipeWriter
 	tracker  docker.StatusTracker
 	ref      string
 	uploadID string
 	err      chan error
+
+	// uploadContentType overrides the Content-Type header sent with each
+	// UploadLayerPart request when set.
+	uploadContentType string
+	// onUploadInit and onUploadComplete are invoked, when set, after the
+	// upload session is initiated and completed respectively.
+	onUploadInit     func(uploadID string)
+	onUploadComplete func(uploadID string, err error)
+	// stallTimeout, when set, fails the upload if no content is written
+	// within the duration while the upload is waiting for it.
+	stallTimeout time.Duration
+	// minPartSize, when larger than the part size returned by ECR, is used
+	// as the size of each uploaded part instead.
+	minPartSize int64
+	// verifier, when set, verifies the layer's content against its digest
+	// as each part is uploaded.
+	verifier digest.Verifier
+	// verified counts the bytes written to verifier.
+	verified int64
+	// retryPolicy configures retries of parts that fail to upload with a
+	// transient error.
+	retryPolicy RetryPolicy
+	// progress, when set, is called with the bytes uploaded as each part is
+	// uploaded.
+	progress func(ref string, desc ocispec.Descriptor, uploaded, total int64)
+	// uploaded counts the bytes of the parts uploaded in the session.
+	uploaded int64
+	// spanContext is the span of the push the writer was created for, which
+	// is the parent of the spans of the writer's requests.
+	spanContext trace.SpanContext
+	// committed and closed record whether Commit and Close have been called.
+	committed bool
+	closed    bool
 }
 
 var _ content.Writer = (*layerWriter)(nil)
@@ -50,29 +88,197 @@ const (
 	layerQueueSize = 5
 )
 
-func newLayerWriter(base *ecrBase, tracker docker.StatusTracker, ref string, desc ocispec.Descriptor) (content.Writer, error) {
-	ctx, cancel := context.WithCancel(context.Background())
-	ctx = log.WithLogger(ctx, log.G(ctx).WithField("desc", desc))
-	reader, writer := io.Pipe()
+// errUploadTruncated stops the upload of a layer whose content is truncated.
+var errUploadTruncated = errors.New("ecr: layer upload truncated")
+
+// errUploadClosed stops the upload of a layer whose writer is closed without
+// being committed.
+var errUploadClosed = errors.New("ecr: layer upload closed without commit")
+
+// layerWriterOption configures optional behavior of a layerWriter.
+type layerWriterOption func(*layerWriter)
+
+// withUploadContentType sets the Content-Type header sent with each
+// UploadLayerPart request.
+func withUploadContentType(contentType string) layerWriterOption {
+	return func(lw *layerWriter) {
+		lw.uploadContentType = contentType
+	}
+}
+
+// withUploadSessionHooks sets the functions invoked when the layer's upload
+// session is initiated and completed.
+func withUploadSessionHooks(onInit func(uploadID string), onComplete func(uploadID string, err error)) layerWriterOption {
+	return func(lw *layerWriter) {
+		lw.onUploadInit = onInit
+		lw.onUploadComplete = onComplete
+	}
+}
+
+// withUploadStallTimeout sets the duration the upload waits for content to be
+// written before failing.
+func withUploadStallTimeout(timeout time.Duration) layerWriterOption {
+	return func(lw *layerWriter) {
+		lw.stallTimeout = timeout
+	}
+}
+
+// withMinUploadPartSize sets the minimum size of each uploaded part.
+func withMinUploadPartSize(size int64) layerWriterOption {
+	return func(lw *layerWriter) {
+		lw.minPartSize = size
+	}
+}
+
+// withPartVerification verifies the layer's content against its digest as
+// each part is uploaded.
+func withPartVerification() layerWriterOption {
+	return func(lw *layerWriter) {
+		if lw.desc.Digest.Validate() == nil {
+			lw.verifier = lw.desc.Digest.Verifier()
+		}
+	}
+}
+
+// verifyPart adds the part's content to the layer's verifier.  A part that
+// completes the layer's expected size must complete its expected digest, so
+// that corrupt content fails before the final part is uploaded.
+func (lw *layerWriter) verifyPart(part []byte) error {
+	lw.verifier.Write(part)
+	lw.verified += int64(len(part))
+	size := lw.desc.Size
+	switch {
+	case size <= 0 || lw.verified < size:
+		return nil
+	case lw.verified > size:
+		return fmt.Errorf("ecr: layer %v exceeds expected size %d: %w", lw.desc.Digest, size, errdefs.ErrFailedPrecondition)
+	case !lw.verifier.Verified():
+		return fmt.Errorf("ecr: layer content does not match expected digest %v: %w", lw.desc.Digest, errdefs.ErrFailedPrecondition)
+	}
+	return nil
+}
+
+// withUploadRetryPolicy sets the policy for retrying parts that fail to
+// upload with a transient error.
+func withUploadRetryPolicy(policy RetryPolicy) layerWriterOption {
+	return func(lw *layerWriter) {
+		lw.retryPolicy = policy
+	}
+}
+
+// withUploadProgress sets the function called as each part is uploaded.
+func withUploadProgress(progress func(ref string, desc ocispec.Descriptor, uploaded, total int64)) layerWriterOption {
+	return func(lw *layerWriter) {
+		lw.progress = progress
+	}
+}
+
+// withParentSpan sets the span of the push the writer is created for.
+func withParentSpan(spanContext trace.SpanContext) layerWriterOption {
+	return func(lw *layerWriter) {
+		lw.spanContext = spanContext
+	}
+}
+
+// uploadPart uploads a layer part, retrying transient failures as configured
+// by the writer's retry policy.
+func (lw *layerWriter) uploadPart(ctx context.Context, input *ecr.UploadLayerPartInput) error {
+	for attempts := 1; ; attempts++ {
+		spanCtx, span := startSpan(ctx, lw.base.tracer, lw.base.ecrSpec, "ecr.UploadLayerPart", digestAttribute.String(lw.desc.Digest.String()))
+		_, err := lw.base.client.UploadLayerPartWithContext(spanCtx, input, lw.uploadLayerPartOptions()...)
+		endSpan(span, err)
+		if err == nil && lw.base.metrics != nil {
+			lw.base.metrics.LayerBytesPushed(int64(len(input.LayerPartBlob)))
+		}
+		if err == nil || !retryableRequestError(err) || !lw.retryPolicy.retryable(attempts) {
+			return err
+		}
+		delay := lw.retryPolicy.backoff(attempts)
+		log.G(ctx).
+			WithError(err).
+			WithField("firstByte", aws.Int64Value(input.PartFirstByte)).
+			WithField("attempts", attempts).
+			WithField("delay", delay).
+			Debug("ecr.layer.callback: retrying part upload")
+		if err := sleep(ctx, delay); err != nil {
+			return err
+		}
+	}
+}
+
+// stallReader fails reads from a pipe that are blocked waiting for a write
+// for longer than the timeout with err.
+type stallReader struct {
+	pipe    *io.PipeReader
+	timeout time.Duration
+	err     error
+	stalled atomic.Bool
+}
+
+func newStallReader(pipe *io.PipeReader, timeout time.Duration, err error) *stallReader {
+	return &stallReader{
+		pipe:    pipe,
+		timeout: timeout,
+		err:     err,
+	}
+}
+
+func (r *stallReader) Read(p []byte) (int, error) {
+	timer := time.AfterFunc(r.timeout, func() {
+		r.stalled.Store(true)
+		// Writers blocked on the pipe are released with the same error.
+		r.pipe.CloseWithError(r.err)
+	})
+	n, err := r.pipe.Read(p)
+	timer.Stop()
+	if r.stalled.Load() {
+		return n, r.err
+	}
+	return n, err
+}
+
+func newLayerWriter(base *ecrBase, tracker docker.StatusTracker, ref string, desc ocispec.Descriptor, opts ...layerWriterOption) (content.Writer, error) {
 	lw := &layerWriter{
-		ctx:     ctx,
 		base:    base,
 		desc:    desc,
-		buf:     writer,
 		tracker: tracker,
 		ref:     ref,
-		err:     make(chan error),
 	}
+	for _, opt := range opts {
+		opt(lw)
+	}
+	if err := lw.initiate(); err != nil {
+		return nil, err
+	}
+	return lw, nil
+}
+
+// initiate starts a new upload session for the layer and uploads the content
+// written to the writer as parts of the session.
+func (lw *layerWriter) initiate() error {
+	base, desc := lw.base, lw.desc
+	ctx, cancel := context.WithCancel(trace.ContextWithSpanContext(context.Background(), lw.spanContext))
+	ctx = withLogFields(ctx, base.logFields)
+	ctx = withRetryBudget(ctx, base.retryDeadline)
+	ctx = log.WithLogger(ctx, log.G(ctx).WithField("desc", desc))
+	reader, writer := io.Pipe()
+	lw.ctx = ctx
+	lw.cancel = cancel
+	lw.buf = writer
+	lw.err = make(chan error)
 
 	// call InitiateLayerUpload and get upload ID
 	initiateLayerUploadInput := &ecr.InitiateLayerUploadInput{
 		RegistryId:     aws.String(base.ecrSpec.Registry()),
 		RepositoryName: aws.String(base.ecrSpec.Repository),
 	}
-	initiateLayerUploadOutput, err := base.client.InitiateLayerUpload(initiateLayerUploadInput)
+	spanCtx, span := startSpan(ctx, base.tracer, base.ecrSpec, "ecr.InitiateLayerUpload", digestAttribute.String(desc.Digest.String()))
+	initiateLayerUploadOutput, err := base.client.InitiateLayerUploadWithContext(spanCtx, initiateLayerUploadInput)
+	endSpan(span, err)
 	if err != nil {
 		cancel()
-		return nil, err
+		close(lw.err)
+		return err
 	}
 	lw.uploadID = aws.StringValue(initiateLayerUploadOutput.UploadId)
 	partSize := aws.Int64Value(initiateLayerUploadOutput.PartSize)
@@ -81,11 +287,26 @@ func newLayerWriter(base *ecrBase, tracker docker.StatusTracker, ref string, des
 		WithField("uploadID", lw.uploadID).
 		WithField("partSize", partSize).
 		Debug("ecr.blob.init")
+	if partSize < lw.minPartSize {
+		log.G(ctx).
+			WithField("partSize", partSize).
+			WithField("minPartSize", lw.minPartSize).
+			Debug("ecr.blob.init: using minimum part size")
+		partSize = lw.minPartSize
+	}
+	if lw.onUploadInit != nil {
+		lw.onUploadInit(lw.uploadID)
+	}
+
+	var content io.Reader = reader
+	if lw.stallTimeout > 0 {
+		content = newStallReader(reader, lw.stallTimeout, fmt.Errorf("ecr: layer upload stalled, no content written within %v", lw.stallTimeout))
+	}
 
 	go func() {
 		defer cancel()
 		defer close(lw.err)
-		_, err := stream.ChunkedProcessor(reader, partSize, layerQueueSize,
+		_, err := stream.ChunkedProcessor(content, partSize, layerQueueSize,
 			func(layerChunk *stream.Chunk) error {
 				begin := layerChunk.BytesBegin
 				end := layerChunk.BytesEnd
@@ -97,6 +318,16 @@ func newLayerWriter(base *ecrBase, tracker docker.StatusTracker, ref string, des
 					WithField("end", end).
 					WithField("bytes", bytesRead).
 					Debug("ecr.layer.callback")
+				if len(layerChunk.Bytes) == 0 {
+					// ECR does not accept empty parts.
+					return nil
+				}
+
+				if lw.verifier != nil {
+					if err := lw.verifyPart(layerChunk.Bytes); err != nil {
+						return err
+					}
+				}
 
 				uploadLayerPartInput := &ecr.UploadLayerPartInput{
 					RegistryId:     aws.String(base.ecrSpec.Registry()),
@@ -107,7 +338,18 @@ func newLayerWriter(base *ecrBase, tracker docker.StatusTracker, ref string, des
 					LayerPartBlob:  layerChunk.Bytes,
 				}
 
-				_, err := base.client.UploadLayerPart(uploadLayerPartInput)
+				err := lw.uploadPart(ctx, uploadLayerPartInput)
+				if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == ecr.ErrCodeLayerPartTooSmallException {
+					log.G(ctx).
+						WithError(err).
+						WithField("part", layerChunk.Part).
+						WithField("bytes", len(layerChunk.Bytes)).
+						WithField("partSize", partSize).
+						WithField("minPartSize", lw.minPartSize).
+						Error("ecr.layer.callback: part rejected as smaller than the minimum part size, check the configured part sizes")
+					return fmt.Errorf("ecr: part %d of layer %v with %d bytes, using part size %d: %w: %w",
+						layerChunk.Part, desc.Digest, len(layerChunk.Bytes), partSize, ErrLayerPartTooSmall, err)
+				}
 				log.G(ctx).
 					WithField("digest", desc.Digest.String()).
 					WithField("part", layerChunk.Part).
@@ -115,27 +357,53 @@ func newLayerWriter(base *ecrBase, tracker docker.StatusTracker, ref string, des
 					WithField("end", end).
 					WithField("bytes", bytesRead).
 					Debug("ecr.layer.callback end")
+				if err == nil && lw.progress != nil {
+					lw.uploaded += int64(len(layerChunk.Bytes))
+					lw.progress(lw.ref, desc, lw.uploaded, desc.Size)
+				}
 				if err == nil {
-					var status docker.Status
-					status, err = lw.tracker.GetStatus(lw.ref)
-					if err == nil {
+					status, statusErr := lw.tracker.GetStatus(lw.ref)
+					if statusErr == nil {
 						status.Offset += int64(bytesRead) + 1
 						status.UpdatedAt = time.Now()
 						lw.tracker.SetStatus(lw.ref, status)
+					} else {
+						log.G(ctx).WithError(statusErr).WithField("ref", lw.ref).Debug("ecr.layer: status not tracked")
 					}
 				}
 				return err
 			})
 		if err != nil {
+			// Fail pending and later writes, nothing is reading them anymore.
+			reader.CloseWithError(err)
 			lw.err <- err
 		}
 		log.G(ctx).WithField("digest", desc.Digest.String()).Debug("ecr.layer upload done")
 	}()
-	return lw, nil
+	return nil
+}
+
+// uploadLayerPartOptions returns the request options applied to each
+// UploadLayerPart request.  Parts are retried by the writer's retry policy,
+// when configured, in place of the SDK.
+func (lw *layerWriter) uploadLayerPartOptions() []request.Option {
+	var opts []request.Option
+	if lw.uploadContentType != "" {
+		opts = append(opts, request.WithSetRequestHeaders(map[string]string{
+			"Content-Type": lw.uploadContentType,
+		}))
+	}
+	if lw.retryPolicy.MaxAttempts > 1 {
+		opts = append(opts, withoutSDKRetries)
+	}
+	return opts
 }
 
 func (lw *layerWriter) Write(b []byte) (int, error) {
 	log.G(lw.ctx).WithField("len(b)", len(b)).Debug("ecr.layer.write")
+	if lw.closed {
+		return 0, errUploadClosed
+	}
 	select {
 	case err := <-lw.err:
 		return 0, err
@@ -146,16 +414,44 @@ func (lw *layerWriter) Write(b []byte) (int, error) {
 	return lw.buf.Write(b)
 }
 
+// Close releases the writer.  Closing a committed writer does nothing.
+// Closing a writer that has not been committed aborts the upload: writes fail,
+// no further parts are uploaded, and the upload session, which ECR cannot
+// discard, is left to expire.
 func (lw *layerWriter) Close() error {
-	return errors.New("lw.Close: not implemented")
+	if lw.committed || lw.closed {
+		return nil
+	}
+	log.G(lw.ctx).Debug("ecr.layer.close: aborting upload")
+	lw.closed = true
+	lw.buf.CloseWithError(errUploadClosed)
+	lw.cancel()
+	// Nothing waits on the upload anymore; let it finish in the background.
+	go func() {
+		for range lw.err {
+		}
+	}()
+	if lw.onUploadComplete != nil {
+		lw.onUploadComplete(lw.uploadID, errUploadClosed)
+	}
+	return nil
 }
 
 func (lw *layerWriter) Digest() digest.Digest {
 	return lw.desc.Digest
 }
 
-func (lw *layerWriter) Commit(ctx context.Context, size int64, expected digest.Digest, opts ...content.Opt) error {
+func (lw *layerWriter) Commit(ctx context.Context, size int64, expected digest.Digest, opts ...content.Opt) (err error) {
 	log.G(lw.ctx).WithField("size", size).WithField("expected", expected).Debug("ecr.layer.commit")
+	if lw.closed {
+		return fmt.Errorf("ecr: committing layer %v: %w", lw.desc.Digest, errUploadClosed)
+	}
+	lw.committed = true
+	if lw.onUploadComplete != nil {
+		defer func() {
+			lw.onUploadComplete(lw.uploadID, err)
+		}()
+	}
 	lw.buf.Close()
 	select {
 	case err := <-lw.err:
@@ -168,6 +464,9 @@ func (lw *layerWriter) Commit(ctx context.Context, size int64, expected digest.D
 		}
 	case <-lw.ctx.Done():
 	}
+	if lw.verifier != nil && !lw.verifier.Verified() {
+		return fmt.Errorf("ecr: layer content does not match expected digest %v: %w", lw.desc.Digest, errdefs.ErrFailedPrecondition)
+	}
 
 	completeLayerUploadInput := &ecr.CompleteLayerUploadInput{
 		RegistryId:     aws.String(lw.base.ecrSpec.Registry()),
@@ -176,22 +475,54 @@ func (lw *layerWriter) Commit(ctx context.Context, size int64, expected digest.D
 		LayerDigests:   []*string{aws.String(expected.String())},
 	}
 
-	completeLayerUploadOutput, err := lw.base.client.CompleteLayerUpload(completeLayerUploadInput)
+	// The writer's context is done once its parts are uploaded, so the upload
+	// is completed with the caller's context in the writer's span.
+	_, span := startSpan(lw.ctx, lw.base.tracer, lw.base.ecrSpec, "ecr.CompleteLayerUpload", digestAttribute.String(expected.String()))
+	completeLayerUploadOutput, err := lw.base.client.CompleteLayerUploadWithContext(trace.ContextWithSpan(ctx, span), completeLayerUploadInput)
+	endSpan(span, err)
 	if err != nil {
 		// If the layer that is being uploaded already exists then return successfully instead of failing. Unfortunately
 		// in this case we do not get the digest back from ECR, but if the client-provided digest starts with a
 		// "sha256:" then the ECR has validated that the digest provided matches ours. If the expected digest uses a
-		// different algorithm we have to fail as we do not know the digest ECR calculated and the expected digest
-		// has not been validated.
+		// different algorithm, ECR has not validated it, so the layer's presence is confirmed with ECR instead.
+		// A zero-length layer has no parts to upload and ECR will not complete an upload without parts, so it
+		// succeeds only when the layer is confirmed to be present already.
 		awsErr, ok := err.(awserr.Error)
-		if ok && awsErr.Code() == "LayerAlreadyExistsException" && strings.HasPrefix(expected.String(), "sha256:") {
-			log.G(lw.ctx).Debug("ecr.layer.commit: layer already exists")
-			return nil
-		} else {
+		if !ok {
+			return err
+		}
+		switch awsErr.Code() {
+		case ecr.ErrCodeLayerAlreadyExistsException:
+			if expected.Algorithm() == digest.SHA256 {
+				log.G(lw.ctx).Debug("ecr.layer.commit: layer already exists")
+				return nil
+			}
+		case ecr.ErrCodeEmptyUploadException:
+			log.G(lw.ctx).Debug("ecr.layer.commit: empty upload, checking for existing layer")
+		default:
+			return err
+		}
+		if !expected.Algorithm().Available() {
+			return err
+		}
+		availability, checkErr := lw.base.checkLayerAvailability(ctx, []digest.Digest{expected})
+		if checkErr != nil {
+			return fmt.Errorf("ecr: confirming existing layer %v: %w", expected, checkErr)
+		}
+		if !availability[expected] {
 			return err
 		}
+		log.G(lw.ctx).Debug("ecr.layer.commit: layer already exists, confirmed available")
+		return nil
 	}
 	actualDigest := aws.StringValue(completeLayerUploadOutput.LayerDigest)
+	// ECR may report success without including the layer's digest. As with an
+	// already existing layer, ECR has validated a "sha256:" digest provided by
+	// the client, so the upload is considered complete.
+	if actualDigest == "" && expected.Algorithm() == digest.SHA256 {
+		log.G(lw.ctx).Debug("ecr.layer.commit: complete without digest in response")
+		return nil
+	}
 	if actualDigest != expected.String() {
 		return errors.New("ecr: failed to validate uploaded digest")
 	}
@@ -210,8 +541,46 @@ func (lw *layerWriter) Status() (content.Status, error) {
 	}, nil
 }
 
+// Truncate discards the content written to the writer, so that an ingest can
+// be restarted.  Only truncating to zero is supported: ECR cannot discard the
+// uploaded parts of an upload session, so a new session is initiated in place
+// of the current one, which is left to expire.  Closed and committed writers
+// cannot be truncated, and a writer whose new session fails to be initiated is
+// closed.
 func (lw *layerWriter) Truncate(size int64) error {
 	log.G(lw.ctx).WithField("size", size).Debug("ecr.layer.truncate")
+	if lw.closed {
+		return fmt.Errorf("ecr: truncating layer %v: %w", lw.desc.Digest, errUploadClosed)
+	}
+	if lw.committed {
+		return fmt.Errorf("ecr: truncating committed layer %v: %w", lw.desc.Digest, errdefs.ErrFailedPrecondition)
+	}
+	if size != 0 {
+		return fmt.Errorf("ecr: truncating layer upload to %d bytes: %w", size, errdefs.ErrNotImplemented)
+	}
 
-	return errors.New("ecr.layer.truncate: not implemented")
+	// Stop the current session's upload and wait for it to finish.
+	lw.buf.CloseWithError(errUploadTruncated)
+	lw.cancel()
+	for range lw.err {
+	}
+	if lw.onUploadComplete != nil {
+		lw.onUploadComplete(lw.uploadID, errUploadTruncated)
+	}
+
+	if lw.verifier != nil {
+		lw.verifier = lw.desc.Digest.Verifier()
+		lw.verified = 0
+	}
+	lw.uploaded = 0
+	if status, err := lw.tracker.GetStatus(lw.ref); err == nil {
+		status.Offset = 0
+		status.UpdatedAt = time.Now()
+		lw.tracker.SetStatus(lw.ref, status)
+	}
+	if err := lw.initiate(); err != nil {
+		lw.closed = true
+		return err
+	}
+	return nil
 }
@@ -17,19 +17,30 @@ package ecr
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"io"
+	"net/http"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/arn"
 	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/awstesting/unit"
 	"github.com/aws/aws-sdk-go/service/ecr"
 	"github.com/awslabs/amazon-ecr-containerd-resolver/ecr/internal/testdata"
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/errdefs"
 	"github.com/containerd/containerd/remotes/docker"
 	"github.com/opencontainers/go-digest"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/trace"
 )
 
 func TestLayerWriter(t *testing.T) {
@@ -50,7 +61,7 @@ func TestLayerWriter(t *testing.T) {
 				PartSize: aws.Int64(1),
 			}, nil
 		},
-		UploadLayerPartFn: func(input *ecr.UploadLayerPartInput) (*ecr.UploadLayerPartOutput, error) {
+		UploadLayerPartFn: func(_ aws.Context, input *ecr.UploadLayerPartInput, _ ...request.Option) (*ecr.UploadLayerPartOutput, error) {
 			assert.Equal(t, registry, aws.StringValue(input.RegistryId))
 			assert.Equal(t, repository, aws.StringValue(input.RepositoryName))
 			assert.Equal(t, uploadID, aws.StringValue(input.UploadId))
@@ -108,6 +119,148 @@ func TestLayerWriter(t *testing.T) {
 	assert.Equal(t, 1, completeLayerUploadCount)
 }
 
+func TestLayerWriterUploadContext(t *testing.T) {
+	spanContext := trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID: trace.TraceID{1},
+		SpanID:  trace.SpanID{2},
+	})
+	assertUploadContext := func(ctx aws.Context) {
+		assert.Equal(t, spanContext.TraceID(), trace.SpanContextFromContext(ctx).TraceID(), "the upload's context should be passed")
+		assert.NoError(t, ctx.Err())
+	}
+	client := &fakeECRClient{
+		InitiateLayerUploadWithContextFn: func(ctx aws.Context, _ *ecr.InitiateLayerUploadInput, _ ...request.Option) (*ecr.InitiateLayerUploadOutput, error) {
+			assertUploadContext(ctx)
+			return &ecr.InitiateLayerUploadOutput{
+				UploadId: aws.String("upload"),
+				PartSize: aws.Int64(1024),
+			}, nil
+		},
+		UploadLayerPartFn: func(aws.Context, *ecr.UploadLayerPartInput, ...request.Option) (*ecr.UploadLayerPartOutput, error) {
+			return &ecr.UploadLayerPartOutput{}, nil
+		},
+		CompleteLayerUploadWithContextFn: func(ctx aws.Context, _ *ecr.CompleteLayerUploadInput, _ ...request.Option) (*ecr.CompleteLayerUploadOutput, error) {
+			assertUploadContext(ctx)
+			return &ecr.CompleteLayerUploadOutput{}, nil
+		},
+	}
+	ecrBase := &ecrBase{
+		client: client,
+		ecrSpec: ECRSpec{
+			arn:        arn.ARN{AccountID: "registry"},
+			Repository: "repository",
+		},
+	}
+	layerData := []byte("layer")
+	desc := ocispec.Descriptor{Digest: digest.FromBytes(layerData)}
+	tracker := docker.NewInMemoryTracker()
+	tracker.SetStatus("refKey", docker.Status{})
+
+	lw, err := newLayerWriter(ecrBase, tracker, "refKey", desc, withParentSpan(spanContext))
+	require.NoError(t, err)
+	_, err = lw.Write(layerData)
+	require.NoError(t, err)
+	require.NoError(t, lw.Commit(context.Background(), int64(len(layerData)), desc.Digest))
+}
+
+func TestLayerWriterLegacyUploadFns(t *testing.T) {
+	var initiateCount, completeCount int
+	client := &fakeECRClient{
+		InitiateLayerUploadFn: func(*ecr.InitiateLayerUploadInput) (*ecr.InitiateLayerUploadOutput, error) {
+			initiateCount++
+			return &ecr.InitiateLayerUploadOutput{
+				UploadId: aws.String("upload"),
+				PartSize: aws.Int64(1024),
+			}, nil
+		},
+		UploadLayerPartFn: func(aws.Context, *ecr.UploadLayerPartInput, ...request.Option) (*ecr.UploadLayerPartOutput, error) {
+			return &ecr.UploadLayerPartOutput{}, nil
+		},
+		CompleteLayerUploadFn: func(*ecr.CompleteLayerUploadInput) (*ecr.CompleteLayerUploadOutput, error) {
+			completeCount++
+			return &ecr.CompleteLayerUploadOutput{}, nil
+		},
+	}
+	ecrBase := &ecrBase{
+		client: client,
+		ecrSpec: ECRSpec{
+			arn:        arn.ARN{AccountID: "registry"},
+			Repository: "repository",
+		},
+	}
+	layerData := []byte("layer")
+	desc := ocispec.Descriptor{Digest: digest.FromBytes(layerData)}
+	tracker := docker.NewInMemoryTracker()
+	tracker.SetStatus("refKey", docker.Status{})
+
+	lw, err := newLayerWriter(ecrBase, tracker, "refKey", desc)
+	require.NoError(t, err)
+	_, err = lw.Write(layerData)
+	require.NoError(t, err)
+	require.NoError(t, lw.Commit(context.Background(), int64(len(layerData)), desc.Digest))
+	assert.Equal(t, 1, initiateCount, "InitiateLayerUploadFn should be called without InitiateLayerUploadWithContextFn")
+	assert.Equal(t, 1, completeCount, "CompleteLayerUploadFn should be called without CompleteLayerUploadWithContextFn")
+}
+
+func TestLayerWriterClose(t *testing.T) {
+	const layerData = "layer"
+	layerDigest := digest.FromString(layerData)
+	var completeCount int
+	var completed []error
+	client := &fakeECRClient{
+		InitiateLayerUploadFn: func(*ecr.InitiateLayerUploadInput) (*ecr.InitiateLayerUploadOutput, error) {
+			return &ecr.InitiateLayerUploadOutput{
+				UploadId: aws.String("upload"),
+				PartSize: aws.Int64(10),
+			}, nil
+		},
+		UploadLayerPartFn: func(aws.Context, *ecr.UploadLayerPartInput, ...request.Option) (*ecr.UploadLayerPartOutput, error) {
+			return &ecr.UploadLayerPartOutput{}, nil
+		},
+		CompleteLayerUploadFn: func(*ecr.CompleteLayerUploadInput) (*ecr.CompleteLayerUploadOutput, error) {
+			completeCount++
+			return &ecr.CompleteLayerUploadOutput{LayerDigest: aws.String(layerDigest.String())}, nil
+		},
+	}
+	hooks := withUploadSessionHooks(nil, func(_ string, err error) {
+		completed = append(completed, err)
+	})
+	newWriter := func() content.Writer {
+		tracker := docker.NewInMemoryTracker()
+		tracker.SetStatus("refKey", docker.Status{})
+		lw, err := newLayerWriter(&ecrBase{client: client}, tracker, "refKey", ocispec.Descriptor{Digest: layerDigest}, hooks)
+		require.NoError(t, err)
+		return lw
+	}
+
+	t.Run("after commit", func(t *testing.T) {
+		lw := newWriter()
+		_, err := lw.Write([]byte(layerData))
+		require.NoError(t, err)
+		require.NoError(t, lw.Commit(context.Background(), int64(len(layerData)), layerDigest))
+		assert.NoError(t, lw.Close())
+		assert.NoError(t, lw.Close())
+		assert.Equal(t, 1, completeCount)
+		assert.Equal(t, []error{nil}, completed, "closing should not end the completed upload again")
+	})
+
+	t.Run("without commit", func(t *testing.T) {
+		completeCount = 0
+		completed = nil
+		lw := newWriter()
+		_, err := lw.Write([]byte(layerData))
+		require.NoError(t, err)
+		assert.NoError(t, lw.Close())
+		assert.NoError(t, lw.Close())
+		_, err = lw.Write([]byte(layerData))
+		assert.ErrorIs(t, err, errUploadClosed, "writes should fail once the upload is aborted")
+		err = lw.Commit(context.Background(), int64(len(layerData)), layerDigest)
+		assert.ErrorIs(t, err, errUploadClosed)
+		assert.Equal(t, 0, completeCount, "an aborted upload should not be completed")
+		assert.Equal(t, []error{errUploadClosed}, completed)
+	})
+}
+
 type layerAlreadyExistsError struct{}
 
 func (l *layerAlreadyExistsError) Code() string    { return "LayerAlreadyExistsException" }
@@ -150,3 +303,633 @@ func TestLayerWriterCommitExists(t *testing.T) {
 	assert.NoError(t, err)
 	assert.Equal(t, 1, callCount)
 }
+
+func TestLayerWriterCommitExistsSHA512(t *testing.T) {
+	layerDigest := digest.SHA512.FromString("layer")
+	for _, tc := range []struct {
+		name         string
+		availability string
+		err          bool
+	}{
+		{name: "available", availability: ecr.LayerAvailabilityAvailable},
+		{name: "unavailable", availability: ecr.LayerAvailabilityUnavailable, err: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var checked []string
+			client := &fakeECRClient{
+				CompleteLayerUploadFn: func(*ecr.CompleteLayerUploadInput) (*ecr.CompleteLayerUploadOutput, error) {
+					return nil, &layerAlreadyExistsError{}
+				},
+				BatchCheckLayerAvailabilityFn: func(_ aws.Context, input *ecr.BatchCheckLayerAvailabilityInput, _ ...request.Option) (*ecr.BatchCheckLayerAvailabilityOutput, error) {
+					checked = append(checked, aws.StringValueSlice(input.LayerDigests)...)
+					return &ecr.BatchCheckLayerAvailabilityOutput{
+						Layers: []*ecr.Layer{{
+							LayerDigest:       aws.String(layerDigest.String()),
+							LayerAvailability: aws.String(tc.availability),
+						}},
+					}, nil
+				},
+			}
+
+			_, writer := io.Pipe()
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			lw := layerWriter{
+				base: &ecrBase{client: client},
+				buf:  writer,
+				ctx:  ctx,
+			}
+
+			err := lw.Commit(context.Background(), 0, layerDigest)
+			assert.Equal(t, []string{layerDigest.String()}, checked)
+			if tc.err {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+		})
+	}
+}
+
+func TestLayerWriterEmptyLayer(t *testing.T) {
+	registry := "registry"
+	repository := "repository"
+	// Digest of zero-length content.
+	layerDigest := digest.FromBytes(nil)
+	uploadID := "upload"
+
+	for _, tc := range []struct {
+		name         string
+		availability string
+		expectErr    bool
+	}{
+		{name: "present", availability: ecr.LayerAvailabilityAvailable},
+		{name: "absent", availability: ecr.LayerAvailabilityUnavailable, expectErr: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			completeLayerUploadCount := 0
+			client := &fakeECRClient{
+				InitiateLayerUploadFn: func(*ecr.InitiateLayerUploadInput) (*ecr.InitiateLayerUploadOutput, error) {
+					return &ecr.InitiateLayerUploadOutput{
+						UploadId: aws.String(uploadID),
+						PartSize: aws.Int64(10),
+					}, nil
+				},
+				UploadLayerPartFn: func(aws.Context, *ecr.UploadLayerPartInput, ...request.Option) (*ecr.UploadLayerPartOutput, error) {
+					t.Error("no part should be uploaded for an empty layer")
+					return &ecr.UploadLayerPartOutput{}, nil
+				},
+				CompleteLayerUploadFn: func(input *ecr.CompleteLayerUploadInput) (*ecr.CompleteLayerUploadOutput, error) {
+					completeLayerUploadCount++
+					return nil, awserr.New(ecr.ErrCodeEmptyUploadException, "no parts", nil)
+				},
+				BatchCheckLayerAvailabilityFn: func(_ aws.Context, input *ecr.BatchCheckLayerAvailabilityInput, _ ...request.Option) (*ecr.BatchCheckLayerAvailabilityOutput, error) {
+					return &ecr.BatchCheckLayerAvailabilityOutput{
+						Layers: []*ecr.Layer{{
+							LayerDigest:       input.LayerDigests[0],
+							LayerAvailability: aws.String(tc.availability),
+						}},
+					}, nil
+				},
+			}
+			ecrBase := &ecrBase{
+				client: client,
+				ecrSpec: ECRSpec{
+					arn: arn.ARN{
+						AccountID: registry,
+					},
+					Repository: repository,
+				},
+			}
+
+			desc := ocispec.Descriptor{
+				Digest: layerDigest,
+			}
+
+			tracker := docker.NewInMemoryTracker()
+			refKey := "refKey"
+			tracker.SetStatus(refKey, docker.Status{})
+
+			lw, err := newLayerWriter(ecrBase, tracker, refKey, desc)
+			require.NoError(t, err)
+
+			err = lw.Commit(context.Background(), 0, desc.Digest)
+			if tc.expectErr {
+				assert.Error(t, err, "an empty layer that is not present cannot be pushed")
+			} else {
+				assert.NoError(t, err)
+			}
+			assert.Equal(t, 1, completeLayerUploadCount)
+
+			status, err := tracker.GetStatus(refKey)
+			require.NoError(t, err)
+			assert.Equal(t, int64(0), status.Offset)
+		})
+	}
+}
+
+func TestLayerWriterUploadContentType(t *testing.T) {
+	const layerData = "layer"
+	layerDigest := digest.FromString(layerData)
+
+	for _, tc := range []struct {
+		name        string
+		opts        []layerWriterOption
+		contentType string
+	}{
+		{name: "default"},
+		{name: "override", opts: []layerWriterOption{withUploadContentType("application/octet-stream")}, contentType: "application/octet-stream"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			uploadLayerPartCount := 0
+			client := &fakeECRClient{
+				InitiateLayerUploadFn: func(*ecr.InitiateLayerUploadInput) (*ecr.InitiateLayerUploadOutput, error) {
+					return &ecr.InitiateLayerUploadOutput{
+						UploadId: aws.String("upload"),
+						PartSize: aws.Int64(10),
+					}, nil
+				},
+				UploadLayerPartFn: func(_ aws.Context, _ *ecr.UploadLayerPartInput, opts ...request.Option) (*ecr.UploadLayerPartOutput, error) {
+					uploadLayerPartCount++
+					req := &request.Request{HTTPRequest: &http.Request{Header: http.Header{}}}
+					req.ApplyOptions(opts...)
+					assert.Equal(t, tc.contentType, req.HTTPRequest.Header.Get("Content-Type"))
+					return &ecr.UploadLayerPartOutput{}, nil
+				},
+				CompleteLayerUploadFn: func(*ecr.CompleteLayerUploadInput) (*ecr.CompleteLayerUploadOutput, error) {
+					return &ecr.CompleteLayerUploadOutput{
+						LayerDigest: aws.String(layerDigest.String()),
+					}, nil
+				},
+			}
+
+			tracker := docker.NewInMemoryTracker()
+			refKey := "refKey"
+			tracker.SetStatus(refKey, docker.Status{})
+
+			lw, err := newLayerWriter(&ecrBase{client: client}, tracker, refKey, ocispec.Descriptor{Digest: layerDigest}, tc.opts...)
+			require.NoError(t, err)
+			_, err = lw.Write([]byte(layerData))
+			require.NoError(t, err)
+			require.NoError(t, lw.Commit(context.Background(), int64(len(layerData)), layerDigest))
+			assert.Equal(t, 1, uploadLayerPartCount)
+		})
+	}
+}
+
+func TestLayerWriterCommitEmptyDigest(t *testing.T) {
+	for _, tc := range []struct {
+		expected digest.Digest
+		err      bool
+	}{
+		{expected: digest.FromString("layer")},
+		{expected: digest.SHA512.FromString("layer"), err: true},
+	} {
+		t.Run(tc.expected.Algorithm().String(), func(t *testing.T) {
+			callCount := 0
+			client := &fakeECRClient{
+				CompleteLayerUploadFn: func(*ecr.CompleteLayerUploadInput) (*ecr.CompleteLayerUploadOutput, error) {
+					callCount++
+					return &ecr.CompleteLayerUploadOutput{}, nil
+				},
+			}
+
+			_, writer := io.Pipe()
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			lw := layerWriter{
+				base: &ecrBase{client: client},
+				buf:  writer,
+				ctx:  ctx,
+			}
+
+			err := lw.Commit(context.Background(), 0, tc.expected)
+			assert.Equal(t, 1, callCount)
+			if tc.err {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+		})
+	}
+}
+
+func TestLayerWriterUploadSessionHooks(t *testing.T) {
+	const (
+		layerData = "layer"
+		uploadID  = "upload"
+	)
+	layerDigest := digest.FromString(layerData)
+	client := &fakeECRClient{
+		InitiateLayerUploadFn: func(*ecr.InitiateLayerUploadInput) (*ecr.InitiateLayerUploadOutput, error) {
+			return &ecr.InitiateLayerUploadOutput{
+				UploadId: aws.String(uploadID),
+				PartSize: aws.Int64(10),
+			}, nil
+		},
+		UploadLayerPartFn: func(aws.Context, *ecr.UploadLayerPartInput, ...request.Option) (*ecr.UploadLayerPartOutput, error) {
+			return &ecr.UploadLayerPartOutput{}, nil
+		},
+		CompleteLayerUploadFn: func(*ecr.CompleteLayerUploadInput) (*ecr.CompleteLayerUploadOutput, error) {
+			return &ecr.CompleteLayerUploadOutput{
+				LayerDigest: aws.String(layerDigest.String()),
+			}, nil
+		},
+	}
+
+	var initIDs, completeIDs []string
+	var completeErr error
+	hooks := withUploadSessionHooks(
+		func(id string) {
+			initIDs = append(initIDs, id)
+		},
+		func(id string, err error) {
+			completeIDs = append(completeIDs, id)
+			completeErr = err
+		})
+
+	tracker := docker.NewInMemoryTracker()
+	refKey := "refKey"
+	tracker.SetStatus(refKey, docker.Status{})
+
+	lw, err := newLayerWriter(&ecrBase{client: client}, tracker, refKey, ocispec.Descriptor{Digest: layerDigest}, hooks)
+	require.NoError(t, err)
+	assert.Equal(t, []string{uploadID}, initIDs, "init hook should fire on construction")
+	assert.Empty(t, completeIDs, "complete hook should not fire before commit")
+
+	_, err = lw.Write([]byte(layerData))
+	require.NoError(t, err)
+	require.NoError(t, lw.Commit(context.Background(), int64(len(layerData)), layerDigest))
+	assert.Equal(t, []string{uploadID}, completeIDs, "complete hook should fire on commit")
+	assert.NoError(t, completeErr)
+}
+
+func TestLayerWriterTruncate(t *testing.T) {
+	const layerData = "layer"
+	layerDigest := digest.FromString(layerData)
+	var (
+		lock          sync.Mutex
+		initiateCount int
+		parts         = map[string]string{}
+		completedID   string
+	)
+	client := &fakeECRClient{
+		InitiateLayerUploadFn: func(*ecr.InitiateLayerUploadInput) (*ecr.InitiateLayerUploadOutput, error) {
+			initiateCount++
+			return &ecr.InitiateLayerUploadOutput{
+				UploadId: aws.String(fmt.Sprintf("upload-%d", initiateCount)),
+				PartSize: aws.Int64(10),
+			}, nil
+		},
+		UploadLayerPartFn: func(_ aws.Context, input *ecr.UploadLayerPartInput, _ ...request.Option) (*ecr.UploadLayerPartOutput, error) {
+			lock.Lock()
+			defer lock.Unlock()
+			parts[aws.StringValue(input.UploadId)] += string(input.LayerPartBlob)
+			return &ecr.UploadLayerPartOutput{}, nil
+		},
+		CompleteLayerUploadFn: func(input *ecr.CompleteLayerUploadInput) (*ecr.CompleteLayerUploadOutput, error) {
+			completedID = aws.StringValue(input.UploadId)
+			return &ecr.CompleteLayerUploadOutput{
+				LayerDigest: aws.String(layerDigest.String()),
+			}, nil
+		},
+	}
+
+	tracker := docker.NewInMemoryTracker()
+	refKey := "refKey"
+	tracker.SetStatus(refKey, docker.Status{})
+
+	lw, err := newLayerWriter(&ecrBase{client: client}, tracker, refKey, ocispec.Descriptor{Digest: layerDigest}, withPartVerification())
+	require.NoError(t, err)
+	_, err = lw.Write([]byte("partial"))
+	require.NoError(t, err)
+
+	err = lw.Truncate(1)
+	assert.True(t, errdefs.IsNotImplemented(err), "non-zero truncate should not be supported")
+	require.NoError(t, lw.Truncate(0))
+	assert.Equal(t, 2, initiateCount, "truncate should initiate a new upload")
+
+	_, err = lw.Write([]byte(layerData))
+	require.NoError(t, err)
+	require.NoError(t, lw.Commit(context.Background(), int64(len(layerData)), layerDigest))
+	assert.Equal(t, "upload-2", completedID)
+	assert.Equal(t, layerData, parts["upload-2"])
+}
+
+func TestLayerWriterTruncateRejected(t *testing.T) {
+	layerDigest := digest.FromString("layer")
+	newWriter := func(t *testing.T, initiateErr *error) *layerWriter {
+		client := &fakeECRClient{
+			InitiateLayerUploadFn: func(*ecr.InitiateLayerUploadInput) (*ecr.InitiateLayerUploadOutput, error) {
+				if *initiateErr != nil {
+					return nil, *initiateErr
+				}
+				return &ecr.InitiateLayerUploadOutput{
+					UploadId: aws.String("upload"),
+					PartSize: aws.Int64(10),
+				}, nil
+			},
+			UploadLayerPartFn: func(aws.Context, *ecr.UploadLayerPartInput, ...request.Option) (*ecr.UploadLayerPartOutput, error) {
+				return &ecr.UploadLayerPartOutput{}, nil
+			},
+			CompleteLayerUploadFn: func(*ecr.CompleteLayerUploadInput) (*ecr.CompleteLayerUploadOutput, error) {
+				return &ecr.CompleteLayerUploadOutput{LayerDigest: aws.String(layerDigest.String())}, nil
+			},
+		}
+		tracker := docker.NewInMemoryTracker()
+		tracker.SetStatus("refKey", docker.Status{})
+		lw, err := newLayerWriter(&ecrBase{client: client}, tracker, "refKey", ocispec.Descriptor{Digest: layerDigest})
+		require.NoError(t, err)
+		return lw.(*layerWriter)
+	}
+
+	t.Run("closed", func(t *testing.T) {
+		var initiateErr error
+		lw := newWriter(t, &initiateErr)
+		require.NoError(t, lw.Close())
+		err := lw.Truncate(0)
+		assert.ErrorIs(t, err, errUploadClosed)
+	})
+
+	t.Run("committed", func(t *testing.T) {
+		var initiateErr error
+		lw := newWriter(t, &initiateErr)
+		_, err := lw.Write([]byte("layer"))
+		require.NoError(t, err)
+		require.NoError(t, lw.Commit(context.Background(), 5, layerDigest))
+		err = lw.Truncate(0)
+		assert.True(t, errdefs.IsFailedPrecondition(err), "expected failed precondition: %v", err)
+	})
+
+	t.Run("initiate failure", func(t *testing.T) {
+		var initiateErr error
+		lw := newWriter(t, &initiateErr)
+		initiateErr = errors.New("initiate failed")
+		assert.ErrorIs(t, lw.Truncate(0), initiateErr)
+
+		_, err := lw.Write([]byte("layer"))
+		assert.ErrorIs(t, err, errUploadClosed)
+		err = lw.Commit(context.Background(), 5, layerDigest)
+		assert.ErrorIs(t, err, errUploadClosed)
+		assert.NoError(t, lw.Close())
+		select {
+		case _, ok := <-lw.err:
+			assert.False(t, ok, "the failed session's error channel should be closed")
+		case <-time.After(time.Second):
+			t.Fatal("the failed session's error channel was not closed")
+		}
+	})
+}
+
+func TestLayerWriterUploadStallTimeout(t *testing.T) {
+	const layerData = "layer"
+	layerDigest := digest.FromString(layerData)
+	uploadLayerPartCount := 0
+	client := &fakeECRClient{
+		InitiateLayerUploadFn: func(*ecr.InitiateLayerUploadInput) (*ecr.InitiateLayerUploadOutput, error) {
+			return &ecr.InitiateLayerUploadOutput{
+				UploadId: aws.String("upload"),
+				PartSize: aws.Int64(10),
+			}, nil
+		},
+		UploadLayerPartFn: func(aws.Context, *ecr.UploadLayerPartInput, ...request.Option) (*ecr.UploadLayerPartOutput, error) {
+			uploadLayerPartCount++
+			return &ecr.UploadLayerPartOutput{}, nil
+		},
+		CompleteLayerUploadFn: func(*ecr.CompleteLayerUploadInput) (*ecr.CompleteLayerUploadOutput, error) {
+			t.Error("stalled upload should not be completed")
+			return nil, errors.New("unexpected")
+		},
+	}
+
+	tracker := docker.NewInMemoryTracker()
+	refKey := "refKey"
+	tracker.SetStatus(refKey, docker.Status{})
+
+	lw, err := newLayerWriter(&ecrBase{client: client}, tracker, refKey, ocispec.Descriptor{Digest: layerDigest},
+		withUploadStallTimeout(10*time.Millisecond))
+	require.NoError(t, err)
+
+	_, err = lw.Write([]byte(layerData[:2]))
+	require.NoError(t, err)
+
+	// Stop writing, the upload should fail once the timeout elapses.
+	time.Sleep(100 * time.Millisecond)
+
+	err = lw.Commit(context.Background(), int64(len(layerData)), layerDigest)
+	assert.ErrorContains(t, err, "stalled")
+	assert.Equal(t, 0, uploadLayerPartCount)
+}
+
+func TestLayerWriterMinUploadPartSize(t *testing.T) {
+	const layerData = "layer data"
+	layerDigest := digest.FromString(layerData)
+
+	for _, tc := range []struct {
+		name  string
+		opts  []layerWriterOption
+		parts []string
+	}{
+		{name: "default", parts: strings.Split(layerData, "")},
+		{name: "floor", opts: []layerWriterOption{withMinUploadPartSize(4)}, parts: []string{"laye", "r da", "ta"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var parts []string
+			client := &fakeECRClient{
+				InitiateLayerUploadFn: func(*ecr.InitiateLayerUploadInput) (*ecr.InitiateLayerUploadOutput, error) {
+					return &ecr.InitiateLayerUploadOutput{
+						UploadId: aws.String("upload"),
+						PartSize: aws.Int64(1),
+					}, nil
+				},
+				UploadLayerPartFn: func(_ aws.Context, input *ecr.UploadLayerPartInput, _ ...request.Option) (*ecr.UploadLayerPartOutput, error) {
+					parts = append(parts, string(input.LayerPartBlob))
+					return &ecr.UploadLayerPartOutput{}, nil
+				},
+				CompleteLayerUploadFn: func(*ecr.CompleteLayerUploadInput) (*ecr.CompleteLayerUploadOutput, error) {
+					return &ecr.CompleteLayerUploadOutput{
+						LayerDigest: aws.String(layerDigest.String()),
+					}, nil
+				},
+			}
+
+			tracker := docker.NewInMemoryTracker()
+			refKey := "refKey"
+			tracker.SetStatus(refKey, docker.Status{})
+
+			lw, err := newLayerWriter(&ecrBase{client: client}, tracker, refKey, ocispec.Descriptor{Digest: layerDigest}, tc.opts...)
+			require.NoError(t, err)
+			_, err = lw.Write([]byte(layerData))
+			require.NoError(t, err)
+			require.NoError(t, lw.Commit(context.Background(), int64(len(layerData)), layerDigest))
+			assert.Equal(t, tc.parts, parts)
+		})
+	}
+}
+
+func TestLayerWriterPartVerification(t *testing.T) {
+	const layerData = "layer data"
+	layerDesc := ocispec.Descriptor{
+		Digest: digest.FromString(layerData),
+		Size:   int64(len(layerData)),
+	}
+
+	for _, tc := range []struct {
+		name      string
+		data      string
+		parts     []string
+		completed bool
+	}{
+		{name: "valid", data: layerData, parts: []string{"laye", "r da", "ta"}, completed: true},
+		{name: "corrupt", data: "layer dat!", parts: []string{"laye", "r da"}},
+		{name: "truncated", data: "layer", parts: []string{"laye", "r"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var parts []string
+			completed := false
+			client := &fakeECRClient{
+				InitiateLayerUploadFn: func(*ecr.InitiateLayerUploadInput) (*ecr.InitiateLayerUploadOutput, error) {
+					return &ecr.InitiateLayerUploadOutput{
+						UploadId: aws.String("upload"),
+						PartSize: aws.Int64(4),
+					}, nil
+				},
+				UploadLayerPartFn: func(_ aws.Context, input *ecr.UploadLayerPartInput, _ ...request.Option) (*ecr.UploadLayerPartOutput, error) {
+					parts = append(parts, string(input.LayerPartBlob))
+					return &ecr.UploadLayerPartOutput{}, nil
+				},
+				CompleteLayerUploadFn: func(*ecr.CompleteLayerUploadInput) (*ecr.CompleteLayerUploadOutput, error) {
+					completed = true
+					return &ecr.CompleteLayerUploadOutput{
+						LayerDigest: aws.String(layerDesc.Digest.String()),
+					}, nil
+				},
+			}
+
+			tracker := docker.NewInMemoryTracker()
+			refKey := "refKey"
+			tracker.SetStatus(refKey, docker.Status{})
+
+			lw, err := newLayerWriter(&ecrBase{client: client}, tracker, refKey, layerDesc, withPartVerification())
+			require.NoError(t, err)
+			// A failed verification may fail the write itself.
+			_, writeErr := lw.Write([]byte(tc.data))
+			err = lw.Commit(context.Background(), layerDesc.Size, layerDesc.Digest)
+			if tc.completed {
+				assert.NoError(t, writeErr)
+				assert.NoError(t, err)
+			} else {
+				assert.True(t, errdefs.IsFailedPrecondition(err), "expected integrity failure, got %v", err)
+				assert.ErrorContains(t, err, "does not match expected digest")
+			}
+			assert.Equal(t, tc.parts, parts)
+			assert.Equal(t, tc.completed, completed)
+		})
+	}
+}
+
+func TestLayerWriterPartTooSmall(t *testing.T) {
+	const layerData = "layer data"
+	layerDigest := digest.FromString(layerData)
+	partTooSmall := awserr.New(ecr.ErrCodeLayerPartTooSmallException, "Layer part size must be at least 5242880 bytes", nil)
+
+	client := &fakeECRClient{
+		InitiateLayerUploadFn: func(*ecr.InitiateLayerUploadInput) (*ecr.InitiateLayerUploadOutput, error) {
+			return &ecr.InitiateLayerUploadOutput{
+				UploadId: aws.String("upload"),
+				PartSize: aws.Int64(4),
+			}, nil
+		},
+		UploadLayerPartFn: func(aws.Context, *ecr.UploadLayerPartInput, ...request.Option) (*ecr.UploadLayerPartOutput, error) {
+			return nil, partTooSmall
+		},
+		CompleteLayerUploadFn: func(*ecr.CompleteLayerUploadInput) (*ecr.CompleteLayerUploadOutput, error) {
+			t.Error("upload should not be completed")
+			return nil, errors.New("unexpected CompleteLayerUpload")
+		},
+	}
+
+	tracker := docker.NewInMemoryTracker()
+	refKey := "refKey"
+	tracker.SetStatus(refKey, docker.Status{})
+
+	lw, err := newLayerWriter(&ecrBase{client: client}, tracker, refKey, ocispec.Descriptor{Digest: layerDigest})
+	require.NoError(t, err)
+	lw.Write([]byte(layerData))
+	err = lw.Commit(context.Background(), int64(len(layerData)), layerDigest)
+	assert.ErrorIs(t, err, ErrLayerPartTooSmall)
+	assert.ErrorIs(t, err, partTooSmall, "the ECR error should be preserved")
+	assert.ErrorContains(t, err, "part 0 of layer "+layerDigest.String()+" with 4 bytes, using part size 4")
+}
+
+func TestLayerWriterUploadRetries(t *testing.T) {
+	const layerData = "layer data"
+	layerDigest := digest.FromString(layerData)
+
+	_, err := NewResolver(WithSession(unit.Session), WithLayerUploadRetries(-1, time.Millisecond))
+	assert.Error(t, err)
+
+	serverError := awserr.NewRequestFailure(awserr.New("ServerException", "internal error", nil), http.StatusInternalServerError, "request")
+	invalidError := awserr.NewRequestFailure(awserr.New(ecr.ErrCodeInvalidParameterException, "invalid", nil), http.StatusBadRequest, "request")
+	for _, tc := range []struct {
+		name     string
+		failures []error
+		attempts int
+		err      error
+	}{
+		{name: "transient", failures: []error{serverError, serverError}, attempts: 3},
+		{name: "exhausted", failures: []error{serverError, serverError, serverError}, attempts: 3, err: serverError},
+		{name: "not retryable", failures: []error{invalidError}, attempts: 1, err: invalidError},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			attempts := 0
+			client := &fakeECRClient{
+				BatchCheckLayerAvailabilityFn: func(aws.Context, *ecr.BatchCheckLayerAvailabilityInput, ...request.Option) (*ecr.BatchCheckLayerAvailabilityOutput, error) {
+					return &ecr.BatchCheckLayerAvailabilityOutput{
+						Layers: []*ecr.Layer{{LayerAvailability: aws.String(ecr.LayerAvailabilityUnavailable)}},
+					}, nil
+				},
+				InitiateLayerUploadFn: func(*ecr.InitiateLayerUploadInput) (*ecr.InitiateLayerUploadOutput, error) {
+					return &ecr.InitiateLayerUploadOutput{
+						UploadId: aws.String("upload"),
+						PartSize: aws.Int64(int64(len(layerData))),
+					}, nil
+				},
+				UploadLayerPartFn: func(_ aws.Context, input *ecr.UploadLayerPartInput, opts ...request.Option) (*ecr.UploadLayerPartOutput, error) {
+					attempts++
+					assert.Equal(t, layerData, string(input.LayerPartBlob))
+					assert.True(t, requestOptionsDisableRetries(opts), "the SDK should not retry parts retried by the writer")
+					if attempts <= len(tc.failures) {
+						return nil, tc.failures[attempts-1]
+					}
+					return &ecr.UploadLayerPartOutput{}, nil
+				},
+				CompleteLayerUploadFn: func(*ecr.CompleteLayerUploadInput) (*ecr.CompleteLayerUploadOutput, error) {
+					return &ecr.CompleteLayerUploadOutput{
+						LayerDigest: aws.String(layerDigest.String()),
+					}, nil
+				},
+			}
+
+			resolver, err := NewResolver(WithSession(unit.Session), WithLayerUploadRetries(2, time.Millisecond))
+			require.NoError(t, err)
+			resolver.(*ecrResolver).clients["fake"] = client
+			pusher, err := resolver.Pusher(context.Background(), "ecr.aws/arn:aws:ecr:fake:123456789012:repository/foo/bar:latest@"+testdata.ImageDigest.String())
+			require.NoError(t, err)
+			lw, err := pusher.Push(context.Background(), ocispec.Descriptor{
+				MediaType: ocispec.MediaTypeImageLayerGzip,
+				Digest:    layerDigest,
+				Size:      int64(len(layerData)),
+			})
+			require.NoError(t, err)
+			lw.Write([]byte(layerData))
+			err = lw.Commit(context.Background(), int64(len(layerData)), layerDigest)
+			if tc.err == nil {
+				assert.NoError(t, err)
+			} else {
+				assert.ErrorIs(t, err, tc.err)
+			}
+			assert.Equal(t, tc.attempts, attempts)
+		})
+	}
+}
@@ -0,0 +1,111 @@
+/*
+ * Copyright 2017-2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You
+ * may not use this file except in compliance with the License. A copy of
+ * the License is located at
+ *
+ * 	http://aws.amazon.com/apache2.0/
+ *
+ * or in the "license" file accompanying this file. This file is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF
+ * ANY KIND, either express or implied. See the License for the specific
+ * language governing permissions and limitations under the License.
+ */
+
+package ecr
+
+import (
+	"sync"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+)
+
+const (
+	// manifestCacheTTL is how long a manifest retrieved by Resolve is reused
+	// by fetches of the same manifest.  It only needs to cover the fetch that
+	// usually follows the resolution of a reference.
+	manifestCacheTTL = 30 * time.Second
+	// manifestCacheSize bounds the number of manifests held by a resolver.
+	manifestCacheSize = 64
+)
+
+// manifestCache holds the manifests retrieved by Resolve for a short time, so
+// that the manifest fetch that follows resolving a reference is served without
+// retrieving the image from ECR again.
+type manifestCache struct {
+	ttl     time.Duration
+	size    int
+	now     func() time.Time
+	lock    sync.Mutex
+	entries map[string]manifestEntry
+}
+
+type manifestEntry struct {
+	mediaType string
+	body      string
+	expires   time.Time
+}
+
+func newManifestCache(ttl time.Duration, size int) *manifestCache {
+	return &manifestCache{
+		ttl:     ttl,
+		size:    size,
+		now:     time.Now,
+		entries: map[string]manifestEntry{},
+	}
+}
+
+// manifestCacheKey identifies the manifest with dgst in the repository arn.
+func manifestCacheKey(arn string, dgst digest.Digest) (string, error) {
+	normalized, err := normalizeDigest(dgst)
+	if err != nil {
+		return "", err
+	}
+	return arn + "@" + normalized.String(), nil
+}
+
+// get returns the unexpired manifest cached for key.  ECR converts manifests
+// between media types, so only a manifest of the requested mediaType is
+// returned; an empty mediaType matches any manifest.
+func (c *manifestCache) get(key, mediaType string) (string, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	entry, ok := c.entries[key]
+	if !ok {
+		return "", false
+	}
+	if !c.now().Before(entry.expires) {
+		delete(c.entries, key)
+		return "", false
+	}
+	if mediaType != "" && mediaType != entry.mediaType {
+		return "", false
+	}
+	return entry.body, true
+}
+
+// put caches the manifest body of mediaType for key.  Expired entries are
+// dropped first and, when the cache is still full, the entry closest to
+// expiring is evicted.
+func (c *manifestCache) put(key, mediaType, body string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	now := c.now()
+	for k, entry := range c.entries {
+		if !now.Before(entry.expires) {
+			delete(c.entries, k)
+		}
+	}
+	if _, ok := c.entries[key]; !ok && len(c.entries) >= c.size {
+		var oldest string
+		for k, entry := range c.entries {
+			if oldest == "" || entry.expires.Before(c.entries[oldest].expires) {
+				oldest = k
+			}
+		}
+		delete(c.entries, oldest)
+	}
+	c.entries[key] = manifestEntry{mediaType: mediaType, body: body, expires: now.Add(c.ttl)}
+}
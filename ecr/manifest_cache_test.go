@@ -0,0 +1,113 @@
+/*
+ * Copyright 2017-2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You
+ * may not use this file except in compliance with the License. A copy of
+ * the License is located at
+ *
+ * 	http://aws.amazon.com/apache2.0/
+ *
+ * or in the "license" file accompanying this file. This file is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF
+ * ANY KIND, either express or implied. See the License for the specific
+ * language governing permissions and limitations under the License.
+ */
+
+package ecr
+
+import (
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/awstesting/unit"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestManifestCacheExpiry(t *testing.T) {
+	now := time.Now()
+	cache := newManifestCache(time.Minute, 2)
+	cache.now = func() time.Time { return now }
+
+	cache.put("key", ocispec.MediaTypeImageManifest, "manifest")
+	body, ok := cache.get("key", ocispec.MediaTypeImageManifest)
+	assert.True(t, ok)
+	assert.Equal(t, "manifest", body)
+	_, ok = cache.get("key", ocispec.MediaTypeImageIndex)
+	assert.False(t, ok, "manifest of another mediaType should not be returned")
+
+	now = now.Add(time.Minute)
+	_, ok = cache.get("key", "")
+	assert.False(t, ok, "expired manifest should not be returned")
+	assert.Empty(t, cache.entries)
+}
+
+func TestManifestCacheSize(t *testing.T) {
+	now := time.Now()
+	cache := newManifestCache(time.Minute, 2)
+	cache.now = func() time.Time { return now }
+
+	for _, key := range []string{"first", "second", "third"} {
+		cache.put(key, ocispec.MediaTypeImageManifest, key)
+		now = now.Add(time.Second)
+	}
+	assert.Len(t, cache.entries, 2)
+	_, ok := cache.get("first", "")
+	assert.False(t, ok, "oldest manifest should be evicted")
+	_, ok = cache.get("third", "")
+	assert.True(t, ok)
+}
+
+func TestResolveFetchManifestCached(t *testing.T) {
+	const manifest = `{"schemaVersion":2,"mediaType":"application/vnd.oci.image.manifest.v1+json"}`
+	manifestDigest := digest.FromString(manifest)
+
+	var batchGetImageCount int
+	fakeClient := &fakeECRClient{
+		BatchGetImageFn: func(_ aws.Context, input *ecr.BatchGetImageInput, _ ...request.Option) (*ecr.BatchGetImageOutput, error) {
+			batchGetImageCount++
+			return &ecr.BatchGetImageOutput{Images: []*ecr.Image{{
+				ImageId:                &ecr.ImageIdentifier{ImageDigest: aws.String(manifestDigest.String())},
+				ImageManifest:          aws.String(manifest),
+				ImageManifestMediaType: aws.String(ocispec.MediaTypeImageManifest),
+			}}}, nil
+		},
+	}
+	resolver := &ecrResolver{
+		clients: map[string]ecrAPI{
+			"fake": fakeClient,
+		},
+		manifests: newManifestCache(manifestCacheTTL, manifestCacheSize),
+	}
+	ref := "ecr.aws/arn:aws:ecr:fake:123456789012:repository/foo/bar:latest"
+
+	_, desc, err := resolver.Resolve(context.Background(), ref)
+	require.NoError(t, err)
+	fetcher, err := resolver.Fetcher(context.Background(), ref)
+	require.NoError(t, err)
+	rc, err := fetcher.Fetch(context.Background(), desc)
+	require.NoError(t, err)
+	body, err := io.ReadAll(rc)
+	rc.Close()
+	require.NoError(t, err)
+
+	assert.Equal(t, manifest, string(body))
+	assert.Equal(t, 1, batchGetImageCount, "manifest fetch should reuse the resolved manifest")
+}
+
+func TestWithNoManifestCache(t *testing.T) {
+	resolver, err := NewResolver(WithSession(unit.Session))
+	require.NoError(t, err)
+	assert.NotNil(t, resolver.(*ecrResolver).manifests, "manifests should be cached by default")
+
+	resolver, err = NewResolver(WithSession(unit.Session), WithNoManifestCache())
+	require.NoError(t, err)
+	assert.Nil(t, resolver.(*ecrResolver).manifests)
+}
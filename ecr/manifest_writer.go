@@ -18,17 +18,23 @@ package ecr
 import (
 	"bytes"
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"strings"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/service/ecr"
 	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/images"
 	"github.com/containerd/containerd/log"
 	"github.com/containerd/containerd/remotes/docker"
 	"github.com/opencontainers/go-digest"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"golang.org/x/sync/semaphore"
 )
 
 type manifestWriter struct {
@@ -38,17 +44,49 @@ type manifestWriter struct {
 	buf     bytes.Buffer
 	tracker docker.StatusTracker
 	ref     string
+	// putLimiter, when set, bounds concurrent PutImage requests; the writer
+	// holds putWeight of it while putting the manifest.
+	putLimiter *semaphore.Weighted
+	putWeight  int64
+	// verifyLayers checks that the layers referenced by an image manifest
+	// are present before it is put.
+	verifyLayers bool
+	// maxSize, when set, is the largest manifest the writer will put.
+	maxSize int64
+	// extraTags are applied to the image's root manifest once it is put.
+	extraTags []string
+	// progress, when set, is called once the manifest is put.
+	progress func(ref string, desc ocispec.Descriptor, uploaded, total int64)
+	// committed and closed record whether Commit and Close have been called.
+	committed bool
+	closed    bool
 }
 
+// errManifestClosed fails writes and commits of a manifest whose writer is
+// closed without being committed.
+var errManifestClosed = errors.New("ecr: manifest writer closed without commit")
+
 var _ content.Writer = (*manifestWriter)(nil)
 
 func (mw *manifestWriter) Write(b []byte) (int, error) {
 	log.G(mw.ctx).WithField("len(b)", len(b)).Debug("ecr.manifest.write")
+	if mw.closed {
+		return 0, errManifestClosed
+	}
 	return mw.buf.Write(b)
 }
 
+// Close releases the writer.  Closing a committed writer does nothing.
+// Closing a writer that has not been committed aborts the push of the
+// manifest, discarding the content written without putting it.
 func (mw *manifestWriter) Close() error {
-	return errors.New("ecr.manifest.close: not implemented")
+	if mw.committed || mw.closed {
+		return nil
+	}
+	log.G(mw.ctx).Debug("ecr.manifest.close: aborting push")
+	mw.closed = true
+	mw.buf.Reset()
+	return nil
 }
 
 func (mw *manifestWriter) Digest() digest.Digest {
@@ -56,6 +94,10 @@ func (mw *manifestWriter) Digest() digest.Digest {
 }
 
 func (mw *manifestWriter) Commit(ctx context.Context, size int64, expected digest.Digest, opts ...content.Opt) error {
+	if mw.closed {
+		return fmt.Errorf("ecr: committing manifest %v: %w", mw.desc.Digest, errManifestClosed)
+	}
+	mw.committed = true
 	manifest := mw.buf.String()
 	ecrSpec := mw.base.ecrSpec
 
@@ -65,18 +107,40 @@ func (mw *manifestWriter) Commit(ctx context.Context, size int64, expected diges
 		WithField("expected", expected.String()).
 		Debug("ecr.manifest.commit")
 
+	if mw.maxSize > 0 && int64(len(manifest)) > mw.maxSize {
+		return fmt.Errorf("ecr: manifest %v size %d exceeds maximum push size %d: %w",
+			mw.desc.Digest, len(manifest), mw.maxSize, errdefs.ErrInvalidArgument)
+	}
+
 	putImageInput := &ecr.PutImageInput{
-		RegistryId:             aws.String(ecrSpec.Registry()),
-		RepositoryName:         aws.String(ecrSpec.Repository),
-		ImageManifest:          aws.String(manifest),
-		ImageManifestMediaType: aws.String(mw.desc.MediaType),
-		ImageDigest:            aws.String(expected.String()),
+		RegistryId:     aws.String(ecrSpec.Registry()),
+		RepositoryName: aws.String(ecrSpec.Repository),
+		ImageManifest:  aws.String(manifest),
+		ImageDigest:    aws.String(expected.String()),
+	}
+	// Descriptors pushed by hint may not carry a mediaType, infer it from the
+	// manifest when possible and otherwise defer to ECR.
+	mediaType := mw.desc.MediaType
+	if mediaType == "" {
+		if parsed, err := parseImageManifestMediaType(ctx, manifest); err == nil {
+			mediaType = parsed
+		}
+	}
+	if mediaType != "" {
+		putImageInput.ImageManifestMediaType = aws.String(mediaType)
+	}
+
+	if mw.verifyLayers {
+		if err := mw.checkLayers(ctx, mediaType, manifest); err != nil {
+			return err
+		}
 	}
 
 	// Tag only if this push is the image's root descriptor, as indicated by the
 	// parsed ECRSpec.
 	rootDigest := ecrSpec.Spec().Digest()
-	if mw.desc.Digest == rootDigest {
+	isRoot := mw.desc.Digest == rootDigest
+	if isRoot {
 		if tag, _ := ecrSpec.TagDigest(); tag != "" {
 			log.G(ctx).
 				WithField("tag", tag).
@@ -86,11 +150,14 @@ func (mw *manifestWriter) Commit(ctx context.Context, size int64, expected diges
 		}
 	}
 
-	output, err := mw.base.client.PutImageWithContext(ctx, putImageInput)
+	output, err := mw.putImage(ctx, putImageInput)
 	if err != nil {
 		return fmt.Errorf("ecr: failed to put manifest: %v: %w", ecrSpec, err)
 	}
 
+	if mw.progress != nil {
+		mw.progress(mw.ref, mw.desc, int64(len(manifest)), mw.desc.Size)
+	}
 	status, err := mw.tracker.GetStatus(mw.ref)
 	if err == nil {
 		status.Offset = int64(len(manifest))
@@ -102,20 +169,106 @@ func (mw *manifestWriter) Commit(ctx context.Context, size int64, expected diges
 	if output == nil {
 		return fmt.Errorf("ecr: failed to put manifest, nil output: %v", ecrSpec)
 	}
+	if output.Image == nil || output.Image.ImageId == nil {
+		return fmt.Errorf("ecr: failed to put manifest, missing image identifier in output: %v", ecrSpec)
+	}
 
 	actual := aws.StringValue(output.Image.ImageId.ImageDigest)
 	if actual != expected.String() {
 		return fmt.Errorf("digest mismatch: ECR returned %s, expected %s", actual, expected)
 	}
 
+	if isRoot && len(mw.extraTags) > 0 {
+		return mw.putExtraTags(ctx, putImageInput)
+	}
 	return nil
 }
 
+// putExtraTags puts the manifest of input again with each of the writer's
+// extra tags.  Every tag is attempted, and the tags that could not be applied
+// are reported together.
+func (mw *manifestWriter) putExtraTags(ctx context.Context, input *ecr.PutImageInput) error {
+	var errs []error
+	var failed []string
+	for _, tag := range mw.extraTags {
+		tagInput := *input
+		tagInput.ImageTag = aws.String(tag)
+		_, err := mw.putImage(ctx, &tagInput)
+		// ECR rejects a put of a tag that already refers to the manifest.
+		if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == ecr.ErrCodeImageAlreadyExistsException {
+			err = nil
+		}
+		if err != nil {
+			log.G(ctx).WithError(err).WithField("tag", tag).Warn("ecr.manifest.commit: failed to apply additional tag")
+			failed = append(failed, tag)
+			errs = append(errs, fmt.Errorf("tag %q: %w", tag, err))
+			continue
+		}
+		log.G(ctx).WithField("tag", tag).Debug("ecr.manifest.commit: additional tag set on push")
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("ecr: manifest %v pushed, but failed to apply additional tags %s: %w",
+			mw.desc.Digest, strings.Join(failed, ", "), errors.Join(errs...))
+	}
+	return nil
+}
+
+// checkLayers returns an error listing the config and layers referenced by an
+// image manifest that are not present in the repository.  Other kinds of
+// manifests are not checked.
+func (mw *manifestWriter) checkLayers(ctx context.Context, mediaType string, body string) error {
+	switch mediaType {
+	case ocispec.MediaTypeImageManifest, images.MediaTypeDockerSchema2Manifest:
+	default:
+		return nil
+	}
+	var manifest ocispec.Manifest
+	if err := json.Unmarshal([]byte(body), &manifest); err != nil {
+		return fmt.Errorf("failed to unmarshal manifest: %v: %w", err, ErrInvalidManifest)
+	}
+	digests := []digest.Digest{manifest.Config.Digest}
+	for _, layer := range manifest.Layers {
+		digests = append(digests, layer.Digest)
+	}
+	availability, err := mw.base.checkLayerAvailability(ctx, digests)
+	if err != nil {
+		return err
+	}
+	var missing []string
+	for _, dgst := range digests {
+		if !availability[dgst] {
+			missing = append(missing, dgst.String())
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("ecr: manifest %v references missing layers %s: %w", mw.desc.Digest, strings.Join(missing, ", "), errdefs.ErrFailedPrecondition)
+	}
+	return nil
+}
+
+func (mw *manifestWriter) putImage(ctx context.Context, input *ecr.PutImageInput) (*ecr.PutImageOutput, error) {
+	if mw.putLimiter != nil {
+		if err := mw.putLimiter.Acquire(ctx, mw.putWeight); err != nil {
+			return nil, err
+		}
+		defer mw.putLimiter.Release(mw.putWeight)
+	}
+	ctx, span := startSpan(ctx, mw.base.tracer, mw.base.ecrSpec, "ecr.PutImage", digestAttribute.String(mw.desc.Digest.String()))
+	output, err := mw.base.client.PutImageWithContext(ctx, input)
+	endSpan(span, err)
+	return output, err
+}
+
 func (mw *manifestWriter) Status() (content.Status, error) {
 	log.G(mw.ctx).Debug("ecr.manifest.status")
 
 	status, err := mw.tracker.GetStatus(mw.ref)
 	if err != nil {
+		if errdefs.IsNotFound(err) {
+			// The tracker may discard statuses, report the write as not
+			// started rather than failing it.
+			return content.Status{Ref: mw.ref}, nil
+		}
 		return content.Status{}, err
 	}
 	return status.Status, nil
@@ -17,15 +17,21 @@ package ecr
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"testing"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/arn"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/awstesting/unit"
 	"github.com/aws/aws-sdk-go/service/ecr"
 	"github.com/awslabs/amazon-ecr-containerd-resolver/ecr/internal/testdata"
+	"github.com/containerd/containerd/errdefs"
 	"github.com/containerd/containerd/remotes"
 	"github.com/containerd/containerd/remotes/docker"
+	"github.com/opencontainers/go-digest"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -114,6 +120,57 @@ func TestManifestWriterCommit(t *testing.T) {
 	assert.Equal(t, 1, callCount, "PutImage should be called once")
 }
 
+func TestManifestWriterCommitAdditionalTags(t *testing.T) {
+	const manifestContent = "manifest content"
+	imageDigest := digest.FromString(manifestContent)
+	errFailed := errors.New("expected")
+	var tags []string
+	client := &fakeECRClient{
+		PutImageFn: func(_ aws.Context, input *ecr.PutImageInput, _ ...request.Option) (*ecr.PutImageOutput, error) {
+			tag := aws.StringValue(input.ImageTag)
+			tags = append(tags, tag)
+			assert.Equal(t, manifestContent, aws.StringValue(input.ImageManifest))
+			switch tag {
+			case "existing":
+				return nil, awserr.New(ecr.ErrCodeImageAlreadyExistsException, "tag exists", nil)
+			case "failing":
+				return nil, errFailed
+			}
+			return &ecr.PutImageOutput{
+				Image: &ecr.Image{
+					ImageId: &ecr.ImageIdentifier{
+						ImageTag:    input.ImageTag,
+						ImageDigest: aws.String(imageDigest.String()),
+					},
+				},
+			}, nil
+		},
+	}
+	client.BatchGetImageFn = func(aws.Context, *ecr.BatchGetImageInput, ...request.Option) (*ecr.BatchGetImageOutput, error) {
+		return &ecr.BatchGetImageOutput{
+			Failures: []*ecr.ImageFailure{
+				{FailureCode: aws.String(ecr.ImageFailureCodeImageNotFound)},
+			},
+		}, nil
+	}
+	_, err := NewResolver(WithSession(unit.Session), WithAdditionalTags([]string{""}))
+	assert.Error(t, err)
+	pusher := newResolverPusher(t, client, imageDigest, WithAdditionalTags([]string{"v1.0", "existing", "failing"}))
+	mw, err := pusher.Push(context.Background(), ocispec.Descriptor{
+		Digest:    imageDigest,
+		MediaType: ocispec.MediaTypeImageManifest,
+	})
+	require.NoError(t, err)
+
+	_, err = mw.Write([]byte(manifestContent))
+	require.NoError(t, err)
+	err = mw.Commit(context.Background(), int64(len(manifestContent)), imageDigest)
+	assert.Equal(t, []string{"latest", "v1.0", "existing", "failing"}, tags)
+	assert.ErrorIs(t, err, errFailed)
+	assert.Contains(t, err.Error(), `"failing"`)
+	assert.NotContains(t, err.Error(), `"v1.0"`)
+}
+
 func TestManifestWriterNoTagCommit(t *testing.T) {
 	const (
 		registry   = "registry"
@@ -199,3 +256,205 @@ func TestManifestWriterNoTagCommit(t *testing.T) {
 	require.NoError(t, err, "failed to commit")
 	assert.Equal(t, 1, callCount, "PutImage should be called once")
 }
+
+func TestManifestWriterCommitMissingImage(t *testing.T) {
+	imageDesc := ocispec.Descriptor{
+		Digest:    testdata.InsignificantDigest,
+		MediaType: ocispec.MediaTypeImageManifest,
+	}
+
+	for _, tc := range []struct {
+		name   string
+		output *ecr.PutImageOutput
+	}{
+		{name: "nil Image", output: &ecr.PutImageOutput{}},
+		{name: "nil ImageId", output: &ecr.PutImageOutput{Image: &ecr.Image{}}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			client := &fakeECRClient{
+				PutImageFn: func(aws.Context, *ecr.PutImageInput, ...request.Option) (*ecr.PutImageOutput, error) {
+					return tc.output, nil
+				},
+			}
+			mw := &manifestWriter{
+				desc: imageDesc,
+				base: &ecrBase{
+					client: client,
+					ecrSpec: ECRSpec{
+						arn: arn.ARN{
+							AccountID: "registry",
+						},
+						Repository: "repository",
+					},
+				},
+				tracker: docker.NewInMemoryTracker(),
+				ref:     "refKey",
+				ctx:     context.Background(),
+			}
+
+			var err error
+			require.NotPanics(t, func() {
+				err = mw.Commit(context.Background(), 0, imageDesc.Digest)
+			})
+			assert.ErrorContains(t, err, "missing image identifier")
+		})
+	}
+}
+
+func TestManifestWriterCommitVerifyLayers(t *testing.T) {
+	configDigest := digest.FromString("config")
+	presentLayer := digest.FromString("present")
+	missingLayer := digest.FromString("missing")
+	manifest, err := json.Marshal(ocispec.Manifest{
+		MediaType: ocispec.MediaTypeImageManifest,
+		Config:    ocispec.Descriptor{MediaType: ocispec.MediaTypeImageConfig, Digest: configDigest},
+		Layers: []ocispec.Descriptor{
+			{MediaType: ocispec.MediaTypeImageLayerGzip, Digest: presentLayer},
+			{MediaType: ocispec.MediaTypeImageLayerGzip, Digest: missingLayer},
+		},
+	})
+	require.NoError(t, err)
+	imageDesc := ocispec.Descriptor{
+		Digest:    digest.FromBytes(manifest),
+		MediaType: ocispec.MediaTypeImageManifest,
+	}
+
+	putCount := 0
+	client := &fakeECRClient{
+		BatchCheckLayerAvailabilityFn: func(_ aws.Context, input *ecr.BatchCheckLayerAvailabilityInput, _ ...request.Option) (*ecr.BatchCheckLayerAvailabilityOutput, error) {
+			assert.ElementsMatch(t,
+				[]string{configDigest.String(), presentLayer.String(), missingLayer.String()},
+				aws.StringValueSlice(input.LayerDigests))
+			return &ecr.BatchCheckLayerAvailabilityOutput{
+				Layers: []*ecr.Layer{
+					{LayerDigest: aws.String(configDigest.String()), LayerAvailability: aws.String(ecr.LayerAvailabilityAvailable)},
+					{LayerDigest: aws.String(presentLayer.String()), LayerAvailability: aws.String(ecr.LayerAvailabilityAvailable)},
+				},
+				Failures: []*ecr.LayerFailure{
+					{LayerDigest: aws.String(missingLayer.String()), FailureCode: aws.String(ecr.LayerFailureCodeMissingLayerDigest)},
+				},
+			}, nil
+		},
+		PutImageFn: func(aws.Context, *ecr.PutImageInput, ...request.Option) (*ecr.PutImageOutput, error) {
+			putCount++
+			return nil, errors.New("unexpected PutImage")
+		},
+	}
+	mw := &manifestWriter{
+		desc: imageDesc,
+		base: &ecrBase{
+			client: client,
+			ecrSpec: ECRSpec{
+				arn: arn.ARN{
+					AccountID: "registry",
+				},
+				Repository: "repository",
+			},
+		},
+		tracker:      docker.NewInMemoryTracker(),
+		ref:          "refKey",
+		ctx:          context.Background(),
+		verifyLayers: true,
+	}
+	_, err = mw.Write(manifest)
+	require.NoError(t, err)
+
+	err = mw.Commit(context.Background(), int64(len(manifest)), imageDesc.Digest)
+	assert.True(t, errdefs.IsFailedPrecondition(err), "expected missing layers error, got %v", err)
+	assert.ErrorContains(t, err, missingLayer.String())
+	assert.NotContains(t, err.Error(), presentLayer.String())
+	assert.Equal(t, 0, putCount, "manifest should not be put")
+}
+
+func TestManifestWriterCommitMaxSize(t *testing.T) {
+	manifest := `{"schemaVersion":2,"mediaType":"` + ocispec.MediaTypeImageManifest + `","layers":[]}`
+	imageDesc := ocispec.Descriptor{
+		Digest:    digest.FromString(manifest),
+		MediaType: ocispec.MediaTypeImageManifest,
+	}
+
+	putCount := 0
+	_, err := NewResolver(WithSession(unit.Session), WithMaxPushManifestSize(-1))
+	assert.Error(t, err)
+	resolver, err := NewResolver(WithSession(unit.Session), WithMaxPushManifestSize(int64(len(manifest)-1)))
+	require.NoError(t, err)
+	resolver.(*ecrResolver).clients["fake"] = &fakeECRClient{
+		BatchGetImageFn: func(aws.Context, *ecr.BatchGetImageInput, ...request.Option) (*ecr.BatchGetImageOutput, error) {
+			return &ecr.BatchGetImageOutput{
+				Failures: []*ecr.ImageFailure{
+					{FailureCode: aws.String(ecr.ImageFailureCodeImageNotFound)},
+				},
+			}, nil
+		},
+		PutImageFn: func(aws.Context, *ecr.PutImageInput, ...request.Option) (*ecr.PutImageOutput, error) {
+			putCount++
+			return nil, errors.New("unexpected PutImage")
+		},
+	}
+	pusher, err := resolver.Pusher(context.Background(), "ecr.aws/arn:aws:ecr:fake:123456789012:repository/foo/bar:latest@"+imageDesc.Digest.String())
+	require.NoError(t, err)
+	mw, err := pusher.Push(context.Background(), imageDesc)
+	require.NoError(t, err)
+	_, err = mw.Write([]byte(manifest))
+	require.NoError(t, err)
+
+	err = mw.Commit(context.Background(), int64(len(manifest)), imageDesc.Digest)
+	assert.True(t, errdefs.IsInvalidArgument(err), "expected size limit error, got %v", err)
+	assert.ErrorContains(t, err, "exceeds maximum push size")
+	assert.Equal(t, 0, putCount, "manifest should not be put")
+}
+
+func TestManifestWriterClose(t *testing.T) {
+	manifest := `{"schemaVersion":2,"mediaType":"` + ocispec.MediaTypeImageManifest + `","layers":[]}`
+	imageDesc := ocispec.Descriptor{
+		Digest:    digest.FromString(manifest),
+		MediaType: ocispec.MediaTypeImageManifest,
+	}
+	putCount := 0
+	client := &fakeECRClient{
+		PutImageFn: func(_ aws.Context, input *ecr.PutImageInput, _ ...request.Option) (*ecr.PutImageOutput, error) {
+			putCount++
+			return &ecr.PutImageOutput{
+				Image: &ecr.Image{ImageId: &ecr.ImageIdentifier{ImageDigest: input.ImageDigest}},
+			}, nil
+		},
+	}
+	newWriter := func() *manifestWriter {
+		return &manifestWriter{
+			desc: imageDesc,
+			base: &ecrBase{
+				client: client,
+				ecrSpec: ECRSpec{
+					arn:        arn.ARN{AccountID: "registry"},
+					Repository: "repository",
+				},
+			},
+			tracker: docker.NewInMemoryTracker(),
+			ref:     "refKey",
+			ctx:     context.Background(),
+		}
+	}
+
+	t.Run("after commit", func(t *testing.T) {
+		mw := newWriter()
+		_, err := mw.Write([]byte(manifest))
+		require.NoError(t, err)
+		require.NoError(t, mw.Commit(context.Background(), int64(len(manifest)), imageDesc.Digest))
+		assert.NoError(t, mw.Close())
+		assert.NoError(t, mw.Close())
+		assert.Equal(t, 1, putCount)
+	})
+
+	t.Run("without commit", func(t *testing.T) {
+		putCount = 0
+		mw := newWriter()
+		_, err := mw.Write([]byte(manifest))
+		require.NoError(t, err)
+		assert.NoError(t, mw.Close())
+		_, err = mw.Write([]byte(manifest))
+		assert.ErrorIs(t, err, errManifestClosed)
+		err = mw.Commit(context.Background(), int64(len(manifest)), imageDesc.Digest)
+		assert.ErrorIs(t, err, errManifestClosed)
+		assert.Equal(t, 0, putCount, "an aborted manifest should not be put")
+	})
+}
@@ -0,0 +1,59 @@
+/*
+ * Copyright 2017-2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You
+ * may not use this file except in compliance with the License. A copy of
+ * the License is located at
+ *
+ * 	http://aws.amazon.com/apache2.0/
+ *
+ * or in the "license" file accompanying this file. This file is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF
+ * ANY KIND, either express or implied. See the License for the specific
+ * language governing permissions and limitations under the License.
+ */
+
+package ecr
+
+import (
+	"io"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/request"
+)
+
+// MetricsRecorder receives measurements of the requests made and content
+// transferred by a resolver, for export to a metrics backend such as
+// Prometheus.  Its methods may be called concurrently and should not block.
+type MetricsRecorder interface {
+	// APICall is called as each ECR API request completes, including its
+	// retries, with the name of the operation, such as "BatchGetImage", the
+	// time taken and the error the request failed with, if any.
+	APICall(operation string, duration time.Duration, err error)
+	// LayerBytesFetched is called with the bytes of layer content read from
+	// the fetchers of the resolver.
+	LayerBytesFetched(n int64)
+	// LayerBytesPushed is called with the bytes of each layer part uploaded
+	// by the pushers of the resolver.
+	LayerBytesPushed(n int64)
+}
+
+// recordAPICall is a request handler reporting the completed request to the
+// resolver's MetricsRecorder.
+func (r *ecrResolver) recordAPICall(req *request.Request) {
+	r.metrics.APICall(req.Operation.Name, time.Since(req.Time), req.Error)
+}
+
+// meteredReadCloser reports the bytes read from it to a MetricsRecorder.
+type meteredReadCloser struct {
+	io.ReadCloser
+	metrics MetricsRecorder
+}
+
+func (rc *meteredReadCloser) Read(p []byte) (int, error) {
+	n, err := rc.ReadCloser.Read(p)
+	if n > 0 {
+		rc.metrics.LayerBytesFetched(int64(n))
+	}
+	return n, err
+}
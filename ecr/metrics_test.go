@@ -0,0 +1,155 @@
+/*
+ * Copyright 2017-2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You
+ * may not use this file except in compliance with the License. A copy of
+ * the License is located at
+ *
+ * 	http://aws.amazon.com/apache2.0/
+ *
+ * or in the "license" file accompanying this file. This file is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF
+ * ANY KIND, either express or implied. See the License for the specific
+ * language governing permissions and limitations under the License.
+ */
+
+package ecr
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/awstesting/unit"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/awslabs/amazon-ecr-containerd-resolver/ecr/internal/testdata"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type apiCall struct {
+	operation string
+	err       error
+}
+
+type fakeMetricsRecorder struct {
+	lock    sync.Mutex
+	calls   []apiCall
+	fetched int64
+	pushed  int64
+}
+
+func (m *fakeMetricsRecorder) APICall(operation string, duration time.Duration, err error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.calls = append(m.calls, apiCall{operation: operation, err: err})
+}
+
+func (m *fakeMetricsRecorder) LayerBytesFetched(n int64) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.fetched += n
+}
+
+func (m *fakeMetricsRecorder) LayerBytesPushed(n int64) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.pushed += n
+}
+
+func TestMetricsRecorderAPICall(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(w, `{"__type":"ServerException","message":"internal failure"}`)
+	}))
+	defer ts.Close()
+
+	metrics := &fakeMetricsRecorder{}
+	resolver, err := NewResolver(
+		WithSession(unit.Session.Copy(&aws.Config{
+			SleepDelay: func(time.Duration) {},
+		})),
+		WithRegionEndpoints(map[string]string{"us-west-2": ts.URL}),
+		WithMaxRetries(1),
+		WithMetricsRecorder(metrics),
+	)
+	require.NoError(t, err)
+	fetcher, err := resolver.Fetcher(context.Background(), "ecr.aws/arn:aws:ecr:us-west-2:123456789012:repository/foo/bar:latest")
+	require.NoError(t, err)
+	_, err = fetcher.Fetch(context.Background(), ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageManifest,
+		Digest:    testdata.ImageDigest,
+	})
+	require.Error(t, err)
+
+	require.Len(t, metrics.calls, 1, "retries should be recorded as a single call")
+	assert.Equal(t, "BatchGetImage", metrics.calls[0].operation)
+	assert.ErrorIs(t, metrics.calls[0].err, ErrECRServer)
+}
+
+func TestMetricsRecorderLayerBytes(t *testing.T) {
+	layer := []byte("layer content")
+	layerDesc := ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageLayer,
+		Digest:    digest.FromBytes(layer),
+		Size:      int64(len(layer)),
+	}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(layer)
+	}))
+	defer ts.Close()
+
+	fakeClient := &fakeECRClient{
+		GetDownloadUrlForLayerFn: func(aws.Context, *ecr.GetDownloadUrlForLayerInput, ...request.Option) (*ecr.GetDownloadUrlForLayerOutput, error) {
+			return &ecr.GetDownloadUrlForLayerOutput{DownloadUrl: aws.String(ts.URL)}, nil
+		},
+		BatchCheckLayerAvailabilityFn: func(_ aws.Context, input *ecr.BatchCheckLayerAvailabilityInput, _ ...request.Option) (*ecr.BatchCheckLayerAvailabilityOutput, error) {
+			return &ecr.BatchCheckLayerAvailabilityOutput{
+				Layers: []*ecr.Layer{{
+					LayerDigest:       input.LayerDigests[0],
+					LayerAvailability: aws.String(ecr.LayerAvailabilityUnavailable),
+				}},
+			}, nil
+		},
+		InitiateLayerUploadFn: func(*ecr.InitiateLayerUploadInput) (*ecr.InitiateLayerUploadOutput, error) {
+			return &ecr.InitiateLayerUploadOutput{
+				UploadId: aws.String("upload"),
+				PartSize: aws.Int64(5),
+			}, nil
+		},
+		UploadLayerPartFn: func(aws.Context, *ecr.UploadLayerPartInput, ...request.Option) (*ecr.UploadLayerPartOutput, error) {
+			return &ecr.UploadLayerPartOutput{}, nil
+		},
+		CompleteLayerUploadFn: func(*ecr.CompleteLayerUploadInput) (*ecr.CompleteLayerUploadOutput, error) {
+			return &ecr.CompleteLayerUploadOutput{
+				LayerDigest: aws.String(layerDesc.Digest.String()),
+			}, nil
+		},
+	}
+	metrics := &fakeMetricsRecorder{}
+
+	fetcher := newResolverFetcher(t, fakeClient, WithHTTPClient(ts.Client()), WithMetricsRecorder(metrics))
+	rc, err := fetcher.Fetch(context.Background(), layerDesc)
+	require.NoError(t, err)
+	_, err = io.Copy(io.Discard, rc)
+	require.NoError(t, err)
+	rc.Close()
+	assert.Equal(t, layerDesc.Size, metrics.fetched)
+
+	pusher := newResolverPusher(t, fakeClient, testdata.ImageDigest, WithMetricsRecorder(metrics))
+	writer, err := pusher.Push(context.Background(), layerDesc)
+	require.NoError(t, err)
+	_, err = writer.Write(layer)
+	require.NoError(t, err)
+	require.NoError(t, writer.Commit(context.Background(), layerDesc.Size, layerDesc.Digest))
+	assert.Equal(t, layerDesc.Size, metrics.pushed)
+}
@@ -0,0 +1,246 @@
+/*
+ * Copyright 2017-2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You
+ * may not use this file except in compliance with the License. A copy of
+ * the License is located at
+ *
+ * 	http://aws.amazon.com/apache2.0/
+ *
+ * or in the "license" file accompanying this file. This file is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF
+ * ANY KIND, either express or implied. See the License for the specific
+ * language governing permissions and limitations under the License.
+ */
+
+// Package proxy serves the pull endpoints of the registry HTTP API from a
+// resolver, so that clients without support for the resolver can pull images
+// through a local registry, such as one run as a sidecar.
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/awslabs/amazon-ecr-containerd-resolver/ecr"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/containerd/remotes"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+const (
+	apiPrefix          = "/v2/"
+	manifestsComponent = "/manifests/"
+	blobsComponent     = "/blobs/"
+
+	headerAPIVersion    = "Docker-Distribution-API-Version"
+	headerContentDigest = "Docker-Content-Digest"
+)
+
+// registryProxy implements the GET and HEAD requests for manifests and blobs
+// of the registry HTTP API by fetching content with a remotes.Resolver.
+type registryProxy struct {
+	resolver remotes.Resolver
+}
+
+// NewRegistryProxy returns an http.Handler serving image pulls from r.
+//
+// Repository names of requests are ECR image URIs, such as
+// localhost:5000/123456789012.dkr.ecr.us-west-2.amazonaws.com/example-name
+// for the ecr.aws/arn:aws:ecr:us-west-2:123456789012:repository/example-name
+// repository.  Names that are not ECR image URIs are passed to r unchanged.
+//
+// Blobs are described with ecr.BlobStatter when r's fetchers implement it, so
+// that HEAD requests do not fetch their content.  Blobs of other resolvers are
+// fetched as image layers, as their mediaType is not known to the proxy.
+func NewRegistryProxy(r remotes.Resolver) http.Handler {
+	return &registryProxy{resolver: r}
+}
+
+func (p *registryProxy) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	ctx := log.WithLogger(req.Context(), log.G(req.Context()).
+		WithField("method", req.Method).
+		WithField("path", req.URL.Path))
+	w.Header().Set(headerAPIVersion, "registry/2.0")
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		writeError(w, http.StatusMethodNotAllowed, "UNSUPPORTED", "only pulls are supported")
+		return
+	}
+	if req.URL.Path == apiPrefix || req.URL.Path == strings.TrimSuffix(apiPrefix, "/") {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	path, ok := strings.CutPrefix(req.URL.Path, apiPrefix)
+	if !ok {
+		writeError(w, http.StatusNotFound, "UNSUPPORTED", "not a registry API path")
+		return
+	}
+	if i := strings.LastIndex(path, manifestsComponent); i > 0 {
+		p.serveManifest(ctx, w, req, path[:i], path[i+len(manifestsComponent):])
+		return
+	}
+	if i := strings.LastIndex(path, blobsComponent); i > 0 {
+		p.serveBlob(ctx, w, req, path[:i], path[i+len(blobsComponent):])
+		return
+	}
+	writeError(w, http.StatusNotFound, "UNSUPPORTED", "not a registry API path")
+}
+
+// serveManifest writes the manifest of the image with the given tag or digest
+// in the repository name.
+func (p *registryProxy) serveManifest(ctx context.Context, w http.ResponseWriter, req *http.Request, name, object string) {
+	ref := resolverRef(name, object)
+	resolved, desc, err := p.resolver.Resolve(ctx, ref)
+	if err != nil {
+		log.G(ctx).WithError(err).WithField("ref", ref).Debug("ecr.proxy: failed to resolve")
+		writeFetchError(w, "MANIFEST_UNKNOWN", err)
+		return
+	}
+	w.Header().Set("Content-Type", desc.MediaType)
+	if req.Method == http.MethodHead {
+		writeHeaders(w, desc)
+		return
+	}
+	fetcher, err := p.resolver.Fetcher(ctx, resolved)
+	if err != nil {
+		writeFetchError(w, "MANIFEST_UNKNOWN", err)
+		return
+	}
+	p.serveContent(ctx, w, fetcher, resolved, desc, "MANIFEST_UNKNOWN")
+}
+
+// serveBlob writes the blob with the given digest in the repository name.
+func (p *registryProxy) serveBlob(ctx context.Context, w http.ResponseWriter, req *http.Request, name, object string) {
+	dgst, err := digest.Parse(object)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "DIGEST_INVALID", err.Error())
+		return
+	}
+	ref := resolverRef(name, object)
+	fetcher, err := p.resolver.Fetcher(ctx, ref)
+	if err != nil {
+		writeFetchError(w, "BLOB_UNKNOWN", err)
+		return
+	}
+	desc := ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageLayer,
+		Digest:    dgst,
+	}
+	statter, ok := fetcher.(ecr.BlobStatter)
+	if ok {
+		stat, err := statter.StatBlob(ctx, dgst)
+		if err != nil {
+			log.G(ctx).WithError(err).WithField("ref", ref).Debug("ecr.proxy: failed to stat")
+			writeFetchError(w, "BLOB_UNKNOWN", err)
+			return
+		}
+		desc.Size = stat.Size
+		desc.MediaType = blobMediaType(stat.MediaType)
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	if req.Method == http.MethodHead {
+		if !ok {
+			// Without a way to describe the blob, its presence is only known
+			// once its fetch starts.
+			rc, err := fetcher.Fetch(ctx, desc)
+			if err != nil {
+				writeFetchError(w, "BLOB_UNKNOWN", err)
+				return
+			}
+			rc.Close()
+		}
+		writeHeaders(w, desc)
+		return
+	}
+	p.serveContent(ctx, w, fetcher, ref, desc, "BLOB_UNKNOWN")
+}
+
+// blobMediaType returns the media type a blob is fetched as given the media
+// type recorded for it.  Blobs pushed by some clients are recorded with an
+// empty media type or an artifact's own, which are fetched as image layers.
+func blobMediaType(mediaType string) string {
+	switch mediaType {
+	case
+		images.MediaTypeDockerSchema2Layer,
+		images.MediaTypeDockerSchema2LayerGzip,
+		images.MediaTypeDockerSchema2Config,
+		ocispec.MediaTypeImageLayerGzip,
+		ocispec.MediaTypeImageLayerZstd,
+		ocispec.MediaTypeImageLayer,
+		ocispec.MediaTypeImageConfig:
+		return mediaType
+	default:
+		return ocispec.MediaTypeImageLayer
+	}
+}
+
+// serveContent writes the content of desc fetched from ref.
+func (p *registryProxy) serveContent(ctx context.Context, w http.ResponseWriter, fetcher remotes.Fetcher, ref string, desc ocispec.Descriptor, unknownCode string) {
+	rc, err := fetcher.Fetch(ctx, desc)
+	if err != nil {
+		log.G(ctx).WithError(err).WithField("ref", ref).Debug("ecr.proxy: failed to fetch")
+		writeFetchError(w, unknownCode, err)
+		return
+	}
+	defer rc.Close()
+	writeHeaders(w, desc)
+	if _, err := io.Copy(w, rc); err != nil {
+		// The status has been written, so the client only sees a short
+		// response.
+		log.G(ctx).WithError(err).WithField("ref", ref).Warn("ecr.proxy: failed to copy content")
+	}
+}
+
+// resolverRef returns the reference passed to the resolver for the image with
+// the given tag or digest in the repository name.
+func resolverRef(name, object string) string {
+	ref := name + ":" + object
+	if _, err := digest.Parse(object); err == nil {
+		ref = name + "@" + object
+	}
+	if spec, err := ecr.ParseImageURI(ref); err == nil {
+		return spec.Canonical()
+	}
+	return ref
+}
+
+func writeHeaders(w http.ResponseWriter, desc ocispec.Descriptor) {
+	w.Header().Set(headerContentDigest, desc.Digest.String())
+	if desc.Size > 0 {
+		w.Header().Set("Content-Length", strconv.FormatInt(desc.Size, 10))
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// writeFetchError writes the registry error for a failure to resolve or fetch
+// content.
+func writeFetchError(w http.ResponseWriter, unknownCode string, err error) {
+	switch {
+	case errdefs.IsNotFound(err):
+		writeError(w, http.StatusNotFound, unknownCode, err.Error())
+	case errdefs.IsInvalidArgument(err):
+		writeError(w, http.StatusBadRequest, "NAME_INVALID", err.Error())
+	default:
+		writeError(w, http.StatusBadGateway, "UNKNOWN", err.Error())
+	}
+}
+
+// writeError writes an error response in the format of the registry HTTP API.
+func writeError(w http.ResponseWriter, status int, code, message string) {
+	type registryError struct {
+		Code    string `json:"code"`
+		Message string `json:"message"`
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(struct {
+		Errors []registryError `json:"errors"`
+	}{Errors: []registryError{{Code: code, Message: message}}})
+}
@@ -0,0 +1,146 @@
+/*
+ * Copyright 2017-2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You
+ * may not use this file except in compliance with the License. A copy of
+ * the License is located at
+ *
+ * 	http://aws.amazon.com/apache2.0/
+ *
+ * or in the "license" file accompanying this file. This file is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF
+ * ANY KIND, either express or implied. See the License for the specific
+ * language governing permissions and limitations under the License.
+ */
+
+package proxy
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/awstesting/unit"
+	"github.com/awslabs/amazon-ecr-containerd-resolver/ecr"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRegistryProxyManifest(t *testing.T) {
+	const manifest = `{"schemaVersion":2,"mediaType":"application/vnd.oci.image.manifest.v1+json"}`
+	manifestDigest := digest.FromString(manifest)
+
+	// api serves the ECR API's BatchGetImage for the resolver.
+	var batchGetImageInput map[string]interface{}
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "AmazonEC2ContainerRegistry_V20150921.BatchGetImage", r.Header.Get("X-Amz-Target"))
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&batchGetImageInput))
+		w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"images": []map[string]interface{}{{
+				"imageId":                map[string]string{"imageDigest": manifestDigest.String(), "imageTag": "latest"},
+				"imageManifest":          manifest,
+				"imageManifestMediaType": ocispec.MediaTypeImageManifest,
+			}},
+		})
+	}))
+	defer api.Close()
+
+	resolver, err := ecr.NewResolver(ecr.WithSession(unit.Session), ecr.WithEndpoint(api.URL))
+	require.NoError(t, err)
+	registry := httptest.NewServer(NewRegistryProxy(resolver))
+	defer registry.Close()
+
+	resp, err := registry.Client().Get(registry.URL + "/v2/123456789012.dkr.ecr.us-west-2.amazonaws.com/foo/bar/manifests/latest")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, manifest, string(body))
+	assert.Equal(t, ocispec.MediaTypeImageManifest, resp.Header.Get("Content-Type"))
+	assert.Equal(t, manifestDigest.String(), resp.Header.Get("Docker-Content-Digest"))
+	assert.Equal(t, "123456789012", batchGetImageInput["registryId"])
+	assert.Equal(t, "foo/bar", batchGetImageInput["repositoryName"])
+}
+
+func TestRegistryProxyBlob(t *testing.T) {
+	const config = `{"architecture":"amd64","os":"linux"}`
+	configDigest := digest.FromString(config)
+
+	// layers serves the blob's content from its download URL.
+	var downloads int
+	layers := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		downloads++
+		io.WriteString(w, config)
+	}))
+	defer layers.Close()
+
+	// api serves the ECR API's BatchCheckLayerAvailability and
+	// GetDownloadUrlForLayer for the resolver.
+	var targets []string
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		target := r.Header.Get("X-Amz-Target")
+		targets = append(targets, target)
+		w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+		switch target {
+		case "AmazonEC2ContainerRegistry_V20150921.BatchCheckLayerAvailability":
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"layers": []map[string]interface{}{{
+					"layerDigest":       configDigest.String(),
+					"layerAvailability": "AVAILABLE",
+					"layerSize":         len(config),
+					"mediaType":         ocispec.MediaTypeImageConfig,
+				}},
+			})
+		case "AmazonEC2ContainerRegistry_V20150921.GetDownloadUrlForLayer":
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"downloadUrl": layers.URL,
+				"layerDigest": configDigest.String(),
+			})
+		default:
+			t.Errorf("unexpected request %q", target)
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+	defer api.Close()
+
+	resolver, err := ecr.NewResolver(ecr.WithSession(unit.Session), ecr.WithEndpoint(api.URL))
+	require.NoError(t, err)
+	registry := httptest.NewServer(NewRegistryProxy(resolver))
+	defer registry.Close()
+	blobURL := registry.URL + "/v2/123456789012.dkr.ecr.us-west-2.amazonaws.com/foo/bar/blobs/" + configDigest.String()
+
+	t.Run("head", func(t *testing.T) {
+		targets, downloads = nil, 0
+		resp, err := registry.Client().Head(blobURL)
+		require.NoError(t, err)
+		resp.Body.Close()
+
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, strconv.Itoa(len(config)), resp.Header.Get("Content-Length"))
+		assert.Equal(t, configDigest.String(), resp.Header.Get("Docker-Content-Digest"))
+		assert.Equal(t, []string{"AmazonEC2ContainerRegistry_V20150921.BatchCheckLayerAvailability"}, targets)
+		assert.Zero(t, downloads, "HEAD should not download the blob")
+	})
+
+	t.Run("get", func(t *testing.T) {
+		targets, downloads = nil, 0
+		resp, err := registry.Client().Get(blobURL)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, config, string(body))
+		assert.Equal(t, strconv.Itoa(len(config)), resp.Header.Get("Content-Length"))
+		assert.Equal(t, 1, downloads)
+	})
+}
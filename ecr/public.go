@@ -0,0 +1,89 @@
+/*
+ * Copyright 2017-2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You
+ * may not use this file except in compliance with the License. A copy of
+ * the License is located at
+ *
+ * 	http://aws.amazon.com/apache2.0/
+ *
+ * or in the "license" file accompanying this file. This file is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF
+ * ANY KIND, either express or implied. See the License for the specific
+ * language governing permissions and limitations under the License.
+ */
+
+package ecr
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/remotes"
+	"github.com/containerd/containerd/remotes/docker"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Amazon ECR Public images cannot be pulled with the ecrpublic API, which has
+// no equivalent of BatchGetImage or GetDownloadUrlForLayer.  Public
+// references are instead resolved and fetched anonymously through the
+// registry API of public.ecr.aws, as Docker clients do.
+
+// newPublicResolver returns the resolver used for Amazon ECR Public
+// references, making requests with httpClient.  public.ecr.aws answers
+// anonymous pulls with a token challenge, which the resolver's authorizer
+// completes with an anonymous token.
+func newPublicResolver(httpClient *http.Client) remotes.Resolver {
+	authorizer := docker.NewDockerAuthorizer(docker.WithAuthClient(httpClient))
+	return docker.NewResolver(docker.ResolverOptions{
+		Hosts: docker.ConfigureDefaultRegistries(
+			docker.WithClient(httpClient),
+			docker.WithAuthorizer(authorizer),
+		),
+	})
+}
+
+// getPublicResolver returns the resolver's resolver for Amazon ECR Public
+// references.
+func (r *ecrResolver) getPublicResolver() remotes.Resolver {
+	if r.publicResolver == nil {
+		return newPublicResolver(r.httpClient)
+	}
+	return r.publicResolver
+}
+
+// resolvePublic resolves an Amazon ECR Public reference.  The manifest is only
+// fetched when it is needed by the resolve verifier.
+func (r *ecrResolver) resolvePublic(ctx context.Context, ecrSpec ECRSpec) (string, ocispec.Descriptor, error) {
+	resolver := r.getPublicResolver()
+	name, desc, err := resolver.Resolve(ctx, ecrSpec.Canonical())
+	if err != nil || r.resolveVerifier == nil {
+		return name, desc, err
+	}
+	fetcher, err := resolver.Fetcher(ctx, name)
+	if err != nil {
+		return "", ocispec.Descriptor{}, err
+	}
+	rc, err := fetcher.Fetch(ctx, desc)
+	if err != nil {
+		return "", ocispec.Descriptor{}, err
+	}
+	defer rc.Close()
+	manifest, err := io.ReadAll(rc)
+	if err != nil {
+		return "", ocispec.Descriptor{}, err
+	}
+	if err := r.verifyResolved(ctx, ecrSpec, desc, manifest); err != nil {
+		return "", ocispec.Descriptor{}, err
+	}
+	return name, desc, nil
+}
+
+// publicUnsupported returns the error for an operation that is not supported
+// for Amazon ECR Public references.
+func publicUnsupported(operation string) error {
+	return fmt.Errorf("ecr: %s is not supported for Amazon ECR Public: %w", operation, errdefs.ErrNotImplemented)
+}
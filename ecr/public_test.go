@@ -0,0 +1,154 @@
+/*
+ * Copyright 2017-2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You
+ * may not use this file except in compliance with the License. A copy of
+ * the License is located at
+ *
+ * 	http://aws.amazon.com/apache2.0/
+ *
+ * or in the "license" file accompanying this file. This file is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF
+ * ANY KIND, either express or implied. See the License for the specific
+ * language governing permissions and limitations under the License.
+ */
+
+package ecr
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/remotes/docker"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResolvePublic(t *testing.T) {
+	const ref = "public.ecr.aws/alias/foo/bar:latest"
+	manifest := `{"schemaVersion":2,"mediaType":"` + ocispec.MediaTypeImageManifest + `","layers":[]}`
+	manifestDigest := digest.FromString(manifest)
+
+	var paths []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.Method+" "+r.URL.Path)
+		switch r.URL.Path {
+		case "/v2/alias/foo/bar/manifests/latest", "/v2/alias/foo/bar/manifests/" + manifestDigest.String():
+			w.Header().Set("Content-Type", ocispec.MediaTypeImageManifest)
+			w.Header().Set("Docker-Content-Digest", manifestDigest.String())
+			w.Header().Set("Content-Length", strconv.Itoa(len(manifest)))
+			if r.Method == http.MethodGet {
+				io.WriteString(w, manifest)
+			}
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer ts.Close()
+
+	resolver := &ecrResolver{
+		clients: map[string]ecrAPI{},
+		publicResolver: docker.NewResolver(docker.ResolverOptions{
+			Hosts: func(host string) ([]docker.RegistryHost, error) {
+				assert.Equal(t, "public.ecr.aws", host)
+				return []docker.RegistryHost{{
+					Client:       ts.Client(),
+					Host:         ts.Listener.Addr().String(),
+					Scheme:       "http",
+					Path:         "/v2",
+					Capabilities: docker.HostCapabilityPull | docker.HostCapabilityResolve,
+				}}, nil
+			},
+		}),
+	}
+
+	name, desc, err := resolver.Resolve(context.Background(), ref)
+	require.NoError(t, err)
+	assert.Equal(t, ref, name)
+	assert.Equal(t, manifestDigest, desc.Digest)
+	assert.Equal(t, ocispec.MediaTypeImageManifest, desc.MediaType)
+
+	fetcher, err := resolver.Fetcher(context.Background(), ref)
+	require.NoError(t, err)
+	rc, err := fetcher.Fetch(context.Background(), desc)
+	require.NoError(t, err)
+	defer rc.Close()
+	body, err := io.ReadAll(rc)
+	require.NoError(t, err)
+	assert.Equal(t, manifest, string(body))
+	assert.Contains(t, paths, "GET /v2/alias/foo/bar/manifests/"+manifestDigest.String())
+	assert.Empty(t, resolver.clients, "no ECR clients should be created for public references")
+
+	_, err = resolver.Pusher(context.Background(), ref+"@"+manifestDigest.String())
+	assert.True(t, errdefs.IsNotImplemented(err), "unexpected error: %v", err)
+}
+
+// hostRewriter sends every request to the server at target, in place of the
+// host it was made for.
+type hostRewriter struct {
+	target *url.URL
+	next   http.RoundTripper
+}
+
+func (h hostRewriter) RoundTrip(req *http.Request) (*http.Response, error) {
+	rewritten := req.Clone(req.Context())
+	rewritten.URL.Scheme = h.target.Scheme
+	rewritten.URL.Host = h.target.Host
+	resp, err := h.next.RoundTrip(rewritten)
+	if resp != nil {
+		// Challenges are remembered per host, so report the original request.
+		resp.Request = req
+	}
+	return resp, err
+}
+
+func TestResolvePublicTokenChallenge(t *testing.T) {
+	const ref = "public.ecr.aws/alias/foo/bar:latest"
+	manifest := `{"schemaVersion":2,"mediaType":"` + ocispec.MediaTypeImageManifest + `","layers":[]}`
+	manifestDigest := digest.FromString(manifest)
+
+	tokenRequests := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/token" {
+			tokenRequests++
+			assert.Equal(t, "public.ecr.aws", r.URL.Query().Get("service"))
+			assert.Equal(t, "repository:alias/foo/bar:pull", r.URL.Query().Get("scope"))
+			io.WriteString(w, `{"token":"anonymous"}`)
+			return
+		}
+		if r.Header.Get("Authorization") != "Bearer anonymous" {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="https://public.ecr.aws/token",service="public.ecr.aws",scope="repository:alias/foo/bar:pull"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		assert.Equal(t, "/v2/alias/foo/bar/manifests/latest", r.URL.Path)
+		w.Header().Set("Content-Type", ocispec.MediaTypeImageManifest)
+		w.Header().Set("Docker-Content-Digest", manifestDigest.String())
+		w.Header().Set("Content-Length", strconv.Itoa(len(manifest)))
+		if r.Method == http.MethodGet {
+			io.WriteString(w, manifest)
+		}
+	}))
+	defer ts.Close()
+	target, err := url.Parse(ts.URL)
+	require.NoError(t, err)
+
+	resolver := &ecrResolver{
+		clients: map[string]ecrAPI{},
+		publicResolver: newPublicResolver(&http.Client{
+			Transport: hostRewriter{target: target, next: ts.Client().Transport},
+		}),
+	}
+	_, desc, err := resolver.Resolve(context.Background(), ref)
+	require.NoError(t, err)
+	assert.Equal(t, manifestDigest, desc.Digest)
+	assert.Equal(t, 1, tokenRequests, "the token challenge should be answered")
+}
@@ -19,37 +19,97 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"sync"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/ecr"
 	"github.com/containerd/containerd/content"
-	"github.com/containerd/containerd/errdefs"
 	"github.com/containerd/containerd/images"
 	"github.com/containerd/containerd/log"
 	"github.com/containerd/containerd/reference"
 	"github.com/containerd/containerd/remotes"
 	"github.com/containerd/containerd/remotes/docker"
+	"github.com/opencontainers/go-digest"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/sync/semaphore"
 )
 
 var (
 	errLayerNotFound = errors.New("ecr: layer not found")
 )
 
+// ManifestHintAnnotation is a descriptor annotation that forces the pusher to
+// handle the content as an image manifest or index when set to "true".  This
+// allows pushing manifests whose descriptors have an empty or unrecognized
+// media type.
+const ManifestHintAnnotation = "com.amazonaws.ecr.containerd-resolver.manifest"
+
+const (
+	// batchCheckLayerAvailabilityLimit is the maximum number of layer digests
+	// ECR accepts in a single BatchCheckLayerAvailability request.
+	batchCheckLayerAvailabilityLimit = 100
+)
+
 // ecrPusher implements the containerd remotes.Pusher interface and can be used
 // to push images to Amazon ECR.
 type ecrPusher struct {
 	ecrBase
-	tracker docker.StatusTracker
+	tracker           docker.StatusTracker
+	uploadContentType string
+	onUploadInit      func(uploadID string)
+	onUploadComplete  func(uploadID string, err error)
+	stallTimeout      time.Duration
+	putLimiter        *semaphore.Weighted
+	putParallelism    int64
+	minPartSize       int64
+	verifyLayers      bool
+	maxManifestSize   int64
+	verifyParts       bool
+	uploadRetryPolicy RetryPolicy
+	additionalTags    []string
+	progress          func(ref string, desc ocispec.Descriptor, uploaded, total int64)
+	// createRepository, when set, configures the repository created when
+	// the pushed repository does not exist.
+	createRepository *RepositorySettings
+	// presentLayers, when set, holds the digests of the blobs CheckLayers
+	// found present, whose pushes skip checking their existence.
+	presentLayers *sync.Map
 }
 
 var _ remotes.Pusher = (*ecrPusher)(nil)
 
 func (p ecrPusher) Push(ctx context.Context, desc ocispec.Descriptor) (content.Writer, error) {
+	ctx = withLogFields(ctx, p.logFields)
+	ctx = withRetryBudget(ctx, p.retryDeadline)
 	ctx = log.WithLogger(ctx, log.G(ctx).WithField("desc", desc))
 	log.G(ctx).Debug("ecr.push")
 
+	writer, err := p.push(ctx, desc)
+	if err != nil && p.createRepository != nil && isRepositoryNotFound(err) {
+		log.G(ctx).Info("ecr.push: repository not found, creating repository")
+		if err := createRepository(ctx, p.client, p.ecrSpec, *p.createRepository); err != nil {
+			return nil, fmt.Errorf("ecr: creating repository %v: %w", p.ecrSpec.ARN(), err)
+		}
+		return p.push(ctx, desc)
+	}
+	return writer, err
+}
+
+func (p ecrPusher) push(ctx context.Context, desc ocispec.Descriptor) (content.Writer, error) {
+	if isPushedAsManifest(desc) {
+		if desc.Annotations[ManifestHintAnnotation] == "true" {
+			log.G(ctx).Debug("ecr.push: manifest hint set")
+		}
+		return p.pushManifest(ctx, desc)
+	}
+	return p.pushBlob(ctx, desc)
+}
+
+// isPushedAsManifest reports whether desc is pushed as an image manifest or
+// index rather than as a blob.
+func isPushedAsManifest(desc ocispec.Descriptor) bool {
 	switch desc.MediaType {
 	case
 		images.MediaTypeDockerSchema1Manifest,
@@ -57,55 +117,109 @@ func (p ecrPusher) Push(ctx context.Context, desc ocispec.Descriptor) (content.W
 		images.MediaTypeDockerSchema2ManifestList,
 		ocispec.MediaTypeImageIndex,
 		ocispec.MediaTypeImageManifest:
-		return p.pushManifest(ctx, desc)
+		return true
 	default:
-		return p.pushBlob(ctx, desc)
+		return desc.Annotations[ManifestHintAnnotation] == "true"
 	}
 }
 
 func (p ecrPusher) pushManifest(ctx context.Context, desc ocispec.Descriptor) (content.Writer, error) {
 	log.G(ctx).Debug("ecr.pusher.manifest")
-	exists, err := p.checkManifestExistence(ctx, desc)
+	image, err := p.checkManifestExistence(ctx, desc)
 	if err != nil {
 		log.G(ctx).WithError(err).
 			Error("ecr.pusher.manifest: failed to check existence")
 		return nil, err
 	}
-	if exists {
+	if image != nil {
 		log.G(ctx).Debug("ecr.pusher.manifest: content already on remote")
 		p.markStatusExists(ctx, desc)
-		return nil, fmt.Errorf("content %v on remote: %w", desc.Digest, errdefs.ErrAlreadyExists)
+		if desc.Digest == p.ecrSpec.Spec().Digest() && len(p.additionalTags) > 0 {
+			if err := p.tagExistingManifest(ctx, desc, image); err != nil {
+				return nil, err
+			}
+		}
+		return nil, fmt.Errorf("content %v: %w", desc.Digest, ErrContentExists)
 	}
 
 	ref := p.markStatusStarted(ctx, desc)
 
 	return &manifestWriter{
-		ctx:     ctx,
-		base:    &p.ecrBase,
-		desc:    desc,
-		tracker: p.tracker,
-		ref:     ref,
+		ctx:          ctx,
+		base:         &p.ecrBase,
+		desc:         desc,
+		tracker:      p.tracker,
+		ref:          ref,
+		putLimiter:   p.putLimiter,
+		putWeight:    p.manifestPutWeight(desc),
+		verifyLayers: p.verifyLayers,
+		maxSize:      p.maxManifestSize,
+		extraTags:    p.additionalTags,
+		progress:     p.progress,
 	}, nil
 }
 
-func (p ecrPusher) checkManifestExistence(ctx context.Context, desc ocispec.Descriptor) (bool, error) {
+// manifestPutWeight returns the weight a manifest put holds on the pusher's
+// limiter.  An index or manifest list holds every slot so that it is put only
+// once the puts of its children have completed.
+func (p ecrPusher) manifestPutWeight(desc ocispec.Descriptor) int64 {
+	switch desc.MediaType {
+	case images.MediaTypeDockerSchema2ManifestList, ocispec.MediaTypeImageIndex:
+		return p.putParallelism
+	default:
+		return 1
+	}
+}
+
+// checkManifestExistence returns the image of the manifest when it is already
+// in the repository, and nil otherwise.
+func (p ecrPusher) checkManifestExistence(ctx context.Context, desc ocispec.Descriptor) (*ecr.Image, error) {
 	image, err := p.getImageByDescriptor(ctx, desc)
 	if err != nil {
-		if err == errImageNotFound {
-			return false, nil
+		if errors.Is(err, ErrImageNotFound) {
+			return nil, nil
 		}
-		return false, err
+		return nil, err
 	}
 	if image == nil {
-		return false, errors.New("ecr.pusher.manifest: unexpected nil image")
+		return nil, errors.New("ecr.pusher.manifest: unexpected nil image")
 	}
 
-	found := desc.Digest.String() == aws.StringValue(image.ImageId.ImageDigest)
-	return found, nil
+	if desc.Digest.String() != aws.StringValue(image.ImageId.ImageDigest) {
+		return nil, nil
+	}
+	return image, nil
+}
+
+// tagExistingManifest applies the pusher's additional tags to the image's root
+// manifest when it is already in the repository, as it is not written again.
+func (p ecrPusher) tagExistingManifest(ctx context.Context, desc ocispec.Descriptor, image *ecr.Image) error {
+	mw := &manifestWriter{
+		ctx:        ctx,
+		base:       &p.ecrBase,
+		desc:       desc,
+		putLimiter: p.putLimiter,
+		putWeight:  p.manifestPutWeight(desc),
+		extraTags:  p.additionalTags,
+	}
+	return mw.putExtraTags(ctx, &ecr.PutImageInput{
+		RegistryId:             aws.String(p.ecrSpec.Registry()),
+		RepositoryName:         aws.String(p.ecrSpec.Repository),
+		ImageManifest:          image.ImageManifest,
+		ImageManifestMediaType: image.ImageManifestMediaType,
+		ImageDigest:            aws.String(desc.Digest.String()),
+	})
 }
 
 func (p ecrPusher) pushBlob(ctx context.Context, desc ocispec.Descriptor) (content.Writer, error) {
 	log.G(ctx).Debug("ecr.pusher.blob")
+	if p.presentLayers != nil {
+		if _, ok := p.presentLayers.Load(desc.Digest); ok {
+			log.G(ctx).Debug("ecr.pusher.blob: content found on remote by CheckLayers")
+			p.markStatusExists(ctx, desc)
+			return nil, fmt.Errorf("content %v: %w", desc.Digest, ErrContentExists)
+		}
+	}
 	exists, err := p.checkBlobExistence(ctx, desc)
 	if err != nil {
 		log.G(ctx).WithError(err).
@@ -115,11 +229,40 @@ func (p ecrPusher) pushBlob(ctx context.Context, desc ocispec.Descriptor) (conte
 	if exists {
 		log.G(ctx).Debug("ecr.pusher.blob: content already on remote")
 		p.markStatusExists(ctx, desc)
-		return nil, fmt.Errorf("content %v on remote: %w", desc.Digest, errdefs.ErrAlreadyExists)
+		return nil, fmt.Errorf("content %v: %w", desc.Digest, ErrContentExists)
 	}
 
 	ref := p.markStatusStarted(ctx, desc)
-	return newLayerWriter(&p.ecrBase, p.tracker, ref, desc)
+	opts := append(p.layerWriterOptions(), withParentSpan(trace.SpanContextFromContext(ctx)))
+	return newLayerWriter(&p.ecrBase, p.tracker, ref, desc, opts...)
+}
+
+// layerWriterOptions returns the options for layerWriters created by the
+// pusher.
+func (p ecrPusher) layerWriterOptions() []layerWriterOption {
+	var opts []layerWriterOption
+	if p.uploadContentType != "" {
+		opts = append(opts, withUploadContentType(p.uploadContentType))
+	}
+	if p.onUploadInit != nil || p.onUploadComplete != nil {
+		opts = append(opts, withUploadSessionHooks(p.onUploadInit, p.onUploadComplete))
+	}
+	if p.stallTimeout > 0 {
+		opts = append(opts, withUploadStallTimeout(p.stallTimeout))
+	}
+	if p.minPartSize > 0 {
+		opts = append(opts, withMinUploadPartSize(p.minPartSize))
+	}
+	if p.verifyParts {
+		opts = append(opts, withPartVerification())
+	}
+	if p.uploadRetryPolicy.MaxAttempts > 1 {
+		opts = append(opts, withUploadRetryPolicy(p.uploadRetryPolicy))
+	}
+	if p.progress != nil {
+		opts = append(opts, withUploadProgress(p.progress))
+	}
+	return opts
 }
 
 func (p ecrPusher) checkBlobExistence(ctx context.Context, desc ocispec.Descriptor) (bool, error) {
@@ -149,6 +292,84 @@ func (p ecrPusher) checkBlobExistence(ctx context.Context, desc ocispec.Descript
 	return aws.StringValue(layer.LayerAvailability) == ecr.LayerAvailabilityAvailable, nil
 }
 
+// LayerChecker is implemented by the pushers of the resolver to check which
+// of an image's blobs are already present before pushing them.
+type LayerChecker interface {
+	// CheckLayers reports whether the blob of each descriptor is present in
+	// the repository.  Descriptors pushed as manifests are not checked.
+	CheckLayers(ctx context.Context, descs []ocispec.Descriptor) (map[digest.Digest]bool, error)
+}
+
+var _ LayerChecker = (*ecrPusher)(nil)
+
+// CheckLayers checks the blobs of descs with as few BatchCheckLayerAvailability
+// requests as possible, up to 100 digests each, in place of a request for each
+// blob as it is pushed.  Later pushes of the blobs found present fail with
+// ErrContentExists without checking them again.
+func (p ecrPusher) CheckLayers(ctx context.Context, descs []ocispec.Descriptor) (map[digest.Digest]bool, error) {
+	ctx = withLogFields(ctx, p.logFields)
+	ctx = withRetryBudget(ctx, p.retryDeadline)
+	log.G(ctx).WithField("count", len(descs)).Debug("ecr.pusher.layers")
+
+	var digests []digest.Digest
+	for _, desc := range descs {
+		if !isPushedAsManifest(desc) {
+			digests = append(digests, desc.Digest)
+		}
+	}
+	availability, err := p.checkLayerAvailability(ctx, digests)
+	if err != nil {
+		return nil, err
+	}
+	if p.presentLayers != nil {
+		for dgst, available := range availability {
+			if available {
+				p.presentLayers.Store(dgst, struct{}{})
+			}
+		}
+	}
+	return availability, nil
+}
+
+// checkLayerAvailability reports whether each of the provided digests is
+// available in the repository, checking them in as few requests as possible.
+func (b *ecrBase) checkLayerAvailability(ctx context.Context, digests []digest.Digest) (map[digest.Digest]bool, error) {
+	availability := make(map[digest.Digest]bool, len(digests))
+	var layerDigests []*string
+	for _, dgst := range digests {
+		if _, ok := availability[dgst]; ok {
+			continue
+		}
+		availability[dgst] = false
+		layerDigests = append(layerDigests, aws.String(dgst.String()))
+	}
+
+	for begin := 0; begin < len(layerDigests); begin += batchCheckLayerAvailabilityLimit {
+		end := begin + batchCheckLayerAvailabilityLimit
+		if end > len(layerDigests) {
+			end = len(layerDigests)
+		}
+		batchCheckLayerAvailabilityOutput, err := b.client.BatchCheckLayerAvailabilityWithContext(ctx, &ecr.BatchCheckLayerAvailabilityInput{
+			RegistryId:     aws.String(b.ecrSpec.Registry()),
+			RepositoryName: aws.String(b.ecrSpec.Repository),
+			LayerDigests:   layerDigests[begin:end],
+		})
+		if err != nil {
+			log.G(ctx).WithError(err).Error("ecr.base.layers: failed to check availability")
+			return nil, err
+		}
+		log.G(ctx).
+			WithField("batchCheckLayerAvailability", batchCheckLayerAvailabilityOutput).
+			Debug("ecr.base.layers")
+
+		for _, layer := range batchCheckLayerAvailabilityOutput.Layers {
+			dgst := digest.Digest(aws.StringValue(layer.LayerDigest))
+			availability[dgst] = aws.StringValue(layer.LayerAvailability) == ecr.LayerAvailabilityAvailable
+		}
+	}
+	return availability, nil
+}
+
 func (p ecrPusher) markStatusExists(ctx context.Context, desc ocispec.Descriptor) string {
 	ref := remotes.MakeRefKey(ctx, desc)
 	p.tracker.SetStatus(ref, docker.Status{
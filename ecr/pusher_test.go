@@ -16,16 +16,23 @@
 package ecr
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
 	"errors"
+	"strconv"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/arn"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/awstesting/unit"
 	"github.com/aws/aws-sdk-go/service/ecr"
 	"github.com/awslabs/amazon-ecr-containerd-resolver/ecr/internal/testdata"
+	"github.com/containerd/containerd/content"
 	"github.com/containerd/containerd/errdefs"
 	"github.com/containerd/containerd/images"
 	"github.com/containerd/containerd/remotes"
@@ -34,8 +41,22 @@ import (
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"golang.org/x/sync/semaphore"
 )
 
+// newResolverPusher returns a pusher of the image with the root digest dgst to
+// a repository in the "fake" region, served by client, from a resolver created
+// with the options.
+func newResolverPusher(t *testing.T, client ecrAPI, dgst digest.Digest, options ...ResolverOption) remotes.Pusher {
+	t.Helper()
+	resolver, err := NewResolver(append([]ResolverOption{WithSession(unit.Session)}, options...)...)
+	require.NoError(t, err)
+	resolver.(*ecrResolver).clients["fake"] = client
+	pusher, err := resolver.Pusher(context.Background(), "ecr.aws/arn:aws:ecr:fake:123456789012:repository/foo/bar:latest@"+dgst.String())
+	require.NoError(t, err)
+	return pusher
+}
+
 func TestPushManifestReturnsManifestWriter(t *testing.T) {
 	registry := "registry"
 	repository := "repository"
@@ -161,6 +182,61 @@ func TestPushManifestAlreadyExists(t *testing.T) {
 		"should be updated between start and end")
 }
 
+func TestPushManifestAlreadyExistsAdditionalTags(t *testing.T) {
+	const manifestContent = "manifest content"
+	imageDigest := digest.FromString(manifestContent)
+	var tags []string
+	fakeClient := &fakeECRClient{
+		BatchGetImageFn: func(aws.Context, *ecr.BatchGetImageInput, ...request.Option) (*ecr.BatchGetImageOutput, error) {
+			return &ecr.BatchGetImageOutput{
+				Images: []*ecr.Image{{
+					ImageId:                &ecr.ImageIdentifier{ImageDigest: aws.String(imageDigest.String())},
+					ImageManifest:          aws.String(manifestContent),
+					ImageManifestMediaType: aws.String(ocispec.MediaTypeImageManifest),
+				}},
+			}, nil
+		},
+		PutImageFn: func(_ aws.Context, input *ecr.PutImageInput, _ ...request.Option) (*ecr.PutImageOutput, error) {
+			tags = append(tags, aws.StringValue(input.ImageTag))
+			assert.Equal(t, manifestContent, aws.StringValue(input.ImageManifest))
+			assert.Equal(t, ocispec.MediaTypeImageManifest, aws.StringValue(input.ImageManifestMediaType))
+			return &ecr.PutImageOutput{}, nil
+		},
+	}
+	pusher := &ecrPusher{
+		ecrBase: ecrBase{
+			client: fakeClient,
+			ecrSpec: ECRSpec{
+				arn:        arn.ARN{AccountID: "registry"},
+				Repository: "repository",
+				Object:     "latest@" + imageDigest.String(),
+			},
+		},
+		tracker:        docker.NewInMemoryTracker(),
+		additionalTags: []string{"v1.0", "stable"},
+	}
+
+	_, err := pusher.Push(context.Background(), ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageManifest,
+		Digest:    imageDigest,
+	})
+	assert.ErrorIs(t, err, errdefs.ErrAlreadyExists)
+	assert.Equal(t, []string{"v1.0", "stable"}, tags, "additional tags should be applied to the existing manifest")
+
+	// A failure to apply the tags fails the push rather than reporting the
+	// manifest as existing.
+	errFailed := errors.New("expected")
+	fakeClient.PutImageFn = func(aws.Context, *ecr.PutImageInput, ...request.Option) (*ecr.PutImageOutput, error) {
+		return nil, errFailed
+	}
+	_, err = pusher.Push(context.Background(), ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageManifest,
+		Digest:    imageDigest,
+	})
+	assert.ErrorIs(t, err, errFailed)
+	assert.False(t, errors.Is(err, errdefs.ErrAlreadyExists))
+}
+
 func TestPushBlobReturnsLayerWriter(t *testing.T) {
 	registry := "registry"
 	repository := "repository"
@@ -313,3 +389,494 @@ func TestPushBlobAPIError(t *testing.T) {
 	_, err := pusher.Push(context.Background(), desc)
 	assert.EqualError(t, err, errLayerNotFound.Error())
 }
+
+func TestPushManifestHint(t *testing.T) {
+	const manifestContent = `{"schemaVersion": 2, "mediaType": "application/vnd.oci.image.index.v1+json", "manifests": []}`
+	imageDigest := digest.FromString(manifestContent)
+
+	putImageCount := 0
+	fakeClient := &fakeECRClient{
+		BatchGetImageFn: func(aws.Context, *ecr.BatchGetImageInput, ...request.Option) (*ecr.BatchGetImageOutput, error) {
+			return &ecr.BatchGetImageOutput{
+				Failures: []*ecr.ImageFailure{
+					{FailureCode: aws.String(ecr.ImageFailureCodeImageNotFound)},
+				},
+			}, nil
+		},
+		PutImageFn: func(_ aws.Context, input *ecr.PutImageInput, _ ...request.Option) (*ecr.PutImageOutput, error) {
+			putImageCount++
+			assert.Equal(t, ocispec.MediaTypeImageIndex, aws.StringValue(input.ImageManifestMediaType),
+				"should infer mediaType from the manifest")
+			return &ecr.PutImageOutput{
+				Image: &ecr.Image{
+					ImageId: &ecr.ImageIdentifier{ImageDigest: aws.String(imageDigest.String())},
+				},
+			}, nil
+		},
+		BatchCheckLayerAvailabilityFn: func(aws.Context, *ecr.BatchCheckLayerAvailabilityInput, ...request.Option) (*ecr.BatchCheckLayerAvailabilityOutput, error) {
+			t.Error("should not check layer availability for a hinted manifest")
+			return nil, errors.New("unexpected")
+		},
+	}
+	pusher := &ecrPusher{
+		ecrBase: ecrBase{
+			client: fakeClient,
+			ecrSpec: ECRSpec{
+				arn: arn.ARN{
+					AccountID: "registry",
+				},
+				Repository: "repository",
+			},
+		},
+		tracker: docker.NewInMemoryTracker(),
+	}
+
+	desc := ocispec.Descriptor{
+		Digest:      imageDigest,
+		Size:        int64(len(manifestContent)),
+		Annotations: map[string]string{ManifestHintAnnotation: "true"},
+	}
+	writer, err := pusher.Push(context.Background(), desc)
+	require.NoError(t, err)
+	_, ok := writer.(*manifestWriter)
+	require.True(t, ok, "writer should be a manifestWriter")
+
+	_, err = writer.Write([]byte(manifestContent))
+	require.NoError(t, err)
+	require.NoError(t, writer.Commit(context.Background(), desc.Size, desc.Digest))
+	assert.Equal(t, 1, putImageCount, "PutImage should be called once")
+}
+
+// TestPushPrunedIndex asserts that pushing an index only considers the index
+// itself. Children are pushed by the caller as they're walked, so platforms
+// pruned from the index must never be requested.
+func TestPushPrunedIndex(t *testing.T) {
+	childDesc := ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageManifest,
+		Digest:    digest.FromString("linux/amd64"),
+		Size:      11,
+		Platform:  &ocispec.Platform{OS: "linux", Architecture: "amd64"},
+	}
+	index, err := json.Marshal(ocispec.Index{
+		MediaType: ocispec.MediaTypeImageIndex,
+		Manifests: []ocispec.Descriptor{childDesc},
+	})
+	require.NoError(t, err)
+	indexDesc := ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageIndex,
+		Digest:    digest.FromBytes(index),
+		Size:      int64(len(index)),
+	}
+
+	var requested []string
+	fakeClient := &fakeECRClient{
+		BatchGetImageFn: func(_ aws.Context, input *ecr.BatchGetImageInput, _ ...request.Option) (*ecr.BatchGetImageOutput, error) {
+			for _, id := range input.ImageIds {
+				requested = append(requested, aws.StringValue(id.ImageDigest))
+			}
+			return &ecr.BatchGetImageOutput{
+				Failures: []*ecr.ImageFailure{
+					{FailureCode: aws.String(ecr.ImageFailureCodeImageNotFound)},
+				},
+			}, nil
+		},
+		PutImageFn: func(_ aws.Context, input *ecr.PutImageInput, _ ...request.Option) (*ecr.PutImageOutput, error) {
+			assert.Equal(t, string(index), aws.StringValue(input.ImageManifest))
+			return &ecr.PutImageOutput{
+				Image: &ecr.Image{
+					ImageId: &ecr.ImageIdentifier{ImageDigest: input.ImageDigest},
+				},
+			}, nil
+		},
+	}
+	pusher := &ecrPusher{
+		ecrBase: ecrBase{
+			client: fakeClient,
+			ecrSpec: ECRSpec{
+				arn: arn.ARN{
+					AccountID: "registry",
+				},
+				Repository: "repository",
+				Object:     "tag@" + indexDesc.Digest.String(),
+			},
+		},
+		tracker: docker.NewInMemoryTracker(),
+	}
+
+	writer, err := pusher.Push(context.Background(), indexDesc)
+	require.NoError(t, err)
+	_, err = writer.Write(index)
+	require.NoError(t, err)
+	require.NoError(t, writer.Commit(context.Background(), indexDesc.Size, indexDesc.Digest))
+
+	assert.Equal(t, []string{indexDesc.Digest.String()}, requested,
+		"only the index should be requested when pushing it")
+}
+
+func TestPushManifestParallelism(t *testing.T) {
+	const parallelism = 2
+
+	var children []ocispec.Descriptor
+	for _, platform := range []string{"linux/amd64", "linux/arm64", "linux/arm/v7", "linux/s390x", "linux/ppc64le"} {
+		children = append(children, ocispec.Descriptor{
+			MediaType: ocispec.MediaTypeImageManifest,
+			Digest:    digest.FromString(platform),
+			Size:      int64(len(platform)),
+		})
+	}
+	index, err := json.Marshal(ocispec.Index{
+		MediaType: ocispec.MediaTypeImageIndex,
+		Manifests: children,
+	})
+	require.NoError(t, err)
+	indexDesc := ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageIndex,
+		Digest:    digest.FromBytes(index),
+		Size:      int64(len(index)),
+	}
+
+	var (
+		lock     sync.Mutex
+		inflight int
+		peak     int
+		put      []string
+	)
+	fakeClient := &fakeECRClient{
+		BatchGetImageFn: func(aws.Context, *ecr.BatchGetImageInput, ...request.Option) (*ecr.BatchGetImageOutput, error) {
+			return &ecr.BatchGetImageOutput{
+				Failures: []*ecr.ImageFailure{
+					{FailureCode: aws.String(ecr.ImageFailureCodeImageNotFound)},
+				},
+			}, nil
+		},
+		PutImageFn: func(_ aws.Context, input *ecr.PutImageInput, _ ...request.Option) (*ecr.PutImageOutput, error) {
+			lock.Lock()
+			inflight++
+			if inflight > peak {
+				peak = inflight
+			}
+			lock.Unlock()
+
+			time.Sleep(20 * time.Millisecond)
+
+			lock.Lock()
+			inflight--
+			put = append(put, aws.StringValue(input.ImageDigest))
+			lock.Unlock()
+			return &ecr.PutImageOutput{
+				Image: &ecr.Image{
+					ImageId: &ecr.ImageIdentifier{ImageDigest: input.ImageDigest},
+				},
+			}, nil
+		},
+	}
+	pusher := &ecrPusher{
+		ecrBase: ecrBase{
+			client: fakeClient,
+			ecrSpec: ECRSpec{
+				arn: arn.ARN{
+					AccountID: "registry",
+				},
+				Repository: "repository",
+				Object:     "tag@" + indexDesc.Digest.String(),
+			},
+		},
+		tracker:        docker.NewInMemoryTracker(),
+		putLimiter:     semaphore.NewWeighted(parallelism),
+		putParallelism: parallelism,
+	}
+
+	push := func(desc ocispec.Descriptor, content []byte) error {
+		writer, err := pusher.Push(context.Background(), desc)
+		if err != nil {
+			return err
+		}
+		if _, err := writer.Write(content); err != nil {
+			return err
+		}
+		return writer.Commit(context.Background(), desc.Size, desc.Digest)
+	}
+
+	// Children are pushed concurrently and the index once they succeed, as
+	// containerd does when pushing a multi-platform image.
+	var wg sync.WaitGroup
+	errs := make(chan error, len(children)+1)
+	for _, child := range children {
+		wg.Add(1)
+		go func(child ocispec.Descriptor) {
+			defer wg.Done()
+			errs <- push(child, []byte("manifest"))
+		}(child)
+	}
+	wg.Wait()
+	errs <- push(indexDesc, index)
+	close(errs)
+	for err := range errs {
+		assert.NoError(t, err)
+	}
+
+	require.Len(t, put, len(children)+1)
+	assert.Equal(t, parallelism, peak, "children should be put concurrently up to the limit")
+	assert.Equal(t, indexDesc.Digest.String(), put[len(put)-1], "index should be put last")
+}
+
+func TestPushNoTracker(t *testing.T) {
+	layer := []byte("layer")
+	layerDesc := ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageLayer,
+		Digest:    digest.FromBytes(layer),
+		Size:      int64(len(layer)),
+	}
+	manifest := []byte(`{"schemaVersion": 2}`)
+	manifestDesc := ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageManifest,
+		Digest:    digest.FromBytes(manifest),
+		Size:      int64(len(manifest)),
+	}
+
+	fakeClient := &fakeECRClient{
+		BatchCheckLayerAvailabilityFn: func(_ aws.Context, input *ecr.BatchCheckLayerAvailabilityInput, _ ...request.Option) (*ecr.BatchCheckLayerAvailabilityOutput, error) {
+			return &ecr.BatchCheckLayerAvailabilityOutput{
+				Layers: []*ecr.Layer{{
+					LayerDigest:       input.LayerDigests[0],
+					LayerAvailability: aws.String(ecr.LayerAvailabilityUnavailable),
+				}},
+			}, nil
+		},
+		InitiateLayerUploadFn: func(*ecr.InitiateLayerUploadInput) (*ecr.InitiateLayerUploadOutput, error) {
+			return &ecr.InitiateLayerUploadOutput{
+				UploadId: aws.String("upload"),
+				PartSize: aws.Int64(2),
+			}, nil
+		},
+		UploadLayerPartFn: func(aws.Context, *ecr.UploadLayerPartInput, ...request.Option) (*ecr.UploadLayerPartOutput, error) {
+			return &ecr.UploadLayerPartOutput{}, nil
+		},
+		CompleteLayerUploadFn: func(*ecr.CompleteLayerUploadInput) (*ecr.CompleteLayerUploadOutput, error) {
+			return &ecr.CompleteLayerUploadOutput{
+				LayerDigest: aws.String(layerDesc.Digest.String()),
+			}, nil
+		},
+		BatchGetImageFn: func(aws.Context, *ecr.BatchGetImageInput, ...request.Option) (*ecr.BatchGetImageOutput, error) {
+			return &ecr.BatchGetImageOutput{
+				Failures: []*ecr.ImageFailure{
+					{FailureCode: aws.String(ecr.ImageFailureCodeImageNotFound)},
+				},
+			}, nil
+		},
+		PutImageFn: func(_ aws.Context, input *ecr.PutImageInput, _ ...request.Option) (*ecr.PutImageOutput, error) {
+			return &ecr.PutImageOutput{
+				Image: &ecr.Image{
+					ImageId: &ecr.ImageIdentifier{ImageDigest: input.ImageDigest},
+				},
+			}, nil
+		},
+	}
+	tracker := noopTracker{}
+	pusher := &ecrPusher{
+		ecrBase: ecrBase{
+			client: fakeClient,
+			ecrSpec: ECRSpec{
+				arn: arn.ARN{
+					AccountID: "registry",
+				},
+				Repository: "repository",
+				Object:     "tag@" + manifestDesc.Digest.String(),
+			},
+		},
+		tracker: tracker,
+	}
+
+	for _, tc := range []struct {
+		desc ocispec.Descriptor
+		data []byte
+	}{
+		{layerDesc, layer},
+		{manifestDesc, manifest},
+	} {
+		t.Run(tc.desc.MediaType, func(t *testing.T) {
+			ctx := context.Background()
+			writer, err := pusher.Push(ctx, tc.desc)
+			require.NoError(t, err)
+			err = content.Copy(ctx, writer, bytes.NewReader(tc.data), tc.desc.Size, tc.desc.Digest)
+			assert.NoError(t, err)
+
+			_, err = tracker.GetStatus(remotes.MakeRefKey(ctx, tc.desc))
+			assert.True(t, errdefs.IsNotFound(err), "status should not be retained")
+		})
+	}
+}
+
+func TestPushProgress(t *testing.T) {
+	layer := []byte("layer content")
+	layerDesc := ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageLayer,
+		Digest:    digest.FromBytes(layer),
+		Size:      int64(len(layer)),
+	}
+	fakeClient := &fakeECRClient{
+		BatchCheckLayerAvailabilityFn: func(_ aws.Context, input *ecr.BatchCheckLayerAvailabilityInput, _ ...request.Option) (*ecr.BatchCheckLayerAvailabilityOutput, error) {
+			return &ecr.BatchCheckLayerAvailabilityOutput{
+				Layers: []*ecr.Layer{{
+					LayerDigest:       input.LayerDigests[0],
+					LayerAvailability: aws.String(ecr.LayerAvailabilityUnavailable),
+				}},
+			}, nil
+		},
+		InitiateLayerUploadFn: func(*ecr.InitiateLayerUploadInput) (*ecr.InitiateLayerUploadOutput, error) {
+			return &ecr.InitiateLayerUploadOutput{
+				UploadId: aws.String("upload"),
+				PartSize: aws.Int64(5),
+			}, nil
+		},
+		UploadLayerPartFn: func(aws.Context, *ecr.UploadLayerPartInput, ...request.Option) (*ecr.UploadLayerPartOutput, error) {
+			return &ecr.UploadLayerPartOutput{}, nil
+		},
+		CompleteLayerUploadFn: func(*ecr.CompleteLayerUploadInput) (*ecr.CompleteLayerUploadOutput, error) {
+			return &ecr.CompleteLayerUploadOutput{
+				LayerDigest: aws.String(layerDesc.Digest.String()),
+			}, nil
+		},
+	}
+
+	var uploaded []int64
+	pusher := newResolverPusher(t, fakeClient, testdata.ImageDigest,
+		WithPushProgress(func(_ string, desc ocispec.Descriptor, n, total int64) {
+			assert.Equal(t, layerDesc.Digest, desc.Digest)
+			assert.Equal(t, layerDesc.Size, total)
+			uploaded = append(uploaded, n)
+		}))
+
+	writer, err := pusher.Push(context.Background(), layerDesc)
+	require.NoError(t, err)
+	_, err = writer.Write(layer)
+	require.NoError(t, err)
+	require.NoError(t, writer.Commit(context.Background(), layerDesc.Size, layerDesc.Digest))
+
+	assert.Equal(t, []int64{5, 10, 13}, uploaded)
+}
+
+func TestPushCreateRepository(t *testing.T) {
+	layer := []byte("layer")
+	layerDesc := ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageLayer,
+		Digest:    digest.FromBytes(layer),
+		Size:      int64(len(layer)),
+	}
+	repositoryExists := false
+	var createInputs []*ecr.CreateRepositoryInput
+	fakeClient := &fakeECRClient{
+		BatchCheckLayerAvailabilityFn: func(_ aws.Context, input *ecr.BatchCheckLayerAvailabilityInput, _ ...request.Option) (*ecr.BatchCheckLayerAvailabilityOutput, error) {
+			if !repositoryExists {
+				return nil, awserr.New(ecr.ErrCodeRepositoryNotFoundException, "repository not found", nil)
+			}
+			return &ecr.BatchCheckLayerAvailabilityOutput{
+				Layers: []*ecr.Layer{{
+					LayerDigest:       input.LayerDigests[0],
+					LayerAvailability: aws.String(ecr.LayerAvailabilityUnavailable),
+				}},
+			}, nil
+		},
+		CreateRepositoryFn: func(_ aws.Context, input *ecr.CreateRepositoryInput, _ ...request.Option) (*ecr.CreateRepositoryOutput, error) {
+			createInputs = append(createInputs, input)
+			repositoryExists = true
+			return &ecr.CreateRepositoryOutput{}, nil
+		},
+		InitiateLayerUploadFn: func(*ecr.InitiateLayerUploadInput) (*ecr.InitiateLayerUploadOutput, error) {
+			return &ecr.InitiateLayerUploadOutput{
+				UploadId: aws.String("upload"),
+				PartSize: aws.Int64(10),
+			}, nil
+		},
+	}
+	pusher := newResolverPusher(t, fakeClient, testdata.ImageDigest)
+	_, err := pusher.Push(context.Background(), layerDesc)
+	assert.Error(t, err, "repository should not be created by default")
+	assert.Empty(t, createInputs)
+
+	pusher = newResolverPusher(t, fakeClient, testdata.ImageDigest,
+		WithCreateRepositoryOnPush(true),
+		WithCreateRepositorySettings(RepositorySettings{
+			ImageTagMutability: ecr.ImageTagMutabilityImmutable,
+			Tags:               map[string]string{"team": "build"},
+		}))
+	writer, err := pusher.Push(context.Background(), layerDesc)
+	require.NoError(t, err)
+	assert.NotNil(t, writer)
+	require.Len(t, createInputs, 1)
+	assert.Equal(t, "123456789012", aws.StringValue(createInputs[0].RegistryId))
+	assert.Equal(t, "foo/bar", aws.StringValue(createInputs[0].RepositoryName))
+	assert.Equal(t, ecr.ImageTagMutabilityImmutable, aws.StringValue(createInputs[0].ImageTagMutability))
+	assert.Equal(t, []*ecr.Tag{{Key: aws.String("team"), Value: aws.String("build")}}, createInputs[0].Tags)
+}
+
+func TestPusherCheckLayers(t *testing.T) {
+	var layers []ocispec.Descriptor
+	present := map[string]bool{}
+	for i := 0; i < 150; i++ {
+		desc := ocispec.Descriptor{
+			MediaType: ocispec.MediaTypeImageLayerGzip,
+			Digest:    digest.FromString(strconv.Itoa(i)),
+		}
+		layers = append(layers, desc)
+		present[desc.Digest.String()] = i%2 == 0
+	}
+	manifest := ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageManifest,
+		Digest:    digest.FromString("manifest"),
+	}
+
+	var requests [][]string
+	fakeClient := &fakeECRClient{
+		BatchCheckLayerAvailabilityFn: func(_ aws.Context, input *ecr.BatchCheckLayerAvailabilityInput, _ ...request.Option) (*ecr.BatchCheckLayerAvailabilityOutput, error) {
+			requests = append(requests, aws.StringValueSlice(input.LayerDigests))
+			output := &ecr.BatchCheckLayerAvailabilityOutput{}
+			for _, dgst := range input.LayerDigests {
+				availability := ecr.LayerAvailabilityUnavailable
+				if present[aws.StringValue(dgst)] {
+					availability = ecr.LayerAvailabilityAvailable
+				}
+				output.Layers = append(output.Layers, &ecr.Layer{
+					LayerDigest:       dgst,
+					LayerAvailability: aws.String(availability),
+				})
+			}
+			return output, nil
+		},
+		InitiateLayerUploadFn: func(*ecr.InitiateLayerUploadInput) (*ecr.InitiateLayerUploadOutput, error) {
+			return &ecr.InitiateLayerUploadOutput{UploadId: aws.String("upload"), PartSize: aws.Int64(10)}, nil
+		},
+	}
+	pusher := &ecrPusher{
+		ecrBase: ecrBase{
+			client: fakeClient,
+			ecrSpec: ECRSpec{
+				arn:        arn.ARN{AccountID: "registry"},
+				Repository: "repository",
+			},
+		},
+		tracker:       docker.NewInMemoryTracker(),
+		presentLayers: &sync.Map{},
+	}
+
+	availability, err := pusher.CheckLayers(context.Background(), append(layers, manifest))
+	require.NoError(t, err)
+	require.Len(t, requests, 2, "layers should be checked in batches of 100")
+	assert.Len(t, requests[0], 100)
+	assert.Len(t, requests[1], 50)
+	assert.Len(t, availability, len(layers))
+	assert.NotContains(t, availability, manifest.Digest, "manifests should not be checked")
+	for _, layer := range layers {
+		assert.Equal(t, present[layer.Digest.String()], availability[layer.Digest], layer.Digest)
+	}
+
+	requests = nil
+	_, err = pusher.Push(context.Background(), layers[0])
+	assert.ErrorIs(t, err, errdefs.ErrAlreadyExists)
+	assert.Empty(t, requests, "a layer found present should not be checked again")
+
+	writer, err := pusher.Push(context.Background(), layers[1])
+	require.NoError(t, err)
+	defer writer.Close()
+	assert.Equal(t, [][]string{{layers[1].Digest.String()}}, requests, "a layer found missing should be checked as it is pushed")
+}
@@ -0,0 +1,202 @@
+/*
+ * Copyright 2017-2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You
+ * may not use this file except in compliance with the License. A copy of
+ * the License is located at
+ *
+ * 	http://aws.amazon.com/apache2.0/
+ *
+ * or in the "license" file accompanying this file. This file is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF
+ * ANY KIND, either express or implied. See the License for the specific
+ * language governing permissions and limitations under the License.
+ */
+
+package ecr
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	httputil "github.com/awslabs/amazon-ecr-containerd-resolver/ecr/internal/util/http"
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/log"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// ReaderAtFetcher is implemented by the fetchers of the resolver to read
+// ranges of a layer's content on demand, such as by snapshotters that pull
+// layers with a table of contents, as eStargz and zstd:chunked layers have,
+// lazily.  A seekable reader of the layer is
+// io.NewSectionReader(readerAt, 0, readerAt.Size()).
+type ReaderAtFetcher interface {
+	// ReaderAt returns a reader of desc's content that downloads only the
+	// ranges that are read.  desc.Size must be set.
+	ReaderAt(ctx context.Context, desc ocispec.Descriptor) (content.ReaderAt, error)
+}
+
+var _ ReaderAtFetcher = (*ecrFetcher)(nil)
+
+// ReaderAt returns a reader of the layer's content that requests each range
+// read from the layer's download URL.  The URL is reused across reads until
+// shortly before its presigned expiry, so that GetDownloadUrlForLayer is not
+// called for every range.  The content read is not validated against the
+// layer's digest.
+func (f *ecrFetcher) ReaderAt(ctx context.Context, desc ocispec.Descriptor) (content.ReaderAt, error) {
+	ctx = withLogFields(ctx, f.logFields)
+	ctx = log.WithLogger(ctx, log.G(ctx).WithField("desc", desc.Digest))
+	log.G(ctx).Debug("ecr.fetch.readerat")
+
+	switch desc.MediaType {
+	case
+		images.MediaTypeDockerSchema2Layer,
+		images.MediaTypeDockerSchema2LayerGzip,
+		ocispec.MediaTypeImageLayerGzip,
+		ocispec.MediaTypeImageLayerZstd,
+		ocispec.MediaTypeImageLayer:
+	default:
+		return nil, fmt.Errorf("ecr: reading ranges of %q: %w", desc.MediaType, errdefs.ErrNotImplemented)
+	}
+	if desc.Size <= 0 {
+		return nil, fmt.Errorf("ecr: reading ranges of layer %v of unknown size: %w", desc.Digest, errdefs.ErrInvalidArgument)
+	}
+	downloadURL, err := f.getDownloadURL(ctx, desc)
+	if err != nil {
+		return nil, err
+	}
+	ra := &layerReaderAt{ctx: ctx, fetcher: f, desc: desc, now: time.Now}
+	ra.setDownloadURL(downloadURL)
+	return ra, nil
+}
+
+// layerReaderAt reads ranges of a layer from its download URL, refreshing the
+// URL when it is rejected as the fetcher is configured to.
+type layerReaderAt struct {
+	ctx     context.Context
+	fetcher *ecrFetcher
+	desc    ocispec.Descriptor
+	now     func() time.Time
+
+	lock        sync.Mutex
+	downloadURL string
+	// expires is when downloadURL should be replaced, or zero when the URL
+	// has no presigned expiry.
+	expires time.Time
+}
+
+// setDownloadURL replaces the download URL of the reader.
+func (ra *layerReaderAt) setDownloadURL(downloadURL string) {
+	ra.lock.Lock()
+	defer ra.lock.Unlock()
+	ra.downloadURL = downloadURL
+	ra.expires = time.Time{}
+	if expires, ok := presignedURLExpiry(downloadURL); ok {
+		ra.expires = expires.Add(-downloadURLExpiryMargin)
+	}
+}
+
+// currentDownloadURL returns the download URL of the reader, replacing it
+// first once it is about to expire.
+func (ra *layerReaderAt) currentDownloadURL() (string, error) {
+	ra.lock.Lock()
+	downloadURL, expires := ra.downloadURL, ra.expires
+	ra.lock.Unlock()
+	if expires.IsZero() || ra.now().Before(expires) {
+		return downloadURL, nil
+	}
+	log.G(ra.ctx).Debug("ecr.fetcher.layer.readerat: download URL expiring, refreshing")
+	downloadURL, err := ra.fetcher.getDownloadURL(ra.ctx, ra.desc)
+	if err != nil {
+		return "", err
+	}
+	ra.setDownloadURL(downloadURL)
+	return downloadURL, nil
+}
+
+func (ra *layerReaderAt) Size() int64 {
+	return ra.desc.Size
+}
+
+func (ra *layerReaderAt) Close() error {
+	return nil
+}
+
+func (ra *layerReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, fmt.Errorf("ecr: invalid offset %d: %w", off, errdefs.ErrInvalidArgument)
+	}
+	if off >= ra.desc.Size {
+		return 0, io.EOF
+	}
+	want := len(p)
+	if remaining := ra.desc.Size - off; int64(want) > remaining {
+		want = int(remaining)
+	}
+	if want == 0 {
+		return 0, nil
+	}
+
+	downloadURL, err := ra.currentDownloadURL()
+	if err != nil {
+		return 0, err
+	}
+	for refreshes := 0; ; refreshes++ {
+		n, err := ra.readRange(downloadURL, p[:want], off)
+		if !errors.Is(err, errDownloadForbidden) || refreshes >= ra.fetcher.urlRefreshes {
+			if err == nil && want < len(p) {
+				err = io.EOF
+			}
+			return n, err
+		}
+		log.G(ra.ctx).WithError(err).Warn("ecr.fetcher.layer.readerat: download URL rejected, refreshing")
+		downloadURL, err = ra.fetcher.refreshDownloadURL(ra.ctx, ra.desc)
+		if err != nil {
+			return 0, err
+		}
+		ra.setDownloadURL(downloadURL)
+	}
+}
+
+// readRange reads len(p) bytes of the content at downloadURL from off.  The
+// read is bounded by the fetcher's download limits, as other downloads are.
+func (ra *layerReaderAt) readRange(downloadURL string, p []byte, off int64) (int, error) {
+	req, err := http.NewRequest(http.MethodGet, downloadURL, nil)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", off, off+int64(len(p))-1))
+	rc, err := ra.fetcher.limitFetch(ra.ctx, func() (io.ReadCloser, error) {
+		resp, err := ra.fetcher.doRequest(ra.ctx, req)
+		if err != nil {
+			return nil, err
+		}
+		redactedDownloadURL := httputil.RedactHTTPQueryValuesFromURL(downloadURL)
+		switch resp.StatusCode {
+		case http.StatusPartialContent:
+			return ra.fetcher.limitDownload(ra.ctx, resp.Body), nil
+		case http.StatusForbidden:
+			resp.Body.Close()
+			return nil, fmt.Errorf("%w: %v: %v", errDownloadForbidden, redactedDownloadURL, resp.Status)
+		default:
+			resp.Body.Close()
+			return nil, fmt.Errorf("ecr.fetcher.layer.readerat: unexpected status %v from %v", resp.Status, redactedDownloadURL)
+		}
+	})
+	if err != nil {
+		return 0, err
+	}
+	defer rc.Close()
+	n, err := io.ReadFull(rc, p)
+	if errors.Is(err, io.ErrUnexpectedEOF) {
+		err = fmt.Errorf("ecr.fetcher.layer.readerat: short range of %d bytes from offset %d: %w", n, off, err)
+	}
+	return n, err
+}
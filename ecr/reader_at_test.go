@@ -0,0 +1,205 @@
+/*
+ * Copyright 2017-2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You
+ * may not use this file except in compliance with the License. A copy of
+ * the License is located at
+ *
+ * 	http://aws.amazon.com/apache2.0/
+ *
+ * or in the "license" file accompanying this file. This file is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF
+ * ANY KIND, either express or implied. See the License for the specific
+ * language governing permissions and limitations under the License.
+ */
+
+package ecr
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/arn"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sync/semaphore"
+)
+
+func TestFetcherReaderAt(t *testing.T) {
+	layer := make([]byte, 4096)
+	_, err := rand.Read(layer)
+	require.NoError(t, err)
+	var ranges []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/expired" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		ranges = append(ranges, r.Header.Get("Range"))
+		http.ServeContent(w, r, "", time.Now(), bytes.NewReader(layer))
+	}))
+	defer ts.Close()
+
+	paths := []string{"/expired", "/fresh"}
+	fetcher := &ecrFetcher{
+		ecrBase: ecrBase{
+			client: &fakeECRClient{
+				GetDownloadUrlForLayerFn: func(aws.Context, *ecr.GetDownloadUrlForLayerInput, ...request.Option) (*ecr.GetDownloadUrlForLayerOutput, error) {
+					path := paths[0]
+					paths = paths[1:]
+					return &ecr.GetDownloadUrlForLayerOutput{DownloadUrl: aws.String(ts.URL + path)}, nil
+				},
+			},
+			ecrSpec: ECRSpec{
+				arn:        arn.ARN{AccountID: "registry"},
+				Repository: "repository",
+			},
+		},
+		httpClient:   ts.Client(),
+		urlRefreshes: 1,
+	}
+	desc := ocispec.Descriptor{
+		MediaType:   ocispec.MediaTypeImageLayerZstd,
+		Digest:      digest.FromBytes(layer),
+		Size:        int64(len(layer)),
+		Annotations: map[string]string{"io.github.containers.zstd-chunked.manifest-checksum": "sha256:toc"},
+	}
+
+	ra, err := fetcher.ReaderAt(context.Background(), desc)
+	require.NoError(t, err)
+	defer ra.Close()
+	assert.Equal(t, int64(len(layer)), ra.Size())
+
+	p := make([]byte, 100)
+	n, err := ra.ReadAt(p, 1000)
+	require.NoError(t, err, "the rejected download URL should be refreshed")
+	assert.Equal(t, layer[1000:1100], p[:n])
+
+	n, err = ra.ReadAt(p, int64(len(layer))-10)
+	assert.ErrorIs(t, err, io.EOF)
+	assert.Equal(t, layer[len(layer)-10:], p[:n])
+
+	_, err = ra.ReadAt(p, int64(len(layer)))
+	assert.ErrorIs(t, err, io.EOF)
+	assert.Equal(t, []string{"bytes=1000-1099", "bytes=4086-4095"}, ranges, "only the ranges read should be downloaded")
+
+	_, err = fetcher.ReaderAt(context.Background(), ocispec.Descriptor{MediaType: ocispec.MediaTypeImageManifest, Size: 1})
+	assert.ErrorIs(t, err, errdefs.ErrNotImplemented)
+	_, err = fetcher.ReaderAt(context.Background(), ocispec.Descriptor{MediaType: ocispec.MediaTypeImageLayerZstd})
+	assert.ErrorIs(t, err, errdefs.ErrInvalidArgument)
+}
+
+func TestFetcherReaderAtExpiringURL(t *testing.T) {
+	layer := []byte("layer with a table of contents")
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "", time.Now(), bytes.NewReader(layer))
+	}))
+	defer ts.Close()
+
+	now := time.Now().UTC()
+	signed := now
+	calls := 0
+	fetcher := &ecrFetcher{
+		ecrBase: ecrBase{
+			client: &fakeECRClient{
+				GetDownloadUrlForLayerFn: func(aws.Context, *ecr.GetDownloadUrlForLayerInput, ...request.Option) (*ecr.GetDownloadUrlForLayerOutput, error) {
+					calls++
+					return &ecr.GetDownloadUrlForLayerOutput{
+						DownloadUrl: aws.String(ts.URL + "/layer?X-Amz-Expires=600&X-Amz-Date=" + signed.Format("20060102T150405Z")),
+					}, nil
+				},
+			},
+			ecrSpec: ECRSpec{
+				arn:        arn.ARN{AccountID: "registry"},
+				Repository: "repository",
+			},
+		},
+		httpClient: ts.Client(),
+	}
+	desc := ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageLayerGzip,
+		Digest:    digest.FromBytes(layer),
+		Size:      int64(len(layer)),
+	}
+
+	ra, err := fetcher.ReaderAt(context.Background(), desc)
+	require.NoError(t, err)
+	ra.(*layerReaderAt).now = func() time.Time { return now }
+	section := io.NewSectionReader(ra, 0, ra.Size())
+	_, err = section.Seek(6, io.SeekStart)
+	require.NoError(t, err)
+	p := make([]byte, 4)
+	_, err = io.ReadFull(section, p)
+	require.NoError(t, err)
+	assert.Equal(t, "with", string(p))
+	_, err = ra.ReadAt(p, 0)
+	require.NoError(t, err)
+	assert.Equal(t, "laye", string(p))
+	assert.Equal(t, 1, calls, "the download URL should be reused until it expires")
+
+	now = now.Add(10*time.Minute - downloadURLExpiryMargin)
+	signed = now
+	_, err = ra.ReadAt(p, 0)
+	require.NoError(t, err)
+	assert.Equal(t, 2, calls, "the download URL should be refreshed before it expires")
+	_, err = ra.ReadAt(p, 0)
+	require.NoError(t, err)
+	assert.Equal(t, 2, calls)
+}
+
+func TestFetcherReaderAtFetchLimiter(t *testing.T) {
+	layer := []byte("layer content read in ranges")
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "", time.Now(), bytes.NewReader(layer))
+	}))
+	defer ts.Close()
+	limiter := semaphore.NewWeighted(1)
+	fetcher := &ecrFetcher{
+		ecrBase: ecrBase{
+			client: &fakeECRClient{
+				GetDownloadUrlForLayerFn: func(aws.Context, *ecr.GetDownloadUrlForLayerInput, ...request.Option) (*ecr.GetDownloadUrlForLayerOutput, error) {
+					return &ecr.GetDownloadUrlForLayerOutput{DownloadUrl: aws.String(ts.URL)}, nil
+				},
+			},
+		},
+		httpClient:   ts.Client(),
+		fetchLimiter: limiter,
+	}
+	desc := ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageLayerGzip,
+		Digest:    digest.FromBytes(layer),
+		Size:      int64(len(layer)),
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	ra, err := fetcher.ReaderAt(ctx, desc)
+	require.NoError(t, err)
+	defer ra.Close()
+
+	// A read waits for a slot of the limiter, as other downloads do.
+	require.True(t, limiter.TryAcquire(1))
+	_, err = ra.ReadAt(make([]byte, 5), 6)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	limiter.Release(1)
+
+	ra, err = fetcher.ReaderAt(context.Background(), desc)
+	require.NoError(t, err)
+	p := make([]byte, 5)
+	_, err = ra.ReadAt(p, 6)
+	require.NoError(t, err)
+	assert.Equal(t, "conte", string(p))
+	assert.True(t, limiter.TryAcquire(1), "the slot should be released once the range is read")
+}
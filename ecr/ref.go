@@ -16,10 +16,12 @@
 package ecr
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"regexp"
 	"strings"
+	"sync"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/arn"
@@ -31,23 +33,93 @@ import (
 
 const (
 	refPrefix        = "ecr.aws/"
+	fipsRefPrefix    = "ecr-fips.aws/"
 	repositoryPrefix = "repository/"
 	arnServiceID     = "ecr"
 )
 
+const (
+	// publicRegistryHost is the host of Amazon ECR Public registries, whose
+	// references are of the form "public.ecr.aws/<alias>/<name>:<tag>".
+	publicRegistryHost = "public.ecr.aws"
+	publicServiceID    = "ecr-public"
+	// publicRegion is the region of the Amazon ECR Public endpoint.
+	publicRegion = "us-east-1"
+)
+
 var (
 	invalidARN = errors.New("ref: invalid ARN")
 	// Expecting to match ECR image names of the form:
 	// Example 1: 777777777777.dkr.ecr.us-west-2.amazonaws.com/my_image:latest
 	// Example 2: 777777777777.dkr.ecr.cn-north-1.amazonaws.com.cn/my_image:latest
-	// TODO: Support ECR FIPS endpoints, i.e "ecr-fips" in the URL instead of "ecr"
-	ecrRegex           = regexp.MustCompile(`(^[a-zA-Z0-9][a-zA-Z0-9-_]*)\.dkr\.ecr\.([a-zA-Z0-9][a-zA-Z0-9-_]*)\.amazonaws\.com(\.cn)?/.*`)
+	// Example 3: 777777777777.dkr.ecr-fips.us-gov-west-1.amazonaws.com/my_image:latest
+	ecrRegex           = regexp.MustCompile(`(^[a-zA-Z0-9][a-zA-Z0-9-_]*)\.dkr\.(ecr|ecr-fips)\.([a-zA-Z0-9][a-zA-Z0-9-_]*)\.amazonaws\.com(\.cn)?/.*`)
 	errInvalidImageURI = errors.New("ecrspec: invalid image URI")
+
+	// hostSuffixes holds the DNS suffixes registered with
+	// RegisterECRHostSuffix.
+	hostSuffixes     []hostSuffix
+	hostSuffixesLock sync.RWMutex
 )
 
+// hostSuffix is an additional ECR DNS suffix and the partition it belongs to.
+type hostSuffix struct {
+	suffix    string
+	partition string
+	regex     *regexp.Regexp
+}
+
+// RegisterECRHostSuffix registers an additional DNS suffix, such as
+// "example.cloud", for ParseImageURI to recognize.  Image URIs of the form
+// "<account>.dkr.ecr.<region>.<suffix>/<repository>" are parsed into
+// references in the given partition.  RegisterECRHostSuffix panics if either
+// suffix or partition is empty.
+func RegisterECRHostSuffix(suffix, partition string) {
+	suffix = strings.Trim(suffix, ".")
+	if suffix == "" || partition == "" {
+		panic("ecr: RegisterECRHostSuffix requires a suffix and partition")
+	}
+	hostSuffixesLock.Lock()
+	defer hostSuffixesLock.Unlock()
+	hostSuffixes = append(hostSuffixes, hostSuffix{
+		suffix:    suffix,
+		partition: partition,
+		regex:     regexp.MustCompile(`(^[a-zA-Z0-9][a-zA-Z0-9-_]*)\.dkr\.(ecr|ecr-fips)\.([a-zA-Z0-9][a-zA-Z0-9-_]*)\.` + regexp.QuoteMeta(suffix) + `/.*`),
+	})
+}
+
+// parseRegisteredHost matches input against the registered host suffixes and
+// returns the matches of the first, along with its partition.
+func parseRegisteredHost(input string) (matches []string, partition string) {
+	hostSuffixesLock.RLock()
+	defer hostSuffixesLock.RUnlock()
+	for _, hs := range hostSuffixes {
+		if matches := hs.regex.FindStringSubmatch(input); len(matches) >= 4 {
+			return matches, hs.partition
+		}
+	}
+	return nil, ""
+}
+
+// registeredDNSSuffix returns the first host suffix registered for the
+// partition.
+func registeredDNSSuffix(partition string) (string, bool) {
+	hostSuffixesLock.RLock()
+	defer hostSuffixesLock.RUnlock()
+	for _, hs := range hostSuffixes {
+		if hs.partition == partition {
+			return hs.suffix, true
+		}
+	}
+	return "", false
+}
+
 // ECRSpec represents a parsed reference.
 //
 // Valid references are of the form "ecr.aws/arn:aws:ecr:<region>:<account>:repository/<name>:<tag>".
+// References of the form "ecr-fips.aws/arn:..." are served by the region's
+// FIPS endpoint.  Amazon ECR Public references are of the form
+// "public.ecr.aws/<alias>/<name>:<tag>".
 type ECRSpec struct {
 	// Repository name for this reference.
 	Repository string
@@ -56,34 +128,84 @@ type ECRSpec struct {
 	Object string
 	// arn holds the canonical AWS resource name for this reference.
 	arn arn.ARN
+	// fips is set when the reference is to be served by a FIPS endpoint.
+	fips bool
+	// registryAlias is the alias of the Amazon ECR Public registry, set only
+	// for public references.
+	registryAlias string
 }
 
 // ParseRef parses an ECR reference into its constituent parts
 func ParseRef(ref string) (ECRSpec, error) {
+	return parseRef(ref, false)
+}
+
+// ParseRefStrict parses an ECR reference like ParseRef, additionally
+// requiring the reference's ARN to name the partition, region, account and
+// resource of an ECR repository.  ParseRef accepts ARNs missing these fields,
+// producing specs that only fail once used.
+func ParseRefStrict(ref string) (ECRSpec, error) {
+	return parseRef(ref, true)
+}
+
+func parseRef(ref string, strict bool) (ECRSpec, error) {
+	if strings.HasPrefix(ref, publicRegistryHost+"/") {
+		return ParsePublicImageURI(ref)
+	}
+	if strings.HasPrefix(ref, fipsRefPrefix) {
+		spec, err := parseARN(ref[len(fipsRefPrefix):], strict)
+		spec.fips = err == nil
+		return spec, err
+	}
 	if !strings.HasPrefix(ref, refPrefix) {
 		return ECRSpec{}, invalidARN
 	}
 	stripped := ref[len(refPrefix):]
-	return parseARN(stripped)
+	return parseARN(stripped, strict)
+}
+
+// validateARN checks that each field of an ECR repository ARN is present.
+func validateARN(a arn.ARN) error {
+	switch {
+	case a.Partition == "":
+		return fmt.Errorf("%w: missing partition", invalidARN)
+	case a.Service == "":
+		return fmt.Errorf("%w: missing service", invalidARN)
+	case a.Service != arnServiceID:
+		return fmt.Errorf("%w: unexpected service %q", invalidARN, a.Service)
+	case a.Region == "":
+		return fmt.Errorf("%w: missing region", invalidARN)
+	case a.AccountID == "":
+		return fmt.Errorf("%w: missing account ID", invalidARN)
+	case a.Resource == "", a.Resource+"/" == repositoryPrefix:
+		return fmt.Errorf("%w: missing resource", invalidARN)
+	}
+	return nil
 }
 
 // ParseImageURI takes an ECR image URI and then constructs and returns an ECRSpec struct
 func ParseImageURI(input string) (ECRSpec, error) {
 	input = strings.TrimPrefix(input, "https://")
 
-	// Matching on account, region
+	// Matching on account, service, region
 	matches := ecrRegex.FindStringSubmatch(input)
-	if len(matches) < 3 {
-		return ECRSpec{}, errInvalidImageURI
+	var partitionID string
+	if len(matches) >= 4 {
+		// Get the correct partition given its region
+		partition, found := endpoints.PartitionForRegion(endpoints.DefaultPartitions(), matches[3])
+		if !found {
+			return ECRSpec{}, errInvalidImageURI
+		}
+		partitionID = partition.ID()
+	} else {
+		matches, partitionID = parseRegisteredHost(input)
+		if matches == nil {
+			return ECRSpec{}, errInvalidImageURI
+		}
 	}
 	account := matches[1]
-	region := matches[2]
-
-	// Get the correct partition given its region
-	partition, found := endpoints.PartitionForRegion(endpoints.DefaultPartitions(), region)
-	if !found {
-		return ECRSpec{}, errInvalidImageURI
-	}
+	fips := matches[2] == "ecr-fips"
+	region := matches[3]
 
 	// Need to include the full repository path and the imageID (e.g. /eks/image-name:tag)
 	tokens := strings.SplitN(input, "/", 2)
@@ -126,15 +248,70 @@ func ParseImageURI(input string) (ECRSpec, error) {
 		Repository: strings.TrimPrefix(ref.Locator, repositoryPrefix),
 		Object:     ref.Object,
 		arn: arn.ARN{
-			Partition: partition.ID(),
+			Partition: partitionID,
 			Service:   arnServiceID,
 			Region:    region,
 			AccountID: account,
 			Resource:  ref.Locator,
 		},
+		fips: fips,
 	}, nil
 }
 
+// ParsePublicImageURI takes an Amazon ECR Public image URI, such as
+// "public.ecr.aws/amazonlinux/amazonlinux:latest", and then constructs and
+// returns an ECRSpec struct
+func ParsePublicImageURI(input string) (ECRSpec, error) {
+	input = strings.TrimPrefix(input, "https://")
+	if !strings.HasPrefix(input, publicRegistryHost+"/") {
+		return ECRSpec{}, errInvalidImageURI
+	}
+	alias, fullRepoPath, ok := strings.Cut(input[len(publicRegistryHost)+1:], "/")
+	if !ok || alias == "" {
+		return ECRSpec{}, errInvalidImageURI
+	}
+	switch {
+	case
+		fullRepoPath == "",
+		strings.HasSuffix(fullRepoPath, ":"),
+		strings.HasSuffix(fullRepoPath, "@"):
+		return ECRSpec{}, errors.New("incomplete reference provided")
+	}
+
+	ref, err := reference.Parse(repositoryPrefix + fullRepoPath)
+	if err != nil {
+		return ECRSpec{}, err
+	}
+	if ref.Digest() != "" {
+		if err := ref.Digest().Validate(); err != nil && err != digest.ErrDigestUnsupported {
+			return ECRSpec{}, fmt.Errorf("%v: %w", errInvalidImageURI.Error(), err)
+		}
+	}
+
+	return ECRSpec{
+		Repository: strings.TrimPrefix(ref.Locator, repositoryPrefix),
+		Object:     ref.Object,
+		arn: arn.ARN{
+			Partition: endpoints.AwsPartitionID,
+			Service:   publicServiceID,
+			Region:    publicRegion,
+			Resource:  ref.Locator,
+		},
+		registryAlias: alias,
+	}, nil
+}
+
+// Public reports whether the reference is to an Amazon ECR Public registry.
+func (spec ECRSpec) Public() bool {
+	return spec.registryAlias != ""
+}
+
+// RegistryAlias returns the alias of the Amazon ECR Public registry, or an
+// empty string for private registries.
+func (spec ECRSpec) RegistryAlias() string {
+	return spec.registryAlias
+}
+
 // Partition returns the AWS partition
 func (spec ECRSpec) Partition() string {
 	return spec.arn.Partition
@@ -145,6 +322,12 @@ func (spec ECRSpec) Region() string {
 	return spec.arn.Region
 }
 
+// FIPS reports whether the reference is to be served by the region's FIPS
+// endpoint.
+func (spec ECRSpec) FIPS() bool {
+	return spec.fips
+}
+
 // Registry returns the Amazon ECR registry
 func (spec ECRSpec) Registry() string {
 	return spec.arn.AccountID
@@ -153,7 +336,7 @@ func (spec ECRSpec) Registry() string {
 // parseARN parses an ECR ARN into its constituent parts.
 //
 // An example ARN is: arn:aws:ecr:us-west-2:123456789012:repository/foo/bar
-func parseARN(a string) (ECRSpec, error) {
+func parseARN(a string, strict bool) (ECRSpec, error) {
 	parsed, err := arn.Parse(a)
 	if err != nil {
 		return ECRSpec{}, err
@@ -164,6 +347,11 @@ func parseARN(a string) (ECRSpec, error) {
 		return ECRSpec{}, err
 	}
 	parsed.Resource = spec.Locator
+	if strict {
+		if err := validateARN(parsed); err != nil {
+			return ECRSpec{}, err
+		}
+	}
 
 	// Extract unprefixed repo name contained in the resource part.
 	unprefixedRepo := strings.TrimPrefix(parsed.Resource, repositoryPrefix)
@@ -178,20 +366,63 @@ func parseARN(a string) (ECRSpec, error) {
 	}, nil
 }
 
+// RegistryURI returns the reference in the form used by Docker clients, such
+// as "123456789012.dkr.ecr.us-west-2.amazonaws.com/my_image:latest".  The URI
+// contains no credentials and is suitable for logging.
+func (spec ECRSpec) RegistryURI() string {
+	if spec.Public() {
+		return spec.Canonical()
+	}
+	dnsSuffix, found := registeredDNSSuffix(spec.Partition())
+	if !found {
+		dnsSuffix = "amazonaws.com"
+	}
+	for _, partition := range endpoints.DefaultPartitions() {
+		if partition.ID() == spec.Partition() {
+			dnsSuffix = partition.DNSSuffix()
+			break
+		}
+	}
+	service := "ecr"
+	if spec.fips {
+		service = "ecr-fips"
+	}
+	uri := fmt.Sprintf("%s.dkr.%s.%s.%s/%s", spec.Registry(), service, spec.Region(), dnsSuffix, spec.Repository)
+	switch {
+	case spec.Object == "":
+	case strings.HasPrefix(spec.Object, "@"):
+		uri += spec.Object
+	default:
+		uri += ":" + spec.Object
+	}
+	return uri
+}
+
 // Canonical returns the canonical representation for the reference
 func (spec ECRSpec) Canonical() string {
 	return spec.Spec().String()
 }
 
-// ARN returns the canonical representation of the ECR ARN
+// ARN returns the canonical representation of the ECR ARN.  The ARN of a public
+// reference has no account as the reference identifies its registry by alias.
 func (spec ECRSpec) ARN() string {
 	return spec.arn.String()
 }
 
 // Spec returns a reference.Spec
 func (spec ECRSpec) Spec() reference.Spec {
+	if spec.Public() {
+		return reference.Spec{
+			Locator: publicRegistryHost + "/" + spec.registryAlias + "/" + spec.Repository,
+			Object:  spec.Object,
+		}
+	}
+	prefix := refPrefix
+	if spec.fips {
+		prefix = fipsRefPrefix
+	}
 	return reference.Spec{
-		Locator: refPrefix + spec.ARN(),
+		Locator: prefix + spec.ARN(),
 		Object:  spec.Object,
 	}
 }
@@ -209,6 +440,32 @@ func (spec ECRSpec) ImageID() *ecr.ImageIdentifier {
 	return &imageID
 }
 
+// MarshalJSON encodes the ECRSpec as its canonical reference string.
+func (spec ECRSpec) MarshalJSON() ([]byte, error) {
+	if spec == (ECRSpec{}) {
+		return json.Marshal("")
+	}
+	return json.Marshal(spec.Canonical())
+}
+
+// UnmarshalJSON decodes an ECRSpec from its canonical reference string.
+func (spec *ECRSpec) UnmarshalJSON(data []byte) error {
+	var ref string
+	if err := json.Unmarshal(data, &ref); err != nil {
+		return err
+	}
+	if ref == "" {
+		*spec = ECRSpec{}
+		return nil
+	}
+	parsed, err := ParseRef(ref)
+	if err != nil {
+		return err
+	}
+	*spec = parsed
+	return nil
+}
+
 // TagDigest returns the tag and/or digest specified by the reference
 func (spec ECRSpec) TagDigest() (string, digest.Digest) {
 	tag, digest := reference.SplitObject(spec.Object)
@@ -16,14 +16,18 @@
 package ecr
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
+	"strconv"
+	"strings"
 	"testing"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/arn"
 	"github.com/aws/aws-sdk-go/service/ecr"
 	"github.com/awslabs/amazon-ecr-containerd-resolver/ecr/internal/testdata"
+	"github.com/opencontainers/go-digest"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -106,6 +110,26 @@ func TestRefRepresentations(t *testing.T) {
 				Object:     "@" + testdata.ImageDigest.String(),
 			},
 		},
+		{
+			ref: "ecr-fips.aws/arn:aws-us-gov:ecr:us-gov-west-1:123456789012:repository/foo/bar:latest",
+			arn: "arn:aws-us-gov:ecr:us-gov-west-1:123456789012:repository/foo/bar",
+			spec: ECRSpec{
+				arn: arn.ARN{
+					Partition: "aws-us-gov",
+					Region:    "us-gov-west-1",
+					AccountID: "123456789012",
+					Service:   "ecr",
+					Resource:  "repository/foo/bar",
+				},
+				Repository: "foo/bar",
+				Object:     "latest",
+				fips:       true,
+			},
+		},
+		{
+			ref: "ecr-fips.aws/arn:nope",
+			err: errors.New("arn: not enough sections"),
+		},
 	}
 	for _, tc := range cases {
 		t.Run(fmt.Sprintf("ParseRef-%s", tc.ref), func(t *testing.T) {
@@ -126,9 +150,82 @@ func TestRefRepresentations(t *testing.T) {
 		t.Run(fmt.Sprintf("ARN-%s", tc.ref), func(t *testing.T) {
 			assert.Equal(t, tc.arn, tc.spec.ARN())
 		})
+		t.Run(fmt.Sprintf("JSON-%s", tc.ref), func(t *testing.T) {
+			data, err := json.Marshal(tc.spec)
+			require.NoError(t, err)
+			assert.JSONEq(t, strconv.Quote(tc.ref), string(data))
+
+			var spec ECRSpec
+			require.NoError(t, json.Unmarshal(data, &spec))
+			assert.Equal(t, tc.spec, spec)
+		})
+	}
+}
+
+func TestParseRefStrict(t *testing.T) {
+	cases := []struct {
+		ref string
+		err string
+	}{
+		{
+			ref: "ecr.aws/arn::ecr:us-west-2:123456789012:repository/foo/bar:latest",
+			err: "ref: invalid ARN: missing partition",
+		},
+		{
+			ref: "ecr.aws/arn:aws::us-west-2:123456789012:repository/foo/bar:latest",
+			err: "ref: invalid ARN: missing service",
+		},
+		{
+			ref: "ecr.aws/arn:aws:s3:us-west-2:123456789012:repository/foo/bar:latest",
+			err: `ref: invalid ARN: unexpected service "s3"`,
+		},
+		{
+			ref: "ecr.aws/arn:aws:ecr::123456789012:repository/foo/bar:latest",
+			err: "ref: invalid ARN: missing region",
+		},
+		{
+			ref: "ecr.aws/arn:aws:ecr:us-west-2::repository/foo/bar:latest",
+			err: "ref: invalid ARN: missing account ID",
+		},
+		{
+			ref: "ecr.aws/arn:aws:ecr:us-west-2:123456789012:repository/:latest",
+			err: "ref: invalid ARN: missing resource",
+		},
+		{
+			ref: "ecr.aws/arn:aws:ecr:us-west-2:123456789012:repository/foo/bar:latest",
+		},
+		{
+			ref: "public.ecr.aws/alias/foo:latest",
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.ref, func(t *testing.T) {
+			spec, err := ParseRefStrict(tc.ref)
+			if tc.err == "" {
+				require.NoError(t, err)
+				assert.Equal(t, tc.ref, spec.Canonical())
+				return
+			}
+			assert.EqualError(t, err, tc.err)
+			assert.ErrorIs(t, err, invalidARN)
+			assert.Equal(t, ECRSpec{}, spec)
+		})
 	}
 }
 
+func TestECRSpecJSON(t *testing.T) {
+	data, err := json.Marshal(ECRSpec{})
+	require.NoError(t, err)
+	assert.Equal(t, `""`, string(data))
+
+	spec := ECRSpec{Repository: "unset"}
+	require.NoError(t, json.Unmarshal(data, &spec))
+	assert.Equal(t, ECRSpec{}, spec)
+
+	assert.Error(t, json.Unmarshal([]byte(`"invalid"`), &spec))
+	assert.Error(t, json.Unmarshal([]byte(`{}`), &spec))
+}
+
 func TestImageID(t *testing.T) {
 	cases := []struct {
 		name    string
@@ -224,6 +321,11 @@ func TestParseImageURIValid(t *testing.T) {
 			"777777777777.dkr.ecr.us-gov-east-1.amazonaws.com/my_image:latest",
 			"ecr.aws/arn:aws-us-gov:ecr:us-gov-east-1:777777777777:repository/my_image:latest",
 		},
+		{
+			"AWS Gov Cloud West FIPS",
+			"777777777777.dkr.ecr-fips.us-gov-west-1.amazonaws.com/my_image:latest",
+			"ecr-fips.aws/arn:aws-us-gov:ecr:us-gov-west-1:777777777777:repository/my_image:latest",
+		},
 	}
 	for _, tc := range tests {
 		t.Run(tc.name, func(t *testing.T) {
@@ -291,3 +393,130 @@ func TestParseImageURIInvalid(t *testing.T) {
 		})
 	}
 }
+
+func TestRegistryURI(t *testing.T) {
+	imageDigest := digest.FromString("image")
+	for _, tc := range []struct {
+		ref      string
+		expected string
+	}{
+		{
+			ref:      "ecr.aws/arn:aws:ecr:us-west-2:123456789012:repository/foo/bar:latest",
+			expected: "123456789012.dkr.ecr.us-west-2.amazonaws.com/foo/bar:latest",
+		},
+		{
+			ref:      "ecr.aws/arn:aws-cn:ecr:cn-north-1:123456789012:repository/foo/bar@" + imageDigest.String(),
+			expected: "123456789012.dkr.ecr.cn-north-1.amazonaws.com.cn/foo/bar@" + imageDigest.String(),
+		},
+		{
+			ref:      "ecr.aws/arn:aws-us-gov:ecr:us-gov-west-1:123456789012:repository/foo/bar:latest@" + imageDigest.String(),
+			expected: "123456789012.dkr.ecr.us-gov-west-1.amazonaws.com/foo/bar:latest@" + imageDigest.String(),
+		},
+		{
+			ref:      "ecr.aws/arn:aws:ecr:us-west-2:123456789012:repository/foo/bar",
+			expected: "123456789012.dkr.ecr.us-west-2.amazonaws.com/foo/bar",
+		},
+		{
+			ref:      "ecr-fips.aws/arn:aws-us-gov:ecr:us-gov-west-1:123456789012:repository/foo/bar:latest",
+			expected: "123456789012.dkr.ecr-fips.us-gov-west-1.amazonaws.com/foo/bar:latest",
+		},
+	} {
+		t.Run(tc.ref, func(t *testing.T) {
+			spec, err := ParseRef(tc.ref)
+			require.NoError(t, err)
+			assert.Equal(t, tc.expected, spec.RegistryURI())
+
+			// The URI should parse back to the same reference.
+			parsed, err := ParseImageURI(spec.RegistryURI())
+			require.NoError(t, err)
+			assert.Equal(t, spec, parsed)
+		})
+	}
+}
+
+func TestParseImageURIRegisteredHostSuffix(t *testing.T) {
+	hostSuffixesLock.RLock()
+	registered := hostSuffixes
+	hostSuffixesLock.RUnlock()
+	t.Cleanup(func() {
+		hostSuffixesLock.Lock()
+		hostSuffixes = registered
+		hostSuffixesLock.Unlock()
+	})
+
+	const imageURI = "777777777777.dkr.ecr.example-region-1.example.cloud/foo/my_image:latest"
+	_, err := ParseImageURI(imageURI)
+	assert.Equal(t, errInvalidImageURI, err, "unregistered suffix should not be recognized")
+
+	RegisterECRHostSuffix("example.cloud", "aws-example")
+	spec, err := ParseImageURI(imageURI)
+	require.NoError(t, err)
+	assert.Equal(t, "aws-example", spec.Partition())
+	assert.Equal(t, "example-region-1", spec.Region())
+	assert.Equal(t, "777777777777", spec.Registry())
+	assert.Equal(t, "foo/my_image", spec.Repository)
+	assert.Equal(t, "arn:aws-example:ecr:example-region-1:777777777777:repository/foo/my_image", spec.ARN())
+	assert.Equal(t, imageURI, spec.RegistryURI())
+
+	_, err = ParseImageURI("777777777777.dkr.ecr.example-region-1.example.cloudy/foo/my_image:latest")
+	assert.Equal(t, errInvalidImageURI, err, "suffix should match exactly")
+	assert.Panics(t, func() { RegisterECRHostSuffix("", "aws-example") })
+}
+
+func TestParsePublicImageURI(t *testing.T) {
+	imageDigest := digest.FromString("image")
+	for _, tc := range []struct {
+		imageName  string
+		alias      string
+		repository string
+		object     string
+	}{
+		{
+			imageName:  "public.ecr.aws/amazonlinux/amazonlinux:latest",
+			alias:      "amazonlinux",
+			repository: "amazonlinux",
+			object:     "latest",
+		},
+		{
+			imageName:  "https://public.ecr.aws/alias/foo/bar@" + imageDigest.String(),
+			alias:      "alias",
+			repository: "foo/bar",
+			object:     "@" + imageDigest.String(),
+		},
+	} {
+		t.Run(tc.imageName, func(t *testing.T) {
+			spec, err := ParsePublicImageURI(tc.imageName)
+			require.NoError(t, err)
+			assert.True(t, spec.Public())
+			assert.Equal(t, tc.alias, spec.RegistryAlias())
+			assert.Equal(t, tc.repository, spec.Repository)
+			assert.Equal(t, tc.object, spec.Object)
+			assert.Equal(t, "us-east-1", spec.Region())
+
+			canonical := strings.TrimPrefix(tc.imageName, "https://")
+			assert.Equal(t, canonical, spec.Canonical())
+			assert.Equal(t, canonical, spec.RegistryURI())
+			parsed, err := ParseRef(spec.Canonical())
+			require.NoError(t, err)
+			assert.Equal(t, spec, parsed)
+		})
+	}
+
+	for _, imageName := range []string{
+		"public.ecr.aws/",
+		"public.ecr.aws/alias",
+		"public.ecr.aws/alias/",
+		"public.ecr.aws//repository:latest",
+		"public.ecr.aws/alias/repository:",
+		"777777777777.dkr.ecr.us-west-2.amazonaws.com/my_image:latest",
+	} {
+		t.Run(imageName, func(t *testing.T) {
+			_, err := ParsePublicImageURI(imageName)
+			assert.Error(t, err)
+		})
+	}
+
+	spec, err := ParseImageURI("777777777777.dkr.ecr.us-west-2.amazonaws.com/my_image:latest")
+	require.NoError(t, err)
+	assert.False(t, spec.Public())
+}
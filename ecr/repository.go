@@ -0,0 +1,173 @@
+/*
+ * Copyright 2017-2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You
+ * may not use this file except in compliance with the License. A copy of
+ * the License is located at
+ *
+ * 	http://aws.amazon.com/apache2.0/
+ *
+ * or in the "license" file accompanying this file. This file is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF
+ * ANY KIND, either express or implied. See the License for the specific
+ * language governing permissions and limitations under the License.
+ */
+
+package ecr
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/log"
+)
+
+// RepositoryInfo describes an Amazon ECR repository.
+type RepositoryInfo struct {
+	// Name of the repository.
+	Name string
+	// ARN of the repository.
+	ARN string
+	// RegistryID is the AWS account ID of the registry that contains the
+	// repository.
+	RegistryID string
+	// URI of the repository, as used by Docker clients.
+	URI string
+	// CreatedAt is when the repository was created.
+	CreatedAt time.Time
+}
+
+// RepositorySettings configures the repositories created on push, as enabled
+// with WithCreateRepositoryOnPush.  Unset fields use ECR's defaults.
+type RepositorySettings struct {
+	// ImageTagMutability is the tag mutability of the repository, either
+	// ecr.ImageTagMutabilityMutable or ecr.ImageTagMutabilityImmutable.
+	ImageTagMutability string
+	// EncryptionConfiguration is the encryption of the repository.  When not
+	// set, repositories are encrypted with the KMS key required with
+	// WithRequiredEncryption, if any.
+	EncryptionConfiguration *ecr.EncryptionConfiguration
+	// ScanOnPush enables scanning of images pushed to the repository.
+	ScanOnPush bool
+	// Tags are applied to the repository.
+	Tags map[string]string
+}
+
+// isRepositoryNotFound reports whether err is ECR's error for a repository
+// that does not exist.
+func isRepositoryNotFound(err error) bool {
+	var awsErr awserr.Error
+	return errors.As(err, &awsErr) && awsErr.Code() == ecr.ErrCodeRepositoryNotFoundException
+}
+
+// createRepository creates the reference's repository with settings.  A
+// repository created concurrently, such as by another push, is not an error.
+func createRepository(ctx context.Context, client ecrAPI, ecrSpec ECRSpec, settings RepositorySettings) error {
+	input := &ecr.CreateRepositoryInput{
+		RegistryId:              aws.String(ecrSpec.Registry()),
+		RepositoryName:          aws.String(ecrSpec.Repository),
+		EncryptionConfiguration: settings.EncryptionConfiguration,
+	}
+	if settings.ImageTagMutability != "" {
+		input.ImageTagMutability = aws.String(settings.ImageTagMutability)
+	}
+	if settings.ScanOnPush {
+		input.ImageScanningConfiguration = &ecr.ImageScanningConfiguration{ScanOnPush: aws.Bool(true)}
+	}
+	keys := make([]string, 0, len(settings.Tags))
+	for key := range settings.Tags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		input.Tags = append(input.Tags, &ecr.Tag{Key: aws.String(key), Value: aws.String(settings.Tags[key])})
+	}
+	_, err := client.CreateRepositoryWithContext(ctx, input)
+	if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == ecr.ErrCodeRepositoryAlreadyExistsException {
+		log.G(ctx).WithField("repository", ecrSpec.ARN()).Debug("ecr.repository.create: repository already exists")
+		return nil
+	}
+	if err != nil {
+		log.G(ctx).WithField("repository", ecrSpec.ARN()).WithError(err).Warn("Failed while calling CreateRepository")
+		return err
+	}
+	log.G(ctx).WithField("repository", ecrSpec.ARN()).Info("ecr.repository.create: created repository")
+	return nil
+}
+
+// RepositoryLister is implemented by the resolver to enumerate repositories.
+type RepositoryLister interface {
+	// ListRepositories returns the repositories of the default registry of
+	// the session's account in region.
+	ListRepositories(ctx context.Context, region string) ([]RepositoryInfo, error)
+}
+
+var _ RepositoryLister = (*ecrResolver)(nil)
+
+// ListRepositories returns all repositories in the default registry of the
+// session's account for the given region.
+func (r *ecrResolver) ListRepositories(ctx context.Context, region string) ([]RepositoryInfo, error) {
+	client := r.getClient(region)
+
+	var repositories []RepositoryInfo
+	input := &ecr.DescribeRepositoriesInput{}
+	for {
+		output, err := client.DescribeRepositoriesWithContext(ctx, input)
+		if err != nil {
+			log.G(ctx).WithField("region", region).WithError(err).Warn("Failed while calling DescribeRepositories")
+			return nil, err
+		}
+		for _, repository := range output.Repositories {
+			repositories = append(repositories, RepositoryInfo{
+				Name:       aws.StringValue(repository.RepositoryName),
+				ARN:        aws.StringValue(repository.RepositoryArn),
+				RegistryID: aws.StringValue(repository.RegistryId),
+				URI:        aws.StringValue(repository.RepositoryUri),
+				CreatedAt:  aws.TimeValue(repository.CreatedAt),
+			})
+		}
+		if aws.StringValue(output.NextToken) == "" {
+			break
+		}
+		input.NextToken = output.NextToken
+	}
+	return repositories, nil
+}
+
+// checkEncryption verifies that the reference's repository is encrypted with
+// the resolver's required KMS key.  Repositories that pass are not checked
+// again.
+func (r *ecrResolver) checkEncryption(ctx context.Context, client ecrAPI, ecrSpec ECRSpec) error {
+	repositoryARN := ecrSpec.ARN()
+	if _, ok := r.encryptionVerified.Load(repositoryARN); ok {
+		return nil
+	}
+
+	output, err := client.DescribeRepositoriesWithContext(ctx, &ecr.DescribeRepositoriesInput{
+		RegistryId:      aws.String(ecrSpec.Registry()),
+		RepositoryNames: []*string{aws.String(ecrSpec.Repository)},
+	})
+	if err != nil {
+		log.G(ctx).WithField("repository", repositoryARN).WithError(err).Warn("Failed while calling DescribeRepositories")
+		return err
+	}
+	if len(output.Repositories) == 0 {
+		return fmt.Errorf("ecr: repository %v: %w", repositoryARN, errdefs.ErrNotFound)
+	}
+	encryption := output.Repositories[0].EncryptionConfiguration
+	if encryption == nil ||
+		aws.StringValue(encryption.EncryptionType) != ecr.EncryptionTypeKms ||
+		aws.StringValue(encryption.KmsKey) != r.requiredEncryptionKey {
+		return fmt.Errorf("ecr: repository %v is not encrypted with the required KMS key %v: %w",
+			repositoryARN, r.requiredEncryptionKey, errdefs.ErrFailedPrecondition)
+	}
+	r.encryptionVerified.Store(repositoryARN, struct{}{})
+	return nil
+}
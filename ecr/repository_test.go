@@ -0,0 +1,87 @@
+/*
+ * Copyright 2017-2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You
+ * may not use this file except in compliance with the License. A copy of
+ * the License is located at
+ *
+ * 	http://aws.amazon.com/apache2.0/
+ *
+ * or in the "license" file accompanying this file. This file is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF
+ * ANY KIND, either express or implied. See the License for the specific
+ * language governing permissions and limitations under the License.
+ */
+
+package ecr
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestListRepositories(t *testing.T) {
+	created := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	pages := map[string]*ecr.DescribeRepositoriesOutput{
+		"": {
+			Repositories: []*ecr.Repository{{
+				RepositoryName: aws.String("foo"),
+				RepositoryArn:  aws.String("arn:aws:ecr:fake:123456789012:repository/foo"),
+				RegistryId:     aws.String("123456789012"),
+				RepositoryUri:  aws.String("123456789012.dkr.ecr.fake.amazonaws.com/foo"),
+				CreatedAt:      aws.Time(created),
+			}},
+			NextToken: aws.String("page-2"),
+		},
+		"page-2": {
+			Repositories: []*ecr.Repository{{
+				RepositoryName: aws.String("foo/bar"),
+				RepositoryArn:  aws.String("arn:aws:ecr:fake:123456789012:repository/foo/bar"),
+				RegistryId:     aws.String("123456789012"),
+				RepositoryUri:  aws.String("123456789012.dkr.ecr.fake.amazonaws.com/foo/bar"),
+				CreatedAt:      aws.Time(created),
+			}},
+		},
+	}
+	callCount := 0
+	fakeClient := &fakeECRClient{
+		DescribeRepositoriesFn: func(_ aws.Context, input *ecr.DescribeRepositoriesInput, _ ...request.Option) (*ecr.DescribeRepositoriesOutput, error) {
+			callCount++
+			page, ok := pages[aws.StringValue(input.NextToken)]
+			require.True(t, ok, "unexpected page token %q", aws.StringValue(input.NextToken))
+			return page, nil
+		},
+	}
+	resolver := &ecrResolver{
+		clients: map[string]ecrAPI{
+			"fake": fakeClient,
+		},
+	}
+
+	repositories, err := resolver.ListRepositories(context.Background(), "fake")
+	require.NoError(t, err)
+	assert.Equal(t, 2, callCount, "DescribeRepositories should be called for each page")
+	assert.Equal(t, []RepositoryInfo{
+		{
+			Name:       "foo",
+			ARN:        "arn:aws:ecr:fake:123456789012:repository/foo",
+			RegistryID: "123456789012",
+			URI:        "123456789012.dkr.ecr.fake.amazonaws.com/foo",
+			CreatedAt:  created,
+		},
+		{
+			Name:       "foo/bar",
+			ARN:        "arn:aws:ecr:fake:123456789012:repository/foo/bar",
+			RegistryID: "123456789012",
+			URI:        "123456789012.dkr.ecr.fake.amazonaws.com/foo/bar",
+			CreatedAt:  created,
+		},
+	}, repositories)
+}
@@ -20,35 +20,178 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"net/http"
+	"strings"
 	"sync"
+	"time"
 
+	awsv2 "github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/endpoints"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/ecr"
 	ecrsdk "github.com/aws/aws-sdk-go/service/ecr"
 	"github.com/containerd/containerd/errdefs"
 	"github.com/containerd/containerd/images"
 	"github.com/containerd/containerd/log"
+	"github.com/containerd/containerd/platforms"
 	"github.com/containerd/containerd/reference"
 	"github.com/containerd/containerd/remotes"
 	"github.com/containerd/containerd/remotes/docker"
 	"github.com/opencontainers/go-digest"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/sync/semaphore"
+	"golang.org/x/time/rate"
 )
 
 var (
 	ErrInvalidManifest = errors.New("invalid manifest")
-	unimplemented      = errors.New("unimplemented")
+	// ErrBlobPresent is returned by a fetcher for blobs reported as present
+	// by the function configured with WithHaveBlob, which are not fetched.
+	// It wraps errdefs.ErrAlreadyExists.
+	ErrBlobPresent = fmt.Errorf("ecr: blob present: %w", errdefs.ErrAlreadyExists)
+	// ErrLayerPartTooSmall is returned when ECR rejects a layer part that is
+	// not the final part as smaller than its minimum part size.
+	ErrLayerPartTooSmall = errors.New("layer part too small")
+	// ErrImageNotFound is returned when a referenced image does not exist in
+	// its repository.  It wraps errdefs.ErrNotFound.
+	ErrImageNotFound = fmt.Errorf("ecr: image not found: %w", errdefs.ErrNotFound)
+	// ErrContentExists is returned by a pusher for content that is already
+	// present in the repository.  It wraps errdefs.ErrAlreadyExists.
+	ErrContentExists = fmt.Errorf("ecr: content exists on remote: %w", errdefs.ErrAlreadyExists)
+	// ErrECRServer is returned when ECR fails a request with a
+	// ServerException, a fault of the service rather than of the request,
+	// which may succeed if retried.  It wraps errdefs.ErrUnavailable.
+	ErrECRServer = fmt.Errorf("ecr: server error: %w", errdefs.ErrUnavailable)
+	// ErrSchema1Unsupported is returned when resolving or fetching a Docker
+	// v2 Schema 1 manifest with a resolver configured with WithRejectSchema1.
+	ErrSchema1Unsupported = errors.New("schema 1 manifests unsupported")
+	unimplemented         = errors.New("unimplemented")
+)
+
+// mediaTypeDockerSchema1ManifestUnsigned is the unsigned variant of Docker v2
+// Schema 1 manifest mediaType.
+const mediaTypeDockerSchema1ManifestUnsigned = "application/vnd.docker.distribution.manifest.v1+json"
+
+// isSchema1 reports whether mediaType is a Docker v2 Schema 1 manifest.
+func isSchema1(mediaType string) bool {
+	return mediaType == images.MediaTypeDockerSchema1Manifest ||
+		mediaType == mediaTypeDockerSchema1ManifestUnsigned
+}
+
+// AnnotationScanStatus is the descriptor annotation set by Resolve to the
+// image's scan status when WithScanStatusOnResolve is enabled.
+const AnnotationScanStatus = "ecr.scan.status"
+
+const (
+	// batchDeleteImageLimit is the maximum number of image identifiers ECR
+	// accepts in a single BatchDeleteImage request.
+	batchDeleteImageLimit = 100
 )
 
 type ecrResolver struct {
-	session                  *session.Session
+	session *session.Session
+	// configV2, when set, configures aws-sdk-go-v2 clients in place of
+	// clients configured by session.
+	configV2 *awsv2.Config
+	// credentials, when set, are used by the clients in place of the
+	// credentials of session or configV2.
+	credentials              *credentials.Credentials
 	clients                  map[string]ecrAPI
 	clientsLock              sync.Mutex
 	tracker                  docker.StatusTracker
 	layerDownloadParallelism int
 	httpClient               *http.Client
+	uploadContentType        string
+	partitionCheck           bool
+	onUploadInit             func(uploadID string)
+	onUploadComplete         func(uploadID string, err error)
+	retryPolicy              RetryPolicy
+	regionEndpoints          map[string]string
+	contentIntegrity         ContentIntegrity
+	uploadStallTimeout       time.Duration
+	scanStatusOnResolve      bool
+	manifestPushParallelism  int
+	manifestPutLimiter       *semaphore.Weighted
+	mediaTypeFamilies        bool
+	requestIDHeader          string
+	requestIDFromContext     func(context.Context) string
+	minUploadPartSize        int64
+	verifyLayers             bool
+	adaptiveParallelism      func(size int64) int
+	haveBlob                 func(digest.Digest) bool
+	requiredEncryptionKey    string
+	// encryptionVerified holds the ARNs of repositories whose encryption
+	// has been verified against requiredEncryptionKey.
+	encryptionVerified  sync.Map
+	maxPushManifestSize int64
+	rejectSchema1       bool
+	// ownsHTTPClient is set when httpClient was created by the resolver with
+	// WithOwnConnectionPool, so that Close may release its connections.
+	ownsHTTPClient bool
+	// publicResolver resolves and fetches Amazon ECR Public references,
+	// which are pulled anonymously through the registry API.
+	publicResolver    remotes.Resolver
+	verifyUploadParts bool
+	baseLogFields     log.Fields
+	uploadRetryPolicy RetryPolicy
+	downloadURLs      *downloadURLCache
+	region            string
+	preferBodyType    bool
+	retryDeadline     time.Duration
+	endpoint          string
+	endpointResolver  endpoints.Resolver
+	// manifests holds the manifests retrieved by Resolve for reuse by the
+	// manifest fetches that follow.
+	manifests *manifestCache
+	// resolveRetryPolicy retries the BatchGetImage requests of Resolve, and
+	// is only set when a retry policy is configured.
+	resolveRetryPolicy RetryPolicy
+	// resolveVerifier, when set, must accept each resolved image.
+	resolveVerifier func(context.Context, ECRSpec, ocispec.Descriptor, []byte) error
+	// maxRetries, when set, overrides the session's maximum number of
+	// retries of ECR API requests.
+	maxRetries *int
+	// onLayerDownload, when set, receives the metadata of layer download
+	// responses.
+	onLayerDownload func(context.Context, ocispec.Descriptor, LayerDownloadMetadata)
+	additionalTags  []string
+	pushProgress    func(ref string, desc ocispec.Descriptor, uploaded, total int64)
+	// createRepository, when set, configures the repositories created by
+	// pushes to repositories that do not exist.
+	createRepository *RepositorySettings
+	// tracer, when set, records spans of the resolver's requests.
+	tracer trace.Tracer
+	// metrics, when set, receives measurements of the resolver's requests
+	// and transfers.
+	metrics MetricsRecorder
+	// apiCallTimeout, when set, bounds the duration of each attempt of an ECR
+	// API request.
+	apiCallTimeout time.Duration
+	// dataPlaneIdleTimeout, when set, fails layer downloads that receive no
+	// content for longer than the timeout.
+	dataPlaneIdleTimeout time.Duration
+	// refNormalizer, when set, rewrites references before they are parsed.
+	refNormalizer func(string) string
+	// downloadURLRefreshes is how many times a layer download rejected as
+	// forbidden is retried with a fresh download URL.
+	downloadURLRefreshes int
+	// sniffMediaType, when set, fetches content with an empty media type as
+	// a manifest or a blob according to what is found in ECR.
+	sniffMediaType bool
+	// downloadLimiter, when set, limits the rate at which layer content is
+	// downloaded across the resolver's fetchers.
+	downloadLimiter *rate.Limiter
+	// fetchLimiter, when set, bounds the layer downloads in progress across
+	// the resolvers sharing it.
+	fetchLimiter *semaphore.Weighted
+	// prefetchPlatforms limits the index children prefetched by fetchers to
+	// those for matching platforms.
+	prefetchPlatforms platforms.Matcher
 }
 
 // ResolverOption represents a functional option for configuring the ECR
@@ -60,6 +203,12 @@ type ResolverOptions struct {
 	// Session is used for configuring the ECR client.  If not specified, a
 	// generic session is used.
 	Session *session.Session
+	// ConfigV2, when set, configures aws-sdk-go-v2 ECR clients, which are
+	// used in place of clients configured by Session.
+	ConfigV2 *awsv2.Config
+	// CredentialsProvider, when set, provides the credentials of the ECR
+	// clients in place of the credentials of Session or ConfigV2.
+	CredentialsProvider credentials.Provider
 	// Tracker is used to track uploads to ECR.  If not specified, an in-memory
 	// tracker is used instead.
 	Tracker docker.StatusTracker
@@ -70,6 +219,172 @@ type ResolverOptions struct {
 	// HTTPClient configures the HTTP client the resolver internally use for fetching.
 	// If not specified, http.DefaultClient is used.
 	HTTPClient *http.Client
+	// OwnConnectionPool, when HTTPClient is not specified, makes requests
+	// with a client with connections of the resolver's own, which Close
+	// releases.
+	OwnConnectionPool bool
+	// UploadContentType overrides the Content-Type header sent when uploading
+	// layer parts.  If not specified, the AWS SDK default is used.
+	UploadContentType string
+	// PartitionCheck configures whether the partition of a reference is
+	// validated against the partition of the session's region before making
+	// any requests.  If not specified, the partition is not checked.
+	PartitionCheck bool
+	// UploadSessionInitHook is invoked with the upload ID of each layer upload
+	// session initiated by the resolver's pushers.
+	UploadSessionInitHook func(uploadID string)
+	// UploadSessionCompleteHook is invoked with the upload ID and result of
+	// each layer upload session completed by the resolver's pushers.
+	UploadSessionCompleteHook func(uploadID string, err error)
+	// RetryPolicy configures retries of requests that fail with a transient
+	// error.  If not specified, a default policy is used.
+	RetryPolicy *RetryPolicy
+	// RegionEndpoints maps AWS regions to the ECR API endpoint used for
+	// requests in that region.  Regions without an entry use the default
+	// endpoint.
+	RegionEndpoints map[string]string
+	// ContentIntegrity configures how fetched layer content is validated
+	// against its descriptor.  If not specified, content is not validated.
+	ContentIntegrity ContentIntegrity
+	// UploadStallTimeout configures how long a layer upload waits for content
+	// to be written before failing.  If not specified, uploads wait
+	// indefinitely.
+	UploadStallTimeout time.Duration
+	// ScanStatusOnResolve configures whether Resolve annotates the resolved
+	// descriptor with the image's scan status.  If not specified, the scan
+	// status is not requested.
+	ScanStatusOnResolve bool
+	// ManifestPushParallelism bounds how many image manifests the resolver's
+	// pushers put concurrently.  If not specified, manifest puts are not
+	// bounded.
+	ManifestPushParallelism int
+	// MediaTypeFamilies configures whether requests for a descriptor's image
+	// accept the OCI and Docker variants of the descriptor's media type.  If
+	// not specified, only the descriptor's exact media type is accepted.
+	MediaTypeFamilies bool
+	// RequestIDHeader is the name of the header set on each ECR API request
+	// to the value returned by RequestIDFromContext for the request's context.
+	RequestIDHeader string
+	// RequestIDFromContext extracts the request ID sent in RequestIDHeader
+	// from a request's context.  Requests for which it returns an empty string
+	// are sent without the header.
+	RequestIDFromContext func(context.Context) string
+	// MinUploadPartSize configures the minimum size of each part uploaded for
+	// a layer.  If not specified, the part size returned by ECR is used.
+	MinUploadPartSize int64
+	// VerifyLayersBeforeManifest configures whether pushed image manifests
+	// are checked to only reference layers present in the repository before
+	// they are put.  If not specified, manifests are put without checking.
+	VerifyLayersBeforeManifest bool
+	// AdaptiveLayerParallelism chooses the number of parts each layer is
+	// downloaded in from the layer's size, in place of
+	// LayerDownloadParallelism.  If not specified, LayerDownloadParallelism
+	// is used for every layer.
+	AdaptiveLayerParallelism func(size int64) int
+	// HaveBlob reports whether a blob is already present with the caller, in
+	// which case it is not fetched.  If not specified, all blobs are fetched.
+	HaveBlob func(digest.Digest) bool
+	// RequiredEncryptionKey is the ARN of the KMS key repositories must be
+	// encrypted with to be pushed to.  If not specified, the encryption of
+	// repositories is not checked.
+	RequiredEncryptionKey string
+	// MaxPushManifestSize is the largest manifest, in bytes, the pusher will
+	// put.  If not specified, the size of pushed manifests is left to ECR to
+	// limit.
+	MaxPushManifestSize int64
+	// RejectSchema1 fails resolving and fetching Docker v2 Schema 1
+	// manifests with ErrSchema1Unsupported.
+	RejectSchema1 bool
+	// VerifyUploadParts verifies the digest of layers as their parts are
+	// uploaded.
+	VerifyUploadParts bool
+	// BaseLogFields are added to the logs of every operation of the
+	// resolver.
+	BaseLogFields map[string]interface{}
+	// LayerUploadRetryPolicy configures retries of layer parts whose upload
+	// fails with a transient error, in place of the retries of the AWS SDK.
+	// If not specified, failed parts are only retried by the AWS SDK.
+	LayerUploadRetryPolicy *RetryPolicy
+	// DownloadURLCacheTTL is how long the download URL of a layer is reused
+	// by the fetchers of the resolver.  If not specified, each fetch of a
+	// layer requests a new download URL.
+	DownloadURLCacheTTL time.Duration
+	// NoManifestCache disables the reuse of manifests retrieved by Resolve by
+	// the manifest fetches that follow.
+	NoManifestCache bool
+	// Region, when set, is the AWS region of every request made by the
+	// resolver, regardless of the region of the reference.
+	Region string
+	// PreferManifestBodyMediaType resolves images with the mediaType declared
+	// in their manifest in preference to the mediaType returned by ECR.
+	PreferManifestBodyMediaType bool
+	// TotalRetryDeadline bounds the total delay between retries of the
+	// requests made by a single operation, such as resolving a reference or
+	// fetching or pushing content.  If not specified, only the retry
+	// policies of each kind of request bound retries.
+	TotalRetryDeadline time.Duration
+	// Endpoint is the ECR API endpoint used for requests in regions without
+	// an endpoint in RegionEndpoints.
+	Endpoint string
+	// EndpointResolver resolves the ECR API endpoint used for requests when
+	// neither RegionEndpoints nor Endpoint provides one.
+	EndpointResolver endpoints.Resolver
+	// ResolveVerifier is called with the descriptor and manifest of each
+	// resolved image; an error fails the resolution.
+	ResolveVerifier func(ctx context.Context, spec ECRSpec, desc ocispec.Descriptor, manifest []byte) error
+	// MaxRetries is the maximum number of times an ECR API request is
+	// retried.  If not specified, the session's configuration or the SDK's
+	// default is used.
+	MaxRetries *int
+	// LayerDownloadHandler is called with the metadata of the response to
+	// each layer downloaded with a single request.
+	LayerDownloadHandler func(ctx context.Context, desc ocispec.Descriptor, metadata LayerDownloadMetadata)
+	// RequireCredentials fails NewResolver when the session's credentials
+	// cannot be resolved or are anonymous.
+	RequireCredentials bool
+	// AdditionalTags are applied to the image's manifest, in addition to the
+	// tag of the reference, when it is pushed.
+	AdditionalTags []string
+	// PushProgress is called with the bytes of content uploaded as each
+	// layer part or manifest is pushed.
+	PushProgress func(ref string, desc ocispec.Descriptor, uploaded, total int64)
+	// CreateRepositoryOnPush creates the repository of a push when it does
+	// not exist.
+	CreateRepositoryOnPush bool
+	// CreateRepositorySettings configures the repositories created on push.
+	CreateRepositorySettings RepositorySettings
+	// TracerProvider, when set, provides the tracer recording spans of ECR
+	// API requests and layer downloads.
+	TracerProvider trace.TracerProvider
+	// MetricsRecorder receives measurements of the ECR API requests made and
+	// the layer content transferred.
+	MetricsRecorder MetricsRecorder
+	// APICallTimeout bounds the duration of each attempt of an ECR API
+	// request, independently of the deadline of the caller's context.
+	APICallTimeout time.Duration
+	// DataPlaneIdleTimeout fails layer downloads that receive no content for
+	// longer than the timeout, regardless of the duration of the download.
+	DataPlaneIdleTimeout time.Duration
+	// RefNormalizer rewrites each reference before it is parsed, such as to
+	// strip variations introduced by other systems.
+	RefNormalizer func(string) string
+	// DownloadURLRefreshes is how many times a layer download is retried with
+	// a fresh download URL once its presigned download URL is rejected.
+	DownloadURLRefreshes int
+	// SniffMediaType fetches descriptors with an empty media type as a
+	// manifest when ECR has an image with the descriptor's digest, and as a
+	// blob otherwise.
+	SniffMediaType bool
+	// DownloadRateLimit limits the aggregate rate, in bytes per second, at
+	// which the resolver downloads layer content.
+	DownloadRateLimit int64
+	// GlobalFetchLimiter bounds the layer downloads in progress across every
+	// resolver configured with the same limiter.
+	GlobalFetchLimiter *semaphore.Weighted
+	// PrefetchPlatforms limits the children of an index that are prefetched
+	// along with it to those for matching platforms.  If not specified,
+	// platforms.Default() is used.
+	PrefetchPlatforms platforms.Matcher
 }
 
 // WithSession is a ResolverOption to use a specific AWS session.Session
@@ -80,6 +395,36 @@ func WithSession(session *session.Session) ResolverOption {
 	}
 }
 
+// WithConfigV2 is a ResolverOption to make ECR API requests with clients of
+// aws-sdk-go-v2 configured by cfg, in place of clients of aws-sdk-go configured
+// by a session.  The region, endpoint, retry, timeout and HTTP client options
+// of the resolver apply to these clients as well; WithEndpointResolver does
+// not, as its resolver is specific to aws-sdk-go.
+func WithConfigV2(cfg awsv2.Config) ResolverOption {
+	return func(options *ResolverOptions) error {
+		options.ConfigV2 = &cfg
+		return nil
+	}
+}
+
+// WithCredentialsProvider is a ResolverOption to sign ECR API requests with the
+// credentials of provider, in place of the credentials of the session or of
+// the config set with WithConfigV2.  The credentials are shared by the
+// clients of all regions and retrieved again from provider once it reports
+// them expired, so that rotating credentials, such as those of EKS IAM roles
+// for service accounts or of EC2 instance profiles, are picked up by a
+// long-lived resolver without recreating it.
+//
+// The default credential chains of aws-sdk-go and aws-sdk-go-v2 refresh
+// expiring credentials in the same way; this option is only needed to use
+// credentials from elsewhere.
+func WithCredentialsProvider(provider credentials.Provider) ResolverOption {
+	return func(options *ResolverOptions) error {
+		options.CredentialsProvider = provider
+		return nil
+	}
+}
+
 // WithTracker is a ResolverOption to use a specific docker.Tracker
 func WithTracker(tracker docker.StatusTracker) ResolverOption {
 	return func(options *ResolverOptions) error {
@@ -88,11 +433,27 @@ func WithTracker(tracker docker.StatusTracker) ResolverOption {
 	}
 }
 
+// WithNoTracker is a ResolverOption to discard upload progress instead of
+// tracking it, avoiding the memory held by the default in-memory tracker in
+// long-lived resolvers.
+func WithNoTracker() ResolverOption {
+	return func(options *ResolverOptions) error {
+		options.Tracker = noopTracker{}
+		return nil
+	}
+}
+
 // WithLayerDownloadParallelism is a ResolverOption to configure whether layer
 // parts should be downloaded in parallel.  Layer parallelism is backed by the
 // htcat library and can increase the speed at which layers are downloaded at
 // the cost of increased memory consumption.  It is recommended to test your
 // workload to determine whether the tradeoff is worthwhile.
+//
+// The size of the parts is chosen by htcat as the layer's size divided by the
+// parallelism, up to 20 MiB, and is not configurable.  Layers whose parts
+// would be smaller than 1 MiB, such as small layers, are instead read in a
+// single request.  Each part being downloaded is buffered in memory in full,
+// so a download may buffer up to 20 MiB for each unit of parallelism.
 func WithLayerDownloadParallelism(parallelism int) ResolverOption {
 	return func(options *ResolverOptions) error {
 		options.LayerDownloadParallelism = parallelism
@@ -108,234 +469,1734 @@ func WithHTTPClient(client *http.Client) ResolverOption {
 	}
 }
 
-// NewResolver creates a new remotes.Resolver capable of interacting with Amazon
-// ECR.  NewResolver can be called with no arguments for default configuration,
-// or can be customized by specifying ResolverOptions.  By default, NewResolver
-// will allocate a new AWS session.Session and an in-memory tracker for layer
-// progress.
-func NewResolver(options ...ResolverOption) (remotes.Resolver, error) {
-	resolverOptions := &ResolverOptions{}
-	for _, option := range options {
-		err := option(resolverOptions)
-		if err != nil {
-			return nil, err
-		}
-	}
-	if resolverOptions.Session == nil {
-		awsSession, err := session.NewSession()
-		if err != nil {
-			return nil, err
-		}
-		resolverOptions.Session = awsSession
+// WithOwnConnectionPool is a ResolverOption to make requests with a connection
+// pool of the resolver's own, with the settings of http.DefaultTransport, in
+// place of http.DefaultClient.  Close releases the idle connections of the
+// pool, such as when a resolver is created for each pull.  The option has no
+// effect when a client is provided with WithHTTPClient.
+func WithOwnConnectionPool() ResolverOption {
+	return func(options *ResolverOptions) error {
+		options.OwnConnectionPool = true
+		return nil
 	}
-	if resolverOptions.Tracker == nil {
-		resolverOptions.Tracker = docker.NewInMemoryTracker()
+}
+
+// WithUploadContentType is a ResolverOption to override the Content-Type header
+// sent when uploading layer parts.  This can be required by proxies in front
+// of ECR that are strict about the content type of uploaded parts.
+func WithUploadContentType(contentType string) ResolverOption {
+	return func(options *ResolverOptions) error {
+		options.UploadContentType = contentType
+		return nil
 	}
+}
 
-	if resolverOptions.HTTPClient == nil {
-		resolverOptions.HTTPClient = http.DefaultClient
+// WithPartitionCheck is a ResolverOption to configure whether the partition of
+// a reference is validated against the partition of the session's configured
+// region.  When enabled, references in a different partition than the
+// session's credentials (such as an aws-us-gov ARN used with commercial
+// credentials) fail early with a descriptive error.
+func WithPartitionCheck(check bool) ResolverOption {
+	return func(options *ResolverOptions) error {
+		options.PartitionCheck = check
+		return nil
 	}
+}
 
-	return &ecrResolver{
-		session:                  resolverOptions.Session,
-		clients:                  map[string]ecrAPI{},
-		tracker:                  resolverOptions.Tracker,
-		layerDownloadParallelism: resolverOptions.LayerDownloadParallelism,
-		httpClient:               resolverOptions.HTTPClient,
-	}, nil
+// WithUploadSessionHooks is a ResolverOption to register functions invoked
+// when a layer upload session is initiated and when it is completed.  This
+// allows callers to track upload sessions externally, for example to clean up
+// orphaned uploads.  Either function may be nil.
+func WithUploadSessionHooks(onInit func(uploadID string), onComplete func(uploadID string, err error)) ResolverOption {
+	return func(options *ResolverOptions) error {
+		options.UploadSessionInitHook = onInit
+		options.UploadSessionCompleteHook = onComplete
+		return nil
+	}
 }
 
-// Resolve attempts to resolve the provided reference into a name and a
-// descriptor.
-//
-// Valid references are of the form "ecr.aws/arn:aws:ecr:<region>:<account>:repository/<name>:<tag>".
-func (r *ecrResolver) Resolve(ctx context.Context, ref string) (string, ocispec.Descriptor, error) {
-	ecrSpec, err := ParseRef(ref)
-	if err != nil {
-		return "", ocispec.Descriptor{}, err
+// WithRetryPolicy is a ResolverOption to configure how requests that fail with
+// a transient error are retried.  The policy also bounds how many times a layer
+// download interrupted part way through, such as by a connection reset, is
+// resumed with a range request from the content already read.  The
+// BatchGetImage requests of Resolve are retried by the policy in place of the
+// AWS SDK only when it is configured; by default, they are retried by the SDK
+// alone.
+func WithRetryPolicy(policy RetryPolicy) ResolverOption {
+	return func(options *ResolverOptions) error {
+		options.RetryPolicy = &policy
+		return nil
 	}
+}
 
-	if ecrSpec.Object == "" {
-		return "", ocispec.Descriptor{}, reference.ErrObjectRequired
+// WithRegionEndpoints is a ResolverOption to configure the ECR API endpoint used
+// for requests in each region, such as a VPC endpoint.  Regions that are not
+// present in the map use the default endpoint.
+func WithRegionEndpoints(endpoints map[string]string) ResolverOption {
+	return func(options *ResolverOptions) error {
+		if options.RegionEndpoints == nil {
+			options.RegionEndpoints = make(map[string]string, len(endpoints))
+		}
+		for region, endpoint := range endpoints {
+			options.RegionEndpoints[region] = endpoint
+		}
+		return nil
 	}
+}
 
-	batchGetImageInput := &ecr.BatchGetImageInput{
-		RegistryId:         aws.String(ecrSpec.Registry()),
-		RepositoryName:     aws.String(ecrSpec.Repository),
-		ImageIds:           []*ecr.ImageIdentifier{ecrSpec.ImageID()},
-		AcceptedMediaTypes: aws.StringSlice(supportedImageMediaTypes),
+// WithContentIntegrity is a ResolverOption to configure how fetched layer
+// content is validated against its descriptor's size and digest.  Validation
+// happens as content is read and a mismatch is reported in place of the end of
+// the content.
+func WithContentIntegrity(mode ContentIntegrity) ResolverOption {
+	return func(options *ResolverOptions) error {
+		switch mode {
+		case ContentIntegrityNone, ContentIntegritySize, ContentIntegrityDigest, ContentIntegrityBoth:
+		default:
+			return fmt.Errorf("ecr: unknown content integrity mode %d", mode)
+		}
+		options.ContentIntegrity = mode
+		return nil
 	}
+}
 
-	client := r.getClient(ecrSpec.Region())
+// WithUploadStallTimeout is a ResolverOption to fail layer uploads when no
+// content is written to them within the timeout.  This detects stalled
+// producers that would otherwise leave the upload waiting indefinitely.
+func WithUploadStallTimeout(timeout time.Duration) ResolverOption {
+	return func(options *ResolverOptions) error {
+		options.UploadStallTimeout = timeout
+		return nil
+	}
+}
 
-	batchGetImageOutput, err := client.BatchGetImageWithContext(ctx, batchGetImageInput)
-	if err != nil {
-		log.G(ctx).
-			WithField("ref", ref).
-			WithError(err).
-			Warn("Failed while calling BatchGetImage")
-		return "", ocispec.Descriptor{}, err
+// WithScanStatusOnResolve is a ResolverOption to configure whether Resolve
+// requests the image's scan status and sets it on the returned descriptor's
+// AnnotationScanStatus annotation.  Enabling this makes an additional
+// DescribeImages request for each resolved reference.
+func WithScanStatusOnResolve(enabled bool) ResolverOption {
+	return func(options *ResolverOptions) error {
+		options.ScanStatusOnResolve = enabled
+		return nil
 	}
-	log.G(ctx).
-		WithField("ref", ref).
-		WithField("batchGetImageOutput", batchGetImageOutput).
-		Debug("ecr.resolver.resolve")
+}
 
-	if len(batchGetImageOutput.Images) == 0 {
-		return "", ocispec.Descriptor{}, reference.ErrInvalid
+// WithAdaptiveLayerParallelism is a ResolverOption to choose the number of
+// parts each layer is downloaded in from the size of the layer, as given by
+// its descriptor.  A return value of 0 downloads the layer in a single
+// request.  The choice takes the place of WithLayerDownloadParallelism.
+func WithAdaptiveLayerParallelism(parallelism func(size int64) int) ResolverOption {
+	return func(options *ResolverOptions) error {
+		options.AdaptiveLayerParallelism = parallelism
+		return nil
 	}
-	ecrImage := batchGetImageOutput.Images[0]
+}
 
-	mediaType := aws.StringValue(ecrImage.ImageManifestMediaType)
-	if mediaType == "" {
-		manifestBody := aws.StringValue(ecrImage.ImageManifest)
-		log.G(ctx).
-			WithField("ref", ref).
-			WithField("manifest", manifestBody).
-			Trace("ecr.resolver.resolve: parsing mediaType from manifest")
-		mediaType, err = parseImageManifestMediaType(ctx, manifestBody)
-		if err != nil {
-			return "", ocispec.Descriptor{}, err
+// WithManifestPushParallelism is a ResolverOption to bound how many image
+// manifests are put concurrently across the resolver's pushers.  An index or
+// manifest list holds every slot while it is put, so it never overlaps with the
+// puts of the manifests it references.
+func WithManifestPushParallelism(parallelism int) ResolverOption {
+	return func(options *ResolverOptions) error {
+		if parallelism < 0 {
+			return fmt.Errorf("ecr: invalid manifest push parallelism %d", parallelism)
 		}
+		options.ManifestPushParallelism = parallelism
+		return nil
 	}
-	log.G(ctx).
-		WithField("ref", ref).
-		WithField("mediaType", mediaType).
-		Debug("ecr.resolver.resolve")
-	// check resolved image's mediaType, it should be one of the specified in
-	// the request.
-	for i, accepted := range aws.StringValueSlice(batchGetImageInput.AcceptedMediaTypes) {
-		if mediaType == accepted {
-			break
-		}
-		if i+1 == len(batchGetImageInput.AcceptedMediaTypes) {
-			log.G(ctx).
-				WithField("ref", ref).
-				WithField("mediaType", mediaType).
-				Debug("ecr.resolver.resolve: unrequested mediaType, deferring to caller")
+}
+
+// WithMediaTypeFamilies is a ResolverOption to configure whether requests for
+// a descriptor's image accept the equivalent OCI and Docker variants of the
+// descriptor's media type, tolerating descriptors whose media type does not
+// exactly match the image stored in ECR.
+func WithMediaTypeFamilies(enabled bool) ResolverOption {
+	return func(options *ResolverOptions) error {
+		options.MediaTypeFamilies = enabled
+		return nil
+	}
+}
+
+// WithRequestIDFromContext is a ResolverOption to set a header on each ECR API
+// request to a request ID extracted from the request's context, such as
+// X-Amzn-Trace-Id, to correlate requests with the caller's own.
+func WithRequestIDFromContext(headerName string, extract func(context.Context) string) ResolverOption {
+	return func(options *ResolverOptions) error {
+		if headerName == "" || extract == nil {
+			return errors.New("ecr: request ID header and extract function are required")
 		}
+		options.RequestIDHeader = headerName
+		options.RequestIDFromContext = extract
+		return nil
 	}
+}
 
-	desc := ocispec.Descriptor{
-		Digest:    digest.Digest(aws.StringValue(ecrImage.ImageId.ImageDigest)),
-		MediaType: mediaType,
-		Size:      int64(len(aws.StringValue(ecrImage.ImageManifest))),
+// WithMinUploadPartSize is a ResolverOption to configure the minimum size of
+// each part uploaded for a layer.  Layers are uploaded in parts of the larger
+// of this size and the part size returned by ECR.
+func WithMinUploadPartSize(size int64) ResolverOption {
+	return func(options *ResolverOptions) error {
+		if size < 0 {
+			return fmt.Errorf("ecr: invalid minimum upload part size %d", size)
+		}
+		options.MinUploadPartSize = size
+		return nil
 	}
-	// assert matching digest if the provided ref includes one.
-	if expectedDigest := ecrSpec.Spec().Digest().String(); expectedDigest != "" &&
-		desc.Digest.String() != expectedDigest {
-		return "", ocispec.Descriptor{}, fmt.Errorf("resolved image digest mismatch: %w", errdefs.ErrFailedPrecondition)
+}
+
+// WithVerifyLayersBeforeManifest is a ResolverOption to configure whether the
+// config and layers referenced by a pushed image manifest are checked to be
+// present in the repository before the manifest is put, failing the push with
+// an error listing those that are missing.
+func WithVerifyLayersBeforeManifest(enabled bool) ResolverOption {
+	return func(options *ResolverOptions) error {
+		options.VerifyLayersBeforeManifest = enabled
+		return nil
 	}
+}
 
-	return ecrSpec.Canonical(), desc, nil
+// WithHaveBlob is a ResolverOption to skip fetching layers and configs that
+// are already present with the caller, such as in a cache populated out of
+// band.  Fetching a blob for which haveBlob returns true fails with an error
+// wrapping ErrBlobPresent instead.  Manifests are always fetched.
+func WithHaveBlob(haveBlob func(digest.Digest) bool) ResolverOption {
+	return func(options *ResolverOptions) error {
+		options.HaveBlob = haveBlob
+		return nil
+	}
 }
 
-func (r *ecrResolver) getClient(region string) ecrAPI {
-	r.clientsLock.Lock()
-	defer r.clientsLock.Unlock()
-	if _, ok := r.clients[region]; !ok {
-		r.clients[region] = ecrsdk.New(r.session, &aws.Config{
-			Region:     aws.String(region),
-			HTTPClient: r.httpClient})
+// WithRequiredEncryption is a ResolverOption to only push to repositories
+// encrypted with the KMS key with the given ARN.  The encryption configuration
+// of each repository is checked once, when first pushed to by the resolver.
+func WithRequiredEncryption(kmsKeyARN string) ResolverOption {
+	return func(options *ResolverOptions) error {
+		options.RequiredEncryptionKey = kmsKeyARN
+		return nil
 	}
-	return r.clients[region]
 }
 
-// manifestProbe provides a structure to parse and then probe a given manifest
-// to determine its mediaType.
-type manifestProbe struct {
-	// SchemaVersion is version identifier for the manifest schema used.
-	SchemaVersion int64 `json:"schemaVersion"`
-	// Explicit MediaType assignment for the manifest.
-	MediaType string `json:"mediaType,omitempty"`
-	// Docker Schema 1 signatures.
-	Signatures []json.RawMessage `json:"signatures,omitempty"`
-	// OCI or Docker Manifest Lists, the list of descriptors has mediaTypes
-	// embedded.
-	Manifests []json.RawMessage `json:"manifests,omitempty"`
+// WithMaxPushManifestSize is a ResolverOption to fail pushes of manifests
+// larger than size bytes before they are sent to ECR.
+func WithMaxPushManifestSize(size int64) ResolverOption {
+	return func(options *ResolverOptions) error {
+		if size < 0 {
+			return fmt.Errorf("ecr: invalid max push manifest size %d", size)
+		}
+		options.MaxPushManifestSize = size
+		return nil
+	}
 }
 
-func parseImageManifestMediaType(ctx context.Context, body string) (string, error) {
-	// The unsigned variant of Docker v2 Schema 1 manifest mediaType.
-	const mediaTypeDockerSchema1ManifestUnsigned = "application/vnd.docker.distribution.manifest.v1+json"
+// WithRejectSchema1 is a ResolverOption to fail resolving and fetching Docker
+// v2 Schema 1 manifests, which are deprecated, with ErrSchema1Unsupported.
+func WithRejectSchema1(reject bool) ResolverOption {
+	return func(options *ResolverOptions) error {
+		options.RejectSchema1 = reject
+		return nil
+	}
+}
 
-	var manifest manifestProbe
-	err := json.Unmarshal([]byte(body), &manifest)
-	if err != nil {
-		return "", fmt.Errorf("failed to unmarshall %q as a manifest: %w", body, ErrInvalidManifest)
+// WithUploadPartVerification is a ResolverOption to verify the content of
+// layers against their digest as their parts are uploaded.  Content that does
+// not match fails the upload before its final part is uploaded and the upload
+// is completed.
+func WithUploadPartVerification(verify bool) ResolverOption {
+	return func(options *ResolverOptions) error {
+		options.VerifyUploadParts = verify
+		return nil
 	}
+}
 
-	switch manifest.SchemaVersion {
-	case 2:
-		// Defer to the manifest declared type.
-		if manifest.MediaType != "" {
-			return manifest.MediaType, nil
-		}
-		// Is a manifest list.
-		if len(manifest.Manifests) > 0 {
-			return images.MediaTypeDockerSchema2ManifestList, nil
+// WithBaseLogFields is a ResolverOption to add fields, such as the tenant or
+// cluster the resolver is used for, to the logs of every operation of the
+// resolver and of its fetchers and pushers.
+func WithBaseLogFields(fields map[string]interface{}) ResolverOption {
+	return func(options *ResolverOptions) error {
+		options.BaseLogFields = make(map[string]interface{}, len(fields))
+		for key, value := range fields {
+			options.BaseLogFields[key] = value
 		}
-		// Is a single image manifest.
-		return images.MediaTypeDockerSchema2Manifest, nil
+		return nil
+	}
+}
 
-	case 1:
-		// Defer to the manifest declared type.
-		if manifest.MediaType != "" {
-			return manifest.MediaType, nil
+// WithLayerUploadRetries is a ResolverOption to retry the upload of a layer
+// part that fails with a transient error, such as a throttling or server
+// error, up to retries times.  Retries are delayed by an exponential, jittered
+// backoff starting at baseDelay.  The AWS SDK does not also retry the part
+// uploads, so that each part is attempted at most retries+1 times.
+func WithLayerUploadRetries(retries int, baseDelay time.Duration) ResolverOption {
+	return func(options *ResolverOptions) error {
+		if retries < 0 || baseDelay < 0 {
+			return fmt.Errorf("ecr: invalid layer upload retries %d with base delay %v", retries, baseDelay)
 		}
-		// Is Signed Docker Schema 1 manifest.
-		if len(manifest.Signatures) > 0 {
-			return images.MediaTypeDockerSchema1Manifest, nil
+		options.LayerUploadRetryPolicy = &RetryPolicy{
+			MaxAttempts: retries + 1,
+			BaseDelay:   baseDelay,
+			MaxDelay:    defaultRetryPolicy.MaxDelay,
 		}
-		// Is Unsigned Docker Schema 1 manifest.
-		return mediaTypeDockerSchema1ManifestUnsigned, nil
-	default:
-		return "", fmt.Errorf("unsupported schema version %d: %w", manifest.SchemaVersion, ErrInvalidManifest)
+		return nil
 	}
 }
 
-func (r *ecrResolver) Fetcher(ctx context.Context, ref string) (remotes.Fetcher, error) {
-	log.G(ctx).WithField("ref", ref).Debug("ecr.resolver.fetcher")
-	ecrSpec, err := ParseRef(ref)
-	if err != nil {
-		return nil, err
+// WithDownloadURLCache is a ResolverOption to reuse the download URL of a
+// layer for ttl across the fetchers of the resolver, such as for the layers
+// shared by the platforms of an image index.  The ttl should be shorter than
+// the validity of the URLs returned by Amazon ECR.
+func WithDownloadURLCache(ttl time.Duration) ResolverOption {
+	return func(options *ResolverOptions) error {
+		if ttl < 0 {
+			return fmt.Errorf("ecr: invalid download URL cache TTL %v", ttl)
+		}
+		options.DownloadURLCacheTTL = ttl
+		return nil
 	}
-	return &ecrFetcher{
-		ecrBase: ecrBase{
-			client:  r.getClient(ecrSpec.Region()),
-			ecrSpec: ecrSpec,
-		},
-		parallelism: r.layerDownloadParallelism,
-		httpClient:  r.httpClient,
-	}, nil
 }
 
-func (r *ecrResolver) Pusher(ctx context.Context, ref string) (remotes.Pusher, error) {
-	log.G(ctx).WithField("ref", ref).Debug("ecr.resolver.pusher")
-	ecrSpec, err := ParseRef(ref)
-	if err != nil {
-		return nil, err
+// WithNoManifestCache is a ResolverOption to retrieve every fetched manifest
+// from ECR.  By default, the manifest retrieved by Resolve is reused for up to
+// 30 seconds by the fetches of the same manifest that follow, saving a
+// BatchGetImage request per pull; resolvers previously retrieved the manifest
+// again for each fetch.  Disable the cache when each fetch must observe the
+// image's current state in ECR.
+func WithNoManifestCache() ResolverOption {
+	return func(options *ResolverOptions) error {
+		options.NoManifestCache = true
+		return nil
 	}
+}
 
-	// References will include a digest when the ref is being pushed to a tag to
-	// denote *which* digest is the root descriptor in this push.
-	tag, digest := ecrSpec.TagDigest()
-	if tag == "" && digest != "" {
-		log.G(ctx).WithField("ref", ref).Debug("ecr.resolver.pusher: push by digest")
+// WithRegion is a ResolverOption to make every request in the given AWS region,
+// regardless of the region in the reference's ARN, such as to pull a
+// replicated image through a regional endpoint.  The account ID in the
+// reference's ARN is still used as the ID of the registry.
+func WithRegion(region string) ResolverOption {
+	return func(options *ResolverOptions) error {
+		options.Region = region
+		return nil
 	}
+}
 
-	// The root descriptor's digest *must* be provided in order to properly tag
-	// manifests. A ref string will provide this as of containerd v1.3.0 -
+// WithPreferManifestBodyMediaType is a ResolverOption to resolve images with
+// the mediaType declared in their manifest, when it declares one, in
+// preference to the mediaType returned by the API, which some proxies return
+// incorrectly.
+func WithPreferManifestBodyMediaType(prefer bool) ResolverOption {
+	return func(options *ResolverOptions) error {
+		options.PreferManifestBodyMediaType = prefer
+		return nil
+	}
+}
+
+// WithTotalRetryDeadline is a ResolverOption to bound the total delay between
+// retries of the requests made by a single operation, such as resolving a
+// reference or fetching or pushing content.  Retries that would exceed the
+// deadline are not made.
+func WithTotalRetryDeadline(deadline time.Duration) ResolverOption {
+	return func(options *ResolverOptions) error {
+		if deadline < 0 {
+			return fmt.Errorf("ecr: invalid total retry deadline %v", deadline)
+		}
+		options.TotalRetryDeadline = deadline
+		return nil
+	}
+}
+
+// WithEndpoint is a ResolverOption to make ECR API requests to the given
+// endpoint, such as a VPC interface endpoint or a local emulator, in every
+// region without an endpoint configured with WithRegionEndpoints.
+func WithEndpoint(url string) ResolverOption {
+	return func(options *ResolverOptions) error {
+		options.Endpoint = url
+		return nil
+	}
+}
+
+// WithEndpointResolver is a ResolverOption to resolve the endpoints of ECR API
+// requests with the given resolver.  Endpoints configured with
+// WithRegionEndpoints or WithEndpoint take precedence.
+func WithEndpointResolver(resolver endpoints.Resolver) ResolverOption {
+	return func(options *ResolverOptions) error {
+		options.EndpointResolver = resolver
+		return nil
+	}
+}
+
+// WithResolveVerifier is a ResolverOption to verify each image before Resolve
+// returns it, such as by checking the image's signatures.  The verifier is
+// called with the resolved descriptor and the manifest's content, and an error
+// returned by the verifier fails the resolution.
+func WithResolveVerifier(verifier func(ctx context.Context, spec ECRSpec, desc ocispec.Descriptor, manifest []byte) error) ResolverOption {
+	return func(options *ResolverOptions) error {
+		options.ResolveVerifier = verifier
+		return nil
+	}
+}
+
+// WithMaxRetries is a ResolverOption to set the maximum number of times an ECR
+// API request, such as BatchGetImage or PutImage, is retried.  Setting zero
+// disables retries.
+func WithMaxRetries(n int) ResolverOption {
+	return func(options *ResolverOptions) error {
+		if n < 0 {
+			return fmt.Errorf("ecr: invalid max retries %d", n)
+		}
+		options.MaxRetries = aws.Int(n)
+		return nil
+	}
+}
+
+// WithLayerDownloadHandler is a ResolverOption to receive the metadata of the
+// response to each layer download, such as its ETag and Last-Modified time, for
+// callers keeping a cache of layers coherent with ECR.  The metadata is not
+// available for layers downloaded in parallel ranges, as configured with
+// WithLayerDownloadParallelism, for which the handler is not called.
+func WithLayerDownloadHandler(handler func(ctx context.Context, desc ocispec.Descriptor, metadata LayerDownloadMetadata)) ResolverOption {
+	return func(options *ResolverOptions) error {
+		options.LayerDownloadHandler = handler
+		return nil
+	}
+}
+
+// WithRequireCredentials is a ResolverOption to fail NewResolver when the
+// session has no usable credentials, rather than at the first request to ECR.
+func WithRequireCredentials(require bool) ResolverOption {
+	return func(options *ResolverOptions) error {
+		options.RequireCredentials = require
+		return nil
+	}
+}
+
+// WithAdditionalTags is a ResolverOption to apply each of the given tags, in
+// addition to the reference's tag, to the image's manifest when it is pushed.
+// The tags are applied with further PutImage requests once the manifest has
+// been put with the reference's tag, or once it is found to be in the
+// repository already.
+func WithAdditionalTags(tags []string) ResolverOption {
+	return func(options *ResolverOptions) error {
+		for _, tag := range tags {
+			if tag == "" {
+				return errors.New("ecr: invalid empty additional tag")
+			}
+		}
+		options.AdditionalTags = tags
+		return nil
+	}
+}
+
+// WithPushProgress is a ResolverOption to report the progress of pushes
+// directly, rather than through the tracker.  The function is called with the
+// tracker's reference of the pushed content, its descriptor, and the bytes
+// uploaded out of the descriptor's size each time a layer part or manifest is
+// uploaded.
+func WithPushProgress(progress func(ref string, desc ocispec.Descriptor, uploaded, total int64)) ResolverOption {
+	return func(options *ResolverOptions) error {
+		options.PushProgress = progress
+		return nil
+	}
+}
+
+// WithCreateRepositoryOnPush is a ResolverOption to create the repository of a
+// push when ECR reports that it does not exist, and then retry the push.
+// Repositories are created with the settings configured with
+// WithCreateRepositorySettings.
+func WithCreateRepositoryOnPush(create bool) ResolverOption {
+	return func(options *ResolverOptions) error {
+		options.CreateRepositoryOnPush = create
+		return nil
+	}
+}
+
+// WithCreateRepositorySettings is a ResolverOption to configure the
+// repositories created on push, as enabled with WithCreateRepositoryOnPush.
+func WithCreateRepositorySettings(settings RepositorySettings) ResolverOption {
+	return func(options *ResolverOptions) error {
+		options.CreateRepositorySettings = settings
+		return nil
+	}
+}
+
+// WithTracerProvider is a ResolverOption to record OpenTelemetry spans of the
+// ECR API requests made by the resolver and of the layer downloads made by
+// its fetchers.  Spans are children of the span of the context passed to the
+// resolver, and carry the repository, region and digest of the request.
+func WithTracerProvider(tp trace.TracerProvider) ResolverOption {
+	return func(options *ResolverOptions) error {
+		options.TracerProvider = tp
+		return nil
+	}
+}
+
+// WithMetricsRecorder is a ResolverOption to report the count, latency and
+// errors of ECR API requests, and the bytes of layer content fetched and
+// pushed, to a MetricsRecorder.
+func WithMetricsRecorder(recorder MetricsRecorder) ResolverOption {
+	return func(options *ResolverOptions) error {
+		options.MetricsRecorder = recorder
+		return nil
+	}
+}
+
+// WithAPICallTimeout is a ResolverOption to bound the duration of each attempt
+// of an ECR API request, so that a stalled attempt fails, and is retried as
+// configured, without waiting for the deadline of the caller's context, if
+// any.  The timeout does not apply to layer part uploads or to the download of
+// layer content.
+func WithAPICallTimeout(timeout time.Duration) ResolverOption {
+	return func(options *ResolverOptions) error {
+		if timeout < 0 {
+			return fmt.Errorf("ecr: invalid API call timeout %v", timeout)
+		}
+		options.APICallTimeout = timeout
+		return nil
+	}
+}
+
+// WithControlPlaneTimeout is an alias of WithAPICallTimeout, named for its
+// use alongside WithDataPlaneIdleTimeout: control-plane ECR API requests,
+// such as BatchGetImage, are bounded by the timeout, while layer content
+// transfers are bounded separately by WithDataPlaneIdleTimeout.
+func WithControlPlaneTimeout(timeout time.Duration) ResolverOption {
+	return WithAPICallTimeout(timeout)
+}
+
+// WithDataPlaneIdleTimeout is a ResolverOption to fail layer downloads that
+// receive no content for longer than the timeout.  Unlike a deadline, the
+// timeout does not limit the duration of downloads that continue to make
+// progress, however large the layer.  Time spent waiting for the caller to
+// read the content is not counted.
+func WithDataPlaneIdleTimeout(timeout time.Duration) ResolverOption {
+	return func(options *ResolverOptions) error {
+		if timeout < 0 {
+			return fmt.Errorf("ecr: invalid data plane idle timeout %v", timeout)
+		}
+		options.DataPlaneIdleTimeout = timeout
+		return nil
+	}
+}
+
+// WithRefNormalizer is a ResolverOption to rewrite references before they are
+// parsed by the resolver, such as to strip a leading "https://" or a trailing
+// slash from references provided by other systems.  The normalized reference
+// must be a valid Amazon ECR reference.
+func WithRefNormalizer(normalizer func(string) string) ResolverOption {
+	return func(options *ResolverOptions) error {
+		options.RefNormalizer = normalizer
+		return nil
+	}
+}
+
+// WithDownloadURLRefreshes is a ResolverOption to retry layer downloads that
+// are rejected as forbidden, as happens once the presigned download URL
+// returned by GetDownloadUrlForLayer expires, with a fresh download URL up to
+// the given number of times.  Parallel downloads rejected part way through
+// resume from the content already received.  By default, rejected downloads
+// are not retried.
+func WithDownloadURLRefreshes(refreshes int) ResolverOption {
+	return func(options *ResolverOptions) error {
+		if refreshes < 0 {
+			return fmt.Errorf("ecr: invalid download URL refreshes %d", refreshes)
+		}
+		options.DownloadURLRefreshes = refreshes
+		return nil
+	}
+}
+
+// WithSniffMediaType is a ResolverOption to fetch descriptors with an empty
+// media type, which are otherwise unimplemented, by first attempting to get a
+// manifest with the descriptor's digest and falling back to fetching a blob
+// when no such manifest exists.
+func WithSniffMediaType(sniff bool) ResolverOption {
+	return func(options *ResolverOptions) error {
+		options.SniffMediaType = sniff
+		return nil
+	}
+}
+
+// WithDownloadRateLimit is a ResolverOption to limit the rate at which layer
+// content is downloaded to bytesPerSec, aggregated across the resolver's
+// concurrent downloads.  The parts of parallel downloads share the limit, as
+// their responses are limited as they are received.  By default, downloads
+// are not limited.
+func WithDownloadRateLimit(bytesPerSec int64) ResolverOption {
+	return func(options *ResolverOptions) error {
+		if bytesPerSec < 0 {
+			return fmt.Errorf("ecr: invalid download rate limit %d", bytesPerSec)
+		}
+		options.DownloadRateLimit = bytesPerSec
+		return nil
+	}
+}
+
+// WithGlobalFetchLimiter is a ResolverOption to bound the layer downloads in
+// progress across every resolver configured with the same limiter, such as
+// the resolvers of a process pulling many images.  Each download holds one
+// unit of the limiter from before it starts until its content is closed.
+func WithGlobalFetchLimiter(limiter *semaphore.Weighted) ResolverOption {
+	return func(options *ResolverOptions) error {
+		options.GlobalFetchLimiter = limiter
+		return nil
+	}
+}
+
+// WithPrefetchPlatforms is a ResolverOption to choose the children of an index
+// that are retrieved along with it, which should match the platforms being
+// pulled.  Callers pulling every platform of an image can use platforms.All.
+// Children without a platform are always prefetched.
+func WithPrefetchPlatforms(matcher platforms.Matcher) ResolverOption {
+	return func(options *ResolverOptions) error {
+		options.PrefetchPlatforms = matcher
+		return nil
+	}
+}
+
+// NewResolver creates a new remotes.Resolver capable of interacting with Amazon
+// ECR.  NewResolver can be called with no arguments for default configuration,
+// or can be customized by specifying ResolverOptions.  By default, NewResolver
+// will allocate a new AWS session.Session and an in-memory tracker for layer
+// progress.  The returned resolver implements io.Closer to release its clients,
+// and the connections of a pool configured with WithOwnConnectionPool, when it
+// is no longer needed.
+//
+// The returned resolver also implements TagDeleter, ManifestLayerChecker,
+// RepositoryLister, ArtifactTypeResolver, Primer, AuthorizationTokenProvider,
+// IndexChecker, ReplicationConfigReader, DiffIDResolver,
+// RegistryScanningConfigReader and TagLister for operations beyond resolving,
+// fetching and pushing.
+func NewResolver(options ...ResolverOption) (remotes.Resolver, error) {
+	resolverOptions := &ResolverOptions{}
+	for _, option := range options {
+		err := option(resolverOptions)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if resolverOptions.Session == nil && resolverOptions.ConfigV2 == nil {
+		awsSession, err := session.NewSession()
+		if err != nil {
+			return nil, err
+		}
+		resolverOptions.Session = awsSession
+	}
+	var creds *credentials.Credentials
+	if resolverOptions.CredentialsProvider != nil {
+		creds = credentials.NewCredentials(resolverOptions.CredentialsProvider)
+	}
+	if resolverOptions.RequireCredentials {
+		var err error
+		switch {
+		case creds != nil:
+			err = checkCredentials(creds)
+		case resolverOptions.ConfigV2 != nil:
+			err = checkCredentialsV2(*resolverOptions.ConfigV2)
+		default:
+			err = checkCredentials(resolverOptions.Session.Config.Credentials)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if resolverOptions.Tracker == nil {
+		resolverOptions.Tracker = docker.NewInMemoryTracker()
+	}
+
+	ownsHTTPClient := resolverOptions.HTTPClient == nil && resolverOptions.OwnConnectionPool
+	if ownsHTTPClient {
+		resolverOptions.HTTPClient = &http.Client{Transport: http.DefaultTransport.(*http.Transport).Clone()}
+	} else if resolverOptions.HTTPClient == nil {
+		resolverOptions.HTTPClient = http.DefaultClient
+	}
+	var resolveRetryPolicy RetryPolicy
+	if resolverOptions.RetryPolicy != nil {
+		resolveRetryPolicy = *resolverOptions.RetryPolicy
+	} else {
+		resolverOptions.RetryPolicy = &defaultRetryPolicy
+	}
+
+	var uploadRetryPolicy RetryPolicy
+	if resolverOptions.LayerUploadRetryPolicy != nil {
+		uploadRetryPolicy = *resolverOptions.LayerUploadRetryPolicy
+	}
+
+	var downloadURLs *downloadURLCache
+	if resolverOptions.DownloadURLCacheTTL > 0 {
+		downloadURLs = newDownloadURLCache(resolverOptions.DownloadURLCacheTTL)
+	}
+
+	var manifests *manifestCache
+	if !resolverOptions.NoManifestCache {
+		manifests = newManifestCache(manifestCacheTTL, manifestCacheSize)
+	}
+
+	var createRepository *RepositorySettings
+	if resolverOptions.CreateRepositoryOnPush {
+		settings := resolverOptions.CreateRepositorySettings
+		if settings.EncryptionConfiguration == nil && resolverOptions.RequiredEncryptionKey != "" {
+			settings.EncryptionConfiguration = &ecr.EncryptionConfiguration{
+				EncryptionType: aws.String(ecr.EncryptionTypeKms),
+				KmsKey:         aws.String(resolverOptions.RequiredEncryptionKey),
+			}
+		}
+		createRepository = &settings
+	}
+
+	var tracer trace.Tracer
+	if resolverOptions.TracerProvider != nil {
+		tracer = resolverOptions.TracerProvider.Tracer(tracerName)
+	}
+
+	var downloadLimiter *rate.Limiter
+	if resolverOptions.DownloadRateLimit > 0 {
+		downloadLimiter = newDownloadLimiter(resolverOptions.DownloadRateLimit)
+	}
+
+	prefetchPlatforms := resolverOptions.PrefetchPlatforms
+	if prefetchPlatforms == nil {
+		prefetchPlatforms = platforms.Default()
+	}
+
+	var manifestPutLimiter *semaphore.Weighted
+	if resolverOptions.ManifestPushParallelism > 0 {
+		manifestPutLimiter = semaphore.NewWeighted(int64(resolverOptions.ManifestPushParallelism))
+	}
+
+	return &ecrResolver{
+		session:                  resolverOptions.Session,
+		configV2:                 resolverOptions.ConfigV2,
+		credentials:              creds,
+		clients:                  map[string]ecrAPI{},
+		tracker:                  resolverOptions.Tracker,
+		layerDownloadParallelism: resolverOptions.LayerDownloadParallelism,
+		httpClient:               resolverOptions.HTTPClient,
+		ownsHTTPClient:           ownsHTTPClient,
+		uploadContentType:        resolverOptions.UploadContentType,
+		partitionCheck:           resolverOptions.PartitionCheck,
+		onUploadInit:             resolverOptions.UploadSessionInitHook,
+		onUploadComplete:         resolverOptions.UploadSessionCompleteHook,
+		retryPolicy:              *resolverOptions.RetryPolicy,
+		regionEndpoints:          resolverOptions.RegionEndpoints,
+		contentIntegrity:         resolverOptions.ContentIntegrity,
+		uploadStallTimeout:       resolverOptions.UploadStallTimeout,
+		scanStatusOnResolve:      resolverOptions.ScanStatusOnResolve,
+		manifestPushParallelism:  resolverOptions.ManifestPushParallelism,
+		manifestPutLimiter:       manifestPutLimiter,
+		mediaTypeFamilies:        resolverOptions.MediaTypeFamilies,
+		requestIDHeader:          resolverOptions.RequestIDHeader,
+		requestIDFromContext:     resolverOptions.RequestIDFromContext,
+		minUploadPartSize:        resolverOptions.MinUploadPartSize,
+		verifyLayers:             resolverOptions.VerifyLayersBeforeManifest,
+		adaptiveParallelism:      resolverOptions.AdaptiveLayerParallelism,
+		haveBlob:                 resolverOptions.HaveBlob,
+		requiredEncryptionKey:    resolverOptions.RequiredEncryptionKey,
+		maxPushManifestSize:      resolverOptions.MaxPushManifestSize,
+		rejectSchema1:            resolverOptions.RejectSchema1,
+		publicResolver:           newPublicResolver(resolverOptions.HTTPClient),
+		verifyUploadParts:        resolverOptions.VerifyUploadParts,
+		baseLogFields:            resolverOptions.BaseLogFields,
+		uploadRetryPolicy:        uploadRetryPolicy,
+		resolveRetryPolicy:       resolveRetryPolicy,
+		downloadURLs:             downloadURLs,
+		region:                   resolverOptions.Region,
+		preferBodyType:           resolverOptions.PreferManifestBodyMediaType,
+		retryDeadline:            resolverOptions.TotalRetryDeadline,
+		endpoint:                 resolverOptions.Endpoint,
+		endpointResolver:         resolverOptions.EndpointResolver,
+		manifests:                manifests,
+		resolveVerifier:          resolverOptions.ResolveVerifier,
+		maxRetries:               resolverOptions.MaxRetries,
+		onLayerDownload:          resolverOptions.LayerDownloadHandler,
+		additionalTags:           resolverOptions.AdditionalTags,
+		pushProgress:             resolverOptions.PushProgress,
+		createRepository:         createRepository,
+		tracer:                   tracer,
+		metrics:                  resolverOptions.MetricsRecorder,
+		apiCallTimeout:           resolverOptions.APICallTimeout,
+		dataPlaneIdleTimeout:     resolverOptions.DataPlaneIdleTimeout,
+		refNormalizer:            resolverOptions.RefNormalizer,
+		downloadURLRefreshes:     resolverOptions.DownloadURLRefreshes,
+		sniffMediaType:           resolverOptions.SniffMediaType,
+		downloadLimiter:          downloadLimiter,
+		fetchLimiter:             resolverOptions.GlobalFetchLimiter,
+		prefetchPlatforms:        prefetchPlatforms,
+	}, nil
+}
+
+// Resolve attempts to resolve the provided reference into a name and a
+// descriptor.
+//
+// Valid references are of the form "ecr.aws/arn:aws:ecr:<region>:<account>:repository/<name>:<tag>".
+func (r *ecrResolver) Resolve(ctx context.Context, ref string) (string, ocispec.Descriptor, error) {
+	ctx = withLogFields(ctx, r.baseLogFields)
+	ctx = withRetryBudget(ctx, r.retryDeadline)
+	ecrSpec, err := r.parseRef(ref)
+	if err != nil {
+		return "", ocispec.Descriptor{}, err
+	}
+	if ecrSpec.Public() {
+		return r.resolvePublic(ctx, ecrSpec)
+	}
+
+	if ecrSpec.Object == "" {
+		return "", ocispec.Descriptor{}, reference.ErrObjectRequired
+	}
+
+	batchGetImageInput := &ecr.BatchGetImageInput{
+		RegistryId:         aws.String(ecrSpec.Registry()),
+		RepositoryName:     aws.String(ecrSpec.Repository),
+		ImageIds:           []*ecr.ImageIdentifier{ecrSpec.ImageID()},
+		AcceptedMediaTypes: aws.StringSlice(acceptedMediaTypes(ctx)),
+	}
+
+	client := r.getSpecClient(ecrSpec)
+
+	batchGetImageOutput, err := r.batchGetImage(ctx, client, ecrSpec, batchGetImageInput)
+	if err != nil {
+		log.G(ctx).
+			WithField("ref", ref).
+			WithError(err).
+			Warn("Failed while calling BatchGetImage")
+		return "", ocispec.Descriptor{}, err
+	}
+	log.G(ctx).
+		WithField("ref", ref).
+		WithField("batchGetImageOutput", batchGetImageOutput).
+		Debug("ecr.resolver.resolve")
+
+	if len(batchGetImageOutput.Images) == 0 {
+		for _, failure := range batchGetImageOutput.Failures {
+			switch aws.StringValue(failure.FailureCode) {
+			case ecr.ImageFailureCodeInvalidImageDigest, ecr.ImageFailureCodeInvalidImageTag:
+				return "", ocispec.Descriptor{}, reference.ErrInvalid
+			}
+		}
+		return "", ocispec.Descriptor{}, fmt.Errorf("%v: %w", ref, ErrImageNotFound)
+	}
+	ecrImage := batchGetImageOutput.Images[0]
+
+	mediaType := aws.StringValue(ecrImage.ImageManifestMediaType)
+	if r.preferBodyType {
+		if declared := declaredManifestMediaType(aws.StringValue(ecrImage.ImageManifest)); declared != "" {
+			mediaType = declared
+		}
+	}
+	if mediaType == "" {
+		manifestBody := aws.StringValue(ecrImage.ImageManifest)
+		log.G(ctx).
+			WithField("ref", ref).
+			WithField("manifest", manifestBody).
+			Trace("ecr.resolver.resolve: parsing mediaType from manifest")
+		mediaType, err = parseImageManifestMediaType(ctx, manifestBody)
+		if err != nil {
+			return "", ocispec.Descriptor{}, err
+		}
+	}
+	log.G(ctx).
+		WithField("ref", ref).
+		WithField("mediaType", mediaType).
+		Debug("ecr.resolver.resolve")
+	if r.rejectSchema1 && isSchema1(mediaType) {
+		return "", ocispec.Descriptor{}, fmt.Errorf("ecr: resolved %q: %w", mediaType, ErrSchema1Unsupported)
+	}
+	// check resolved image's mediaType, it should be one of the specified in
+	// the request.
+	for i, accepted := range aws.StringValueSlice(batchGetImageInput.AcceptedMediaTypes) {
+		if mediaType == accepted {
+			break
+		}
+		if i+1 == len(batchGetImageInput.AcceptedMediaTypes) {
+			log.G(ctx).
+				WithField("ref", ref).
+				WithField("mediaType", mediaType).
+				Debug("ecr.resolver.resolve: unrequested mediaType, deferring to caller")
+		}
+	}
+
+	desc := ocispec.Descriptor{
+		Digest:    digest.Digest(aws.StringValue(ecrImage.ImageId.ImageDigest)),
+		MediaType: mediaType,
+		Size:      int64(len(aws.StringValue(ecrImage.ImageManifest))),
+	}
+	// assert matching digest if the provided ref includes one.
+	if expectedDigest := ecrSpec.Spec().Digest(); expectedDigest != "" {
+		resolved, err := normalizeDigest(desc.Digest)
+		if err != nil {
+			return "", ocispec.Descriptor{}, err
+		}
+		expected, err := normalizeDigest(expectedDigest)
+		if err != nil {
+			return "", ocispec.Descriptor{}, err
+		}
+		if resolved != expected {
+			return "", ocispec.Descriptor{}, fmt.Errorf("resolved image digest mismatch: %w", errdefs.ErrFailedPrecondition)
+		}
+	}
+
+	if r.scanStatusOnResolve {
+		status, err := r.getScanStatus(ctx, client, ecrSpec, desc.Digest)
+		if err != nil {
+			return "", ocispec.Descriptor{}, err
+		}
+		if status != "" {
+			desc.Annotations = map[string]string{AnnotationScanStatus: status}
+		}
+	}
+
+	if err := r.verifyResolved(ctx, ecrSpec, desc, []byte(aws.StringValue(ecrImage.ImageManifest))); err != nil {
+		return "", ocispec.Descriptor{}, err
+	}
+	if r.manifests != nil {
+		if key, err := manifestCacheKey(ecrSpec.ARN(), desc.Digest); err == nil {
+			r.manifests.put(key, mediaType, aws.StringValue(ecrImage.ImageManifest))
+		}
+	}
+	return ecrSpec.Canonical(), desc, nil
+}
+
+// batchGetImage calls BatchGetImage, retrying requests that fail with a
+// transient error as configured by the resolver's resolve retry policy, if
+// any, in place of the SDK's retries.
+func (r *ecrResolver) batchGetImage(ctx context.Context, client ecrAPI, ecrSpec ECRSpec, input *ecr.BatchGetImageInput) (*ecr.BatchGetImageOutput, error) {
+	var opts []request.Option
+	if r.resolveRetryPolicy.MaxAttempts > 1 {
+		opts = append(opts, withoutSDKRetries)
+	}
+	for attempts := 1; ; attempts++ {
+		spanCtx, span := startSpan(ctx, r.tracer, ecrSpec, "ecr.BatchGetImage")
+		output, err := client.BatchGetImageWithContext(spanCtx, input, opts...)
+		endSpan(span, err)
+		if err == nil || !retryableRequestError(err) || !r.resolveRetryPolicy.retryable(attempts) {
+			return output, err
+		}
+		delay := r.resolveRetryPolicy.backoff(attempts)
+		log.G(ctx).
+			WithError(err).
+			WithField("attempts", attempts).
+			WithField("delay", delay).
+			Debug("ecr.resolver.resolve: retrying BatchGetImage")
+		if err := sleep(ctx, delay); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// verifyResolved calls the configured resolve verifier, if any, with the
+// resolved image.
+func (r *ecrResolver) verifyResolved(ctx context.Context, ecrSpec ECRSpec, desc ocispec.Descriptor, manifest []byte) error {
+	if r.resolveVerifier == nil {
+		return nil
+	}
+	if err := r.resolveVerifier(ctx, ecrSpec, desc, manifest); err != nil {
+		log.G(ctx).
+			WithField("ref", ecrSpec.Canonical()).
+			WithError(err).
+			Warn("ecr.resolver.resolve: image rejected by verifier")
+		return fmt.Errorf("ecr: verifying %v: %w", ecrSpec.Canonical(), err)
+	}
+	return nil
+}
+
+// normalizeDigest returns the canonical, lowercase form of a digest so that
+// equivalent representations, such as an upper-cased algorithm or encoding,
+// compare equal.  Digests that are not valid once normalized are rejected
+// with an error wrapping errdefs.ErrInvalidArgument.
+func normalizeDigest(dgst digest.Digest) (digest.Digest, error) {
+	normalized, err := digest.Parse(strings.ToLower(strings.TrimSpace(dgst.String())))
+	if err != nil {
+		return "", fmt.Errorf("ecr: invalid digest %q: %w: %w", dgst, err, errdefs.ErrInvalidArgument)
+	}
+	return normalized, nil
+}
+
+// getScanStatus returns the scan status of the image with the given digest, or
+// an empty string when the image has no scan status.
+func (r *ecrResolver) getScanStatus(ctx context.Context, client ecrAPI, ecrSpec ECRSpec, dgst digest.Digest) (string, error) {
+	describeImagesOutput, err := client.DescribeImagesWithContext(ctx, &ecr.DescribeImagesInput{
+		RegistryId:     aws.String(ecrSpec.Registry()),
+		RepositoryName: aws.String(ecrSpec.Repository),
+		ImageIds:       []*ecr.ImageIdentifier{{ImageDigest: aws.String(dgst.String())}},
+	})
+	if err != nil {
+		log.G(ctx).
+			WithField("digest", dgst).
+			WithError(err).
+			Warn("Failed while calling DescribeImages")
+		return "", err
+	}
+	for _, detail := range describeImagesOutput.ImageDetails {
+		if detail.ImageScanStatus != nil {
+			return aws.StringValue(detail.ImageScanStatus.Status), nil
+		}
+	}
+	return "", nil
+}
+
+// parseRef normalizes and parses the provided reference and applies the
+// resolver's configured validation to it.
+func (r *ecrResolver) parseRef(ref string) (ECRSpec, error) {
+	if r.refNormalizer != nil {
+		ref = r.refNormalizer(ref)
+	}
+	ecrSpec, err := ParseRef(ref)
+	if err != nil {
+		return ECRSpec{}, err
+	}
+	if r.partitionCheck && !ecrSpec.Public() {
+		if err := r.checkPartition(ecrSpec); err != nil {
+			return ECRSpec{}, err
+		}
+	}
+	return ecrSpec, nil
+}
+
+// checkPartition asserts that the reference's partition matches the partition
+// of the session's configured region. The check is skipped when the session
+// has no region configured or the region's partition is unknown.
+func (r *ecrResolver) checkPartition(ecrSpec ECRSpec) error {
+	var region string
+	switch {
+	case r.configV2 != nil:
+		region = r.configV2.Region
+	case r.session != nil:
+		region = aws.StringValue(r.session.Config.Region)
+	}
+	if region == "" {
+		return nil
+	}
+	partition, found := endpoints.PartitionForRegion(endpoints.DefaultPartitions(), region)
+	if !found {
+		return nil
+	}
+	if partition.ID() != ecrSpec.Partition() {
+		return fmt.Errorf("ecr: reference partition %q does not match session partition %q for region %q: %w",
+			ecrSpec.Partition(), partition.ID(), region, errdefs.ErrInvalidArgument)
+	}
+	return nil
+}
+
+func (r *ecrResolver) getClient(region string) ecrAPI {
+	return r.getRegionClient(region, false)
+}
+
+// getSpecClient returns the client for the reference's region, using the
+// region's FIPS endpoint if the reference requests it.
+func (r *ecrResolver) getSpecClient(ecrSpec ECRSpec) ecrAPI {
+	return r.getRegionClient(ecrSpec.Region(), ecrSpec.FIPS())
+}
+
+// fipsClientSuffix is appended to the region to key the clients using FIPS
+// endpoints.
+const fipsClientSuffix = "/fips"
+
+func (r *ecrResolver) getRegionClient(region string, fips bool) ecrAPI {
+	if r.region != "" {
+		region = r.region
+	}
+	key := region
+	if fips {
+		key += fipsClientSuffix
+	}
+	r.clientsLock.Lock()
+	defer r.clientsLock.Unlock()
+	if _, ok := r.clients[key]; !ok {
+		if r.configV2 != nil {
+			r.clients[key] = r.newClientV2(region, fips)
+		} else {
+			r.clients[key] = r.newClient(region, fips)
+		}
+	}
+	return r.clients[key]
+}
+
+// newClient creates an aws-sdk-go client for the region from the resolver's
+// session.
+func (r *ecrResolver) newClient(region string, fips bool) ecrAPI {
+	config := &aws.Config{
+		Region:      aws.String(region),
+		HTTPClient:  r.httpClient,
+		Credentials: r.credentials,
+	}
+	if fips {
+		config.UseFIPSEndpoint = endpoints.FIPSEndpointStateEnabled
+	}
+	var retryConfig *aws.Config
+	if r.session != nil {
+		retryConfig = r.session.Config
+	}
+	if r.maxRetries != nil {
+		config.MaxRetries = aws.Int(*r.maxRetries)
+		retryConfig = config
+	}
+	config = request.WithRetryer(config, newThrottleRetryer(retryConfig, r.retryPolicy.MaxDelay))
+	if endpoint, ok := r.regionEndpoints[region]; ok {
+		config.Endpoint = aws.String(endpoint)
+	} else if r.endpoint != "" {
+		config.Endpoint = aws.String(r.endpoint)
+	}
+	if r.endpointResolver != nil {
+		config.EndpointResolver = r.endpointResolver
+	}
+	client := ecrsdk.New(r.session, config)
+	client.Handlers.Build.PushBack(addUserAgent)
+	client.Handlers.AfterRetry.PushBack(wrapServerError)
+	if r.metrics != nil {
+		client.Handlers.Complete.PushBack(r.recordAPICall)
+	}
+	if r.requestIDFromContext != nil {
+		client.Handlers.Build.PushBack(r.setRequestID)
+	}
+	if r.apiCallTimeout > 0 {
+		client.Handlers.Validate.PushFront(r.setAPICallTimeout)
+	}
+	return client
+}
+
+// manifestProbe provides a structure to parse and then probe a given manifest
+// to determine its mediaType.
+type manifestProbe struct {
+	// SchemaVersion is version identifier for the manifest schema used.
+	SchemaVersion int64 `json:"schemaVersion"`
+	// Explicit MediaType assignment for the manifest.
+	MediaType string `json:"mediaType,omitempty"`
+	// Docker Schema 1 signatures.
+	Signatures []json.RawMessage `json:"signatures,omitempty"`
+	// OCI or Docker Manifest Lists, the list of descriptors has mediaTypes
+	// embedded.
+	Manifests []json.RawMessage `json:"manifests,omitempty"`
+}
+
+// declaredManifestMediaType returns the mediaType declared in the body of a
+// manifest, or an empty string if it declares none.
+func declaredManifestMediaType(body string) string {
+	var manifest manifestProbe
+	if err := json.Unmarshal([]byte(body), &manifest); err != nil {
+		return ""
+	}
+	return manifest.MediaType
+}
+
+func parseImageManifestMediaType(ctx context.Context, body string) (string, error) {
+	var manifest manifestProbe
+	err := json.Unmarshal([]byte(body), &manifest)
+	if err != nil {
+		return "", fmt.Errorf("failed to unmarshall %q as a manifest: %w", body, ErrInvalidManifest)
+	}
+
+	switch manifest.SchemaVersion {
+	case 2:
+		// Defer to the manifest declared type.
+		if manifest.MediaType != "" {
+			return manifest.MediaType, nil
+		}
+		// Is a manifest list.
+		if len(manifest.Manifests) > 0 {
+			return images.MediaTypeDockerSchema2ManifestList, nil
+		}
+		// Is a single image manifest.
+		return images.MediaTypeDockerSchema2Manifest, nil
+
+	case 1:
+		// Defer to the manifest declared type.
+		if manifest.MediaType != "" {
+			return manifest.MediaType, nil
+		}
+		// Is Signed Docker Schema 1 manifest.
+		if len(manifest.Signatures) > 0 {
+			return images.MediaTypeDockerSchema1Manifest, nil
+		}
+		// Is Unsigned Docker Schema 1 manifest.
+		return mediaTypeDockerSchema1ManifestUnsigned, nil
+	default:
+		return "", fmt.Errorf("unsupported schema version %d: %w", manifest.SchemaVersion, ErrInvalidManifest)
+	}
+}
+
+// setRequestID is a request handler that sets the request ID extracted from
+// the request's context on the request.
+func (r *ecrResolver) setRequestID(req *request.Request) {
+	if requestID := r.requestIDFromContext(req.Context()); requestID != "" {
+		req.HTTPRequest.Header.Set(r.requestIDHeader, requestID)
+	}
+}
+
+// setAPICallTimeout is a request handler that bounds the context of each
+// attempt of the request by the resolver's API call timeout, so that an
+// attempt that times out is retried like other failed attempts.  Layer part
+// uploads, which carry layer content, are not bounded.
+func (r *ecrResolver) setAPICallTimeout(req *request.Request) {
+	if req.Operation.Name == "UploadLayerPart" {
+		return
+	}
+	// Each attempt is signed again, replacing the context of the previous
+	// attempt, whose response has been read, before it is used to sign.
+	cancel := context.CancelFunc(func() {})
+	req.Handlers.Sign.PushFront(func(req *request.Request) {
+		cancel()
+		var ctx context.Context
+		ctx, cancel = context.WithTimeout(req.Context(), r.apiCallTimeout)
+		req.HTTPRequest = req.HTTPRequest.WithContext(ctx)
+	})
+	req.Handlers.Complete.PushBack(func(*request.Request) { cancel() })
+}
+
+// ManifestLayerChecker is implemented by the resolver to check which of an
+// image's blobs are present in its repository, such as to plan a push.
+type ManifestLayerChecker interface {
+	// ManifestLayerAvailability reports whether the config and each layer of
+	// ref's image manifest are available in ref's repository.
+	ManifestLayerAvailability(ctx context.Context, ref string) (map[digest.Digest]bool, error)
+}
+
+var _ ManifestLayerChecker = (*ecrResolver)(nil)
+
+// ManifestLayerAvailability resolves the image manifest for the provided
+// reference and reports whether its config and each of its layers are
+// available in the reference's repository.
+//
+// Image indexes and manifest lists are not supported; resolve a specific
+// platform's manifest instead.
+func (r *ecrResolver) ManifestLayerAvailability(ctx context.Context, ref string) (map[digest.Digest]bool, error) {
+	base, mediaType, manifest, err := r.getImageManifest(ctx, ref)
+	if err != nil {
+		return nil, err
+	}
+	if manifest == nil {
+		return nil, fmt.Errorf("ecr: layer availability of %q: %w", mediaType, errdefs.ErrNotImplemented)
+	}
+
+	digests := []digest.Digest{manifest.Config.Digest}
+	for _, layer := range manifest.Layers {
+		digests = append(digests, layer.Digest)
+	}
+	return base.checkLayerAvailability(ctx, digests)
+}
+
+// ArtifactTypeResolver is implemented by the resolver to report the type of
+// artifact an image manifest describes.
+type ArtifactTypeResolver interface {
+	// ResolveArtifactType returns the artifact type of ref's image manifest.
+	ResolveArtifactType(ctx context.Context, ref string) (string, error)
+}
+
+var _ ArtifactTypeResolver = (*ecrResolver)(nil)
+
+// ResolveArtifactType resolves the image manifest for the provided reference
+// and returns the type of artifact it describes: the manifest's artifactType
+// when set, as for OCI 1.1 artifacts, and otherwise its config's mediaType.
+//
+// Image indexes and manifest lists are not supported; resolve a specific
+// manifest instead.
+func (r *ecrResolver) ResolveArtifactType(ctx context.Context, ref string) (string, error) {
+	_, mediaType, manifest, err := r.getImageManifest(ctx, ref)
+	if err != nil {
+		return "", err
+	}
+	if manifest == nil {
+		return "", fmt.Errorf("ecr: artifact type of %q: %w", mediaType, errdefs.ErrNotImplemented)
+	}
+
+	if manifest.ArtifactType != "" {
+		return manifest.ArtifactType, nil
+	}
+	return manifest.Config.MediaType, nil
+}
+
+// IndexChecker is implemented by the resolver to report whether a reference
+// is to a multi-platform image.
+type IndexChecker interface {
+	// IsIndex reports whether ref resolves to an image index or manifest
+	// list.
+	IsIndex(ctx context.Context, ref string) (bool, error)
+}
+
+var _ IndexChecker = (*ecrResolver)(nil)
+
+// IsIndex resolves the provided reference and reports whether it refers to an
+// image index or manifest list, such as a multi-platform image, rather than a
+// single manifest.
+func (r *ecrResolver) IsIndex(ctx context.Context, ref string) (bool, error) {
+	_, desc, err := r.Resolve(ctx, ref)
+	if err != nil {
+		return false, err
+	}
+	switch desc.MediaType {
+	case ocispec.MediaTypeImageIndex, images.MediaTypeDockerSchema2ManifestList:
+		return true, nil
+	default:
+		return false, nil
+	}
+}
+
+// TagLister is implemented by the resolver to list the tags of an image.
+type TagLister interface {
+	// TagsForDigest returns the tags that refer to the image with ref's
+	// digest, or the digest ref's tag resolves to.
+	TagsForDigest(ctx context.Context, ref string) ([]string, error)
+}
+
+var _ TagLister = (*ecrResolver)(nil)
+
+// TagsForDigest returns the tags that currently refer to the image with the
+// reference's digest.  References without a digest are resolved to the digest
+// of the image their tag currently refers to.
+func (r *ecrResolver) TagsForDigest(ctx context.Context, ref string) ([]string, error) {
+	ecrSpec, err := r.parseRef(ref)
+	if err != nil {
+		return nil, err
+	}
+	if ecrSpec.Public() {
+		return nil, publicUnsupported("listing tags")
+	}
+	_, dgst := ecrSpec.TagDigest()
+	if dgst == "" {
+		_, desc, err := r.Resolve(ctx, ref)
+		if err != nil {
+			return nil, err
+		}
+		dgst = desc.Digest
+	}
+
+	output, err := r.getSpecClient(ecrSpec).DescribeImagesWithContext(ctx, &ecr.DescribeImagesInput{
+		RegistryId:     aws.String(ecrSpec.Registry()),
+		RepositoryName: aws.String(ecrSpec.Repository),
+		ImageIds:       []*ecr.ImageIdentifier{{ImageDigest: aws.String(dgst.String())}},
+	})
+	if err != nil {
+		log.G(ctx).
+			WithField("digest", dgst).
+			WithError(err).
+			Warn("Failed while calling DescribeImages")
+		return nil, err
+	}
+	tags := []string{}
+	for _, detail := range output.ImageDetails {
+		tags = append(tags, aws.StringValueSlice(detail.ImageTags)...)
+	}
+	return tags, nil
+}
+
+// DiffIDResolver is implemented by the resolver to read the diff IDs of an
+// image's layers without fetching its layers.
+type DiffIDResolver interface {
+	// DiffIDs returns the diff IDs of the layers of ref's image, using the
+	// best match of platform when ref is to an image index.
+	DiffIDs(ctx context.Context, ref string, platform platforms.MatchComparer) ([]digest.Digest, error)
+}
+
+var _ DiffIDResolver = (*ecrResolver)(nil)
+
+// DiffIDs resolves the provided reference and returns the diff IDs of its
+// image's layers, as listed in the rootfs of the image's config.  When the
+// reference is to an image index or manifest list, the manifest of the best
+// match of platform is used; platform must then not be nil.
+func (r *ecrResolver) DiffIDs(ctx context.Context, ref string, platform platforms.MatchComparer) ([]digest.Digest, error) {
+	name, desc, err := r.Resolve(ctx, ref)
+	if err != nil {
+		return nil, err
+	}
+	fetcher, err := r.Fetcher(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	manifestBody, err := fetchContent(ctx, fetcher, desc)
+	if err != nil {
+		return nil, err
+	}
+	if images.IsIndexType(desc.MediaType) {
+		if platform == nil {
+			return nil, fmt.Errorf("ecr: diff IDs of index %s require a platform: %w", desc.Digest, errdefs.ErrInvalidArgument)
+		}
+		var index ocispec.Index
+		if err := json.Unmarshal(manifestBody, &index); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal index: %v: %w", err, ErrInvalidManifest)
+		}
+		desc, err = platformManifest(index, platform)
+		if err != nil {
+			return nil, err
+		}
+		manifestBody, err = fetchContent(ctx, fetcher, desc)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if !images.IsManifestType(desc.MediaType) {
+		return nil, fmt.Errorf("ecr: diff IDs of %q: %w", desc.MediaType, errdefs.ErrNotImplemented)
+	}
+
+	var manifest ocispec.Manifest
+	if err := json.Unmarshal(manifestBody, &manifest); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal manifest: %v: %w", err, ErrInvalidManifest)
+	}
+	configBody, err := fetchContent(ctx, fetcher, manifest.Config)
+	if err != nil {
+		return nil, err
+	}
+	var config ocispec.Image
+	if err := json.Unmarshal(configBody, &config); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal image config %s: %w", manifest.Config.Digest, err)
+	}
+	return config.RootFS.DiffIDs, nil
+}
+
+// platformManifest returns the descriptor of the index's manifest that best
+// matches platform.  Manifests without a platform are not matched.
+func platformManifest(index ocispec.Index, platform platforms.MatchComparer) (ocispec.Descriptor, error) {
+	var (
+		best  ocispec.Descriptor
+		found bool
+	)
+	for _, desc := range index.Manifests {
+		if desc.Platform == nil || !platform.Match(*desc.Platform) {
+			continue
+		}
+		if !found || platform.Less(*desc.Platform, *best.Platform) {
+			best, found = desc, true
+		}
+	}
+	if !found {
+		return ocispec.Descriptor{}, fmt.Errorf("ecr: no manifest matches the platform: %w", errdefs.ErrNotFound)
+	}
+	return best, nil
+}
+
+// fetchContent fetches and reads the content of desc.
+func fetchContent(ctx context.Context, fetcher remotes.Fetcher, desc ocispec.Descriptor) ([]byte, error) {
+	rc, err := fetcher.Fetch(ctx, desc)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return io.ReadAll(rc)
+}
+
+// getImageManifest gets the image for the provided reference and returns its
+// manifest's media type along with the parsed manifest.  The manifest is nil
+// when the image is not an OCI or Docker schema 2 image manifest, such as an
+// index.
+func (r *ecrResolver) getImageManifest(ctx context.Context, ref string) (*ecrBase, string, *ocispec.Manifest, error) {
+	ecrSpec, err := r.parseRef(ref)
+	if err != nil {
+		return nil, "", nil, err
+	}
+	if ecrSpec.Object == "" {
+		return nil, "", nil, reference.ErrObjectRequired
+	}
+	if ecrSpec.Public() {
+		return nil, "", nil, publicUnsupported("reading image manifests")
+	}
+	base := &ecrBase{
+		client:  r.getSpecClient(ecrSpec),
+		ecrSpec: ecrSpec,
+		tracer:  r.tracer,
+	}
+
+	image, err := base.getImage(ctx)
+	if err != nil {
+		return nil, "", nil, err
+	}
+	manifestBody := aws.StringValue(image.ImageManifest)
+	mediaType := aws.StringValue(image.ImageManifestMediaType)
+	if mediaType == "" {
+		mediaType, err = parseImageManifestMediaType(ctx, manifestBody)
+		if err != nil {
+			return nil, "", nil, err
+		}
+	}
+	switch mediaType {
+	case ocispec.MediaTypeImageManifest, images.MediaTypeDockerSchema2Manifest:
+	default:
+		return base, mediaType, nil, nil
+	}
+
+	var manifest ocispec.Manifest
+	if err := json.Unmarshal([]byte(manifestBody), &manifest); err != nil {
+		return nil, "", nil, fmt.Errorf("failed to unmarshal manifest: %v: %w", err, ErrInvalidManifest)
+	}
+	return base, mediaType, &manifest, nil
+}
+
+func (r *ecrResolver) Fetcher(ctx context.Context, ref string) (remotes.Fetcher, error) {
+	ctx = withLogFields(ctx, r.baseLogFields)
+	log.G(ctx).WithField("ref", ref).Debug("ecr.resolver.fetcher")
+	ecrSpec, err := r.parseRef(ref)
+	if err != nil {
+		return nil, err
+	}
+	if ecrSpec.Public() {
+		return r.getPublicResolver().Fetcher(ctx, ecrSpec.Canonical())
+	}
+	return &ecrFetcher{
+		ecrBase: ecrBase{
+			client:            r.getSpecClient(ecrSpec),
+			ecrSpec:           ecrSpec,
+			mediaTypeFamilies: r.mediaTypeFamilies,
+			logFields:         r.baseLogFields,
+			retryDeadline:     r.retryDeadline,
+			tracer:            r.tracer,
+			metrics:           r.metrics,
+		},
+		parallelism:         r.layerDownloadParallelism,
+		httpClient:          r.httpClient,
+		retryPolicy:         r.retryPolicy,
+		integrity:           r.contentIntegrity,
+		adaptiveParallelism: r.adaptiveParallelism,
+		haveBlob:            r.haveBlob,
+		rejectSchema1:       r.rejectSchema1,
+		downloadURLs:        r.downloadURLs,
+		manifests:           r.manifests,
+		onLayerDownload:     r.onLayerDownload,
+		idleTimeout:         r.dataPlaneIdleTimeout,
+		urlRefreshes:        r.downloadURLRefreshes,
+		sniffMediaType:      r.sniffMediaType,
+		downloadLimiter:     r.downloadLimiter,
+		fetchLimiter:        r.fetchLimiter,
+		prefetchPlatforms:   r.prefetchPlatforms,
+	}, nil
+}
+
+// Pusher returns a pusher for ref.  The pusher also implements LayerChecker.
+func (r *ecrResolver) Pusher(ctx context.Context, ref string) (remotes.Pusher, error) {
+	ctx = withLogFields(ctx, r.baseLogFields)
+	log.G(ctx).WithField("ref", ref).Debug("ecr.resolver.pusher")
+	ecrSpec, err := r.parseRef(ref)
+	if err != nil {
+		return nil, err
+	}
+	if ecrSpec.Public() {
+		return nil, publicUnsupported("pushing")
+	}
+
+	// References will include a digest when the ref is being pushed to a tag to
+	// denote *which* digest is the root descriptor in this push.
+	tag, digest := ecrSpec.TagDigest()
+	if tag == "" && digest != "" {
+		log.G(ctx).WithField("ref", ref).Debug("ecr.resolver.pusher: push by digest")
+	}
+
+	// The root descriptor's digest *must* be provided in order to properly tag
+	// manifests. A ref string will provide this as of containerd v1.3.0 -
 	// earlier versions do not provide it.
 	if digest == "" {
 		return nil, errors.New("pusher: root descriptor missing from push reference")
 	}
 
+	client := r.getSpecClient(ecrSpec)
+	if r.requiredEncryptionKey != "" {
+		err := r.checkEncryption(ctx, client, ecrSpec)
+		if err != nil && r.createRepository != nil && isRepositoryNotFound(err) {
+			if err := createRepository(ctx, client, ecrSpec, *r.createRepository); err != nil {
+				return nil, fmt.Errorf("ecr: creating repository %v: %w", ecrSpec.ARN(), err)
+			}
+			err = r.checkEncryption(ctx, client, ecrSpec)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	return &ecrPusher{
 		ecrBase: ecrBase{
-			client:  r.getClient(ecrSpec.Region()),
-			ecrSpec: ecrSpec,
+			client:            client,
+			ecrSpec:           ecrSpec,
+			mediaTypeFamilies: r.mediaTypeFamilies,
+			logFields:         r.baseLogFields,
+			retryDeadline:     r.retryDeadline,
+			tracer:            r.tracer,
+			metrics:           r.metrics,
 		},
-		tracker: r.tracker,
+		tracker:           r.tracker,
+		uploadContentType: r.uploadContentType,
+		onUploadInit:      r.onUploadInit,
+		onUploadComplete:  r.onUploadComplete,
+		stallTimeout:      r.uploadStallTimeout,
+		putLimiter:        r.manifestPutLimiter,
+		putParallelism:    int64(r.manifestPushParallelism),
+		minPartSize:       r.minUploadPartSize,
+		verifyLayers:      r.verifyLayers,
+		maxManifestSize:   r.maxPushManifestSize,
+		verifyParts:       r.verifyUploadParts,
+		uploadRetryPolicy: r.uploadRetryPolicy,
+		additionalTags:    r.additionalTags,
+		progress:          r.pushProgress,
+		createRepository:  r.createRepository,
+		presentLayers:     &sync.Map{},
 	}, nil
 }
+
+// TagDeleter is implemented by the resolver to delete tags in bulk.
+type TagDeleter interface {
+	// DeleteTagsByPrefix deletes every tag in ref's repository that starts
+	// with prefix and returns the tags that were deleted.
+	DeleteTagsByPrefix(ctx context.Context, ref string, prefix string) ([]string, error)
+}
+
+var _ TagDeleter = (*ecrResolver)(nil)
+
+// DeleteTagsByPrefix deletes every tag in the reference's repository that
+// starts with prefix and returns the tags that were deleted. Only the tags are
+// removed; images left untagged are subject to the repository's lifecycle
+// policy.
+//
+// The reference's object, if any, is ignored.
+func (r *ecrResolver) DeleteTagsByPrefix(ctx context.Context, ref string, prefix string) ([]string, error) {
+	if prefix == "" {
+		return nil, errors.New("ecr: refusing to delete tags without a prefix")
+	}
+	ecrSpec, err := r.parseRef(ref)
+	if err != nil {
+		return nil, err
+	}
+	if ecrSpec.Public() {
+		return nil, publicUnsupported("deleting tags")
+	}
+	client := r.getSpecClient(ecrSpec)
+
+	var matched []*ecr.ImageIdentifier
+	listImagesInput := &ecr.ListImagesInput{
+		RegistryId:     aws.String(ecrSpec.Registry()),
+		RepositoryName: aws.String(ecrSpec.Repository),
+		Filter:         &ecr.ListImagesFilter{TagStatus: aws.String(ecr.TagStatusTagged)},
+	}
+	for {
+		listImagesOutput, err := client.ListImagesWithContext(ctx, listImagesInput)
+		if err != nil {
+			log.G(ctx).WithField("ref", ref).WithError(err).Warn("Failed while calling ListImages")
+			return nil, err
+		}
+		for _, imageID := range listImagesOutput.ImageIds {
+			if tag := aws.StringValue(imageID.ImageTag); strings.HasPrefix(tag, prefix) {
+				matched = append(matched, &ecr.ImageIdentifier{ImageTag: aws.String(tag)})
+			}
+		}
+		if aws.StringValue(listImagesOutput.NextToken) == "" {
+			break
+		}
+		listImagesInput.NextToken = listImagesOutput.NextToken
+	}
+	log.G(ctx).
+		WithField("ref", ref).
+		WithField("prefix", prefix).
+		WithField("count", len(matched)).
+		Debug("ecr.resolver.delete: matched tags")
+
+	var (
+		deleted  []string
+		failures int
+	)
+	for begin := 0; begin < len(matched); begin += batchDeleteImageLimit {
+		end := begin + batchDeleteImageLimit
+		if end > len(matched) {
+			end = len(matched)
+		}
+		batchDeleteImageOutput, err := client.BatchDeleteImageWithContext(ctx, &ecr.BatchDeleteImageInput{
+			RegistryId:     aws.String(ecrSpec.Registry()),
+			RepositoryName: aws.String(ecrSpec.Repository),
+			ImageIds:       matched[begin:end],
+		})
+		if err != nil {
+			log.G(ctx).WithField("ref", ref).WithError(err).Warn("Failed while calling BatchDeleteImage")
+			return deleted, err
+		}
+		for _, imageID := range batchDeleteImageOutput.ImageIds {
+			deleted = append(deleted, aws.StringValue(imageID.ImageTag))
+		}
+		for _, failure := range batchDeleteImageOutput.Failures {
+			log.G(ctx).WithField("failure", failure).Warn("ecr.resolver.delete: failed to delete tag")
+			failures++
+		}
+	}
+	if failures > 0 {
+		return deleted, fmt.Errorf("ecr: failed to delete %d of %d tags with prefix %q", failures, len(matched), prefix)
+	}
+	return deleted, nil
+}
+
+// Primer is implemented by the resolver to prepare a region ahead of the
+// first pull or push.
+type Primer interface {
+	// Prime establishes a connection to Amazon ECR in region and checks the
+	// resolver's credentials.
+	Prime(ctx context.Context, region string) error
+}
+
+var _ Primer = (*ecrResolver)(nil)
+
+// Prime makes a single inexpensive request to Amazon ECR in the given region,
+// establishing a connection to the regional endpoint ahead of the first pull
+// or push and surfacing credential errors early.
+func (r *ecrResolver) Prime(ctx context.Context, region string) error {
+	_, err := r.getClient(region).GetAuthorizationTokenWithContext(ctx, &ecr.GetAuthorizationTokenInput{})
+	if err != nil {
+		log.G(ctx).WithField("region", region).WithError(err).Warn("Failed while calling GetAuthorizationToken")
+		return err
+	}
+	return nil
+}
+
+// ReplicationConfigReader is implemented by the resolver to read the
+// registry's replication configuration.
+type ReplicationConfigReader interface {
+	// ReplicationConfig returns the replication configuration of the
+	// session's account's registry in region.
+	ReplicationConfig(ctx context.Context, region string) (*ecr.ReplicationConfiguration, error)
+}
+
+var _ ReplicationConfigReader = (*ecrResolver)(nil)
+
+// ReplicationConfig returns the replication configuration of the session's
+// account's registry in the given region.  The configuration has no rules if
+// replication is not configured.
+func (r *ecrResolver) ReplicationConfig(ctx context.Context, region string) (*ecr.ReplicationConfiguration, error) {
+	output, err := r.getClient(region).DescribeRegistryWithContext(ctx, &ecr.DescribeRegistryInput{})
+	if err != nil {
+		log.G(ctx).WithField("region", region).WithError(err).Warn("Failed while calling DescribeRegistry")
+		return nil, err
+	}
+	if output.ReplicationConfiguration == nil {
+		return &ecr.ReplicationConfiguration{}, nil
+	}
+	return output.ReplicationConfiguration, nil
+}
+
+// RegistryScanningConfigReader is implemented by the resolver to read the
+// registry's scanning configuration.
+type RegistryScanningConfigReader interface {
+	// RegistryScanningConfig returns the scanning configuration of the
+	// session's account's registry in region.
+	RegistryScanningConfig(ctx context.Context, region string) (*ecr.RegistryScanningConfiguration, error)
+}
+
+var _ RegistryScanningConfigReader = (*ecrResolver)(nil)
+
+// RegistryScanningConfig returns the scanning configuration of the session's
+// account's registry in the given region, including whether enhanced scanning
+// is enabled.  The configuration is empty if scanning is not configured.
+func (r *ecrResolver) RegistryScanningConfig(ctx context.Context, region string) (*ecr.RegistryScanningConfiguration, error) {
+	output, err := r.getClient(region).GetRegistryScanningConfigurationWithContext(ctx, &ecr.GetRegistryScanningConfigurationInput{})
+	if err != nil {
+		log.G(ctx).WithField("region", region).WithError(err).Warn("Failed while calling GetRegistryScanningConfiguration")
+		return nil, err
+	}
+	if output.ScanningConfiguration == nil {
+		return &ecr.RegistryScanningConfiguration{}, nil
+	}
+	return output.ScanningConfiguration, nil
+}
+
+var _ io.Closer = (*ecrResolver)(nil)
+
+// Close discards the resolver's ECR clients and, for a resolver configured with
+// WithOwnConnectionPool, releases the idle connections of its pool.  The
+// connections of http.DefaultClient and of a client provided with
+// WithHTTPClient may be shared, and are left open.  Requests in flight are not ended by Close, and their
+// connections remain open for reuse once they complete.  The resolver remains
+// usable after Close, creating new clients and connections as needed.
+func (r *ecrResolver) Close() error {
+	r.clientsLock.Lock()
+	r.clients = map[string]ecrAPI{}
+	r.clientsLock.Unlock()
+	if r.ownsHTTPClient && r.httpClient != nil {
+		r.httpClient.CloseIdleConnections()
+	}
+	return nil
+}
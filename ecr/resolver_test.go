@@ -17,18 +17,39 @@ package ecr
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/endpoints"
 	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/awstesting/unit"
 	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/containerd/platforms"
 	"github.com/containerd/containerd/reference"
+	"github.com/containerd/containerd/remotes"
+	"github.com/containerd/containerd/remotes/docker"
 	"github.com/opencontainers/go-digest"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"golang.org/x/sync/semaphore"
 
 	"github.com/awslabs/amazon-ecr-containerd-resolver/ecr/internal/testdata"
 )
@@ -109,6 +130,70 @@ func TestResolve(t *testing.T) {
 	assert.Equal(t, expectedDesc, desc)
 }
 
+func TestResolveRefNormalizer(t *testing.T) {
+	const normalizedRef = "ecr.aws/arn:aws:ecr:fake:123456789012:repository/foo/bar:latest"
+	imageManifest := `{"schemaVersion": 2, "mediaType": "application/vnd.oci.image.manifest.v1+json"}`
+	fakeClient := &fakeECRClient{
+		BatchGetImageFn: func(_ aws.Context, input *ecr.BatchGetImageInput, _ ...request.Option) (*ecr.BatchGetImageOutput, error) {
+			assert.Equal(t, "foo/bar", aws.StringValue(input.RepositoryName))
+			return &ecr.BatchGetImageOutput{Images: []*ecr.Image{{
+				ImageId:       &ecr.ImageIdentifier{ImageDigest: aws.String(testdata.ImageDigest.String())},
+				ImageManifest: aws.String(imageManifest),
+			}}}, nil
+		},
+	}
+	resolver, err := NewResolver(WithSession(unit.Session), WithRefNormalizer(func(ref string) string {
+		return strings.TrimPrefix(ref, "https://")
+	}))
+	require.NoError(t, err)
+	resolver.(*ecrResolver).clients["fake"] = fakeClient
+
+	ref, _, err := resolver.Resolve(context.Background(), "https://"+normalizedRef)
+	require.NoError(t, err)
+	assert.Equal(t, normalizedRef, ref)
+
+	_, err = resolver.Fetcher(context.Background(), "https://"+normalizedRef)
+	assert.NoError(t, err)
+	_, err = resolver.Pusher(context.Background(), "https://"+normalizedRef+"@"+testdata.ImageDigest.String())
+	assert.NoError(t, err)
+}
+
+func TestResolveAcceptedMediaTypesContext(t *testing.T) {
+	ref := "ecr.aws/arn:aws:ecr:fake:123456789012:repository/foo/bar:latest"
+	accepted := []string{ocispec.MediaTypeImageManifest}
+
+	imageManifest := `{"schemaVersion": 2, "mediaType": "application/vnd.oci.image.manifest.v1+json"}`
+	callCount := 0
+	fakeClient := &fakeECRClient{
+		BatchGetImageFn: func(_ aws.Context, input *ecr.BatchGetImageInput, _ ...request.Option) (*ecr.BatchGetImageOutput, error) {
+			callCount++
+			assert.Equal(t, accepted, aws.StringValueSlice(input.AcceptedMediaTypes),
+				"should request the mediaTypes set on the context")
+			return &ecr.BatchGetImageOutput{Images: []*ecr.Image{{
+				ImageId:       &ecr.ImageIdentifier{ImageDigest: aws.String(testdata.ImageDigest.String())},
+				ImageManifest: aws.String(imageManifest),
+			}}}, nil
+		},
+	}
+	resolver := &ecrResolver{
+		clients: map[string]ecrAPI{
+			"fake": fakeClient,
+		},
+	}
+
+	ctx := WithAcceptedMediaTypesContext(context.Background(), accepted)
+	_, _, err := resolver.Resolve(ctx, ref)
+	require.NoError(t, err)
+	assert.Equal(t, 1, callCount)
+
+	fetcher, err := resolver.Fetcher(ctx, ref)
+	require.NoError(t, err)
+	reader, err := fetcher.Fetch(ctx, ocispec.Descriptor{MediaType: ocispec.MediaTypeImageManifest})
+	require.NoError(t, err)
+	reader.Close()
+	assert.Equal(t, 2, callCount)
+}
+
 func TestResolveError(t *testing.T) {
 	// input
 	ref := "ecr.aws/arn:aws:ecr:fake:123456789012:repository/foo/bar:latest"
@@ -145,7 +230,17 @@ func TestResolveNoResult(t *testing.T) {
 		},
 	}
 	_, _, err := resolver.Resolve(context.Background(), ref)
-	assert.Error(t, err)
+	assert.ErrorIs(t, err, ErrImageNotFound)
+	assert.True(t, errdefs.IsNotFound(err), "unexpected error: %v", err)
+
+	fakeClient.BatchGetImageFn = func(aws.Context, *ecr.BatchGetImageInput, ...request.Option) (*ecr.BatchGetImageOutput, error) {
+		return &ecr.BatchGetImageOutput{
+			Failures: []*ecr.ImageFailure{
+				{FailureCode: aws.String(ecr.ImageFailureCodeInvalidImageTag)},
+			},
+		}, nil
+	}
+	_, _, err = resolver.Resolve(context.Background(), ref)
 	assert.Equal(t, reference.ErrInvalid, err)
 }
 
@@ -183,3 +278,1422 @@ func TestResolvePusherAllowTagDigest(t *testing.T) {
 		})
 	}
 }
+
+func TestResolvePusherRequiredEncryption(t *testing.T) {
+	const requiredKey = "arn:aws:kms:fake:123456789012:key/required"
+	ref := "ecr.aws/arn:aws:ecr:fake:123456789012:repository/foo/bar@" + testdata.ImageDigest.String()
+	for _, tc := range []struct {
+		name       string
+		encryption *ecr.EncryptionConfiguration
+		valid      bool
+	}{
+		{
+			name:       "matching key",
+			encryption: &ecr.EncryptionConfiguration{EncryptionType: aws.String(ecr.EncryptionTypeKms), KmsKey: aws.String(requiredKey)},
+			valid:      true,
+		},
+		{
+			name:       "different key",
+			encryption: &ecr.EncryptionConfiguration{EncryptionType: aws.String(ecr.EncryptionTypeKms), KmsKey: aws.String("arn:aws:kms:fake:123456789012:key/other")},
+		},
+		{
+			name:       "AES256",
+			encryption: &ecr.EncryptionConfiguration{EncryptionType: aws.String(ecr.EncryptionTypeAes256)},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			callCount := 0
+			fakeClient := &fakeECRClient{
+				DescribeRepositoriesFn: func(_ aws.Context, input *ecr.DescribeRepositoriesInput, _ ...request.Option) (*ecr.DescribeRepositoriesOutput, error) {
+					callCount++
+					assert.Equal(t, "123456789012", aws.StringValue(input.RegistryId))
+					assert.Equal(t, []*string{aws.String("foo/bar")}, input.RepositoryNames)
+					return &ecr.DescribeRepositoriesOutput{
+						Repositories: []*ecr.Repository{{EncryptionConfiguration: tc.encryption}},
+					}, nil
+				},
+			}
+			resolver, err := NewResolver(WithSession(unit.Session), WithRequiredEncryption(requiredKey))
+			require.NoError(t, err)
+			resolver.(*ecrResolver).clients["fake"] = fakeClient
+
+			for i := 0; i < 2; i++ {
+				p, err := resolver.Pusher(context.Background(), ref)
+				if tc.valid {
+					assert.NoError(t, err)
+					assert.NotNil(t, p)
+				} else {
+					assert.True(t, errdefs.IsFailedPrecondition(err), "unexpected error: %v", err)
+					assert.Nil(t, p)
+				}
+			}
+			if tc.valid {
+				assert.Equal(t, 1, callCount, "verified repository should not be checked again")
+			} else {
+				assert.Equal(t, 2, callCount, "failed check should not be cached")
+			}
+		})
+	}
+}
+
+func TestDeleteTagsByPrefix(t *testing.T) {
+	ref := "ecr.aws/arn:aws:ecr:fake:123456789012:repository/foo/bar"
+
+	// Enough matching tags to require more than one BatchDeleteImage call.
+	var expected []string
+	var firstPage, secondPage []*ecr.ImageIdentifier
+	for i := 0; i < batchDeleteImageLimit+5; i++ {
+		tag := fmt.Sprintf("pr-123-%d", i)
+		expected = append(expected, tag)
+		firstPage = append(firstPage, &ecr.ImageIdentifier{ImageTag: aws.String(tag)})
+	}
+	secondPage = []*ecr.ImageIdentifier{
+		{ImageTag: aws.String("latest")},
+		{ImageTag: aws.String("pr-1234")},
+		{ImageTag: aws.String("main-pr-123-0")},
+	}
+	expected = append(expected, "pr-1234")
+
+	fakeClient := &fakeECRClient{
+		ListImagesFn: func(_ aws.Context, input *ecr.ListImagesInput, _ ...request.Option) (*ecr.ListImagesOutput, error) {
+			assert.Equal(t, "123456789012", aws.StringValue(input.RegistryId))
+			assert.Equal(t, "foo/bar", aws.StringValue(input.RepositoryName))
+			if input.NextToken == nil {
+				return &ecr.ListImagesOutput{ImageIds: firstPage, NextToken: aws.String("next")}, nil
+			}
+			assert.Equal(t, "next", aws.StringValue(input.NextToken))
+			return &ecr.ListImagesOutput{ImageIds: secondPage}, nil
+		},
+	}
+	var deleteCalls int
+	fakeClient.BatchDeleteImageFn = func(_ aws.Context, input *ecr.BatchDeleteImageInput, _ ...request.Option) (*ecr.BatchDeleteImageOutput, error) {
+		deleteCalls++
+		assert.LessOrEqual(t, len(input.ImageIds), batchDeleteImageLimit)
+		return &ecr.BatchDeleteImageOutput{ImageIds: input.ImageIds}, nil
+	}
+	resolver := &ecrResolver{
+		clients: map[string]ecrAPI{
+			"fake": fakeClient,
+		},
+	}
+
+	deleted, err := resolver.DeleteTagsByPrefix(context.Background(), ref, "pr-123")
+	require.NoError(t, err)
+	assert.Equal(t, 2, deleteCalls, "BatchDeleteImage should be called once per chunk")
+	assert.ElementsMatch(t, expected, deleted)
+}
+
+func TestResolverPartitionCheck(t *testing.T) {
+	sess := unit.Session.Copy(&aws.Config{Region: aws.String("us-west-2")})
+
+	for _, tc := range []struct {
+		ref   string
+		check bool
+		err   bool
+	}{
+		{ref: "ecr.aws/arn:aws:ecr:us-west-2:123456789012:repository/foo/bar:latest", check: true},
+		{ref: "ecr.aws/arn:aws-us-gov:ecr:us-gov-west-1:123456789012:repository/foo/bar:latest", check: true, err: true},
+		{ref: "ecr.aws/arn:aws-cn:ecr:cn-north-1:123456789012:repository/foo/bar:latest", check: true, err: true},
+		{ref: "ecr.aws/arn:aws-us-gov:ecr:us-gov-west-1:123456789012:repository/foo/bar:latest", check: false},
+	} {
+		t.Run(fmt.Sprintf("%s-%t", tc.ref, tc.check), func(t *testing.T) {
+			resolver := &ecrResolver{
+				session:        sess,
+				clients:        map[string]ecrAPI{},
+				partitionCheck: tc.check,
+			}
+			_, err := resolver.Fetcher(context.Background(), tc.ref)
+			if tc.err {
+				assert.Error(t, err)
+				assert.True(t, errors.Is(err, errdefs.ErrInvalidArgument))
+				return
+			}
+			assert.NoError(t, err)
+		})
+	}
+}
+
+func TestManifestLayerAvailability(t *testing.T) {
+	ref := "ecr.aws/arn:aws:ecr:fake:123456789012:repository/foo/bar:latest"
+
+	configDigest := digest.FromString("config")
+	availableLayer := digest.FromString("available")
+	missingLayer := digest.FromString("missing")
+	manifest, err := json.Marshal(ocispec.Manifest{
+		MediaType: ocispec.MediaTypeImageManifest,
+		Config:    ocispec.Descriptor{MediaType: ocispec.MediaTypeImageConfig, Digest: configDigest},
+		Layers: []ocispec.Descriptor{
+			{MediaType: ocispec.MediaTypeImageLayerGzip, Digest: availableLayer},
+			{MediaType: ocispec.MediaTypeImageLayerGzip, Digest: missingLayer},
+		},
+	})
+	require.NoError(t, err)
+
+	callCount := 0
+	fakeClient := &fakeECRClient{
+		BatchGetImageFn: func(aws.Context, *ecr.BatchGetImageInput, ...request.Option) (*ecr.BatchGetImageOutput, error) {
+			return &ecr.BatchGetImageOutput{Images: []*ecr.Image{{
+				ImageId:                &ecr.ImageIdentifier{ImageDigest: aws.String(testdata.ImageDigest.String())},
+				ImageManifest:          aws.String(string(manifest)),
+				ImageManifestMediaType: aws.String(ocispec.MediaTypeImageManifest),
+			}}}, nil
+		},
+		BatchCheckLayerAvailabilityFn: func(_ aws.Context, input *ecr.BatchCheckLayerAvailabilityInput, _ ...request.Option) (*ecr.BatchCheckLayerAvailabilityOutput, error) {
+			callCount++
+			assert.ElementsMatch(t,
+				[]string{configDigest.String(), availableLayer.String(), missingLayer.String()},
+				aws.StringValueSlice(input.LayerDigests))
+			return &ecr.BatchCheckLayerAvailabilityOutput{
+				Layers: []*ecr.Layer{
+					{LayerDigest: aws.String(configDigest.String()), LayerAvailability: aws.String(ecr.LayerAvailabilityAvailable)},
+					{LayerDigest: aws.String(availableLayer.String()), LayerAvailability: aws.String(ecr.LayerAvailabilityAvailable)},
+				},
+				Failures: []*ecr.LayerFailure{
+					{LayerDigest: aws.String(missingLayer.String()), FailureCode: aws.String(ecr.LayerFailureCodeMissingLayerDigest)},
+				},
+			}, nil
+		},
+	}
+	resolver := &ecrResolver{
+		clients: map[string]ecrAPI{
+			"fake": fakeClient,
+		},
+	}
+
+	availability, err := resolver.ManifestLayerAvailability(context.Background(), ref)
+	require.NoError(t, err)
+	assert.Equal(t, 1, callCount, "BatchCheckLayerAvailability should be called once")
+	assert.Equal(t, map[digest.Digest]bool{
+		configDigest:   true,
+		availableLayer: true,
+		missingLayer:   false,
+	}, availability)
+}
+
+func TestDiffIDs(t *testing.T) {
+	ref := "ecr.aws/arn:aws:ecr:fake:123456789012:repository/foo/bar:latest"
+	diffIDs := []digest.Digest{digest.FromString("layer 1"), digest.FromString("layer 2")}
+
+	config, err := json.Marshal(ocispec.Image{
+		Platform: ocispec.Platform{OS: "linux", Architecture: "arm64"},
+		RootFS:   ocispec.RootFS{Type: "layers", DiffIDs: diffIDs},
+	})
+	require.NoError(t, err)
+	configDesc := ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageConfig,
+		Digest:    digest.FromBytes(config),
+		Size:      int64(len(config)),
+	}
+	manifest, err := json.Marshal(ocispec.Manifest{
+		MediaType: ocispec.MediaTypeImageManifest,
+		Config:    configDesc,
+	})
+	require.NoError(t, err)
+	manifestDesc := ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageManifest,
+		Digest:    digest.FromBytes(manifest),
+		Size:      int64(len(manifest)),
+		Platform:  &ocispec.Platform{OS: "linux", Architecture: "arm64"},
+	}
+	index, err := json.Marshal(ocispec.Index{
+		MediaType: ocispec.MediaTypeImageIndex,
+		Manifests: []ocispec.Descriptor{
+			{
+				MediaType: ocispec.MediaTypeImageManifest,
+				Digest:    digest.FromString("amd64"),
+				Size:      5,
+				Platform:  &ocispec.Platform{OS: "linux", Architecture: "amd64"},
+			},
+			manifestDesc,
+		},
+	})
+	require.NoError(t, err)
+	indexDigest := digest.FromBytes(index)
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(config)
+	}))
+	defer ts.Close()
+
+	fakeClient := &fakeECRClient{
+		BatchGetImageFn: func(_ aws.Context, input *ecr.BatchGetImageInput, _ ...request.Option) (*ecr.BatchGetImageOutput, error) {
+			output := &ecr.BatchGetImageOutput{}
+			for _, imageID := range input.ImageIds {
+				switch {
+				case aws.StringValue(imageID.ImageTag) == "latest", aws.StringValue(imageID.ImageDigest) == indexDigest.String():
+					output.Images = append(output.Images, &ecr.Image{
+						ImageId:                &ecr.ImageIdentifier{ImageDigest: aws.String(indexDigest.String())},
+						ImageManifest:          aws.String(string(index)),
+						ImageManifestMediaType: aws.String(ocispec.MediaTypeImageIndex),
+					})
+				case aws.StringValue(imageID.ImageDigest) == manifestDesc.Digest.String():
+					output.Images = append(output.Images, &ecr.Image{
+						ImageId:                &ecr.ImageIdentifier{ImageDigest: aws.String(manifestDesc.Digest.String())},
+						ImageManifest:          aws.String(string(manifest)),
+						ImageManifestMediaType: aws.String(ocispec.MediaTypeImageManifest),
+					})
+				}
+			}
+			return output, nil
+		},
+		GetDownloadUrlForLayerFn: func(_ aws.Context, input *ecr.GetDownloadUrlForLayerInput, _ ...request.Option) (*ecr.GetDownloadUrlForLayerOutput, error) {
+			assert.Equal(t, configDesc.Digest.String(), aws.StringValue(input.LayerDigest))
+			return &ecr.GetDownloadUrlForLayerOutput{DownloadUrl: aws.String(ts.URL)}, nil
+		},
+	}
+	resolver := &ecrResolver{
+		clients: map[string]ecrAPI{
+			"fake": fakeClient,
+		},
+		httpClient: ts.Client(),
+	}
+
+	_, err = resolver.DiffIDs(context.Background(), ref, nil)
+	assert.True(t, errdefs.IsInvalidArgument(err), "an index should require a platform: %v", err)
+
+	_, err = resolver.DiffIDs(context.Background(), ref, platforms.Only(ocispec.Platform{OS: "windows", Architecture: "amd64"}))
+	assert.True(t, errdefs.IsNotFound(err), "unexpected error: %v", err)
+
+	actual, err := resolver.DiffIDs(context.Background(), ref, platforms.Only(ocispec.Platform{OS: "linux", Architecture: "arm64"}))
+	require.NoError(t, err)
+	assert.Equal(t, diffIDs, actual)
+}
+
+func TestResolverRegionEndpoints(t *testing.T) {
+	const manifest = `{"schemaVersion": 2, "mediaType": "application/vnd.oci.image.manifest.v1+json"}`
+	var requests atomic.Int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+		json.NewEncoder(w).Encode(map[string]any{
+			"images": []map[string]any{{
+				"imageId":       map[string]string{"imageDigest": digest.FromString(manifest).String()},
+				"imageManifest": manifest,
+			}},
+		})
+	}))
+	defer ts.Close()
+
+	resolver, err := NewResolver(
+		WithSession(unit.Session),
+		WithRegionEndpoints(map[string]string{
+			"us-west-2": ts.URL,
+			"us-east-1": "https://vpce-east.ecr.us-east-1.vpce.amazonaws.com",
+		}),
+	)
+	require.NoError(t, err)
+
+	fetcher, err := resolver.Fetcher(context.Background(), "ecr.aws/arn:aws:ecr:us-west-2:123456789012:repository/foo/bar:latest")
+	require.NoError(t, err)
+	rc, err := fetcher.Fetch(context.Background(), ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageManifest,
+		Digest:    digest.FromString(manifest),
+	})
+	require.NoError(t, err)
+	body, err := io.ReadAll(rc)
+	rc.Close()
+	require.NoError(t, err)
+	assert.Equal(t, manifest, string(body))
+	assert.Equal(t, int32(1), requests.Load(), "the region's endpoint should serve the request")
+
+	for region, expected := range map[string]string{
+		"us-east-1": "https://vpce-east.ecr.us-east-1.vpce.amazonaws.com",
+		"eu-west-1": "https://api.ecr.eu-west-1.amazonaws.com",
+	} {
+		t.Run(region, func(t *testing.T) {
+			client, ok := resolver.(*ecrResolver).getClient(region).(*ecr.ECR)
+			require.True(t, ok)
+			assert.Equal(t, expected, client.Endpoint)
+		})
+	}
+}
+
+func TestResolverEndpoint(t *testing.T) {
+	const manifest = `{"schemaVersion": 2, "mediaType": "application/vnd.oci.image.manifest.v1+json"}`
+	var requests atomic.Int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		writeBatchGetImageOutput(w, manifest)
+	}))
+	defer ts.Close()
+
+	resolver, err := NewResolver(
+		WithSession(unit.Session),
+		WithRegionEndpoints(map[string]string{
+			"us-west-2": "https://vpce-west.ecr.us-west-2.vpce.amazonaws.com",
+		}),
+		WithEndpoint(ts.URL),
+	)
+	require.NoError(t, err)
+
+	fetcher, err := resolver.Fetcher(context.Background(), "ecr.aws/arn:aws:ecr:eu-west-1:123456789012:repository/foo/bar:latest")
+	require.NoError(t, err)
+	rc, err := fetcher.Fetch(context.Background(), ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageManifest,
+		Digest:    digest.FromString(manifest),
+	})
+	require.NoError(t, err)
+	rc.Close()
+	assert.Equal(t, int32(1), requests.Load(), "the endpoint should serve regions without an endpoint of their own")
+
+	client, ok := resolver.(*ecrResolver).getClient("us-west-2").(*ecr.ECR)
+	require.True(t, ok)
+	assert.Equal(t, "https://vpce-west.ecr.us-west-2.vpce.amazonaws.com", client.Endpoint,
+		"the region's endpoint should take precedence")
+}
+
+func TestResolverMaxRetries(t *testing.T) {
+	_, err := NewResolver(WithSession(unit.Session), WithMaxRetries(-1))
+	assert.Error(t, err)
+
+	var attempts atomic.Int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts.Add(1)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer ts.Close()
+
+	resolver, err := NewResolver(
+		WithSession(unit.Session),
+		WithRegionEndpoints(map[string]string{"us-west-2": ts.URL}),
+		WithMaxRetries(2),
+	)
+	require.NoError(t, err)
+	fetcher, err := resolver.Fetcher(context.Background(), "ecr.aws/arn:aws:ecr:us-west-2:123456789012:repository/foo/bar:latest")
+	require.NoError(t, err)
+	_, err = fetcher.Fetch(context.Background(), ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageManifest,
+		Digest:    testdata.ImageDigest,
+	})
+	assert.Error(t, err)
+	assert.Equal(t, int32(3), attempts.Load(), "the request should be retried twice")
+}
+
+func TestResolverEndpointResolver(t *testing.T) {
+	const manifest = `{"schemaVersion": 2, "mediaType": "application/vnd.oci.image.manifest.v1+json"}`
+	var requests atomic.Int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		writeBatchGetImageOutput(w, manifest)
+	}))
+	defer ts.Close()
+
+	var regions []string
+	resolver, err := NewResolver(
+		WithSession(unit.Session),
+		WithEndpointResolver(endpoints.ResolverFunc(
+			func(service, region string, _ ...func(*endpoints.Options)) (endpoints.ResolvedEndpoint, error) {
+				regions = append(regions, region)
+				return endpoints.ResolvedEndpoint{
+					URL:           ts.URL,
+					SigningRegion: region,
+				}, nil
+			})),
+	)
+	require.NoError(t, err)
+
+	fetcher, err := resolver.Fetcher(context.Background(), "ecr.aws/arn:aws:ecr:eu-west-1:123456789012:repository/foo/bar:latest")
+	require.NoError(t, err)
+	rc, err := fetcher.Fetch(context.Background(), ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageManifest,
+		Digest:    digest.FromString(manifest),
+	})
+	require.NoError(t, err)
+	rc.Close()
+	assert.Contains(t, regions, "eu-west-1")
+	assert.Equal(t, int32(1), requests.Load(), "the resolved endpoint should serve the request")
+}
+
+func TestResolverRegion(t *testing.T) {
+	const manifest = `{"schemaVersion":2}`
+	var registryIDs []string
+	fakeClient := &fakeECRClient{
+		BatchGetImageFn: func(_ aws.Context, input *ecr.BatchGetImageInput, _ ...request.Option) (*ecr.BatchGetImageOutput, error) {
+			registryIDs = append(registryIDs, aws.StringValue(input.RegistryId))
+			return &ecr.BatchGetImageOutput{Images: []*ecr.Image{{
+				ImageId:                &ecr.ImageIdentifier{ImageDigest: aws.String(digest.FromString(manifest).String())},
+				ImageManifest:          aws.String(manifest),
+				ImageManifestMediaType: aws.String(ocispec.MediaTypeImageManifest),
+			}}}, nil
+		},
+	}
+	resolver, err := NewResolver(WithSession(unit.Session), WithNoManifestCache(), WithRegion("us-east-2"))
+	require.NoError(t, err)
+	resolver.(*ecrResolver).clients["us-east-2"] = fakeClient
+
+	for _, ref := range []string{
+		"ecr.aws/arn:aws:ecr:us-west-2:123456789012:repository/foo/bar:latest",
+		"ecr.aws/arn:aws:ecr:eu-west-1:210987654321:repository/foo/bar:latest",
+	} {
+		_, desc, err := resolver.Resolve(context.Background(), ref)
+		require.NoError(t, err)
+		fetcher, err := resolver.Fetcher(context.Background(), ref)
+		require.NoError(t, err)
+		rc, err := fetcher.Fetch(context.Background(), desc)
+		require.NoError(t, err)
+		rc.Close()
+	}
+	assert.Equal(t, []string{"123456789012", "123456789012", "210987654321", "210987654321"}, registryIDs,
+		"the reference's account should be the registry")
+	assert.Len(t, resolver.(*ecrResolver).clients, 1, "only the configured region's client should be used")
+}
+
+func TestResolverFIPSClient(t *testing.T) {
+	resolver := &ecrResolver{
+		session: unit.Session,
+		clients: map[string]ecrAPI{},
+	}
+	for ref, expected := range map[string]string{
+		"ecr.aws/arn:aws-us-gov:ecr:us-gov-west-1:123456789012:repository/foo/bar:latest":      "https://api.ecr.us-gov-west-1.amazonaws.com",
+		"ecr-fips.aws/arn:aws-us-gov:ecr:us-gov-west-1:123456789012:repository/foo/bar:latest": "https://ecr-fips.us-gov-west-1.amazonaws.com",
+	} {
+		t.Run(ref, func(t *testing.T) {
+			ecrSpec, err := ParseRef(ref)
+			require.NoError(t, err)
+			client, ok := resolver.getSpecClient(ecrSpec).(*ecr.ECR)
+			require.True(t, ok)
+			assert.Equal(t, expected, client.Endpoint)
+		})
+	}
+	assert.Len(t, resolver.clients, 2, "FIPS and non-FIPS clients should be separate")
+}
+
+func TestResolveScanStatus(t *testing.T) {
+	ref := "ecr.aws/arn:aws:ecr:fake:123456789012:repository/foo/bar:latest"
+	imageManifest := `{"schemaVersion": 2, "mediaType": "application/vnd.oci.image.manifest.v1+json"}`
+
+	for _, enabled := range []bool{true, false} {
+		t.Run(fmt.Sprintf("enabled=%t", enabled), func(t *testing.T) {
+			describeCount := 0
+			fakeClient := &fakeECRClient{
+				BatchGetImageFn: func(aws.Context, *ecr.BatchGetImageInput, ...request.Option) (*ecr.BatchGetImageOutput, error) {
+					return &ecr.BatchGetImageOutput{Images: []*ecr.Image{{
+						ImageId:       &ecr.ImageIdentifier{ImageDigest: aws.String(testdata.ImageDigest.String())},
+						ImageManifest: aws.String(imageManifest),
+					}}}, nil
+				},
+				DescribeImagesFn: func(_ aws.Context, input *ecr.DescribeImagesInput, _ ...request.Option) (*ecr.DescribeImagesOutput, error) {
+					describeCount++
+					assert.Equal(t, []*ecr.ImageIdentifier{{ImageDigest: aws.String(testdata.ImageDigest.String())}}, input.ImageIds)
+					return &ecr.DescribeImagesOutput{ImageDetails: []*ecr.ImageDetail{{
+						ImageScanStatus: &ecr.ImageScanStatus{Status: aws.String(ecr.ScanStatusComplete)},
+					}}}, nil
+				},
+			}
+			resolver := &ecrResolver{
+				clients: map[string]ecrAPI{
+					"fake": fakeClient,
+				},
+				scanStatusOnResolve: enabled,
+			}
+
+			_, desc, err := resolver.Resolve(context.Background(), ref)
+			require.NoError(t, err)
+			if !enabled {
+				assert.Equal(t, 0, describeCount, "DescribeImages should not be called")
+				assert.NotContains(t, desc.Annotations, AnnotationScanStatus)
+				return
+			}
+			assert.Equal(t, 1, describeCount, "DescribeImages should be called once")
+			assert.Equal(t, ecr.ScanStatusComplete, desc.Annotations[AnnotationScanStatus])
+		})
+	}
+}
+
+func TestResolveEquivalentDigest(t *testing.T) {
+	imageManifest := `{"schemaVersion": 2, "mediaType": "application/vnd.oci.image.manifest.v1+json"}`
+	imageDigest := digest.FromString(imageManifest)
+	// The reference carries an upper-cased, yet equivalent, form of the digest
+	// ECR returns.
+	ref := "ecr.aws/arn:aws:ecr:fake:123456789012:repository/foo/bar@" + strings.ToUpper(imageDigest.String())
+
+	fakeClient := &fakeECRClient{
+		BatchGetImageFn: func(aws.Context, *ecr.BatchGetImageInput, ...request.Option) (*ecr.BatchGetImageOutput, error) {
+			return &ecr.BatchGetImageOutput{Images: []*ecr.Image{{
+				ImageId:       &ecr.ImageIdentifier{ImageDigest: aws.String(imageDigest.String())},
+				ImageManifest: aws.String(imageManifest),
+			}}}, nil
+		},
+	}
+	resolver := &ecrResolver{
+		clients: map[string]ecrAPI{
+			"fake": fakeClient,
+		},
+	}
+
+	_, desc, err := resolver.Resolve(context.Background(), ref)
+	require.NoError(t, err, "equivalent digests should not be a mismatch")
+	assert.Equal(t, imageDigest, desc.Digest)
+
+	_, _, err = resolver.Resolve(context.Background(),
+		"ecr.aws/arn:aws:ecr:fake:123456789012:repository/foo/bar@"+digest.FromString("other").String())
+	assert.True(t, errdefs.IsFailedPrecondition(err), "different digests should be a mismatch")
+}
+
+func TestNormalizeDigest(t *testing.T) {
+	dgst := digest.FromString("content")
+	for _, tc := range []struct {
+		name  string
+		input digest.Digest
+	}{
+		{name: "canonical", input: dgst},
+		{name: "upper-cased", input: digest.Digest(strings.ToUpper(dgst.String()))},
+		{name: "surrounding space", input: " " + dgst + "\n"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			normalized, err := normalizeDigest(tc.input)
+			require.NoError(t, err)
+			assert.Equal(t, dgst, normalized)
+		})
+	}
+
+	for _, invalid := range []digest.Digest{"", "sha256", "sha256:abc", "sha256:" + digest.Digest(strings.Repeat("z", 64))} {
+		_, err := normalizeDigest(invalid)
+		assert.True(t, errdefs.IsInvalidArgument(err), "%q should be rejected, got %v", invalid, err)
+	}
+}
+
+func TestResolveArtifactType(t *testing.T) {
+	ref := "ecr.aws/arn:aws:ecr:fake:123456789012:repository/foo/bar:latest"
+	const (
+		configMediaType   = "application/vnd.example.config.v1+json"
+		artifactMediaType = "application/vnd.example.artifact.v1"
+	)
+
+	for _, tc := range []struct {
+		name     string
+		manifest ocispec.Manifest
+		expected string
+	}{
+		{
+			name: "config",
+			manifest: ocispec.Manifest{
+				MediaType: ocispec.MediaTypeImageManifest,
+				Config:    ocispec.Descriptor{MediaType: configMediaType},
+			},
+			expected: configMediaType,
+		},
+		{
+			name: "artifactType",
+			manifest: ocispec.Manifest{
+				MediaType:    ocispec.MediaTypeImageManifest,
+				ArtifactType: artifactMediaType,
+				Config:       ocispec.DescriptorEmptyJSON,
+			},
+			expected: artifactMediaType,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.manifest.SchemaVersion = 2
+			manifest, err := json.Marshal(tc.manifest)
+			require.NoError(t, err)
+
+			fakeClient := &fakeECRClient{
+				BatchGetImageFn: func(aws.Context, *ecr.BatchGetImageInput, ...request.Option) (*ecr.BatchGetImageOutput, error) {
+					return &ecr.BatchGetImageOutput{Images: []*ecr.Image{{
+						ImageId:       &ecr.ImageIdentifier{ImageDigest: aws.String(testdata.ImageDigest.String())},
+						ImageManifest: aws.String(string(manifest)),
+					}}}, nil
+				},
+			}
+			resolver := &ecrResolver{
+				clients: map[string]ecrAPI{
+					"fake": fakeClient,
+				},
+			}
+
+			artifactType, err := resolver.ResolveArtifactType(context.Background(), ref)
+			require.NoError(t, err)
+			assert.Equal(t, tc.expected, artifactType)
+		})
+	}
+}
+
+func TestIsIndex(t *testing.T) {
+	ref := "ecr.aws/arn:aws:ecr:fake:123456789012:repository/foo/bar:latest"
+	for _, tc := range []struct {
+		mediaType string
+		expected  bool
+	}{
+		{mediaType: ocispec.MediaTypeImageIndex, expected: true},
+		{mediaType: images.MediaTypeDockerSchema2ManifestList, expected: true},
+		{mediaType: ocispec.MediaTypeImageManifest, expected: false},
+		{mediaType: images.MediaTypeDockerSchema2Manifest, expected: false},
+	} {
+		t.Run(tc.mediaType, func(t *testing.T) {
+			fakeClient := &fakeECRClient{
+				BatchGetImageFn: func(aws.Context, *ecr.BatchGetImageInput, ...request.Option) (*ecr.BatchGetImageOutput, error) {
+					return &ecr.BatchGetImageOutput{Images: []*ecr.Image{{
+						ImageId:                &ecr.ImageIdentifier{ImageDigest: aws.String(testdata.ImageDigest.String())},
+						ImageManifest:          aws.String(`{"schemaVersion":2}`),
+						ImageManifestMediaType: aws.String(tc.mediaType),
+					}}}, nil
+				},
+			}
+			resolver := &ecrResolver{
+				clients: map[string]ecrAPI{
+					"fake": fakeClient,
+				},
+			}
+
+			isIndex, err := resolver.IsIndex(context.Background(), ref)
+			require.NoError(t, err)
+			assert.Equal(t, tc.expected, isIndex)
+		})
+	}
+}
+
+func TestTagsForDigest(t *testing.T) {
+	const manifest = `{"schemaVersion":2,"mediaType":"application/vnd.oci.image.manifest.v1+json"}`
+	manifestDigest := digest.FromString(manifest)
+	fakeClient := &fakeECRClient{
+		BatchGetImageFn: func(aws.Context, *ecr.BatchGetImageInput, ...request.Option) (*ecr.BatchGetImageOutput, error) {
+			return &ecr.BatchGetImageOutput{Images: []*ecr.Image{{
+				ImageId:       &ecr.ImageIdentifier{ImageDigest: aws.String(manifestDigest.String())},
+				ImageManifest: aws.String(manifest),
+			}}}, nil
+		},
+		DescribeImagesFn: func(_ aws.Context, input *ecr.DescribeImagesInput, _ ...request.Option) (*ecr.DescribeImagesOutput, error) {
+			assert.Equal(t, "123456789012", aws.StringValue(input.RegistryId))
+			assert.Equal(t, "foo/bar", aws.StringValue(input.RepositoryName))
+			assert.Equal(t, []*ecr.ImageIdentifier{{ImageDigest: aws.String(manifestDigest.String())}}, input.ImageIds)
+			return &ecr.DescribeImagesOutput{ImageDetails: []*ecr.ImageDetail{{
+				ImageDigest: aws.String(manifestDigest.String()),
+				ImageTags:   aws.StringSlice([]string{"latest", "v1", "stable"}),
+			}}}, nil
+		},
+	}
+	resolver := &ecrResolver{
+		clients: map[string]ecrAPI{
+			"fake": fakeClient,
+		},
+	}
+
+	for _, ref := range []string{
+		"ecr.aws/arn:aws:ecr:fake:123456789012:repository/foo/bar@" + manifestDigest.String(),
+		"ecr.aws/arn:aws:ecr:fake:123456789012:repository/foo/bar:latest",
+	} {
+		t.Run(ref, func(t *testing.T) {
+			tags, err := resolver.TagsForDigest(context.Background(), ref)
+			require.NoError(t, err)
+			assert.Equal(t, []string{"latest", "v1", "stable"}, tags)
+		})
+	}
+}
+
+func TestResolveRetry(t *testing.T) {
+	const manifest = `{"schemaVersion":2,"mediaType":"application/vnd.oci.image.manifest.v1+json"}`
+	attempts := 0
+	fakeClient := &fakeECRClient{
+		BatchGetImageFn: func(aws.Context, *ecr.BatchGetImageInput, ...request.Option) (*ecr.BatchGetImageOutput, error) {
+			attempts++
+			if attempts == 1 {
+				return nil, awserr.NewRequestFailure(awserr.New("ServerException", "transient", nil), 500, "request")
+			}
+			return &ecr.BatchGetImageOutput{Images: []*ecr.Image{{
+				ImageId:                &ecr.ImageIdentifier{ImageDigest: aws.String(digest.FromString(manifest).String())},
+				ImageManifest:          aws.String(manifest),
+				ImageManifestMediaType: aws.String(ocispec.MediaTypeImageManifest),
+			}}}, nil
+		},
+	}
+	resolver, err := NewResolver(WithSession(unit.Session), WithRetryPolicy(RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond}))
+	require.NoError(t, err)
+	resolver.(*ecrResolver).clients["fake"] = fakeClient
+
+	_, desc, err := resolver.Resolve(context.Background(), "ecr.aws/arn:aws:ecr:fake:123456789012:repository/foo/bar:latest")
+	require.NoError(t, err)
+	assert.Equal(t, digest.FromString(manifest), desc.Digest)
+	assert.Equal(t, 2, attempts)
+
+	// Errors that are not transient are not retried.
+	attempts = 1
+	fakeClient.BatchGetImageFn = func(aws.Context, *ecr.BatchGetImageInput, ...request.Option) (*ecr.BatchGetImageOutput, error) {
+		attempts++
+		return nil, awserr.New(ecr.ErrCodeRepositoryNotFoundException, "not found", nil)
+	}
+	_, _, err = resolver.Resolve(context.Background(), "ecr.aws/arn:aws:ecr:fake:123456789012:repository/foo/bar:latest")
+	assert.Error(t, err)
+	assert.Equal(t, 2, attempts)
+}
+
+func TestResolveVerifier(t *testing.T) {
+	const manifest = `{"schemaVersion":2,"mediaType":"application/vnd.oci.image.manifest.v1+json"}`
+	manifestDigest := digest.FromString(manifest)
+	fakeClient := &fakeECRClient{
+		BatchGetImageFn: func(aws.Context, *ecr.BatchGetImageInput, ...request.Option) (*ecr.BatchGetImageOutput, error) {
+			return &ecr.BatchGetImageOutput{Images: []*ecr.Image{{
+				ImageId:                &ecr.ImageIdentifier{ImageDigest: aws.String(manifestDigest.String())},
+				ImageManifest:          aws.String(manifest),
+				ImageManifestMediaType: aws.String(ocispec.MediaTypeImageManifest),
+			}}}, nil
+		},
+	}
+	errUnsigned := errors.New("image is not signed")
+	var verified []byte
+	resolver, err := NewResolver(
+		WithSession(unit.Session),
+		WithResolveVerifier(func(_ context.Context, spec ECRSpec, desc ocispec.Descriptor, manifest []byte) error {
+			assert.Equal(t, "foo/bar", spec.Repository)
+			assert.Equal(t, manifestDigest, desc.Digest)
+			verified = manifest
+			return errUnsigned
+		}),
+	)
+	require.NoError(t, err)
+	resolver.(*ecrResolver).clients["fake"] = fakeClient
+
+	_, _, err = resolver.Resolve(context.Background(), "ecr.aws/arn:aws:ecr:fake:123456789012:repository/foo/bar:latest")
+	assert.ErrorIs(t, err, errUnsigned)
+	assert.Equal(t, manifest, string(verified))
+}
+
+func TestResolveRejectSchema1(t *testing.T) {
+	ref := "ecr.aws/arn:aws:ecr:fake:123456789012:repository/foo/bar:latest"
+	for _, sample := range []testdata.MediaTypeSample{
+		testdata.DockerSchema1Manifest,
+		testdata.DockerSchema1ManifestUnsigned,
+	} {
+		t.Run(sample.MediaType(), func(t *testing.T) {
+			fakeClient := &fakeECRClient{
+				BatchGetImageFn: func(aws.Context, *ecr.BatchGetImageInput, ...request.Option) (*ecr.BatchGetImageOutput, error) {
+					return &ecr.BatchGetImageOutput{Images: []*ecr.Image{{
+						ImageId:       &ecr.ImageIdentifier{ImageDigest: aws.String(testdata.ImageDigest.String())},
+						ImageManifest: aws.String(sample.Content()),
+					}}}, nil
+				},
+			}
+			resolver, err := NewResolver(WithSession(unit.Session))
+			require.NoError(t, err)
+			resolver.(*ecrResolver).clients["fake"] = fakeClient
+
+			_, desc, err := resolver.Resolve(context.Background(), ref)
+			require.NoError(t, err, "schema 1 should be accepted by default")
+			assert.Equal(t, sample.MediaType(), desc.MediaType)
+
+			resolver, err = NewResolver(WithSession(unit.Session), WithRejectSchema1(true))
+			require.NoError(t, err)
+			resolver.(*ecrResolver).clients["fake"] = fakeClient
+
+			_, _, err = resolver.Resolve(context.Background(), ref)
+			assert.ErrorIs(t, err, ErrSchema1Unsupported)
+
+			fetcher, err := resolver.Fetcher(context.Background(), ref)
+			require.NoError(t, err)
+			_, err = fetcher.Fetch(context.Background(), ocispec.Descriptor{
+				MediaType: images.MediaTypeDockerSchema1Manifest,
+				Digest:    testdata.ImageDigest,
+			})
+			assert.ErrorIs(t, err, ErrSchema1Unsupported)
+		})
+	}
+}
+
+func TestResolverBaseLogFields(t *testing.T) {
+	ref := "ecr.aws/arn:aws:ecr:fake:123456789012:repository/foo/bar:latest"
+	manifest := `{"schemaVersion":2,"mediaType":"` + ocispec.MediaTypeImageManifest + `","layers":[]}`
+	manifestDesc := ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageManifest,
+		Digest:    digest.FromString(manifest),
+		Size:      int64(len(manifest)),
+	}
+	fakeClient := &fakeECRClient{
+		BatchGetImageFn: func(aws.Context, *ecr.BatchGetImageInput, ...request.Option) (*ecr.BatchGetImageOutput, error) {
+			return &ecr.BatchGetImageOutput{Images: []*ecr.Image{{
+				ImageId:                &ecr.ImageIdentifier{ImageDigest: aws.String(manifestDesc.Digest.String())},
+				ImageManifest:          aws.String(manifest),
+				ImageManifestMediaType: aws.String(manifestDesc.MediaType),
+			}}}, nil
+		},
+	}
+	resolver, err := NewResolver(
+		WithSession(unit.Session),
+		WithBaseLogFields(map[string]interface{}{
+			"tenant":  "example-tenant",
+			"cluster": "example-cluster",
+		}),
+	)
+	require.NoError(t, err)
+	resolver.(*ecrResolver).clients["fake"] = fakeClient
+
+	logger, hook := logtest.NewNullLogger()
+	logger.SetLevel(logrus.DebugLevel)
+	ctx := log.WithLogger(context.Background(), logrus.NewEntry(logger))
+
+	_, _, err = resolver.Resolve(ctx, ref)
+	require.NoError(t, err)
+	fetcher, err := resolver.Fetcher(ctx, ref)
+	require.NoError(t, err)
+	rc, err := fetcher.Fetch(ctx, manifestDesc)
+	require.NoError(t, err)
+	rc.Close()
+	pusher, err := resolver.Pusher(ctx, ref+"@"+manifestDesc.Digest.String())
+	require.NoError(t, err)
+	// The manifest is already present in the fake repository.
+	_, err = pusher.Push(ctx, manifestDesc)
+	require.True(t, errdefs.IsAlreadyExists(err), "unexpected error: %v", err)
+
+	messages := map[string]bool{}
+	for _, entry := range hook.AllEntries() {
+		messages[entry.Message] = true
+		assert.Equal(t, "example-tenant", entry.Data["tenant"], "entry %q", entry.Message)
+		assert.Equal(t, "example-cluster", entry.Data["cluster"], "entry %q", entry.Message)
+	}
+	for _, message := range []string{"ecr.resolver.resolve", "ecr.resolver.fetcher", "ecr.fetch", "ecr.resolver.pusher", "ecr.push"} {
+		assert.True(t, messages[message], "expected %q to be logged", message)
+	}
+}
+
+func TestResolvePreferManifestBodyMediaType(t *testing.T) {
+	ref := "ecr.aws/arn:aws:ecr:fake:123456789012:repository/foo/bar:latest"
+	for _, tc := range []struct {
+		name      string
+		prefer    bool
+		manifest  string
+		mediaType string
+		expected  string
+	}{
+		{
+			name:      "api field",
+			manifest:  testdata.OCIImageIndex.Content(),
+			mediaType: ocispec.MediaTypeImageManifest,
+			expected:  ocispec.MediaTypeImageManifest,
+		},
+		{
+			name:      "body declared",
+			prefer:    true,
+			manifest:  testdata.OCIImageIndex.Content(),
+			mediaType: ocispec.MediaTypeImageManifest,
+			expected:  ocispec.MediaTypeImageIndex,
+		},
+		{
+			name:      "body undeclared",
+			prefer:    true,
+			manifest:  `{"schemaVersion":2}`,
+			mediaType: ocispec.MediaTypeImageIndex,
+			expected:  ocispec.MediaTypeImageIndex,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			fakeClient := &fakeECRClient{
+				BatchGetImageFn: func(aws.Context, *ecr.BatchGetImageInput, ...request.Option) (*ecr.BatchGetImageOutput, error) {
+					return &ecr.BatchGetImageOutput{Images: []*ecr.Image{{
+						ImageId:                &ecr.ImageIdentifier{ImageDigest: aws.String(testdata.ImageDigest.String())},
+						ImageManifest:          aws.String(tc.manifest),
+						ImageManifestMediaType: aws.String(tc.mediaType),
+					}}}, nil
+				},
+			}
+			resolver, err := NewResolver(WithSession(unit.Session), WithPreferManifestBodyMediaType(tc.prefer))
+			require.NoError(t, err)
+			resolver.(*ecrResolver).clients["fake"] = fakeClient
+
+			_, desc, err := resolver.Resolve(context.Background(), ref)
+			require.NoError(t, err)
+			assert.Equal(t, tc.expected, desc.MediaType)
+		})
+	}
+}
+
+func TestPrime(t *testing.T) {
+	authErr := awserr.New("UnrecognizedClientException", "The security token included in the request is invalid.", nil)
+	for _, expected := range []error{nil, authErr} {
+		t.Run(fmt.Sprintf("err=%v", expected), func(t *testing.T) {
+			callCount := 0
+			fakeClient := &fakeECRClient{
+				GetAuthorizationTokenFn: func(aws.Context, *ecr.GetAuthorizationTokenInput, ...request.Option) (*ecr.GetAuthorizationTokenOutput, error) {
+					callCount++
+					if expected != nil {
+						return nil, expected
+					}
+					return &ecr.GetAuthorizationTokenOutput{}, nil
+				},
+			}
+			resolver := &ecrResolver{
+				clients: map[string]ecrAPI{
+					"fake": fakeClient,
+				},
+			}
+
+			err := resolver.Prime(context.Background(), "fake")
+			assert.Equal(t, expected, err)
+			assert.Equal(t, 1, callCount, "Prime should make exactly one request")
+		})
+	}
+}
+
+type requestIDKey struct{}
+
+func TestResolverRequestIDFromContext(t *testing.T) {
+	const (
+		header   = "X-Amzn-Trace-Id"
+		manifest = `{"schemaVersion": 2, "mediaType": "application/vnd.oci.image.manifest.v1+json"}`
+	)
+	var requestIDs []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestIDs = append(requestIDs, r.Header.Get(header))
+		writeBatchGetImageOutput(w, manifest)
+	}))
+	defer ts.Close()
+
+	resolver, err := NewResolver(
+		WithSession(unit.Session),
+		WithRegionEndpoints(map[string]string{"us-west-2": ts.URL}),
+		WithNoManifestCache(),
+		WithRequestIDFromContext(header, func(ctx context.Context) string {
+			requestID, _ := ctx.Value(requestIDKey{}).(string)
+			return requestID
+		}),
+	)
+	require.NoError(t, err)
+	fetcher, err := resolver.Fetcher(context.Background(), "ecr.aws/arn:aws:ecr:us-west-2:123456789012:repository/foo/bar:latest")
+	require.NoError(t, err)
+
+	for _, ctx := range []context.Context{
+		context.WithValue(context.Background(), requestIDKey{}, "Root=1-5759e988-bd862e3fe1be46a994272793"),
+		context.Background(),
+	} {
+		rc, err := fetcher.Fetch(ctx, ocispec.Descriptor{
+			MediaType: ocispec.MediaTypeImageManifest,
+			Digest:    digest.FromString(manifest),
+		})
+		require.NoError(t, err)
+		rc.Close()
+	}
+	assert.Equal(t, []string{"Root=1-5759e988-bd862e3fe1be46a994272793", ""}, requestIDs)
+}
+
+// writeBatchGetImageOutput responds to a BatchGetImage request with the
+// manifest, as the ECR API would.
+func writeBatchGetImageOutput(w http.ResponseWriter, manifest string) {
+	w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+	json.NewEncoder(w).Encode(map[string]any{
+		"images": []map[string]any{{
+			"imageId":       map[string]string{"imageDigest": digest.FromString(manifest).String()},
+			"imageManifest": manifest,
+		}},
+	})
+}
+
+func TestResolverAPICallTimeout(t *testing.T) {
+	const manifest = `{"schemaVersion": 2, "mediaType": "application/vnd.oci.image.manifest.v1+json"}`
+	for _, tc := range []struct {
+		name   string
+		option ResolverOption
+	}{
+		{name: "aws-sdk-go", option: WithSession(unit.Session)},
+		{name: "aws-sdk-go-v2", option: WithConfigV2(testConfigV2())},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			// The first attempt stalls; the retried attempt succeeds.
+			var attempts atomic.Int32
+			stalled := make(chan struct{})
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if attempts.Add(1) == 1 {
+					select {
+					case <-stalled:
+					case <-r.Context().Done():
+					}
+					return
+				}
+				w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+				json.NewEncoder(w).Encode(map[string]any{
+					"images": []map[string]any{{
+						"imageId":       map[string]string{"imageDigest": digest.FromString(manifest).String(), "imageTag": "latest"},
+						"imageManifest": manifest,
+					}},
+				})
+			}))
+			defer ts.Close()
+			defer close(stalled)
+
+			_, err := NewResolver(tc.option, WithAPICallTimeout(-time.Second))
+			require.Error(t, err)
+			resolver, err := NewResolver(
+				tc.option,
+				WithRegionEndpoints(map[string]string{"us-west-2": ts.URL}),
+				WithAPICallTimeout(100*time.Millisecond),
+			)
+			require.NoError(t, err)
+
+			_, desc, err := resolver.Resolve(context.Background(), "ecr.aws/arn:aws:ecr:us-west-2:123456789012:repository/foo/bar:latest")
+			require.NoError(t, err, "the stalled attempt should time out and be retried")
+			assert.Equal(t, digest.FromString(manifest), desc.Digest)
+			assert.Equal(t, int32(2), attempts.Load())
+		})
+	}
+
+	resolver, err := NewResolver(WithSession(unit.Session), WithAPICallTimeout(time.Second))
+	require.NoError(t, err)
+	client, ok := resolver.(*ecrResolver).getClient("us-west-2").(*ecr.ECR)
+	require.True(t, ok)
+	req, _ := client.UploadLayerPartRequest(&ecr.UploadLayerPartInput{})
+	req.Build()
+	assert.Equal(t, client.Handlers.Sign.Len(), req.Handlers.Sign.Len(), "layer part uploads should not be bounded")
+}
+
+func TestResolverCrossRegion(t *testing.T) {
+	const manifest = `{"schemaVersion": 2, "mediaType": "application/vnd.oci.image.manifest.v1+json"}`
+	manifestDesc := ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageManifest,
+		Digest:    digest.FromString(manifest),
+		Size:      int64(len(manifest)),
+	}
+	sourceRef := "ecr.aws/arn:aws:ecr:us-west-2:123456789012:repository/source@" + manifestDesc.Digest.String()
+	targetRef := "ecr.aws/arn:aws:ecr:eu-west-1:123456789012:repository/target:latest@" + manifestDesc.Digest.String()
+
+	var sourceCalls, targetCalls atomic.Int32
+	source := &fakeECRClient{
+		BatchGetImageFn: func(_ aws.Context, input *ecr.BatchGetImageInput, _ ...request.Option) (*ecr.BatchGetImageOutput, error) {
+			sourceCalls.Add(1)
+			assert.Equal(t, "source", aws.StringValue(input.RepositoryName))
+			return &ecr.BatchGetImageOutput{Images: []*ecr.Image{{
+				ImageId:       &ecr.ImageIdentifier{ImageDigest: aws.String(manifestDesc.Digest.String())},
+				ImageManifest: aws.String(manifest),
+			}}}, nil
+		},
+	}
+	target := &fakeECRClient{
+		BatchGetImageFn: func(_ aws.Context, input *ecr.BatchGetImageInput, _ ...request.Option) (*ecr.BatchGetImageOutput, error) {
+			targetCalls.Add(1)
+			assert.Equal(t, "target", aws.StringValue(input.RepositoryName))
+			return &ecr.BatchGetImageOutput{
+				Failures: []*ecr.ImageFailure{
+					{FailureCode: aws.String(ecr.ImageFailureCodeImageNotFound)},
+				},
+			}, nil
+		},
+		PutImageFn: func(_ aws.Context, input *ecr.PutImageInput, _ ...request.Option) (*ecr.PutImageOutput, error) {
+			targetCalls.Add(1)
+			assert.Equal(t, "target", aws.StringValue(input.RepositoryName))
+			return &ecr.PutImageOutput{
+				Image: &ecr.Image{
+					ImageId: &ecr.ImageIdentifier{ImageDigest: input.ImageDigest},
+				},
+			}, nil
+		},
+	}
+	resolver := &ecrResolver{
+		clients: map[string]ecrAPI{
+			"us-west-2": source,
+			"eu-west-1": target,
+		},
+		tracker: docker.NewInMemoryTracker(),
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			fetcher, err := resolver.Fetcher(context.Background(), sourceRef)
+			if !assert.NoError(t, err) {
+				return
+			}
+			reader, err := fetcher.Fetch(context.Background(), manifestDesc)
+			if !assert.NoError(t, err) {
+				return
+			}
+			defer reader.Close()
+			body, err := io.ReadAll(reader)
+			assert.NoError(t, err)
+			assert.Equal(t, manifest, string(body))
+		}()
+		go func() {
+			defer wg.Done()
+			pusher, err := resolver.Pusher(context.Background(), targetRef)
+			if !assert.NoError(t, err) {
+				return
+			}
+			writer, err := pusher.Push(context.Background(), manifestDesc)
+			if !assert.NoError(t, err) {
+				return
+			}
+			_, err = writer.Write([]byte(manifest))
+			assert.NoError(t, err)
+			assert.NoError(t, writer.Commit(context.Background(), manifestDesc.Size, manifestDesc.Digest))
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, int32(10), sourceCalls.Load(), "fetches should use the source region's client")
+	assert.Equal(t, int32(20), targetCalls.Load(), "pushes should use the target region's client")
+}
+
+func TestReplicationConfig(t *testing.T) {
+	expected := &ecr.ReplicationConfiguration{
+		Rules: []*ecr.ReplicationRule{{
+			Destinations: []*ecr.ReplicationDestination{{
+				Region:     aws.String("us-east-2"),
+				RegistryId: aws.String("123456789012"),
+			}},
+		}},
+	}
+	for _, tc := range []struct {
+		name     string
+		output   *ecr.DescribeRegistryOutput
+		expected *ecr.ReplicationConfiguration
+	}{
+		{
+			name:     "configured",
+			output:   &ecr.DescribeRegistryOutput{ReplicationConfiguration: expected},
+			expected: expected,
+		},
+		{
+			name:     "not configured",
+			output:   &ecr.DescribeRegistryOutput{},
+			expected: &ecr.ReplicationConfiguration{},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			fakeClient := &fakeECRClient{
+				DescribeRegistryFn: func(aws.Context, *ecr.DescribeRegistryInput, ...request.Option) (*ecr.DescribeRegistryOutput, error) {
+					return tc.output, nil
+				},
+			}
+			resolver := &ecrResolver{
+				clients: map[string]ecrAPI{
+					"fake": fakeClient,
+				},
+			}
+
+			config, err := resolver.ReplicationConfig(context.Background(), "fake")
+			require.NoError(t, err)
+			assert.Equal(t, tc.expected, config)
+		})
+	}
+}
+
+func TestRegistryScanningConfig(t *testing.T) {
+	expected := &ecr.RegistryScanningConfiguration{
+		ScanType: aws.String(ecr.ScanTypeEnhanced),
+		Rules: []*ecr.RegistryScanningRule{{
+			ScanFrequency: aws.String(ecr.ScanFrequencyContinuousScan),
+			RepositoryFilters: []*ecr.ScanningRepositoryFilter{{
+				Filter:     aws.String("*"),
+				FilterType: aws.String(ecr.ScanningRepositoryFilterTypeWildcard),
+			}},
+		}},
+	}
+	for _, tc := range []struct {
+		name     string
+		output   *ecr.GetRegistryScanningConfigurationOutput
+		expected *ecr.RegistryScanningConfiguration
+	}{
+		{
+			name:     "configured",
+			output:   &ecr.GetRegistryScanningConfigurationOutput{ScanningConfiguration: expected},
+			expected: expected,
+		},
+		{
+			name:     "not configured",
+			output:   &ecr.GetRegistryScanningConfigurationOutput{},
+			expected: &ecr.RegistryScanningConfiguration{},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			fakeClient := &fakeECRClient{
+				GetRegistryScanningConfigurationFn: func(aws.Context, *ecr.GetRegistryScanningConfigurationInput, ...request.Option) (*ecr.GetRegistryScanningConfigurationOutput, error) {
+					return tc.output, nil
+				},
+			}
+			resolver := &ecrResolver{
+				clients: map[string]ecrAPI{
+					"fake": fakeClient,
+				},
+			}
+
+			config, err := resolver.RegistryScanningConfig(context.Background(), "fake")
+			require.NoError(t, err)
+			assert.Equal(t, tc.expected, config)
+		})
+	}
+}
+
+func TestResolverClose(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		options []ResolverOption
+		// closes is whether Close releases the idle connection.
+		closes bool
+	}{
+		{name: "default client"},
+		{name: "own connection pool", options: []ResolverOption{WithOwnConnectionPool()}, closes: true},
+		{
+			name:    "provided client",
+			options: []ResolverOption{WithHTTPClient(&http.Client{Transport: &http.Transport{}}), WithOwnConnectionPool()},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			closed := make(chan struct{}, 1)
+			ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				fmt.Fprint(w, `{"registryId":"123456789012"}`)
+			}))
+			ts.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+				if state == http.StateClosed {
+					closed <- struct{}{}
+				}
+			}
+			ts.Start()
+			defer ts.Close()
+
+			resolver, err := NewResolver(append([]ResolverOption{
+				WithSession(unit.Session),
+				WithRegionEndpoints(map[string]string{"us-west-2": ts.URL}),
+			}, tc.options...)...)
+			require.NoError(t, err)
+			ecrResolver := resolver.(*ecrResolver)
+			_, err = ecrResolver.ReplicationConfig(context.Background(), "us-west-2")
+			require.NoError(t, err)
+			require.Len(t, ecrResolver.clients, 1)
+
+			closer, ok := resolver.(io.Closer)
+			require.True(t, ok, "resolver should implement io.Closer")
+			require.NoError(t, closer.Close())
+			assert.Empty(t, ecrResolver.clients)
+			if tc.closes {
+				select {
+				case <-closed:
+				case <-time.After(5 * time.Second):
+					t.Fatal("idle connection was not closed")
+				}
+				return
+			}
+			select {
+			case <-closed:
+				t.Fatal("idle connection of a shared client was closed")
+			case <-time.After(100 * time.Millisecond):
+			}
+		})
+	}
+}
+
+func TestResolverGlobalFetchLimiter(t *testing.T) {
+	const limit = 2
+	var inFlight, maxInFlight atomic.Int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := inFlight.Add(1)
+		defer inFlight.Add(-1)
+		for {
+			m := maxInFlight.Load()
+			if n <= m || maxInFlight.CompareAndSwap(m, n) {
+				break
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+		fmt.Fprint(w, "layer")
+	}))
+	defer ts.Close()
+
+	limiter := semaphore.NewWeighted(limit)
+	var fetchers []remotes.Fetcher
+	for i := 0; i < 2; i++ {
+		resolver, err := NewResolver(
+			WithSession(unit.Session),
+			WithHTTPClient(ts.Client()),
+			WithGlobalFetchLimiter(limiter),
+		)
+		require.NoError(t, err)
+		resolver.(*ecrResolver).clients["fake"] = &fakeECRClient{
+			GetDownloadUrlForLayerFn: func(aws.Context, *ecr.GetDownloadUrlForLayerInput, ...request.Option) (*ecr.GetDownloadUrlForLayerOutput, error) {
+				return &ecr.GetDownloadUrlForLayerOutput{DownloadUrl: aws.String(ts.URL)}, nil
+			},
+		}
+		fetcher, err := resolver.Fetcher(context.Background(), "ecr.aws/arn:aws:ecr:fake:123456789012:repository/foo/bar:latest")
+		require.NoError(t, err)
+		fetchers = append(fetchers, fetcher)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		fetcher := fetchers[i%len(fetchers)]
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rc, err := fetcher.Fetch(context.Background(), ocispec.Descriptor{
+				MediaType: ocispec.MediaTypeImageLayerGzip,
+				Digest:    testdata.InsignificantDigest,
+			})
+			if !assert.NoError(t, err) {
+				return
+			}
+			defer rc.Close()
+			body, err := io.ReadAll(rc)
+			assert.NoError(t, err)
+			assert.Equal(t, "layer", string(body))
+		}()
+	}
+	wg.Wait()
+	assert.LessOrEqual(t, maxInFlight.Load(), int32(limit), "downloads should not exceed the shared limit")
+	assert.True(t, limiter.TryAcquire(limit), "every download should release the limiter")
+}
+
+func TestResolverPrefetchPlatforms(t *testing.T) {
+	linuxAMD64 := ocispec.Platform{OS: "linux", Architecture: "amd64"}
+	linuxARM64 := ocispec.Platform{OS: "linux", Architecture: "arm64"}
+	windowsAMD64 := ocispec.Platform{OS: "windows", Architecture: "amd64"}
+	children := map[digest.Digest]string{}
+	index := ocispec.Index{MediaType: ocispec.MediaTypeImageIndex}
+	for _, platform := range []ocispec.Platform{linuxAMD64, linuxARM64, windowsAMD64} {
+		platform := platform
+		manifest := fmt.Sprintf(`{"schemaVersion":2,"mediaType":"application/vnd.oci.image.manifest.v1+json","annotations":{"platform":%q}}`, platforms.Format(platform))
+		children[digest.FromString(manifest)] = manifest
+		index.Manifests = append(index.Manifests, ocispec.Descriptor{
+			MediaType: ocispec.MediaTypeImageManifest,
+			Digest:    digest.FromString(manifest),
+			Size:      int64(len(manifest)),
+			Platform:  &platform,
+		})
+	}
+	indexBody, err := json.Marshal(index)
+	require.NoError(t, err)
+	indexDigest := digest.FromBytes(indexBody)
+
+	var requestedIDs [][]string
+	resolver, err := NewResolver(
+		WithSession(unit.Session),
+		WithNoManifestCache(),
+		WithPrefetchPlatforms(platforms.Any(linuxAMD64, linuxARM64)),
+	)
+	require.NoError(t, err)
+	resolver.(*ecrResolver).clients["fake"] = &fakeECRClient{
+		BatchGetImageFn: func(_ aws.Context, input *ecr.BatchGetImageInput, _ ...request.Option) (*ecr.BatchGetImageOutput, error) {
+			var ids []string
+			output := &ecr.BatchGetImageOutput{}
+			for _, id := range input.ImageIds {
+				dgst := digest.Digest(aws.StringValue(id.ImageDigest))
+				ids = append(ids, dgst.String())
+				manifest, mediaType := children[dgst], ocispec.MediaTypeImageManifest
+				if dgst == indexDigest {
+					manifest, mediaType = string(indexBody), ocispec.MediaTypeImageIndex
+				}
+				output.Images = append(output.Images, &ecr.Image{
+					ImageId:                &ecr.ImageIdentifier{ImageDigest: id.ImageDigest},
+					ImageManifest:          aws.String(manifest),
+					ImageManifestMediaType: aws.String(mediaType),
+				})
+			}
+			requestedIDs = append(requestedIDs, ids)
+			return output, nil
+		},
+	}
+	fetcher, err := resolver.Fetcher(context.Background(), "ecr.aws/arn:aws:ecr:fake:123456789012:repository/foo/bar:latest")
+	require.NoError(t, err)
+
+	rc, err := fetcher.Fetch(context.Background(), ocispec.Descriptor{MediaType: ocispec.MediaTypeImageIndex, Digest: indexDigest})
+	require.NoError(t, err)
+	rc.Close()
+	for _, child := range index.Manifests {
+		rc, err := fetcher.Fetch(context.Background(), child)
+		require.NoError(t, err)
+		body, err := io.ReadAll(rc)
+		rc.Close()
+		require.NoError(t, err)
+		assert.Equal(t, children[child.Digest], string(body))
+	}
+
+	assert.Equal(t, [][]string{
+		{indexDigest.String()},
+		{index.Manifests[0].Digest.String(), index.Manifests[1].Digest.String()},
+		{index.Manifests[2].Digest.String()},
+	}, requestedIDs, "only the children of the matched platforms should be prefetched")
+}
@@ -0,0 +1,289 @@
+/*
+ * Copyright 2017-2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You
+ * may not use this file except in compliance with the License. A copy of
+ * the License is located at
+ *
+ * 	http://aws.amazon.com/apache2.0/
+ *
+ * or in the "license" file accompanying this file. This file is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF
+ * ANY KIND, either express or implied. See the License for the specific
+ * language governing permissions and limitations under the License.
+ */
+
+package ecr
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/ecr"
+)
+
+// RetryPolicy configures how the resolver retries requests that fail with a
+// transient error, such as an Amazon S3 SlowDown response while downloading a
+// layer.  Layer downloads interrupted part way through are also resumed from
+// the content already received, when the server accepts range requests.
+type RetryPolicy struct {
+	// MaxAttempts is the total number of attempts made for a request,
+	// including the first.  Values less than 2 disable retries.
+	MaxAttempts int
+	// BaseDelay is the delay before the first retry.  Each later retry doubles
+	// the previous delay.
+	BaseDelay time.Duration
+	// MaxDelay caps the delay between any two attempts.  If not specified,
+	// delays are not capped.
+	MaxDelay time.Duration
+}
+
+// defaultRetryPolicy is used when a RetryPolicy is not provided to the
+// resolver.
+var defaultRetryPolicy = RetryPolicy{
+	MaxAttempts: 4,
+	BaseDelay:   200 * time.Millisecond,
+	MaxDelay:    10 * time.Second,
+}
+
+// retryable reports whether another attempt should be made after the given
+// number of attempts have been made.
+func (p RetryPolicy) retryable(attempts int) bool {
+	return attempts < p.MaxAttempts
+}
+
+// backoff returns the delay before the retry following the given number of
+// attempts.  The delay grows exponentially and is jittered to spread out
+// retries from concurrent requests.
+func (p RetryPolicy) backoff(attempts int) time.Duration {
+	delay := p.BaseDelay
+	for i := 1; i < attempts; i++ {
+		delay *= 2
+		if p.MaxDelay > 0 && delay >= p.MaxDelay {
+			break
+		}
+	}
+	if p.MaxDelay > 0 && delay > p.MaxDelay {
+		delay = p.MaxDelay
+	}
+	if delay <= 0 {
+		return 0
+	}
+	half := delay / 2
+	return half + time.Duration(rand.Int63n(int64(delay-half)+1))
+}
+
+// retryAfter returns the delay requested by a response's Retry-After header,
+// which may be given in seconds or as an HTTP date.
+func retryAfter(resp *http.Response) (time.Duration, bool) {
+	value := resp.Header.Get("Retry-After")
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		delay := time.Until(date)
+		if delay < 0 {
+			delay = 0
+		}
+		return delay, true
+	}
+	return 0, false
+}
+
+// ErrRetryDeadlineExceeded is returned when a retry is not made because the
+// total delay between retries of an operation would exceed the deadline
+// configured with WithTotalRetryDeadline.
+var ErrRetryDeadlineExceeded = errors.New("retry deadline exceeded")
+
+// retryBudgetKey is the context key of an operation's retryBudget.
+type retryBudgetKey struct{}
+
+// retryBudget is the total delay remaining for the retries of an operation,
+// shared by the retries of each request the operation makes.
+type retryBudget struct {
+	lock      sync.Mutex
+	remaining time.Duration
+}
+
+// withRetryBudget returns a context bounding the total delay of retries to
+// total.  A context that already has a budget is returned unchanged, so that
+// nested operations share the budget of the outermost operation.
+func withRetryBudget(ctx context.Context, total time.Duration) context.Context {
+	if total <= 0 {
+		return ctx
+	}
+	if _, ok := ctx.Value(retryBudgetKey{}).(*retryBudget); ok {
+		return ctx
+	}
+	return context.WithValue(ctx, retryBudgetKey{}, &retryBudget{remaining: total})
+}
+
+// reserveRetryDelay takes delay from the context's retry budget, reporting
+// false without taking it if the remaining budget is smaller than delay.
+func reserveRetryDelay(ctx context.Context, delay time.Duration) bool {
+	budget, ok := ctx.Value(retryBudgetKey{}).(*retryBudget)
+	if !ok {
+		return true
+	}
+	budget.lock.Lock()
+	defer budget.lock.Unlock()
+	if delay > budget.remaining {
+		return false
+	}
+	budget.remaining -= delay
+	return true
+}
+
+// sleep waits for the given delay or until the context is done, whichever
+// comes first.  The delay is taken from the context's retry budget, failing
+// with ErrRetryDeadlineExceeded if the budget cannot cover it.
+func sleep(ctx context.Context, delay time.Duration) error {
+	if !reserveRetryDelay(ctx, delay) {
+		return fmt.Errorf("ecr: retry delay %v: %w", delay, ErrRetryDeadlineExceeded)
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// throttleRetryer is the request.Retryer used for ECR API requests.  It wraps
+// the retryer of the session, or the SDK's default retryer, and delays retries
+// of throttled requests by the response's Retry-After header when present,
+// which the SDK's default retryer only adds to its own backoff and only for
+// some status codes.
+type throttleRetryer struct {
+	request.Retryer
+	// maxDelay, when set, caps the delays requested by Retry-After.
+	maxDelay time.Duration
+}
+
+// newThrottleRetryer returns a throttleRetryer wrapping the retryer configured
+// by config, or the SDK's default retryer making at most the number of retries
+// configured by config, or the SDK's default if not configured.
+func newThrottleRetryer(config *aws.Config, maxDelay time.Duration) throttleRetryer {
+	if config != nil {
+		if retryer, ok := config.Retryer.(request.Retryer); ok {
+			return throttleRetryer{Retryer: retryer, maxDelay: maxDelay}
+		}
+	}
+	maxRetries := client.DefaultRetryerMaxNumRetries
+	if config != nil && config.MaxRetries != nil && aws.IntValue(config.MaxRetries) != aws.UseServiceDefaultRetries {
+		maxRetries = aws.IntValue(config.MaxRetries)
+	}
+	return throttleRetryer{
+		Retryer:  client.DefaultRetryer{NumMaxRetries: maxRetries},
+		maxDelay: maxDelay,
+	}
+}
+
+// ShouldRetry reports whether the request should be retried, which it is not
+// once the retry budget of the request's context cannot cover the delay
+// before the retry.  The delay taken from the budget is estimated by
+// RetryRules, as the delay used is computed separately by the SDK.
+func (r throttleRetryer) ShouldRetry(req *request.Request) bool {
+	if !r.Retryer.ShouldRetry(req) {
+		return false
+	}
+	if req.RetryCount >= r.MaxRetries() {
+		return true
+	}
+	return reserveRetryDelay(req.Context(), r.RetryRules(req))
+}
+
+func (r throttleRetryer) RetryRules(req *request.Request) time.Duration {
+	if req.HTTPResponse != nil && req.IsErrorThrottle() {
+		if delay, ok := retryAfter(req.HTTPResponse); ok {
+			if r.maxDelay > 0 && delay > r.maxDelay {
+				delay = r.maxDelay
+			}
+			return delay
+		}
+	}
+	return r.Retryer.RetryRules(req)
+}
+
+// withoutSDKRetries is a request option disabling the AWS SDK's retries of
+// requests that the resolver retries itself, so that the attempts of each do
+// not multiply.
+func withoutSDKRetries(req *request.Request) {
+	req.Retryer = client.NoOpRetryer{}
+}
+
+// retryableRequestError reports whether an ECR API request failed with a
+// transient error that may succeed if retried.
+func retryableRequestError(err error) bool {
+	if request.IsErrorThrottle(err) || request.IsErrorRetryable(err) || errors.Is(err, ErrECRServer) {
+		return true
+	}
+	var requestFailure awserr.RequestFailure
+	return errors.As(err, &requestFailure) && requestFailure.StatusCode() >= 500
+}
+
+// serverError is an ECR ServerException, which is matched by ErrECRServer.
+// The error remains an awserr.Error so that its code is still available.
+type serverError struct {
+	err awserr.Error
+}
+
+func (e serverError) Error() string {
+	return e.err.Error()
+}
+
+func (e serverError) Code() string {
+	return e.err.Code()
+}
+
+func (e serverError) Message() string {
+	return e.err.Message()
+}
+
+func (e serverError) OrigErr() error {
+	return e.err.OrigErr()
+}
+
+func (e serverError) Unwrap() error {
+	return e.err
+}
+
+func (e serverError) Is(target error) bool {
+	return target == ErrECRServer || errors.Is(ErrECRServer, target)
+}
+
+// asServerError returns err as a serverError if it is an ECR ServerException,
+// or err unchanged otherwise.
+func asServerError(err error) error {
+	var awsErr awserr.Error
+	if errors.As(err, &awsErr) && awsErr.Code() == ecr.ErrCodeServerException {
+		if _, ok := err.(serverError); !ok {
+			return serverError{awsErr}
+		}
+	}
+	return err
+}
+
+// wrapServerError is a request handler marking the ServerException responses
+// of ECR API requests as ErrECRServer once the request's retries are
+// exhausted.
+func wrapServerError(req *request.Request) {
+	if req.Error != nil {
+		req.Error = asServerError(req.Error)
+	}
+}
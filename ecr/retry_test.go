@@ -0,0 +1,288 @@
+/*
+ * Copyright 2017-2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You
+ * may not use this file except in compliance with the License. A copy of
+ * the License is located at
+ *
+ * 	http://aws.amazon.com/apache2.0/
+ *
+ * or in the "license" file accompanying this file. This file is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF
+ * ANY KIND, either express or implied. See the License for the specific
+ * language governing permissions and limitations under the License.
+ */
+
+package ecr
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/awstesting/unit"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/containerd/containerd/errdefs"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/awslabs/amazon-ecr-containerd-resolver/ecr/internal/testdata"
+)
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	policy := RetryPolicy{
+		MaxAttempts: 10,
+		BaseDelay:   100 * time.Millisecond,
+		MaxDelay:    time.Second,
+	}
+	for _, tc := range []struct {
+		attempts int
+		max      time.Duration
+	}{
+		{attempts: 1, max: 100 * time.Millisecond},
+		{attempts: 2, max: 200 * time.Millisecond},
+		{attempts: 3, max: 400 * time.Millisecond},
+		{attempts: 9, max: time.Second},
+	} {
+		delay := policy.backoff(tc.attempts)
+		assert.GreaterOrEqual(t, delay, tc.max/2, "attempts %d", tc.attempts)
+		assert.LessOrEqual(t, delay, tc.max, "attempts %d", tc.attempts)
+	}
+
+	assert.True(t, policy.retryable(9))
+	assert.False(t, policy.retryable(10))
+	assert.False(t, RetryPolicy{}.retryable(1), "zero value should not retry")
+}
+
+func TestRetryAfter(t *testing.T) {
+	resp := &http.Response{Header: http.Header{}}
+	_, ok := retryAfter(resp)
+	assert.False(t, ok)
+
+	resp.Header.Set("Retry-After", "3")
+	delay, ok := retryAfter(resp)
+	assert.True(t, ok)
+	assert.Equal(t, 3*time.Second, delay)
+
+	resp.Header.Set("Retry-After", time.Now().Add(-time.Minute).UTC().Format(http.TimeFormat))
+	delay, ok = retryAfter(resp)
+	assert.True(t, ok)
+	assert.Equal(t, time.Duration(0), delay)
+
+	resp.Header.Set("Retry-After", "soon")
+	_, ok = retryAfter(resp)
+	assert.False(t, ok)
+}
+
+func TestThrottleRetryerRetryAfter(t *testing.T) {
+	attempts := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		if attempts == 1 {
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"__type":"ThrottlingException","message":"Rate exceeded"}`)
+			return
+		}
+		fmt.Fprint(w, `{}`)
+	}))
+	defer ts.Close()
+
+	var delays []time.Duration
+	resolver := &ecrResolver{
+		session: unit.Session.Copy(&aws.Config{
+			SleepDelay: func(delay time.Duration) {
+				delays = append(delays, delay)
+			},
+		}),
+		clients:         map[string]ecrAPI{},
+		regionEndpoints: map[string]string{"us-west-2": ts.URL},
+	}
+	_, err := resolver.getClient("us-west-2").GetAuthorizationTokenWithContext(context.Background(), &ecr.GetAuthorizationTokenInput{})
+	require.NoError(t, err)
+	assert.Equal(t, 2, attempts, "throttled request should be retried")
+	assert.Equal(t, []time.Duration{time.Second}, delays, "retry should wait for Retry-After")
+}
+
+// countingRetryer counts the retries its Retryer is asked about.
+type countingRetryer struct {
+	request.Retryer
+	asked int
+}
+
+func (r *countingRetryer) ShouldRetry(req *request.Request) bool {
+	r.asked++
+	return r.Retryer.ShouldRetry(req)
+}
+
+func TestThrottleRetryerSessionRetryer(t *testing.T) {
+	attempts := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		w.Header().Set("Retry-After", "60")
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, `{"__type":"ThrottlingException","message":"Rate exceeded"}`)
+	}))
+	defer ts.Close()
+
+	var delays []time.Duration
+	retryer := &countingRetryer{Retryer: client.DefaultRetryer{NumMaxRetries: 1}}
+	resolver := &ecrResolver{
+		session: unit.Session.Copy(request.WithRetryer(&aws.Config{
+			SleepDelay: func(delay time.Duration) {
+				delays = append(delays, delay)
+			},
+		}, retryer)),
+		clients:         map[string]ecrAPI{},
+		regionEndpoints: map[string]string{"us-west-2": ts.URL},
+		retryPolicy:     RetryPolicy{MaxDelay: 2 * time.Second},
+	}
+	_, err := resolver.getClient("us-west-2").GetAuthorizationTokenWithContext(context.Background(), &ecr.GetAuthorizationTokenInput{})
+	assert.Error(t, err)
+	assert.Equal(t, 2, attempts, "the session's retryer should bound the retries")
+	assert.NotZero(t, retryer.asked, "the session's retryer should be consulted")
+	assert.Equal(t, []time.Duration{2 * time.Second}, delays, "Retry-After should be capped at the policy's maximum delay")
+}
+
+func TestRetryBudget(t *testing.T) {
+	ctx := withRetryBudget(context.Background(), 100*time.Millisecond)
+	assert.Equal(t, ctx, withRetryBudget(ctx, time.Hour), "nested operations should share the budget")
+
+	assert.True(t, reserveRetryDelay(ctx, 60*time.Millisecond))
+	assert.False(t, reserveRetryDelay(ctx, 60*time.Millisecond), "delay beyond the remaining budget should not be reserved")
+	assert.True(t, reserveRetryDelay(ctx, 40*time.Millisecond))
+	assert.ErrorIs(t, sleep(ctx, time.Millisecond), ErrRetryDeadlineExceeded)
+
+	assert.True(t, reserveRetryDelay(context.Background(), time.Hour), "no budget should not limit retries")
+}
+
+func TestTotalRetryDeadline(t *testing.T) {
+	_, err := NewResolver(WithSession(unit.Session), WithTotalRetryDeadline(-time.Second))
+	assert.Error(t, err)
+
+	t.Run("api", func(t *testing.T) {
+		attempts := 0
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			attempts++
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"__type":"ThrottlingException","message":"Rate exceeded"}`)
+		}))
+		defer ts.Close()
+
+		var delays []time.Duration
+		resolver, err := NewResolver(
+			WithSession(unit.Session.Copy(&aws.Config{
+				SleepDelay: func(delay time.Duration) {
+					delays = append(delays, delay)
+				},
+			})),
+			WithRegionEndpoints(map[string]string{"us-west-2": ts.URL}),
+			WithTotalRetryDeadline(1500*time.Millisecond),
+		)
+		require.NoError(t, err)
+		_, _, err = resolver.Resolve(context.Background(), "ecr.aws/arn:aws:ecr:us-west-2:123456789012:repository/foo/bar:latest")
+		assert.Error(t, err)
+		assert.Equal(t, 2, attempts, "retries should stop once the deadline would be exceeded")
+		assert.Equal(t, []time.Duration{time.Second}, delays)
+	})
+
+	t.Run("layer", func(t *testing.T) {
+		requests := 0
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requests++
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}))
+		defer ts.Close()
+
+		resolver, err := NewResolver(
+			WithSession(unit.Session),
+			WithHTTPClient(ts.Client()),
+			WithRetryPolicy(RetryPolicy{MaxAttempts: 10}),
+			WithTotalRetryDeadline(1500*time.Millisecond),
+		)
+		require.NoError(t, err)
+		resolver.(*ecrResolver).clients["fake"] = &fakeECRClient{
+			GetDownloadUrlForLayerFn: func(aws.Context, *ecr.GetDownloadUrlForLayerInput, ...request.Option) (*ecr.GetDownloadUrlForLayerOutput, error) {
+				return &ecr.GetDownloadUrlForLayerOutput{DownloadUrl: aws.String(ts.URL)}, nil
+			},
+		}
+		fetcher, err := resolver.Fetcher(context.Background(), "ecr.aws/arn:aws:ecr:fake:123456789012:repository/foo/bar:latest")
+		require.NoError(t, err)
+		_, err = fetcher.Fetch(context.Background(), ocispec.Descriptor{
+			MediaType: ocispec.MediaTypeImageLayerGzip,
+			Digest:    testdata.InsignificantDigest,
+		})
+		assert.ErrorIs(t, err, ErrRetryDeadlineExceeded)
+		assert.Equal(t, 2, requests, "retries should stop once the deadline would be exceeded")
+	})
+}
+
+func TestServerError(t *testing.T) {
+	err := asServerError(awserr.New(ecr.ErrCodeServerException, "internal failure", nil))
+	assert.ErrorIs(t, err, ErrECRServer)
+	assert.True(t, errdefs.IsUnavailable(err), "unexpected error: %v", err)
+	assert.True(t, retryableRequestError(err))
+	awsErr, ok := err.(awserr.Error)
+	require.True(t, ok, "the error should remain an awserr.Error")
+	assert.Equal(t, ecr.ErrCodeServerException, awsErr.Code())
+	assert.Equal(t, err, asServerError(err), "the error should not be wrapped twice")
+
+	err = asServerError(awserr.New(ecr.ErrCodeRepositoryNotFoundException, "not found", nil))
+	assert.NotErrorIs(t, err, ErrECRServer)
+	assert.False(t, retryableRequestError(err))
+}
+
+func TestServerErrorResolve(t *testing.T) {
+	attempts := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(w, `{"__type":"ServerException","message":"internal failure"}`)
+	}))
+	defer ts.Close()
+
+	resolver := &ecrResolver{
+		session: unit.Session.Copy(&aws.Config{
+			SleepDelay: func(time.Duration) {},
+		}),
+		clients:         map[string]ecrAPI{},
+		regionEndpoints: map[string]string{"us-west-2": ts.URL},
+		maxRetries:      aws.Int(2),
+	}
+	_, _, err := resolver.Resolve(context.Background(), "ecr.aws/arn:aws:ecr:us-west-2:123456789012:repository/foo/bar:latest")
+	assert.ErrorIs(t, err, ErrECRServer)
+	assert.Equal(t, 3, attempts, "ServerException should be retried by the SDK")
+}
+
+func TestResolveRetryPolicyReplacesSDKRetries(t *testing.T) {
+	attempts := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(w, `{"__type":"ServerException","message":"internal failure"}`)
+	}))
+	defer ts.Close()
+
+	resolver := &ecrResolver{
+		session: unit.Session.Copy(&aws.Config{
+			SleepDelay: func(time.Duration) {},
+		}),
+		clients:            map[string]ecrAPI{},
+		regionEndpoints:    map[string]string{"us-west-2": ts.URL},
+		maxRetries:         aws.Int(2),
+		resolveRetryPolicy: RetryPolicy{MaxAttempts: 2},
+	}
+	_, _, err := resolver.Resolve(context.Background(), "ecr.aws/arn:aws:ecr:us-west-2:123456789012:repository/foo/bar:latest")
+	assert.ErrorIs(t, err, ErrECRServer)
+	assert.Equal(t, 2, attempts, "the SDK should not retry the attempts of the retry policy")
+}
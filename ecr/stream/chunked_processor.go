@@ -19,6 +19,7 @@ package stream
 
 import (
 	"context"
+	"fmt"
 	"io"
 	"time"
 )
@@ -56,17 +57,26 @@ type readCallbackFunc func(*Chunk) error
 // ChunkedProcessor will block waiting until the next readCallback is invoked
 // to read from the queued Chunks.
 //
+// ChunkedProcessor returns as soon as a readCallback or a read fails, without
+// waiting for reading to stop.  A read already in progress is left to finish
+// in the background, after which no further reads are made; callers may close
+// the reader to end such a read early.
+//
 // Parameters
 //
 // reader - the io.Reader to read.
 //
 // chunkSize - the maximum number of bytes that should be present in each chunk.
-// All chunks except the last chunk should be exactly chunkSize.
+// All chunks except the last chunk should be exactly chunkSize, which must be
+// positive.
 //
 // queueSize - the maximum number of unprocessed chunks to buffer.
 //
 // readCallback - the callback function to invoke for each chunk.
 func ChunkedProcessor(reader io.Reader, chunkSize int64, queueSize int64, readCallback readCallbackFunc) (int64, error) {
+	if chunkSize <= 0 {
+		return 0, fmt.Errorf("invalid chunk size %d", chunkSize)
+	}
 	ctx, cancel := context.WithCancel(context.Background())
 	bufferedReader := &chunkedProcessor{
 		ctx:          ctx,
@@ -77,16 +87,6 @@ func ChunkedProcessor(reader io.Reader, chunkSize int64, queueSize int64, readCa
 		chunkSize:    chunkSize,
 		queueSize:    queueSize,
 	}
-	defer close(bufferedReader.errorChannel)
-
-	// Drain the read channel to void leaking the readIntoChunks goroutine.
-	// When we return with an error out, we may have Chunks that have been read but not yet processed.
-	defer func() {
-		i := 0
-		for range bufferedReader.readChannel {
-			i++
-		}
-	}()
 
 	go bufferedReader.readIntoChunks()
 
@@ -97,7 +97,8 @@ func ChunkedProcessor(reader io.Reader, chunkSize int64, queueSize int64, readCa
 // On return, either the complete buffer is read (or there is an
 // error reading from the buffer) and the readChannel
 //
-// Can be canceled by canceling the context.
+// Can be canceled by canceling the context, which also unblocks any pending
+// send of a Chunk or an error.
 func (processor *chunkedProcessor) readIntoChunks() {
 	var currentBytes, currentPart int64
 	defer close(processor.readChannel)
@@ -109,12 +110,17 @@ func (processor *chunkedProcessor) readIntoChunks() {
 		default:
 			chunk, err := processor.readChunk(currentBytes, currentPart)
 			if err != nil && err != io.EOF {
-				processor.errorChannel <- err
+				select {
+				case processor.errorChannel <- err:
+				case <-processor.ctx.Done():
+				}
 				return
 			}
 
 			if chunk != nil {
-				processor.readChannel <- chunk
+				if !processor.send(chunk) {
+					return
+				}
 				currentBytes = chunk.BytesEnd + 1
 				currentPart++
 			}
@@ -127,6 +133,17 @@ func (processor *chunkedProcessor) readIntoChunks() {
 
 }
 
+// send queues a Chunk for processing, returning false if the context is
+// canceled before the Chunk could be queued.
+func (processor *chunkedProcessor) send(chunk *Chunk) bool {
+	select {
+	case processor.readChannel <- chunk:
+		return true
+	case <-processor.ctx.Done():
+		return false
+	}
+}
+
 // processChunks selects between the read & error channels provided in the
 // context and invokes the readCallback with the results on success.
 //
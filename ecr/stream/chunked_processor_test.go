@@ -17,8 +17,11 @@ package stream
 
 import (
 	"errors"
+	"io"
+	"runtime"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -96,3 +99,88 @@ func TestChunkedProcessorEmptySuccess(t *testing.T) {
 	assert.Equal(t, int64(0), size)
 	assert.Equal(t, 0, index)
 }
+
+func TestChunkedProcessorInvalidChunkSize(t *testing.T) {
+	_, err := ChunkedProcessor(strings.NewReader(testReaderString), 0, 2, func(b *Chunk) error {
+		t.Error("no chunk should be processed")
+		return nil
+	})
+	assert.Error(t, err)
+}
+
+// errAfterReader returns its content and then fails the following read.
+type errAfterReader struct {
+	content io.Reader
+	err     error
+}
+
+func (r *errAfterReader) Read(p []byte) (int, error) {
+	n, err := r.content.Read(p)
+	if err == io.EOF {
+		return n, r.err
+	}
+	return n, err
+}
+
+// waitForGoroutines waits for the number of goroutines to drop to at most n.
+func waitForGoroutines(n int) bool {
+	deadline := time.Now().Add(5 * time.Second)
+	for runtime.NumGoroutine() > n {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return true
+}
+
+func TestChunkedProcessorFailBlockedRead(t *testing.T) {
+	goroutines := runtime.NumGoroutine()
+	reader, writer := io.Pipe()
+	go writer.Write([]byte("A"))
+
+	// The reader blocks after the first chunk, as a stream may while its
+	// producer waits on the failed upload.
+	done := make(chan error)
+	go func() {
+		_, err := ChunkedProcessor(reader, 1, 2, func(b *Chunk) error {
+			return errors.New("error")
+		})
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		assert.Error(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("ChunkedProcessor should return without waiting for the blocked read")
+	}
+
+	reader.CloseWithError(errors.New("closed"))
+	assert.True(t, waitForGoroutines(goroutines), "reading goroutine should exit once the read is unblocked")
+}
+
+func TestChunkedProcessorFailStress(t *testing.T) {
+	goroutines := runtime.NumGoroutine()
+	for i := 0; i < 200; i++ {
+		reader := &errAfterReader{
+			content: strings.NewReader(testReaderString),
+			err:     errors.New("read error"),
+		}
+		done := make(chan error)
+		go func() {
+			// The callback fails while the reader fails, racing the read
+			// error against the callback error.
+			_, err := ChunkedProcessor(reader, 1, 1, func(b *Chunk) error {
+				return errors.New("callback error")
+			})
+			done <- err
+		}()
+		select {
+		case err := <-done:
+			assert.Error(t, err)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("ChunkedProcessor did not return on iteration %d", i)
+		}
+	}
+	assert.True(t, waitForGoroutines(goroutines), "reading goroutines should not leak")
+}
@@ -0,0 +1,74 @@
+/*
+ * Copyright 2017-2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You
+ * may not use this file except in compliance with the License. A copy of
+ * the License is located at
+ *
+ * 	http://aws.amazon.com/apache2.0/
+ *
+ * or in the "license" file accompanying this file. This file is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF
+ * ANY KIND, either express or implied. See the License for the specific
+ * language governing permissions and limitations under the License.
+ */
+
+package ecr
+
+import (
+	"context"
+	"io"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+// tracerName is the instrumentation name of the tracer created from the
+// TracerProvider configured with WithTracerProvider.
+const tracerName = "github.com/awslabs/amazon-ecr-containerd-resolver/ecr"
+
+// Span attribute keys describing the requests made by the resolver.
+const (
+	repositoryAttribute = attribute.Key("aws.ecr.repository")
+	registryAttribute   = attribute.Key("aws.ecr.registry_id")
+	regionAttribute     = attribute.Key("aws.region")
+	digestAttribute     = attribute.Key("oci.digest")
+)
+
+// startSpan starts a span named for an operation on the reference's
+// repository.  Without a tracer, the span returned records nothing.
+func startSpan(ctx context.Context, tracer trace.Tracer, spec ECRSpec, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	if tracer == nil {
+		tracer = noop.NewTracerProvider().Tracer(tracerName)
+	}
+	attrs = append([]attribute.KeyValue{
+		repositoryAttribute.String(spec.Repository),
+		registryAttribute.String(spec.Registry()),
+		regionAttribute.String(spec.Region()),
+	}, attrs...)
+	return tracer.Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// endSpan ends the span, recording err as its status when set.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// tracedReadCloser ends its span when closed, so that the span of a download
+// covers the transfer of the content as well as the request.
+type tracedReadCloser struct {
+	io.ReadCloser
+	span trace.Span
+}
+
+func (rc *tracedReadCloser) Close() error {
+	err := rc.ReadCloser.Close()
+	endSpan(rc.span, err)
+	return err
+}
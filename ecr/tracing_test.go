@@ -0,0 +1,107 @@
+/*
+ * Copyright 2017-2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You
+ * may not use this file except in compliance with the License. A copy of
+ * the License is located at
+ *
+ * 	http://aws.amazon.com/apache2.0/
+ *
+ * or in the "license" file accompanying this file. This file is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF
+ * ANY KIND, either express or implied. See the License for the specific
+ * language governing permissions and limitations under the License.
+ */
+
+package ecr
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/awstesting/unit"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestTracerProviderFetchLayer(t *testing.T) {
+	const layerData = "layer"
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, layerData)
+	}))
+	defer ts.Close()
+
+	recorder := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	resolver, err := NewResolver(WithSession(unit.Session), WithHTTPClient(ts.Client()), WithTracerProvider(tp))
+	require.NoError(t, err)
+	resolver.(*ecrResolver).clients["fake"] = &fakeECRClient{
+		GetDownloadUrlForLayerFn: func(aws.Context, *ecr.GetDownloadUrlForLayerInput, ...request.Option) (*ecr.GetDownloadUrlForLayerOutput, error) {
+			return &ecr.GetDownloadUrlForLayerOutput{DownloadUrl: aws.String(ts.URL)}, nil
+		},
+	}
+
+	ctx, parent := tp.Tracer("test").Start(context.Background(), "pull")
+	fetcher, err := resolver.Fetcher(ctx, "ecr.aws/arn:aws:ecr:fake:123456789012:repository/foo/bar:latest")
+	require.NoError(t, err)
+	desc := ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageLayerGzip,
+		Digest:    digest.FromString(layerData),
+		Size:      int64(len(layerData)),
+	}
+	rc, err := fetcher.Fetch(ctx, desc)
+	require.NoError(t, err)
+
+	ended := recorder.Ended()
+	require.Len(t, ended, 1, "the download span should end once the content is closed")
+	assert.Equal(t, "ecr.GetDownloadUrlForLayer", ended[0].Name())
+
+	_, err = io.ReadAll(rc)
+	require.NoError(t, err)
+	require.NoError(t, rc.Close())
+	parent.End()
+
+	ended = recorder.Ended()
+	require.Len(t, ended, 3)
+	for _, span := range ended[:2] {
+		assert.Equal(t, parent.SpanContext().SpanID(), span.Parent().SpanID(), "%s should be a child of the pull", span.Name())
+		assert.Contains(t, span.Attributes(), attribute.String("aws.ecr.repository", "foo/bar"))
+		assert.Contains(t, span.Attributes(), attribute.String("aws.region", "fake"))
+		assert.Contains(t, span.Attributes(), attribute.String("oci.digest", desc.Digest.String()))
+	}
+	assert.Equal(t, "ecr.DownloadLayer", ended[1].Name())
+}
+
+func TestTracerProviderResolve(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	resolver := &ecrResolver{
+		clients: map[string]ecrAPI{
+			"fake": &fakeECRClient{
+				BatchGetImageFn: func(aws.Context, *ecr.BatchGetImageInput, ...request.Option) (*ecr.BatchGetImageOutput, error) {
+					return &ecr.BatchGetImageOutput{}, nil
+				},
+			},
+		},
+		tracer: tp.Tracer(tracerName),
+	}
+
+	_, _, err := resolver.Resolve(context.Background(), "ecr.aws/arn:aws:ecr:fake:123456789012:repository/foo/bar:latest")
+	assert.ErrorIs(t, err, ErrImageNotFound)
+
+	ended := recorder.Ended()
+	require.Len(t, ended, 1)
+	assert.Equal(t, "ecr.BatchGetImage", ended[0].Name())
+	assert.Contains(t, ended[0].Attributes(), attribute.String("aws.ecr.registry_id", "123456789012"))
+}
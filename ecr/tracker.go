@@ -0,0 +1,50 @@
+/*
+ * Copyright 2017-2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You
+ * may not use this file except in compliance with the License. A copy of
+ * the License is located at
+ *
+ * 	http://aws.amazon.com/apache2.0/
+ *
+ * or in the "license" file accompanying this file. This file is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF
+ * ANY KIND, either express or implied. See the License for the specific
+ * language governing permissions and limitations under the License.
+ */
+
+package ecr
+
+import (
+	"fmt"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/remotes/docker"
+)
+
+// noopTracker is a docker.StatusTracker that discards every status it is
+// given.
+type noopTracker struct{}
+
+var _ docker.StatusTracker = noopTracker{}
+
+func (noopTracker) GetStatus(ref string) (docker.Status, error) {
+	return docker.Status{}, fmt.Errorf("status for ref %v: %w", ref, errdefs.ErrNotFound)
+}
+
+func (noopTracker) SetStatus(string, docker.Status) {}
+
+// TrackedTotals sums the offset and total of the statuses tracked for the
+// provided refs, as reported by the tracker used by a resolver's pushers or
+// any other docker.StatusTracker.  Refs without a tracked status are skipped.
+func TrackedTotals(tracker docker.StatusTracker, refs []string) (offset, total int64) {
+	for _, ref := range refs {
+		status, err := tracker.GetStatus(ref)
+		if err != nil {
+			continue
+		}
+		offset += status.Offset
+		total += status.Total
+	}
+	return offset, total
+}
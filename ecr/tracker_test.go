@@ -0,0 +1,45 @@
+/*
+ * Copyright 2017-2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You
+ * may not use this file except in compliance with the License. A copy of
+ * the License is located at
+ *
+ * 	http://aws.amazon.com/apache2.0/
+ *
+ * or in the "license" file accompanying this file. This file is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF
+ * ANY KIND, either express or implied. See the License for the specific
+ * language governing permissions and limitations under the License.
+ */
+
+package ecr
+
+import (
+	"testing"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/remotes/docker"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTrackedTotals(t *testing.T) {
+	tracker := docker.NewInMemoryTracker()
+	tracker.SetStatus("layer-1", docker.Status{
+		Status: content.Status{Ref: "layer-1", Offset: 10, Total: 100},
+	})
+	tracker.SetStatus("layer-2", docker.Status{
+		Status: content.Status{Ref: "layer-2", Offset: 200, Total: 200},
+	})
+	tracker.SetStatus("untracked-by-caller", docker.Status{
+		Status: content.Status{Ref: "untracked-by-caller", Offset: 1000, Total: 1000},
+	})
+
+	offset, total := TrackedTotals(tracker, []string{"layer-1", "layer-2", "missing"})
+	assert.Equal(t, int64(210), offset)
+	assert.Equal(t, int64(300), total)
+
+	offset, total = TrackedTotals(tracker, nil)
+	assert.Zero(t, offset)
+	assert.Zero(t, total)
+}
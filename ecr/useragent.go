@@ -0,0 +1,65 @@
+/*
+ * Copyright 2017-2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You
+ * may not use this file except in compliance with the License. A copy of
+ * the License is located at
+ *
+ * 	http://aws.amazon.com/apache2.0/
+ *
+ * or in the "license" file accompanying this file. This file is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF
+ * ANY KIND, either express or implied. See the License for the specific
+ * language governing permissions and limitations under the License.
+ */
+
+package ecr
+
+import (
+	"runtime/debug"
+
+	"github.com/aws/aws-sdk-go/aws/request"
+)
+
+const (
+	// modulePath is the path of the module providing the resolver, looked up
+	// in the binary's build information.
+	modulePath = "github.com/awslabs/amazon-ecr-containerd-resolver"
+	// userAgentName is the name identifying the resolver in the User-Agent
+	// of its ECR API requests.
+	userAgentName = "amazon-ecr-containerd-resolver"
+)
+
+// userAgentVersion is the version of the resolver's module built into the
+// binary, included in the User-Agent of its ECR API requests.
+var userAgentVersion = moduleVersion(debug.ReadBuildInfo())
+
+// moduleVersion returns the version of the resolver's module from the build
+// information, which is "devel" when the module is built from a working tree
+// and "unknown" when the information is not available.
+func moduleVersion(info *debug.BuildInfo, ok bool) string {
+	if !ok {
+		return "unknown"
+	}
+	module := &info.Main
+	for _, dep := range info.Deps {
+		if dep.Path == modulePath {
+			module = dep
+			break
+		}
+	}
+	if module.Path != modulePath {
+		return "unknown"
+	}
+	if module.Replace != nil {
+		module = module.Replace
+	}
+	if module.Version == "" || module.Version == "(devel)" {
+		return "devel"
+	}
+	return module.Version
+}
+
+// addUserAgent adds the resolver's name and version to the User-Agent of
+// aws-sdk-go requests.
+var addUserAgent = request.MakeAddToUserAgentHandler(userAgentName, userAgentVersion)
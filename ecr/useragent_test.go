@@ -0,0 +1,98 @@
+/*
+ * Copyright 2017-2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You
+ * may not use this file except in compliance with the License. A copy of
+ * the License is located at
+ *
+ * 	http://aws.amazon.com/apache2.0/
+ *
+ * or in the "license" file accompanying this file. This file is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF
+ * ANY KIND, either express or implied. See the License for the specific
+ * language governing permissions and limitations under the License.
+ */
+
+package ecr
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"runtime/debug"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/awstesting/unit"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestModuleVersion(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		info     *debug.BuildInfo
+		ok       bool
+		expected string
+	}{
+		{
+			name:     "dependency",
+			info:     &debug.BuildInfo{Deps: []*debug.Module{{Path: modulePath, Version: "v0.1.0"}}},
+			ok:       true,
+			expected: "v0.1.0",
+		},
+		{
+			name: "replaced dependency",
+			info: &debug.BuildInfo{Deps: []*debug.Module{{
+				Path:    modulePath,
+				Version: "v0.1.0",
+				Replace: &debug.Module{Path: "example.com/fork", Version: "v0.1.1"},
+			}}},
+			ok:       true,
+			expected: "v0.1.1",
+		},
+		{
+			name:     "main module",
+			info:     &debug.BuildInfo{Main: debug.Module{Path: modulePath, Version: "(devel)"}},
+			ok:       true,
+			expected: "devel",
+		},
+		{
+			name:     "not built",
+			info:     &debug.BuildInfo{Main: debug.Module{Path: "example.com/other"}},
+			ok:       true,
+			expected: "unknown",
+		},
+		{
+			name:     "no build information",
+			expected: "unknown",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, moduleVersion(tc.info, tc.ok))
+		})
+	}
+}
+
+func TestUserAgent(t *testing.T) {
+	var userAgent string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userAgent = r.Header.Get("User-Agent")
+		fmt.Fprint(w, `{"authorizationData":[{"authorizationToken":"QVdTOnBhc3N3b3Jk"}]}`)
+	}))
+	defer ts.Close()
+
+	for name, configure := range map[string]ResolverOption{
+		"session":  WithSession(unit.Session),
+		"configV2": WithConfigV2(testConfigV2()),
+	} {
+		t.Run(name, func(t *testing.T) {
+			userAgent = ""
+			resolver, err := NewResolver(configure, WithRegionEndpoints(map[string]string{"us-west-2": ts.URL}))
+			require.NoError(t, err)
+			_, err = resolver.(*ecrResolver).AuthorizationToken(context.Background(), "us-west-2")
+			require.NoError(t, err)
+			assert.Contains(t, userAgent, "amazon-ecr-containerd-resolver/"+userAgentVersion)
+		})
+	}
+}
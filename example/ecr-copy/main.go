@@ -21,13 +21,14 @@ import (
 	"strconv"
 
 	"github.com/awslabs/amazon-ecr-containerd-resolver/ecr"
-	"github.com/containerd/containerd"
 	"github.com/containerd/containerd/log"
 	"github.com/containerd/containerd/namespaces"
 	"github.com/sirupsen/logrus"
 )
 
 const (
+	// Default to copying 4 blobs at a time.
+	defaultParallelism = 4
 	// Default to no debug logging.
 	defaultEnableDebug = 0
 )
@@ -44,44 +45,31 @@ func main() {
 	sourceRef := os.Args[1]
 	destRef := os.Args[2]
 
+	parallelism := defaultParallelism
+	parseEnvInt(ctx, "ECR_COPY_PARALLEL", &parallelism)
+
 	enableDebug := defaultEnableDebug
 	parseEnvInt(ctx, "ECR_COPY_DEBUG", &enableDebug)
 	if enableDebug == 1 {
 		log.L.Logger.SetLevel(logrus.TraceLevel)
 	}
 
-	client, err := containerd.New("/run/containerd/containerd.sock")
-	if err != nil {
-		log.G(ctx).WithError(err).Fatal("Failed to connect to containerd")
-	}
-	defer client.Close()
-
 	resolver, err := ecr.NewResolver()
 	if err != nil {
 		log.G(ctx).WithError(err).Fatal("Failed to create resolver")
 	}
 
-	log.G(ctx).WithField("sourceRef", sourceRef).Info("Pulling from Amazon ECR")
-	img, err := client.Fetch(
-		ctx,
-		sourceRef,
-		containerd.WithResolver(resolver),
-	)
-	if err != nil {
-		log.G(ctx).WithError(err).WithField("sourceRef", sourceRef).Fatal("Failed to pull")
-	}
-	log.G(ctx).WithField("img", img.Name).Info("Pulled successfully!")
-
-	log.G(ctx).WithField("sourceRef", sourceRef).WithField("destRef", destRef).Info("Pushing to Amazon ECR")
-	desc := img.Target
-	err = client.Push(ctx, destRef, desc,
-		containerd.WithResolver(resolver),
-	)
+	log.G(ctx).
+		WithField("sourceRef", sourceRef).
+		WithField("destRef", destRef).
+		WithField("parallelism", parallelism).
+		Info("Copying within Amazon ECR")
+	err = ecr.Copy(ctx, resolver, sourceRef, destRef, ecr.WithCopyParallelism(parallelism))
 	if err != nil {
-		log.G(ctx).WithError(err).WithField("destRef", destRef).Fatal("Failed to push")
+		log.G(ctx).WithError(err).WithField("sourceRef", sourceRef).WithField("destRef", destRef).Fatal("Failed to copy")
 	}
 
-	log.G(ctx).WithField("destRef", destRef).Info("Pushed successfully!")
+	log.G(ctx).WithField("destRef", destRef).Info("Copied successfully!")
 }
 
 func parseEnvInt(ctx context.Context, varname string, val *int) {